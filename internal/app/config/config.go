@@ -4,21 +4,63 @@ import (
 	"encoding/json"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"stream-recorder/pkg/logger"
+	"stream-recorder/pkg/pathtemplate"
+	"strings"
+	"time"
 )
 
+const (
+	DefaultDirTemplate  = "{platform}_{username}_%Y-%m-%d"
+	DefaultFileTemplate = "{platform}_{username}_{offset}"
+)
+
+// TemplatePlaceholders are the variables available in the directory and file templates
+var TemplatePlaceholders = []string{"platform", "username", "display_name", "title", "category", "offset", "part", "quality"}
+
 type Config struct {
 	LoggerLevel            string `json:"logger_level"`
 	TimeCheck              int    `json:"time_check"`
 	FFmpegPATH             string `json:"ffmpeg_path"`
+	FFprobePATH            string `json:"ffprobe_path"`
 	MediaPATH              string `json:"media_path"`
 	TempPATH               string `json:"temp_path"`
 	AutoCleanMediaPATH     bool   `json:"auto_clean_media_path"`
 	TimeAutoCleanMediaPATH int    `json:"time_auto_clean_media_path"`
+	RetentionFallback      bool   `json:"retention_fallback"`
 	BufferSize             int    `json:"buffer_size"`
 	VideoCodec             string `json:"video_codec"`
 	AudioCodec             string `json:"audio_codec"`
 	FileFormat             string `json:"file_format"`
+	FragmentedMP4          bool   `json:"fragmented_mp4"`
+	DownloadWorkers        int    `json:"download_workers"`
+	DownloadHostLimit      int    `json:"download_host_limit"`
+	DownloadBandwidthLimit int    `json:"download_bandwidth_limit"`
+	ShutdownTimeout        int    `json:"shutdown_timeout"`
+	VerifyRecordings       bool   `json:"verify_recordings"`
+	MaxAVDesync            int    `json:"max_av_desync"`
+	DirTemplate            string `json:"dir_template"`
+	FileTemplate           string `json:"file_template"`
+	Timezone               string `json:"timezone"`
+	JobWorkers             int    `json:"job_workers"`
+	JobMaxAttempts         int    `json:"job_max_attempts"`
+	JobRetryDelay          int    `json:"job_retry_delay"`
+	ReplayCooldown         int    `json:"replay_cooldown"`
+	ContactSheetFrames     int    `json:"contact_sheet_frames"`
+	DiskCheckInterval      int    `json:"disk_check_interval"`
+	DiskWarnFree           int    `json:"disk_warn_free"`
+	DiskPurgeFree          int    `json:"disk_purge_free"`
+	DiskCriticalFree       int    `json:"disk_critical_free"`
+	ScrubInterval          int    `json:"scrub_interval"`
+	HotCheck               int    `json:"hot_check"`
+	HotWindow              int    `json:"hot_window"`
+	BackoffMax             int    `json:"backoff_max"`
+	MaxRecordings          int    `json:"max_recordings"`
+	BandwidthBudget        int    `json:"bandwidth_budget"`
+	Preempt                bool   `json:"preempt"`
+
+	Storages map[string]StorageConfig `json:"storages"`
 
 	// server
 	Port    int    `json:"port"`
@@ -40,10 +82,16 @@ func New(configFile string, log *logger.Logger, workMode string) (*Config, error
 		log.Error("Failed to parse config JSON from file", err, slog.Any("file", configFile))
 		return nil, err
 	}
+	// the keys present in the file tell an unset flag from one that is turned off
+	keys := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &keys); err != nil {
+		log.Error("Failed to parse config JSON from file", err, slog.Any("file", configFile))
+		return nil, err
+	}
 	log.Debug("Successfully parsed config JSON")
 
 	log.Trace("Setting default config values")
-	cfg.setDefaults(workMode)
+	cfg.setDefaults(workMode, keys)
 	log.Debug("Defaults have been set")
 
 	log.Trace("Normalizing environment settings")
@@ -54,7 +102,7 @@ func New(configFile string, log *logger.Logger, workMode string) (*Config, error
 	return &cfg, nil
 }
 
-func (c *Config) setDefaults(workMode string) {
+func (c *Config) setDefaults(workMode string, keys map[string]json.RawMessage) {
 	if c.LoggerLevel == "" {
 		c.LoggerLevel = "warn"
 	}
@@ -67,7 +115,7 @@ func (c *Config) setDefaults(workMode string) {
 	if c.TempPATH == "" {
 		c.TempPATH = "tmp"
 	}
-	if c.AutoCleanMediaPATH && c.TimeAutoCleanMediaPATH == 0 {
+	if (c.AutoCleanMediaPATH || c.RetentionFallback) && c.TimeAutoCleanMediaPATH == 0 {
 		c.TimeAutoCleanMediaPATH = 7
 	}
 	if c.BufferSize == 0 {
@@ -82,6 +130,69 @@ func (c *Config) setDefaults(workMode string) {
 	if c.FileFormat == "" {
 		c.FileFormat = "mp4"
 	}
+	if c.DownloadWorkers == 0 {
+		c.DownloadWorkers = 16
+	}
+	if c.DownloadHostLimit == 0 {
+		c.DownloadHostLimit = 6
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 300
+	}
+	if c.MaxAVDesync == 0 {
+		c.MaxAVDesync = 1000
+	}
+	if c.DirTemplate == "" {
+		c.DirTemplate = DefaultDirTemplate
+	}
+	if c.FileTemplate == "" {
+		c.FileTemplate = DefaultFileTemplate
+	}
+	if c.Timezone == "" {
+		c.Timezone = "Local"
+	}
+	if c.JobWorkers == 0 {
+		c.JobWorkers = 2
+	}
+	if c.JobMaxAttempts == 0 {
+		c.JobMaxAttempts = 3
+	}
+	if c.JobRetryDelay == 0 {
+		c.JobRetryDelay = 30
+	}
+	if c.ReplayCooldown == 0 {
+		c.ReplayCooldown = 60
+	}
+	if c.ContactSheetFrames == 0 {
+		c.ContactSheetFrames = 16
+	}
+	if c.DiskCheckInterval == 0 {
+		c.DiskCheckInterval = 60
+	}
+	if c.DiskWarnFree == 0 {
+		c.DiskWarnFree = 15
+	}
+	if c.DiskPurgeFree == 0 {
+		c.DiskPurgeFree = 10
+	}
+	if c.DiskCriticalFree == 0 {
+		c.DiskCriticalFree = 5
+	}
+	if c.ScrubInterval == 0 {
+		c.ScrubInterval = 168
+	}
+	if c.HotCheck == 0 {
+		c.HotCheck = 5
+	}
+	if c.HotWindow == 0 {
+		c.HotWindow = 30
+	}
+	if c.BackoffMax == 0 {
+		c.BackoffMax = 600
+	}
+	if _, ok := keys["verify_recordings"]; !ok {
+		c.VerifyRecordings = true
+	}
 
 	// server
 	if workMode == "server" {
@@ -114,6 +225,18 @@ func (c *Config) normalizeEnv(log *logger.Logger, workMode string) {
 		}
 	}
 
+	if c.FFprobePATH != "" {
+		if _, err := os.Stat(c.FFprobePATH); os.IsNotExist(err) {
+			log.Fatal("FFprobePATH does not exist", err)
+		}
+	} else if c.FFmpegPATH != "" {
+		// ffprobe is usually shipped next to ffmpeg
+		sibling := filepath.Join(filepath.Dir(c.FFmpegPATH), strings.Replace(filepath.Base(c.FFmpegPATH), "ffmpeg", "ffprobe", 1))
+		if _, err := os.Stat(sibling); err == nil && sibling != c.FFmpegPATH {
+			c.FFprobePATH = sibling
+		}
+	}
+
 	if _, err := os.Stat(c.TempPATH); os.IsNotExist(err) {
 		err = os.MkdirAll(c.TempPATH, 0755)
 		if err != nil {
@@ -138,6 +261,121 @@ func (c *Config) normalizeEnv(log *logger.Logger, workMode string) {
 		c.BufferSize = 32
 	}
 
+	if c.DownloadWorkers < 1 {
+		log.Warn("The number of download workers must be at least 1. By default, 16 is selected")
+		c.DownloadWorkers = 16
+	}
+
+	if c.DownloadHostLimit < 1 {
+		log.Warn("The download limit per host must be at least 1. By default, 6 is selected")
+		c.DownloadHostLimit = 6
+	}
+
+	if c.DownloadBandwidthLimit < 0 {
+		log.Warn("The download bandwidth limit cannot be negative. By default, the bandwidth is not limited")
+		c.DownloadBandwidthLimit = 0
+	}
+
+	if c.ShutdownTimeout < 1 {
+		log.Warn("The shutdown timeout is too short. By default, 300 seconds is selected")
+		c.ShutdownTimeout = 300
+	}
+
+	if c.MaxAVDesync < 0 {
+		log.Warn("The maximum A/V desync cannot be negative. By default, 1000 milliseconds is selected")
+		c.MaxAVDesync = 1000
+	}
+
+	if _, err := pathtemplate.Parse(c.DirTemplate, TemplatePlaceholders...); err != nil {
+		log.Warn("Invalid directory template. The default template is selected", slog.String("template", c.DirTemplate), slog.String("error", err.Error()))
+		c.DirTemplate = DefaultDirTemplate
+	}
+
+	if _, err := pathtemplate.Parse(c.FileTemplate, TemplatePlaceholders...); err != nil || strings.Contains(c.FileTemplate, "/") {
+		log.Warn("Invalid file template. The default template is selected", slog.String("template", c.FileTemplate))
+		c.FileTemplate = DefaultFileTemplate
+	}
+
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		log.Warn("Unknown timezone. By default, the local timezone is selected", slog.String("timezone", c.Timezone))
+		c.Timezone = "Local"
+	}
+
+	if c.JobWorkers < 1 {
+		log.Warn("The number of job workers must be at least 1. By default, 2 is selected")
+		c.JobWorkers = 2
+	}
+
+	if c.JobMaxAttempts < 1 {
+		log.Warn("The number of job attempts must be at least 1. By default, 3 is selected")
+		c.JobMaxAttempts = 3
+	}
+
+	if c.JobRetryDelay < 1 {
+		log.Warn("The job retry delay is too short. By default, 30 seconds is selected")
+		c.JobRetryDelay = 30
+	}
+
+	if c.ReplayCooldown < 0 {
+		log.Warn("The replay cooldown cannot be negative. By default, 60 seconds is selected")
+		c.ReplayCooldown = 60
+	}
+
+	if c.ContactSheetFrames < 1 || c.ContactSheetFrames > 100 {
+		log.Warn("The number of contact sheet frames must be between 1 and 100. By default, 16 is selected")
+		c.ContactSheetFrames = 16
+	}
+
+	if c.DiskCheckInterval < 5 {
+		log.Warn("The disk check interval is too short. By default, 5 seconds is selected")
+		c.DiskCheckInterval = 5
+	}
+
+	if c.DiskCriticalFree < 1 || c.DiskCriticalFree >= c.DiskPurgeFree || c.DiskPurgeFree >= c.DiskWarnFree || c.DiskWarnFree >= 100 {
+		log.Warn("The free disk space thresholds must satisfy 0 < critical < purge < warn < 100 percent. By default, 5, 10 and 15 percent are selected",
+			slog.Int("critical", c.DiskCriticalFree), slog.Int("purge", c.DiskPurgeFree), slog.Int("warn", c.DiskWarnFree))
+		c.DiskWarnFree, c.DiskPurgeFree, c.DiskCriticalFree = 15, 10, 5
+	}
+
+	if c.ScrubInterval < 1 {
+		log.Warn("The scrub interval must be at least 1 hour. By default, 168 hours is selected")
+		c.ScrubInterval = 168
+	}
+
+	if c.HotCheck < 5 {
+		log.Warn("The hot check interval is too short. By default, 5 seconds is selected")
+		c.HotCheck = 5
+	}
+
+	if c.HotWindow < 1 {
+		log.Warn("The hot window must be at least 1 minute. By default, 30 minutes is selected")
+		c.HotWindow = 30
+	}
+
+	if c.BackoffMax < c.TimeCheck {
+		log.Warn("The maximum backoff cannot be shorter than the check interval. By default, 600 seconds is selected")
+		c.BackoffMax = 600
+	}
+
+	if c.MaxRecordings < 0 {
+		log.Warn("The maximum number of recordings cannot be negative. By default, there is no limit")
+		c.MaxRecordings = 0
+	}
+
+	if c.BandwidthBudget < 0 {
+		log.Warn("The bandwidth budget cannot be negative. By default, there is no limit")
+		c.BandwidthBudget = 0
+	}
+
+	for name, storage := range c.Storages {
+		if err := storage.validate(); err != nil {
+			log.Warn("Invalid storage backend, it is disabled", slog.String("storage", name), slog.String("error", err.Error()))
+			delete(c.Storages, name)
+			continue
+		}
+		c.Storages[name] = storage
+	}
+
 	if workMode == "server" {
 		if c.Port < 0 || c.Port > 65535 {
 			log.Warn("The port must be between 1 and 65535, By default, 8080 is selected")
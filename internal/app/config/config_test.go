@@ -0,0 +1,41 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"stream-recorder/pkg/logger"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// the logger writes to logs/ in the working directory
+	dir, err := os.MkdirTemp("", "config")
+	if err != nil {
+		panic(err)
+	}
+	os.Chdir(dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestVerifyRecordingsDefault(t *testing.T) {
+	dir := t.TempDir()
+	for content, want := range map[string]bool{
+		`{}`:                           true,
+		`{"verify_recordings": true}`:  true,
+		`{"verify_recordings": false}`: false,
+	} {
+		file := filepath.Join(dir, "config.json")
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := New(file, logger.New(), "cli")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.VerifyRecordings != want {
+			t.Errorf("VerifyRecordings for %s = %v, want %v", content, cfg.VerifyRecordings, want)
+		}
+	}
+}
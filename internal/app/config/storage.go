@@ -0,0 +1,84 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+)
+
+const (
+	StorageLocal  = "local"
+	StorageS3     = "s3"
+	StorageSFTP   = "sftp"
+	StorageWebDAV = "webdav"
+)
+
+// StorageConfig is a named backend finished recordings are uploaded to. Path is the target directory
+// of the local and SFTP backends and the key prefix of the S3 and WebDAV ones.
+type StorageConfig struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+
+	// s3 and webdav
+	Endpoint string `json:"endpoint"`
+
+	// s3
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	PathStyle bool   `json:"path_style"`
+	PartSize  int    `json:"part_size"`
+
+	// sftp and webdav
+	Host       string `json:"host"`
+	User       string `json:"user"`
+	Password   string `json:"password"`
+	KeyFile    string `json:"key_file"`
+	KnownHosts string `json:"known_hosts"`
+}
+
+func (s *StorageConfig) validate() error {
+	switch s.Type {
+	case StorageLocal:
+		if s.Path == "" {
+			return fmt.Errorf("path is required")
+		}
+	case StorageS3:
+		if s.Endpoint == "" || s.Bucket == "" || s.AccessKey == "" || s.SecretKey == "" {
+			return fmt.Errorf("endpoint, bucket, access_key and secret_key are required")
+		}
+		if _, err := url.Parse(s.Endpoint); err != nil {
+			return fmt.Errorf("invalid endpoint: %w", err)
+		}
+		if s.Region == "" {
+			s.Region = "us-east-1"
+		}
+		// S3 does not accept parts smaller than 5 MB except for the last one
+		if s.PartSize == 0 {
+			s.PartSize = 16
+		}
+		if s.PartSize < 5 || s.PartSize > 5120 {
+			return fmt.Errorf("part_size must be between 5 and 5120 megabytes")
+		}
+	case StorageSFTP:
+		if s.Host == "" || s.User == "" || s.Path == "" {
+			return fmt.Errorf("host, user and path are required")
+		}
+		if s.Password == "" && s.KeyFile == "" {
+			return fmt.Errorf("password or key_file is required")
+		}
+		if s.KnownHosts == "" {
+			return fmt.Errorf("known_hosts is required to check the host key")
+		}
+	case StorageWebDAV:
+		if s.Endpoint == "" {
+			return fmt.Errorf("endpoint is required")
+		}
+		if _, err := url.Parse(s.Endpoint); err != nil {
+			return fmt.Errorf("invalid endpoint: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown type %q (available values - 'local', 's3', 'sftp', 'webdav')", s.Type)
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"stream-recorder/internal/app/services/capacity"
+	"stream-recorder/pkg/logger"
+)
+
+type CapacityHandler struct {
+	log *logger.Logger
+	cp  *capacity.Limiter
+}
+
+func NewCapacity(log *logger.Logger, cp *capacity.Limiter) *CapacityHandler {
+	return &CapacityHandler{
+		log: log,
+		cp:  cp,
+	}
+}
+
+// GetCapacityStatusHandler returns the running recordings, the queued streamers and the limits they are held to
+func (h *CapacityHandler) GetCapacityStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, h.cp.Status())
+}
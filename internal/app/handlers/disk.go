@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"stream-recorder/internal/app/services/disk"
+	"stream-recorder/pkg/logger"
+)
+
+type DiskHandler struct {
+	log *logger.Logger
+	dm  *disk.Monitor
+}
+
+func NewDisk(log *logger.Logger, dm *disk.Monitor) *DiskHandler {
+	return &DiskHandler{
+		log: log,
+		dm:  dm,
+	}
+}
+
+// GetDiskStatusHandler returns the free space of the watched paths, the counters and the recent events
+func (d *DiskHandler) GetDiskStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, d.dm.Status())
+}
+
+// CheckDiskHandler measures the paths right away instead of waiting for the next check
+func (d *DiskHandler) CheckDiskHandler(c *gin.Context) {
+	d.log.Debug("Handling CheckDisk request")
+
+	// a purge must not stop halfway because the client went away
+	d.dm.Check(context.WithoutCancel(c.Request.Context()))
+	c.JSON(http.StatusOK, d.dm.Status())
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/integrity"
+	"stream-recorder/pkg/logger"
+)
+
+type IntegrityHandler struct {
+	log *logger.Logger
+	lr  *repository.LibraryRepository
+	s   *integrity.Scrubber
+}
+
+func NewIntegrity(log *logger.Logger, lr *repository.LibraryRepository, s *integrity.Scrubber) *IntegrityHandler {
+	return &IntegrityHandler{
+		log: log,
+		lr:  lr,
+		s:   s,
+	}
+}
+
+// GetIntegrityReportHandler lists the recordings that failed their last check together with the last scrub
+func (i *IntegrityHandler) GetIntegrityReportHandler(c *gin.Context) {
+	problems, err := i.lr.ListIntegrity(models.IntegrityMismatch, models.IntegrityMissing)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"running": i.s.Running(), "last_scrub": i.s.Last(), "total": len(problems), "recordings": problems})
+}
+
+// ScrubIntegrityHandler starts a scrub of the files that are due instead of waiting for the next run
+func (i *IntegrityHandler) ScrubIntegrityHandler(c *gin.Context) {
+	if i.s.Running() {
+		c.JSON(http.StatusConflict, gin.H{"error": "a scrub is already running"})
+		return
+	}
+
+	go func() {
+		if _, err := i.s.Scrub(context.Background()); err != nil {
+			i.log.Error("Failed to scrub library", err)
+		}
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"status": "started"})
+}
+
+// CheckIntegrityHandler re-hashes a single recording and compares it with its checksum
+func (i *IntegrityHandler) CheckIntegrityHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id contains an invalid value"})
+		return
+	}
+
+	item, err := i.lr.Get(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "recording not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := i.s.Check(c.Request.Context(), item); err != nil {
+		i.log.Error("Failed to check recording", err, slog.String("path", item.Path))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": item.ID, "path": item.Path, "sha256": item.Sha256, "integrity": item.Integrity})
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/jobs"
+	"stream-recorder/pkg/logger"
+)
+
+type JobsHandler struct {
+	log *logger.Logger
+	jr  *repository.JobsRepository
+	q   *jobs.Queue
+}
+
+func NewJobs(log *logger.Logger, jr *repository.JobsRepository, q *jobs.Queue) *JobsHandler {
+	return &JobsHandler{
+		log: log,
+		jr:  jr,
+		q:   q,
+	}
+}
+
+func (j *JobsHandler) ListJobsHandler(c *gin.Context) {
+	j.log.Debug("Handling ListJobs request", slog.String("status", c.Query("status")), slog.String("type", c.Query("type")))
+
+	limit, offset, err := parsePage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filter := repository.JobsFilter{
+		Status:   c.Query("status"),
+		Type:     c.Query("type"),
+		Key:      c.Query("key"),
+		Platform: c.Query("platform"),
+		Username: c.Query("username"),
+	}
+	list, total, err := j.jr.List(filter, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"total": total, "jobs": list})
+}
+
+func (j *JobsHandler) GetJobLogHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id contains an invalid value"})
+		return
+	}
+
+	job, err := j.jr.Get(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return
+	}
+
+	c.String(http.StatusOK, job.Log)
+}
+
+func (j *JobsHandler) RetryJobHandler(c *gin.Context) {
+	j.action(c, "retry", j.q.Retry)
+}
+
+func (j *JobsHandler) CancelJobHandler(c *gin.Context) {
+	j.action(c, "cancel", j.q.Cancel)
+}
+
+func (j *JobsHandler) action(c *gin.Context, name string, fn func(id int) error) {
+	id, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id contains an invalid value"})
+		return
+	}
+
+	if err := fn(id); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, jobs.ErrNotFound) {
+			status = http.StatusConflict
+		}
+		j.log.Warn("Job action failed", slog.String("action", name), slog.Int("id", id), slog.String("error", err.Error()))
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	j.log.Info("Job action applied", slog.String("action", name), slog.Int("id", id))
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// parsePage reads the limit and offset query parameters, the limit is 50 by default and at most 500
+func parsePage(c *gin.Context) (int, int, error) {
+	limit, offset := 50, 0
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 500 {
+			return 0, 0, errors.New("limit must be between 1 and 500")
+		}
+		limit = parsed
+	}
+	if value := c.Query("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return 0, 0, errors.New("offset contains an invalid value")
+		}
+		offset = parsed
+	}
+	return limit, offset, nil
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/library"
+	"stream-recorder/internal/app/services/preview"
+	"stream-recorder/pkg/logger"
+	"time"
+)
+
+type LibraryHandler struct {
+	log *logger.Logger
+	cfg *config.Config
+	lr  *repository.LibraryRepository
+	l   *library.Library
+}
+
+func NewLibrary(log *logger.Logger, cfg *config.Config, lr *repository.LibraryRepository, l *library.Library) *LibraryHandler {
+	return &LibraryHandler{
+		log: log,
+		cfg: cfg,
+		lr:  lr,
+		l:   l,
+	}
+}
+
+func (l *LibraryHandler) ListLibraryHandler(c *gin.Context) {
+	l.log.Debug("Handling ListLibrary request", slog.String("platform", c.Query("platform")), slog.String("username", c.Query("username")))
+
+	limit, offset, err := parsePage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filter := repository.LibraryFilter{
+		Platform: c.Query("platform"),
+		Username: c.Query("username"),
+		Title:    c.Query("title"),
+	}
+	if filter.From, err = parseDate(c.Query("from"), false); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from " + err.Error()})
+		return
+	}
+	if filter.To, err = parseDate(c.Query("to"), true); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to " + err.Error()})
+		return
+	}
+
+	list, total, err := l.lr.List(filter, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"total": total, "recordings": list})
+}
+
+// GetLibraryItemHandler returns an entry together with its manifest and the ffprobe output
+func (l *LibraryHandler) GetLibraryItemHandler(c *gin.Context) {
+	item, ok := l.item(c)
+	if !ok {
+		return
+	}
+
+	response := gin.H{"recording": item, "manifest": nil, "probe": nil}
+	if item.Manifest != "" {
+		response["manifest"] = json.RawMessage(item.Manifest)
+	}
+	if item.Probe != "" {
+		response["probe"] = json.RawMessage(item.Probe)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// ServeLibraryFileHandler streams the media file, range requests are supported so players can seek
+func (l *LibraryHandler) ServeLibraryFileHandler(c *gin.Context) {
+	item, ok := l.item(c)
+	if !ok {
+		return
+	}
+
+	file := l.l.File(item)
+	if c.Query("download") == "true" {
+		c.FileAttachment(file, filepath.Base(file))
+		return
+	}
+	c.File(file)
+}
+
+// PosterLibraryHandler returns the poster frame of a recording, it is made on request when the job did not make it
+func (l *LibraryHandler) PosterLibraryHandler(c *gin.Context) {
+	l.preview(c, preview.PosterPath, func(ctx context.Context, file string) error {
+		return preview.Poster(ctx, l.cfg, file)
+	})
+}
+
+// SheetLibraryHandler returns the contact sheet of a recording, it is made on request when the job did not make it
+func (l *LibraryHandler) SheetLibraryHandler(c *gin.Context) {
+	l.preview(c, preview.SheetPath, func(ctx context.Context, file string) error {
+		return preview.ContactSheet(ctx, l.cfg, file, l.cfg.ContactSheetFrames)
+	})
+}
+
+func (l *LibraryHandler) DeleteLibraryItemHandler(c *gin.Context) {
+	item, ok := l.item(c)
+	if !ok {
+		return
+	}
+
+	if item.Pinned {
+		c.JSON(http.StatusConflict, gin.H{"error": "the recording is pinned, unpin it first"})
+		return
+	}
+
+	if err := l.l.Delete(item); err != nil {
+		l.log.Error("Failed to delete recording", err, slog.String("path", item.Path))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	l.log.Info("Recording deleted", slog.String("path", item.Path))
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// PinLibraryItemHandler protects a recording from retention and the disk-space guard, pinned=false releases it
+func (l *LibraryHandler) PinLibraryItemHandler(c *gin.Context) {
+	item, ok := l.item(c)
+	if !ok {
+		return
+	}
+
+	pinned := true
+	if value := c.Query("pinned"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "pinned contains an invalid value (expected true/false)"})
+			return
+		}
+		pinned = parsed
+	}
+
+	if err := l.lr.UpdatePinned(item.ID, pinned); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	l.log.Info("Recording pin changed", slog.String("path", item.Path), slog.Bool("pinned", pinned))
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// ScanLibraryHandler indexes MediaPATH again, it is needed after files were changed outside the recorder
+func (l *LibraryHandler) ScanLibraryHandler(c *gin.Context) {
+	indexed, removed, err := l.l.Scan(c.Request.Context())
+	if err != nil {
+		l.log.Error("Failed to scan library", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"indexed": indexed, "removed": removed})
+}
+
+func (l *LibraryHandler) item(c *gin.Context) (*models.LibraryItems, bool) {
+	id, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id contains an invalid value"})
+		return nil, false
+	}
+
+	item, err := l.lr.Get(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "recording not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return item, true
+}
+
+// preview serves a sidecar image of the recording and makes it first when it is missing
+func (l *LibraryHandler) preview(c *gin.Context, path func(file string) string, generate func(ctx context.Context, file string) error) {
+	item, ok := l.item(c)
+	if !ok {
+		return
+	}
+
+	file := l.l.File(item)
+	image := path(file)
+	if _, err := os.Stat(image); os.IsNotExist(err) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Minute)
+		defer cancel()
+
+		if err := generate(ctx, file); err != nil {
+			l.log.Warn("Failed to generate preview", slog.String("path", item.Path), slog.String("error", err.Error()))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.File(image)
+}
+
+// parseDate reads an RFC 3339 time or a date, a date used as the upper bound includes the whole day
+func parseDate(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("must be a date (2006-01-02) or an RFC 3339 time")
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"stream-recorder/internal/app/services/live"
+	"stream-recorder/pkg/logger"
+	"strings"
+)
+
+type LiveHandler struct {
+	log *logger.Logger
+	p   *live.Publisher
+}
+
+func NewLive(log *logger.Logger, p *live.Publisher) *LiveHandler {
+	return &LiveHandler{
+		log: log,
+		p:   p,
+	}
+}
+
+// LiveHandler serves /live/<platform>/<username>/index.m3u8, the segments it lists
+// and snapshot.jpg, the latest frame of the active session
+func (l *LiveHandler) LiveHandler(c *gin.Context) {
+	platform, username, file := c.Param("platform"), c.Param("username"), c.Param("file")
+	// browser players are usually served from another origin
+	c.Header("Access-Control-Allow-Origin", "*")
+
+	if file == "snapshot.jpg" {
+		l.snapshot(c, platform, username)
+		return
+	}
+
+	if file == "index.m3u8" {
+		playlist, err := l.p.Playlist(platform, username)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "the streamer has no recordings"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(playlist))
+		return
+	}
+
+	segmentID, err := strconv.Atoi(strings.TrimSuffix(file, ".ts"))
+	if err != nil || !strings.HasSuffix(file, ".ts") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+
+	path, err := l.p.Segment(c.Request.Context(), platform, username, segmentID)
+	if errors.Is(err, live.ErrNotFound) || errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "segment not found"})
+		return
+	}
+	if err != nil {
+		l.log.Warn("Failed to serve live segment", slog.String("platform", platform), slog.String("username", username), slog.Int("segment", segmentID), slog.String("error", err.Error()))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer os.Remove(path)
+
+	c.Header("Content-Type", "video/mp2t")
+	c.File(path)
+}
+
+func (l *LiveHandler) snapshot(c *gin.Context, platform, username string) {
+	image, err := l.p.Snapshot(c.Request.Context(), platform, username)
+	if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, live.ErrNotActive) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "the streamer is not being recorded"})
+		return
+	}
+	if errors.Is(err, live.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no segment has been written yet"})
+		return
+	}
+	if err != nil {
+		l.log.Warn("Failed to take live snapshot", slog.String("platform", platform), slog.String("username", username), slog.String("error", err.Error()))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Data(http.StatusOK, "image/jpeg", image)
+}
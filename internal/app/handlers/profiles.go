@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/profiles"
+	"stream-recorder/pkg/logger"
+)
+
+type ProfilesHandler struct {
+	log *logger.Logger
+	pr  *repository.ProfilesRepository
+	v   *profiles.Validator
+}
+
+func NewProfiles(log *logger.Logger, pr *repository.ProfilesRepository, v *profiles.Validator) *ProfilesHandler {
+	return &ProfilesHandler{
+		log: log,
+		pr:  pr,
+		v:   v,
+	}
+}
+
+func (p *ProfilesHandler) GetProfilesHandler(c *gin.Context) {
+	list, err := p.pr.Get()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+func (p *ProfilesHandler) AddProfileHandler(c *gin.Context) {
+	p.log.Debug("Handling AddProfile request", slog.String("name", c.Query("name")))
+
+	if _, err := p.pr.GetByName(c.Query("name")); err == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the profile already exists"})
+		return
+	}
+
+	var profile models.EncodingProfiles
+	profile.Name = c.Query("name")
+	p.save(c, &profile, p.pr.Add)
+}
+
+func (p *ProfilesHandler) UpdateProfileHandler(c *gin.Context) {
+	p.log.Debug("Handling UpdateProfile request", slog.String("name", c.Query("name")))
+
+	profile, err := p.pr.GetByName(c.Query("name"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "profile not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	p.save(c, profile, p.pr.Update)
+}
+
+func (p *ProfilesHandler) DeleteProfileHandler(c *gin.Context) {
+	name := c.Query("name")
+	p.log.Debug("Handling DeleteProfile request", slog.String("name", name))
+
+	if _, err := p.pr.GetByName(name); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "profile not found"})
+		return
+	}
+
+	deleted, err := p.pr.Delete(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusConflict, gin.H{"error": "the profile is assigned to a streamer"})
+		return
+	}
+
+	p.log.Info("Encoding profile deleted", slog.String("name", name))
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// save applies the query parameters present in the request to the profile, validates it against ffmpeg and stores it
+func (p *ProfilesHandler) save(c *gin.Context, profile *models.EncodingProfiles, store func(*models.EncodingProfiles) error) {
+	if err := applyProfileQuery(c, profile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := p.v.Validate(c.Request.Context(), profile); err != nil {
+		p.log.Warn("Invalid encoding profile", slog.String("name", profile.Name), slog.String("error", err.Error()))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := store(profile); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	p.log.Info("Encoding profile saved", slog.String("name", profile.Name))
+	c.JSON(http.StatusOK, profile)
+}
+
+func applyProfileQuery(c *gin.Context, profile *models.EncodingProfiles) error {
+	for param, field := range map[string]*string{
+		"video_codec":   &profile.VideoCodec,
+		"audio_codec":   &profile.AudioCodec,
+		"file_format":   &profile.FileFormat,
+		"preset":        &profile.Preset,
+		"video_bitrate": &profile.VideoBitrate,
+		"scale":         &profile.Scale,
+		"audio_bitrate": &profile.AudioBitrate,
+	} {
+		if value, ok := c.GetQuery(param); ok {
+			*field = value
+		}
+	}
+
+	if value, ok := c.GetQuery("fragmented_mp4"); ok {
+		fragmented, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("fragmented_mp4 contains an invalid value (expected value is true/false)")
+		}
+		profile.FragmentedMP4 = fragmented
+	}
+
+	if value, ok := c.GetQuery("crf"); ok {
+		crf := 0
+		if value != "" {
+			var err error
+			if crf, err = strconv.Atoi(value); err != nil {
+				return errors.New("crf contains an invalid value")
+			}
+		}
+		profile.CRF = crf
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"stream-recorder/internal/app/services/retention"
+	"stream-recorder/pkg/logger"
+)
+
+type RetentionHandler struct {
+	log *logger.Logger
+	r   *retention.Retention
+}
+
+func NewRetention(log *logger.Logger, r *retention.Retention) *RetentionHandler {
+	return &RetentionHandler{
+		log: log,
+		r:   r,
+	}
+}
+
+// PlanRetentionHandler is the dry run: it lists what the retention rules would delete now
+func (rh *RetentionHandler) PlanRetentionHandler(c *gin.Context) {
+	rh.log.Debug("Handling PlanRetention request", slog.String("platform", c.Query("platform")), slog.String("username", c.Query("username")))
+
+	candidates, err := rh.r.Plan()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var size int64
+	list := make([]retention.Candidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if platform := c.Query("platform"); platform != "" && candidate.Item.Platform != platform {
+			continue
+		}
+		if username := c.Query("username"); username != "" && candidate.Item.Username != username {
+			continue
+		}
+		list = append(list, candidate)
+		size += candidate.Item.Size
+	}
+
+	c.JSON(http.StatusOK, gin.H{"total": len(list), "size": size, "recordings": list})
+}
+
+// ApplyRetentionHandler deletes what the retention rules select instead of waiting for the next run
+func (rh *RetentionHandler) ApplyRetentionHandler(c *gin.Context) {
+	rh.log.Debug("Handling ApplyRetention request")
+
+	deleted, err := rh.r.Apply(context.WithoutCancel(c.Request.Context()))
+	if err != nil {
+		rh.log.Error("Failed to apply retention", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var size int64
+	for _, candidate := range deleted {
+		size += candidate.Item.Size
+	}
+	c.JSON(http.StatusOK, gin.H{"total": len(deleted), "size": size, "recordings": deleted})
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/time/rate"
@@ -9,8 +10,15 @@ import (
 	"strconv"
 	"stream-recorder/internal/app/config"
 	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/capacity"
+	"stream-recorder/internal/app/services/clips"
+	"stream-recorder/internal/app/services/disk"
+	"stream-recorder/internal/app/services/downloader"
+	"stream-recorder/internal/app/services/jobs"
 	"stream-recorder/internal/app/services/m3u8"
 	"stream-recorder/internal/app/services/state"
+	"stream-recorder/internal/app/services/tracker"
 	"stream-recorder/internal/app/services/utils"
 	"stream-recorder/pkg/logger"
 	"strings"
@@ -22,16 +30,28 @@ type StreamHandler struct {
 	maps *state.State
 	cfg  *config.Config
 	u    *utils.Utils
+	dp   *downloader.Pool
+	tr   *tracker.Tracker
+	rr   *repository.RecordingsRepository
+	q    *jobs.Queue
+	dm   *disk.Monitor
+	cp   *capacity.Limiter
 
 	limiter map[string]*rate.Limiter
 }
 
-func NewStream(log *logger.Logger, maps *state.State, cfg *config.Config, u *utils.Utils) *StreamHandler {
+func NewStream(log *logger.Logger, maps *state.State, cfg *config.Config, u *utils.Utils, dp *downloader.Pool, tr *tracker.Tracker, rr *repository.RecordingsRepository, q *jobs.Queue, dm *disk.Monitor, cp *capacity.Limiter) *StreamHandler {
 	return &StreamHandler{
 		log:     log,
 		maps:    maps,
 		cfg:     cfg,
 		u:       u,
+		dp:      dp,
+		tr:      tr,
+		rr:      rr,
+		q:       q,
+		dm:      dm,
+		cp:      cp,
 		limiter: make(map[string]*rate.Limiter),
 	}
 }
@@ -98,6 +118,102 @@ func (s *StreamHandler) CutStreamHandler(c *gin.Context) {
 	})
 }
 
+// SaveReplayHandler saves the last minutes of a streamer recorded in the instant-replay mode as a clip
+func (s *StreamHandler) SaveReplayHandler(c *gin.Context) {
+	platform, username := c.Query("platform"), c.Query("username")
+	if platform == "" || username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "platform or username is empty"})
+		return
+	}
+
+	var minutes int
+	if value := c.Query("minutes"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "minutes contains an invalid value"})
+			return
+		}
+		minutes = parsed
+	}
+
+	val := s.maps.GetActiveM3u8(fmt.Sprintf("%s-%s", platform, username))
+	if val == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the streamer is not live"})
+		return
+	}
+	if err := val.SaveReplay(minutes); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.log.Info(fmt.Sprintf("[%s/%s] Replay requested", username, platform), slog.Int("minutes", minutes))
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// ClipStreamHandler queues a clip of a recording. The recording is given by its ID or by the streamer,
+// in which case the session running at the start time (or the latest one for offsets) is used.
+func (s *StreamHandler) ClipStreamHandler(c *gin.Context) {
+	now := time.Now()
+	start, err := clips.ParsePoint(c.Query("start"), now)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "start: " + err.Error()})
+		return
+	}
+	end, err := clips.ParsePoint(c.Query("end"), now)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end: " + err.Error()})
+		return
+	}
+	if start.Time.IsZero() == end.Time.IsZero() && (end.Time.Before(start.Time) || end.Offset < start.Offset) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end is before start"})
+		return
+	}
+
+	var reencode bool
+	if value := c.Query("reencode"); value != "" {
+		reencode, err = strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "reencode contains an invalid value (expected true/false)"})
+			return
+		}
+	}
+
+	var rec *models.Recordings
+	if value := c.Query("recording_id"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "recording_id contains an invalid value"})
+			return
+		}
+		rec, err = s.rr.GetRecording(id)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "recording not found"})
+			return
+		}
+	} else {
+		platform, username := c.Query("platform"), c.Query("username")
+		if platform == "" || username == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "recording_id or platform and username are required"})
+			return
+		}
+		rec, err = s.rr.FindRecording(platform, username, start.Time)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no recording of the streamer covers the start"})
+			return
+		}
+	}
+
+	job, err := clips.Enqueue(s.q, s.cfg, rec, clips.Request{Start: start, End: end, Reencode: reencode})
+	if err != nil {
+		s.log.Error(fmt.Sprintf("[%s/%s] Failed to queue clip", rec.Username, rec.Platform), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.log.Info(fmt.Sprintf("[%s/%s] Clip queued", rec.Username, rec.Platform), slog.Int("job", job.ID), slog.String("file", job.Key))
+	c.JSON(http.StatusOK, gin.H{"job_id": job.ID, "file": job.Key})
+}
+
 func (s *StreamHandler) DownloadM3u8Handler(c *gin.Context) {
 	url := c.Query("url")
 	isValid := (strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")) && strings.HasSuffix(url, ".m3u8")
@@ -136,15 +252,42 @@ func (s *StreamHandler) DownloadM3u8Handler(c *gin.Context) {
 		timeSegment = parsed
 	}
 
+	if err := s.dm.Allow(platform, username); err != nil {
+		s.log.Warn("Recording refused", slog.String("platform", platform), slog.String("username", username), slog.String("error", err.Error()))
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+		return
+	}
+
+	var priority int
+	if priorityStr := c.Query("priority"); priorityStr != "" {
+		parsed, err := strconv.Atoi(priorityStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "priority contains an invalid value"})
+			return
+		}
+		priority = parsed
+	}
+
 	key := fmt.Sprintf("%s-%s", platform, username)
-	val, err := m3u8.New(s.log, platform, username, splitSegments, timeSegment, s.cfg, s.u)
+	val, err := m3u8.New(s.log, platform, username, splitSegments, timeSegment, s.cfg, s.u, s.dp, s.tr, s.rr, s.q)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+
+	// the bandwidth of a bare media playlist is not known, it only counts against max_recordings
+	release, err := s.cp.Acquire(platform, username, priority, 0, func() { val.ChangeIsCancel(true) })
+	if err != nil {
+		s.cp.Leave(platform, username)
+		s.log.Warn("Recording refused", slog.String("platform", platform), slog.String("username", username), slog.String("error", err.Error()))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	defer release()
 	s.maps.UpdateActiveM3u8(key, val)
 
-	err = s.maps.GetActiveM3u8(key).Run(url)
+	// the recording outlives the request, it is stopped through ChangeIsCancel instead
+	err = val.Run(context.WithoutCancel(c.Request.Context()), url)
 	if err != nil {
 		s.log.Error("Error running m3u8", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to run m3u8"})
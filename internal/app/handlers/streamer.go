@@ -6,22 +6,33 @@ import (
 	"log/slog"
 	"net/http"
 	"strconv"
+	"stream-recorder/internal/app/config"
 	"stream-recorder/internal/app/models"
 	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/postprocess"
 	"stream-recorder/internal/app/services/state"
+	"stream-recorder/internal/app/services/storage"
 	"stream-recorder/pkg/logger"
+	"stream-recorder/pkg/pathtemplate"
+	"stream-recorder/pkg/schedule"
+	"strings"
+	"time"
 )
 
 type StreamerHandler struct {
 	log  *logger.Logger
+	cfg  *config.Config
 	sr   *repository.StreamersRepository
+	pr   *repository.ProfilesRepository
 	maps *state.State
 }
 
-func NewStreamer(log *logger.Logger, sr *repository.StreamersRepository, maps *state.State) *StreamerHandler {
+func NewStreamer(log *logger.Logger, cfg *config.Config, sr *repository.StreamersRepository, pr *repository.ProfilesRepository, maps *state.State) *StreamerHandler {
 	return &StreamerHandler{
 		log:  log,
+		cfg:  cfg,
 		sr:   sr,
+		pr:   pr,
 		maps: maps,
 	}
 }
@@ -40,6 +51,13 @@ func (s *StreamerHandler) GetStreamersHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, streamers)
 }
 
+// GetStreamersStatusHandler returns what the checker of every streamer is doing and when it checks next
+func (s *StreamerHandler) GetStreamersStatusHandler(c *gin.Context) {
+	s.log.Debug("Handling GetStreamersStatus request")
+
+	c.JSON(http.StatusOK, s.maps.Pollers())
+}
+
 func (s *StreamerHandler) AddStreamerHandler(c *gin.Context) {
 	s.log.Debug("Handling AddStreamer request",
 		slog.String("platform", c.Query("platform")),
@@ -79,6 +97,86 @@ func (s *StreamerHandler) AddStreamerHandler(c *gin.Context) {
 		Quality:       c.Query("quality"),
 		SplitSegments: splitSegments,
 		TimeSegment:   timeSegment,
+		DirTemplate:   c.Query("dir_template"),
+		FileTemplate:  c.Query("file_template"),
+		Timezone:      c.Query("timezone"),
+	}
+
+	if err := validateNaming(st.DirTemplate, st.FileTemplate, st.Timezone); err != nil {
+		s.log.Warn("Invalid naming settings", slog.String("error", err.Error()))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	splitPolicy, err := parseSplitPolicy(c)
+	if err != nil {
+		s.log.Warn("Invalid split policy", slog.String("error", err.Error()))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	splitPolicy.set(&st)
+
+	replay, err := parseReplay(c)
+	if err != nil {
+		s.log.Warn("Invalid replay settings", slog.String("error", err.Error()))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	replay.set(&st)
+
+	st.PostProcess = c.Query("post_process")
+	if _, err := postprocess.Parse(st.PostProcess); err != nil {
+		s.log.Warn("Invalid post-processing pipeline", slog.String("error", err.Error()))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	st.Profile = c.Query("profile")
+	if st.Profile != "" {
+		if _, err := s.pr.GetByName(st.Profile); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "the encoding profile does not exist"})
+			return
+		}
+	}
+
+	upload, err := parseStorage(c, s.cfg)
+	if err != nil {
+		s.log.Warn("Invalid storage settings", slog.String("error", err.Error()))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	upload.set(&st)
+
+	retention, err := parseRetention(c)
+	if err != nil {
+		s.log.Warn("Invalid retention rules", slog.String("error", err.Error()))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	retention.set(&st)
+
+	polling, err := parsePolling(c)
+	if err != nil {
+		s.log.Warn("Invalid polling intervals", slog.String("error", err.Error()))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	polling.set(&st)
+
+	window, err := parseSchedule(c)
+	if err != nil {
+		s.log.Warn("Invalid schedule", slog.String("error", err.Error()))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	window.set(&st)
+
+	if priority := c.Query("priority"); priority != "" {
+		st.Priority, err = strconv.Atoi(priority)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "priority contains an invalid value"})
+			return
+		}
 	}
 
 	if st.Platform == "" || st.Username == "" || st.Quality == "" {
@@ -154,6 +252,7 @@ func (s *StreamerHandler) DeleteStreamerHandler(c *gin.Context) {
 
 	key := fmt.Sprintf("%s-%s", st.Platform, st.Username)
 	s.maps.UpdateActiveStreamers(key, false)
+	s.maps.CancelStreamer(key)
 
 	if s.maps.GetActiveM3u8(key) != nil {
 		s.maps.GetActiveM3u8(key).ChangeIsCancel(true)
@@ -180,51 +279,559 @@ func (s *StreamerHandler) UpdateStreamerHandler(c *gin.Context) {
 		return
 	}
 
+	// every group is validated before the first one is written, a bad value leaves the streamer untouched
+	update, err := s.parseUpdate(c)
+	if err != nil {
+		s.log.Warn("Invalid streamer settings", slog.String("error", err.Error()))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.sr.Transaction(func(tx *repository.StreamersRepository) error {
+		return update.apply(tx, platform, username)
+	}); err != nil {
+		s.log.Error("Failed to update streamer", err, slog.String("platform", platform), slog.String("username", username))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.log.Info("Streamer update successful", slog.String("platform", platform), slog.String("username", username))
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// streamerUpdate holds the settings groups present in the query, a nil group is left as it is
+type streamerUpdate struct {
+	quality     *string
+	segments    *segmentSettings
+	naming      *namingSettings
+	splitPolicy *splitPolicy
+	postProcess *string
+	replay      *replaySettings
+	profile     *string
+	storage     *storageSettings
+	retention   *retentionRules
+	polling     *pollingIntervals
+	priority    *int
+	schedule    *scheduleSettings
+}
+
+func (s *StreamerHandler) parseUpdate(c *gin.Context) (streamerUpdate, error) {
+	var u streamerUpdate
+	var err error
+
 	if quality := c.Query("quality"); quality != "" {
-		s.log.Debug("Updating quality", slog.String("platform", platform), slog.String("username", username), slog.String("quality", quality))
+		u.quality = &quality
+	}
+	if u.segments, err = parseSegments(c); err != nil {
+		return u, err
+	}
+	if u.naming, err = parseNaming(c); err != nil {
+		return u, err
+	}
+	if u.splitPolicy, err = parseSplitPolicy(c); err != nil {
+		return u, err
+	}
+	if pipeline, ok := c.GetQuery("post_process"); ok {
+		if _, err := postprocess.Parse(pipeline); err != nil {
+			return u, err
+		}
+		u.postProcess = &pipeline
+	}
+	if u.replay, err = parseReplay(c); err != nil {
+		return u, err
+	}
+	if profile, ok := c.GetQuery("profile"); ok {
+		if profile != "" {
+			if _, err := s.pr.GetByName(profile); err != nil {
+				return u, fmt.Errorf("the encoding profile does not exist")
+			}
+		}
+		u.profile = &profile
+	}
+	if u.storage, err = parseStorage(c, s.cfg); err != nil {
+		return u, err
+	}
+	if u.retention, err = parseRetention(c); err != nil {
+		return u, err
+	}
+	if u.polling, err = parsePolling(c); err != nil {
+		return u, err
+	}
+	if priorityStr := c.Query("priority"); priorityStr != "" {
+		priority, err := strconv.Atoi(priorityStr)
+		if err != nil {
+			return u, fmt.Errorf("priority contains an invalid value")
+		}
+		u.priority = &priority
+	}
+	if u.schedule, err = parseSchedule(c); err != nil {
+		return u, err
+	}
+	return u, nil
+}
 
-		if err := s.sr.UpdateQuality(platform, username, quality); err != nil {
-			s.log.Error("Failed to update quality", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+// apply writes the present groups, the first failure rolls back the transaction of tx
+func (u streamerUpdate) apply(tx *repository.StreamersRepository, platform, username string) error {
+	if u.quality != nil {
+		if err := tx.UpdateQuality(platform, username, *u.quality); err != nil {
+			return err
+		}
+	}
+	if u.segments != nil {
+		if err := tx.UpdateSegmentSettings(platform, username, u.segments.SplitSegments, u.segments.TimeSegment); err != nil {
+			return err
+		}
+	}
+	if u.naming != nil {
+		if err := tx.UpdateNaming(platform, username, u.naming.fields()); err != nil {
+			return err
+		}
+	}
+	if u.splitPolicy != nil {
+		if err := tx.UpdateSplitPolicy(platform, username, u.splitPolicy.fields()); err != nil {
+			return err
+		}
+	}
+	if u.postProcess != nil {
+		if err := tx.UpdatePostProcess(platform, username, *u.postProcess); err != nil {
+			return err
+		}
+	}
+	if u.replay != nil {
+		if err := tx.UpdateReplay(platform, username, u.replay.fields()); err != nil {
+			return err
+		}
+	}
+	if u.profile != nil {
+		if err := tx.UpdateProfile(platform, username, *u.profile); err != nil {
+			return err
+		}
+	}
+	if u.storage != nil {
+		if err := tx.UpdateStorage(platform, username, u.storage.fields()); err != nil {
+			return err
+		}
+	}
+	if u.retention != nil {
+		if err := tx.UpdateRetention(platform, username, u.retention.fields()); err != nil {
+			return err
+		}
+	}
+	if u.polling != nil {
+		if err := tx.UpdatePolling(platform, username, u.polling.fields()); err != nil {
+			return err
+		}
+	}
+	if u.priority != nil {
+		if err := tx.UpdatePriority(platform, username, *u.priority); err != nil {
+			return err
+		}
+	}
+	if u.schedule != nil {
+		if err := tx.UpdateSchedule(platform, username, u.schedule.fields()); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+type segmentSettings struct {
+	SplitSegments bool
+	TimeSegment   int
+}
 
-		s.log.Info("Quality updated", slog.String("platform", platform), slog.String("username", username))
+// parseSegments reads split_segments and the time_segment in seconds that goes with it
+func parseSegments(c *gin.Context) (*segmentSettings, error) {
+	splitSegmentsStr := c.Query("split_segments")
+	if splitSegmentsStr == "" {
+		return nil, nil
 	}
 
-	if splitSegmentsStr := c.Query("split_segments"); splitSegmentsStr != "" {
-		splitSegments, err := strconv.ParseBool(splitSegmentsStr)
-		if err != nil {
-			s.log.Error("Invalid split_segments value", err, slog.String("value", splitSegmentsStr))
-			c.JSON(http.StatusBadRequest, gin.H{"error": "split_segments contains an invalid value (expected true/false)"})
-			return
+	var settings segmentSettings
+	var err error
+	if settings.SplitSegments, err = strconv.ParseBool(splitSegmentsStr); err != nil {
+		return nil, fmt.Errorf("split_segments contains an invalid value (expected true/false)")
+	}
+	if timeSegmentStr := c.Query("time_segment"); timeSegmentStr != "" {
+		if settings.TimeSegment, err = strconv.Atoi(timeSegmentStr); err != nil {
+			return nil, fmt.Errorf("time_segment contains an invalid value")
 		}
+	}
+	return &settings, nil
+}
 
-		var timeSegment int
-		if timeSegmentStr := c.Query("time_segment"); timeSegmentStr != "" {
-			timeSegment, err = strconv.Atoi(timeSegmentStr)
-			if err != nil {
-				s.log.Error("Invalid time_segment value", err, slog.String("value", timeSegmentStr))
-				c.JSON(http.StatusBadRequest, gin.H{"error": "time_segment contains an invalid value"})
-				return
+type namingSettings struct {
+	DirTemplate  *string
+	FileTemplate *string
+	Timezone     *string
+}
+
+// parseNaming reads the dir_template, file_template and timezone present in the query
+func parseNaming(c *gin.Context) (*namingSettings, error) {
+	var naming namingSettings
+	var present bool
+	for param, field := range map[string]**string{"dir_template": &naming.DirTemplate, "file_template": &naming.FileTemplate, "timezone": &naming.Timezone} {
+		if value, ok := c.GetQuery(param); ok {
+			*field, present = &value, true
+		}
+	}
+	if !present {
+		return nil, nil
+	}
+
+	if err := validateNaming(deref(naming.DirTemplate), deref(naming.FileTemplate), deref(naming.Timezone)); err != nil {
+		return nil, err
+	}
+	return &naming, nil
+}
+
+func (n namingSettings) fields() map[string]interface{} {
+	fields := make(map[string]interface{})
+	setField(fields, "dir_template", n.DirTemplate)
+	setField(fields, "file_template", n.FileTemplate)
+	setField(fields, "timezone", n.Timezone)
+	return fields
+}
+
+type splitPolicy struct {
+	Size       *int
+	Clock      *int
+	OnCategory *bool
+	OnTitle    *bool
+}
+
+// parseSplitPolicy reads the split rules present in the query: split_size in megabytes,
+// split_clock in minutes counted from midnight and the split_on_category/split_on_title flags
+func parseSplitPolicy(c *gin.Context) (*splitPolicy, error) {
+	var policy splitPolicy
+	var err error
+
+	if policy.Size, err = queryInt(c, "split_size"); err != nil {
+		return nil, err
+	}
+	if policy.Clock, err = queryInt(c, "split_clock"); err != nil {
+		return nil, err
+	}
+	if policy.Clock != nil && *policy.Clock > 0 && (24*60)%*policy.Clock != 0 {
+		return nil, fmt.Errorf("split_clock must divide a day evenly (e.g. 60, 180, 1440)")
+	}
+	if policy.OnCategory, err = queryBool(c, "split_on_category"); err != nil {
+		return nil, err
+	}
+	if policy.OnTitle, err = queryBool(c, "split_on_title"); err != nil {
+		return nil, err
+	}
+
+	if policy == (splitPolicy{}) {
+		return nil, nil
+	}
+	return &policy, nil
+}
+
+func (p splitPolicy) fields() map[string]interface{} {
+	fields := make(map[string]interface{})
+	setField(fields, "split_size", p.Size)
+	setField(fields, "split_clock", p.Clock)
+	setField(fields, "split_on_category", p.OnCategory)
+	setField(fields, "split_on_title", p.OnTitle)
+	return fields
+}
+
+// set copies the present rules into a new streamer
+func (p *splitPolicy) set(st *models.Streamers) {
+	if p == nil {
+		return
+	}
+	setValue(&st.SplitSize, p.Size)
+	setValue(&st.SplitClock, p.Clock)
+	setValue(&st.SplitOnCategory, p.OnCategory)
+	setValue(&st.SplitOnTitle, p.OnTitle)
+}
+
+type replaySettings struct {
+	Minutes  *int
+	Keywords *string
+}
+
+// parseReplay reads the instant-replay settings present in the query: replay_minutes is the length
+// of the buffer (0 records the whole stream) and replay_keywords the comma separated chat triggers
+func parseReplay(c *gin.Context) (*replaySettings, error) {
+	var replay replaySettings
+
+	if value, ok := c.GetQuery("replay_minutes"); ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || parsed > 24*60 {
+			return nil, fmt.Errorf("replay_minutes must be between 0 and 1440")
+		}
+		replay.Minutes = &parsed
+	}
+	if value, ok := c.GetQuery("replay_keywords"); ok {
+		replay.Keywords = &value
+	}
+
+	if replay == (replaySettings{}) {
+		return nil, nil
+	}
+	return &replay, nil
+}
+
+func (r replaySettings) fields() map[string]interface{} {
+	fields := make(map[string]interface{})
+	setField(fields, "replay_minutes", r.Minutes)
+	setField(fields, "replay_keywords", r.Keywords)
+	return fields
+}
+
+func (r *replaySettings) set(st *models.Streamers) {
+	if r == nil {
+		return
+	}
+	setValue(&st.ReplayMinutes, r.Minutes)
+	setValue(&st.ReplayKeywords, r.Keywords)
+}
+
+// validateNaming checks the per streamer templates and timezone, empty values fall back to the global settings
+func validateNaming(dirTemplate, fileTemplate, timezone string) error {
+	if dirTemplate != "" {
+		if _, err := pathtemplate.Parse(dirTemplate, config.TemplatePlaceholders...); err != nil {
+			return fmt.Errorf("dir_template is invalid: %w", err)
+		}
+	}
+	if fileTemplate != "" {
+		if _, err := pathtemplate.Parse(fileTemplate, config.TemplatePlaceholders...); err != nil {
+			return fmt.Errorf("file_template is invalid: %w", err)
+		}
+		if strings.Contains(fileTemplate, "/") {
+			return fmt.Errorf("file_template cannot contain directories, use dir_template instead")
+		}
+	}
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			return fmt.Errorf("timezone is invalid: %w", err)
+		}
+	}
+	return nil
+}
+
+type storageSettings struct {
+	Storage   *string
+	KeepLocal *bool
+}
+
+// parseStorage reads the upload settings present in the query: storage is the name of a configured
+// backend (empty disables the upload) and keep_local keeps the local file after the upload
+func parseStorage(c *gin.Context, cfg *config.Config) (*storageSettings, error) {
+	var upload storageSettings
+
+	if value, ok := c.GetQuery("storage"); ok {
+		if value != "" && !storage.Known(cfg, value) {
+			return nil, fmt.Errorf("the storage backend %q is not configured", value)
+		}
+		upload.Storage = &value
+	}
+	var err error
+	if upload.KeepLocal, err = queryBool(c, "keep_local"); err != nil {
+		return nil, err
+	}
+
+	if upload == (storageSettings{}) {
+		return nil, nil
+	}
+	return &upload, nil
+}
+
+func (s storageSettings) fields() map[string]interface{} {
+	fields := make(map[string]interface{})
+	setField(fields, "storage", s.Storage)
+	setField(fields, "keep_local", s.KeepLocal)
+	return fields
+}
+
+func (s *storageSettings) set(st *models.Streamers) {
+	if s == nil {
+		return
+	}
+	setValue(&st.Storage, s.Storage)
+	setValue(&st.KeepLocal, s.KeepLocal)
+}
+
+type retentionRules struct {
+	Count *int
+	Size  *int
+	Days  *int
+}
+
+// parseRetention reads the retention rules present in the query: retain_count recordings, retain_size
+// megabytes in total and retain_days of age, 0 removes the limit
+func parseRetention(c *gin.Context) (*retentionRules, error) {
+	var retention retentionRules
+	var err error
+
+	if retention.Count, err = queryInt(c, "retain_count"); err != nil {
+		return nil, err
+	}
+	if retention.Size, err = queryInt(c, "retain_size"); err != nil {
+		return nil, err
+	}
+	if retention.Days, err = queryInt(c, "retain_days"); err != nil {
+		return nil, err
+	}
+
+	if retention == (retentionRules{}) {
+		return nil, nil
+	}
+	return &retention, nil
+}
+
+func (r retentionRules) fields() map[string]interface{} {
+	fields := make(map[string]interface{})
+	setField(fields, "retain_count", r.Count)
+	setField(fields, "retain_size", r.Size)
+	setField(fields, "retain_days", r.Days)
+	return fields
+}
+
+func (r *retentionRules) set(st *models.Streamers) {
+	if r == nil {
+		return
+	}
+	setValue(&st.RetainCount, r.Count)
+	setValue(&st.RetainSize, r.Size)
+	setValue(&st.RetainDays, r.Days)
+}
+
+type pollingIntervals struct {
+	Check *int
+	Hot   *int
+}
+
+// parsePolling reads the polling intervals present in the query: check_interval and hot_interval are
+// the seconds between checks of an offline streamer, 0 selects the global setting
+func parsePolling(c *gin.Context) (*pollingIntervals, error) {
+	var polling pollingIntervals
+
+	for param, field := range map[string]**int{"check_interval": &polling.Check, "hot_interval": &polling.Hot} {
+		value, ok := c.GetQuery(param)
+		if !ok {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || (parsed > 0 && parsed < 5) {
+			return nil, fmt.Errorf("%s must be 0 or at least 5 seconds", param)
+		}
+		*field = &parsed
+	}
+
+	if polling == (pollingIntervals{}) {
+		return nil, nil
+	}
+	return &polling, nil
+}
+
+func (p pollingIntervals) fields() map[string]interface{} {
+	fields := make(map[string]interface{})
+	setField(fields, "check_interval", p.Check)
+	setField(fields, "hot_interval", p.Hot)
+	return fields
+}
+
+func (p *pollingIntervals) set(st *models.Streamers) {
+	if p == nil {
+		return
+	}
+	setValue(&st.CheckInterval, p.Check)
+	setValue(&st.HotInterval, p.Hot)
+}
+
+type scheduleSettings struct {
+	Schedule *string
+	End      *string
+}
+
+// parseSchedule reads the recording schedule present in the query: schedule holds the time windows in the
+// streamer's timezone (empty records at any time) and schedule_end is finish or cut for a window that closes mid-stream
+func parseSchedule(c *gin.Context) (*scheduleSettings, error) {
+	var window scheduleSettings
+
+	if value, ok := c.GetQuery("schedule"); ok {
+		if value != "" {
+			if _, err := schedule.Parse(value); err != nil {
+				return nil, fmt.Errorf("schedule is invalid: %w", err)
 			}
-			s.log.Debug("Parsed time_segment", slog.Int("time_segment", timeSegment))
-		}
-
-		s.log.Debug("Updating segment settings",
-			slog.String("platform", platform),
-			slog.String("username", username),
-			slog.Bool("split_segments", splitSegments),
-			slog.Int("time_segment", timeSegment),
-		)
-		if err := s.sr.UpdateSegmentSettings(platform, username, splitSegments, timeSegment); err != nil {
-			s.log.Error("Failed to update segment settings", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
 		}
-		s.log.Debug("Segment settings updated", slog.String("platform", platform), slog.String("username", username))
+		window.Schedule = &value
+	}
+	if value, ok := c.GetQuery("schedule_end"); ok {
+		if value != "" && value != models.ScheduleFinish && value != models.ScheduleCut {
+			return nil, fmt.Errorf("schedule_end must be finish or cut")
+		}
+		window.End = &value
 	}
 
-	s.log.Info("Streamer update successful", slog.String("platform", platform), slog.String("username", username))
-	c.JSON(http.StatusOK, gin.H{"status": "success"})
+	if window == (scheduleSettings{}) {
+		return nil, nil
+	}
+	return &window, nil
+}
+
+func (s scheduleSettings) fields() map[string]interface{} {
+	fields := make(map[string]interface{})
+	setField(fields, "schedule", s.Schedule)
+	setField(fields, "schedule_end", s.End)
+	return fields
+}
+
+func (s *scheduleSettings) set(st *models.Streamers) {
+	if s == nil {
+		return
+	}
+	setValue(&st.Schedule, s.Schedule)
+	setValue(&st.ScheduleEnd, s.End)
+}
+
+// queryInt reads a non-negative number, nil when the parameter is absent
+func queryInt(c *gin.Context, param string) (*int, error) {
+	value, ok := c.GetQuery(param)
+	if !ok {
+		return nil, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return nil, fmt.Errorf("%s contains an invalid value", param)
+	}
+	return &parsed, nil
+}
+
+// queryBool reads a flag, nil when the parameter is absent
+func queryBool(c *gin.Context, param string) (*bool, error) {
+	value, ok := c.GetQuery(param)
+	if !ok {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s contains an invalid value (expected true/false)", param)
+	}
+	return &parsed, nil
+}
+
+// setField adds the column when the value was present in the query
+func setField[T any](fields map[string]interface{}, column string, value *T) {
+	if value != nil {
+		fields[column] = *value
+	}
+}
+
+// setValue overwrites the field when the value was present in the query
+func setValue[T any](field *T, value *T) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+func deref(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
 }
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/state"
+	"stream-recorder/pkg/logger"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMain(m *testing.M) {
+	// the logger writes to logs/ in the working directory
+	dir, err := os.MkdirTemp("", "handlers")
+	if err != nil {
+		panic(err)
+	}
+	os.Chdir(dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestStreamerHandler returns a handler over a fresh database holding the streamer twitch/foo
+func newTestStreamerHandler(t *testing.T, cfg *config.Config) *StreamerHandler {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "db.sqlite")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(models.Streamers{}, models.EncodingProfiles{}); err != nil {
+		t.Fatal(err)
+	}
+
+	log := logger.New()
+	sr := repository.NewStreamers(log, db)
+	if err := sr.Add(models.Streamers{Platform: "twitch", Username: "foo", Quality: "best"}); err != nil {
+		t.Fatal(err)
+	}
+	return NewStreamer(log, cfg, sr, repository.NewProfiles(log, db), state.New())
+}
+
+// updateStreamer sends the settings to UpdateStreamerHandler and returns the status and the stored streamer
+func updateStreamer(t *testing.T, s *StreamerHandler, settings url.Values) (int, models.Streamers) {
+	t.Helper()
+
+	settings.Set("platform", "twitch")
+	settings.Set("username", "foo")
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/?"+settings.Encode(), nil)
+	s.UpdateStreamerHandler(c)
+
+	streamers, err := s.sr.Get()
+	if err != nil || len(streamers) != 1 {
+		t.Fatalf("Get() = %v, %v", streamers, err)
+	}
+	return w.Code, streamers[0]
+}
+
+// queryContext returns a request context carrying the query string
+func queryContext(query string) *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/?"+query, nil)
+	return c
+}
+
+func TestParseSplitPolicy(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{query: "", want: nil},
+		{query: "split_size=2048", want: map[string]interface{}{"split_size": 2048}},
+		{query: "split_clock=180&split_on_category=true", want: map[string]interface{}{"split_clock": 180, "split_on_category": true}},
+		{query: "split_size=0&split_clock=0&split_on_title=false", want: map[string]interface{}{"split_size": 0, "split_clock": 0, "split_on_title": false}},
+		{query: "split_clock=1440", want: map[string]interface{}{"split_clock": 1440}},
+		{query: "split_size=-1", wantErr: true},
+		{query: "split_size=big", wantErr: true},
+		{query: "split_clock=7", wantErr: true},
+		{query: "split_on_title=maybe", wantErr: true},
+	}
+	for _, tt := range tests {
+		policy, err := parseSplitPolicy(queryContext(tt.query))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSplitPolicy(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		var got map[string]interface{}
+		if policy != nil {
+			got = policy.fields()
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSplitPolicy(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestUpdatePostProcess(t *testing.T) {
+	s := newTestStreamerHandler(t, &config.Config{})
+
+	pipeline := `[{"type":"loudnorm"},{"type":"thumbnail","format":"jpg"}]`
+	if code, st := updateStreamer(t, s, url.Values{"post_process": {pipeline}}); code != http.StatusOK || st.PostProcess != pipeline {
+		t.Fatalf("a valid pipeline answered %d and stored %q", code, st.PostProcess)
+	}
+
+	// a bad pipeline rejects the whole update, the quality is not written either
+	for _, bad := range []string{`{"type":"loudnorm"}`, `[{"type":"transcode","crf":99}]`, `[{"type":"unknown"}]`} {
+		code, st := updateStreamer(t, s, url.Values{"quality": {"720p"}, "post_process": {bad}})
+		if code != http.StatusBadRequest || st.Quality != "best" || st.PostProcess != pipeline {
+			t.Errorf("the pipeline %s answered %d and left quality %q and pipeline %q", bad, code, st.Quality, st.PostProcess)
+		}
+	}
+
+	if code, st := updateStreamer(t, s, url.Values{"post_process": {""}}); code != http.StatusOK || st.PostProcess != "" {
+		t.Errorf("an empty pipeline answered %d and stored %q, want it cleared", code, st.PostProcess)
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	s := newTestStreamerHandler(t, &config.Config{})
+	if err := s.pr.Add(&models.EncodingProfiles{Name: "archive", VideoCodec: "libx265", AudioCodec: "aac", FileFormat: "mkv"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, st := updateStreamer(t, s, url.Values{"profile": {"archive"}}); code != http.StatusOK || st.Profile != "archive" {
+		t.Fatalf("an existing profile answered %d and stored %q", code, st.Profile)
+	}
+	if code, st := updateStreamer(t, s, url.Values{"quality": {"720p"}, "profile": {"missing"}}); code != http.StatusBadRequest || st.Profile != "archive" || st.Quality != "best" {
+		t.Errorf("a missing profile answered %d and left profile %q and quality %q", code, st.Profile, st.Quality)
+	}
+	if code, st := updateStreamer(t, s, url.Values{"profile": {""}}); code != http.StatusOK || st.Profile != "" {
+		t.Errorf("an empty profile answered %d and stored %q, want the global settings", code, st.Profile)
+	}
+}
+
+func TestParseReplay(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{query: "", want: nil},
+		{query: "replay_minutes=10", want: map[string]interface{}{"replay_minutes": 10}},
+		{query: "replay_minutes=0&replay_keywords=", want: map[string]interface{}{"replay_minutes": 0, "replay_keywords": ""}},
+		{query: "replay_minutes=1440&replay_keywords=clip,pog", want: map[string]interface{}{"replay_minutes": 1440, "replay_keywords": "clip,pog"}},
+		{query: "replay_minutes=1441", wantErr: true},
+		{query: "replay_minutes=-5", wantErr: true},
+		{query: "replay_minutes=ten", wantErr: true},
+	}
+	for _, tt := range tests {
+		replay, err := parseReplay(queryContext(tt.query))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseReplay(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		var got map[string]interface{}
+		if replay != nil {
+			got = replay.fields()
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseReplay(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateStorage(t *testing.T) {
+	cfg := &config.Config{Storages: map[string]config.StorageConfig{"nas": {Type: config.StorageLocal, Path: t.TempDir()}}}
+	s := newTestStreamerHandler(t, cfg)
+
+	if code, st := updateStreamer(t, s, url.Values{"storage": {"nas"}, "keep_local": {"true"}}); code != http.StatusOK || st.Storage != "nas" || !st.KeepLocal {
+		t.Fatalf("a configured backend answered %d and stored %q with keep_local %v", code, st.Storage, st.KeepLocal)
+	}
+	for _, bad := range []url.Values{{"storage": {"s3"}}, {"keep_local": {"sometimes"}}} {
+		bad.Set("quality", "720p")
+		if code, st := updateStreamer(t, s, bad); code != http.StatusBadRequest || st.Storage != "nas" || !st.KeepLocal || st.Quality != "best" {
+			t.Errorf("%v answered %d and left storage %q, keep_local %v and quality %q", bad, code, st.Storage, st.KeepLocal, st.Quality)
+		}
+	}
+	if code, st := updateStreamer(t, s, url.Values{"storage": {""}}); code != http.StatusOK || st.Storage != "" || !st.KeepLocal {
+		t.Errorf("an empty backend answered %d and stored %q with keep_local %v, want the upload disabled", code, st.Storage, st.KeepLocal)
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{query: "", want: nil},
+		{query: "retain_count=5", want: map[string]interface{}{"retain_count": 5}},
+		{query: "retain_size=2048&retain_days=30", want: map[string]interface{}{"retain_size": 2048, "retain_days": 30}},
+		{query: "retain_count=0&retain_size=0&retain_days=0", want: map[string]interface{}{"retain_count": 0, "retain_size": 0, "retain_days": 0}},
+		{query: "retain_days=-1", wantErr: true},
+		{query: "retain_count=many", wantErr: true},
+	}
+	for _, tt := range tests {
+		retention, err := parseRetention(queryContext(tt.query))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRetention(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		var got map[string]interface{}
+		if retention != nil {
+			got = retention.fields()
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRetention(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestParsePolling(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{query: "", want: nil},
+		{query: "check_interval=60", want: map[string]interface{}{"check_interval": 60}},
+		{query: "check_interval=0&hot_interval=5", want: map[string]interface{}{"check_interval": 0, "hot_interval": 5}},
+		{query: "hot_interval=4", wantErr: true},
+		{query: "check_interval=-1", wantErr: true},
+		{query: "check_interval=often", wantErr: true},
+	}
+	for _, tt := range tests {
+		polling, err := parsePolling(queryContext(tt.query))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePolling(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		var got map[string]interface{}
+		if polling != nil {
+			got = polling.fields()
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePolling(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{query: "", want: nil},
+		{query: "schedule=mon-fri+18:00-23:30", want: map[string]interface{}{"schedule": "mon-fri 18:00-23:30"}},
+		{query: "schedule=&schedule_end=", want: map[string]interface{}{"schedule": "", "schedule_end": ""}},
+		{query: "schedule_end=cut", want: map[string]interface{}{"schedule_end": "cut"}},
+		{query: "schedule=someday", wantErr: true},
+		{query: "schedule_end=pause", wantErr: true},
+	}
+	for _, tt := range tests {
+		window, err := parseSchedule(queryContext(tt.query))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSchedule(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		var got map[string]interface{}
+		if window != nil {
+			got = window.fields()
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSchedule(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestUpdatePriority(t *testing.T) {
+	s := newTestStreamerHandler(t, &config.Config{})
+
+	if code, st := updateStreamer(t, s, url.Values{"priority": {"-2"}}); code != http.StatusOK || st.Priority != -2 {
+		t.Fatalf("a valid priority answered %d and stored %d", code, st.Priority)
+	}
+	if code, st := updateStreamer(t, s, url.Values{"quality": {"720p"}, "priority": {"high"}}); code != http.StatusBadRequest || st.Priority != -2 || st.Quality != "best" {
+		t.Errorf("an invalid priority answered %d and left priority %d and quality %q", code, st.Priority, st.Quality)
+	}
+}
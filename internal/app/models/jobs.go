@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusDone      = "done"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+
+	JobTypeConcat      = "concat"
+	JobTypeVerify      = "verify"
+	JobTypePostProcess = "postprocess"
+	JobTypeClip        = "clip"
+	JobTypeIndex       = "index"
+	JobTypePreview     = "preview"
+	JobTypeUpload      = "upload"
+)
+
+// Jobs is a unit of post-processing work. Key identifies what the job works on (the temp
+// path of a part for the finalization steps) and Payload holds its type specific parameters.
+type Jobs struct {
+	ID          int        `gorm:"primaryKey;column:id" json:"id"`
+	Type        string     `gorm:"column:type;type:varchar(50);not null;index" json:"type"`
+	Key         string     `gorm:"column:job_key;not null;index" json:"key"`
+	Label       string     `gorm:"column:label" json:"label,omitempty"`
+	Platform    string     `gorm:"column:platform;type:varchar(50)" json:"platform"`
+	Username    string     `gorm:"column:username;type:varchar(100)" json:"username"`
+	RecordingID int        `gorm:"column:recording_id;index" json:"recording_id"`
+	Payload     string     `gorm:"column:payload" json:"payload"`
+	Status      string     `gorm:"column:status;type:varchar(20);not null;index" json:"status"`
+	Attempts    int        `gorm:"column:attempts;not null" json:"attempts"`
+	MaxAttempts int        `gorm:"column:max_attempts;not null" json:"max_attempts"`
+	NextRunAt   time.Time  `gorm:"column:next_run_at;not null;index" json:"next_run_at"`
+	Error       string     `gorm:"column:error" json:"error,omitempty"`
+	Log         string     `gorm:"column:log" json:"-"`
+	CreatedAt   time.Time  `gorm:"column:created_at" json:"created_at"`
+	StartedAt   *time.Time `gorm:"column:started_at" json:"started_at,omitempty"`
+	FinishedAt  *time.Time `gorm:"column:finished_at" json:"finished_at,omitempty"`
+}
+
+// LastAttempt reports whether a failure of the running attempt is final
+func (j *Jobs) LastAttempt() bool {
+	return j.Attempts >= j.MaxAttempts
+}
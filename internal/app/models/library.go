@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+const (
+	IntegrityOK       = "ok"
+	IntegrityMismatch = "mismatch"
+	IntegrityMissing  = "missing"
+)
+
+// LibraryItems is a media file of MediaPATH together with what its manifest and ffprobe tell about it.
+// Path is relative to MediaPATH, Manifest and Probe keep the raw JSON of both. A pinned file is never deleted by retention.
+// Sha256 is the checksum taken when the recorder wrote the file, the scrubber compares the file with it.
+type LibraryItems struct {
+	ID         int        `gorm:"primaryKey;column:id" json:"id"`
+	Path       string     `gorm:"column:path;not null;uniqueIndex" json:"path"`
+	Platform   string     `gorm:"column:platform;type:varchar(50);index" json:"platform"`
+	Username   string     `gorm:"column:username;type:varchar(100);index" json:"username"`
+	Title      string     `gorm:"column:title" json:"title,omitempty"`
+	Category   string     `gorm:"column:category" json:"category,omitempty"`
+	Format     string     `gorm:"column:format;type:varchar(20)" json:"format"`
+	Size       int64      `gorm:"column:size;not null" json:"size"`
+	Duration   float64    `gorm:"column:duration;not null" json:"duration"`
+	VideoCodec string     `gorm:"column:video_codec;type:varchar(50)" json:"video_codec,omitempty"`
+	AudioCodec string     `gorm:"column:audio_codec;type:varchar(50)" json:"audio_codec,omitempty"`
+	Width      int        `gorm:"column:width;not null;default:0" json:"width,omitempty"`
+	Height     int        `gorm:"column:height;not null;default:0" json:"height,omitempty"`
+	StartedAt  time.Time  `gorm:"column:started_at;not null;index" json:"started_at"`
+	ModifiedAt time.Time  `gorm:"column:modified_at;not null" json:"modified_at"`
+	Manifest   string     `gorm:"column:manifest" json:"-"`
+	Probe      string     `gorm:"column:probe" json:"-"`
+	IndexedAt  time.Time  `gorm:"column:indexed_at" json:"indexed_at"`
+	Pinned     bool       `gorm:"column:pinned;not null;default:false" json:"pinned"`
+	Sha256     string     `gorm:"column:sha256;type:varchar(64)" json:"sha256,omitempty"`
+	Integrity  string     `gorm:"column:integrity;type:varchar(20);index" json:"integrity,omitempty"`
+	CheckedAt  *time.Time `gorm:"column:checked_at" json:"checked_at,omitempty"`
+}
@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// Manifest is the JSON sidecar written next to every output file
+type Manifest struct {
+	Platform         string    `json:"platform"`
+	Username         string    `json:"username"`
+	Title            string    `json:"title,omitempty"`
+	Category         string    `json:"category,omitempty"`
+	File             string    `json:"file"`
+	Size             int64     `json:"size,omitempty"`
+	Sha256           string    `json:"sha256,omitempty"`
+	StartedAt        time.Time `json:"started_at"`
+	EndedAt          time.Time `json:"ended_at"`
+	StreamOffset     float64   `json:"stream_offset"`
+	Duration         float64   `json:"duration"`
+	RequestedVariant string    `json:"requested_variant,omitempty"`
+	Variant          Variant   `json:"variant"`
+	VideoCodec       string    `json:"video_codec,omitempty"`
+	AudioCodec       string    `json:"audio_codec,omitempty"`
+
+	SegmentCount  int             `json:"segment_count"`
+	MediaSequence ManifestRange   `json:"media_sequence"`
+	AdBreaks      []ManifestRange `json:"ad_breaks"`
+	Gaps          []ManifestRange `json:"gaps"`
+
+	Settings     ManifestSettings    `json:"ffmpeg"`
+	Verification *VerificationReport `json:"verification,omitempty"`
+}
+
+// ManifestRange is a range of media sequence numbers, Offset is its position in the file in seconds
+type ManifestRange struct {
+	First  int64   `json:"first"`
+	Last   int64   `json:"last"`
+	Offset float64 `json:"offset,omitempty"`
+}
+
+type ManifestSettings struct {
+	Muxer         string `json:"muxer"`
+	FileFormat    string `json:"file_format"`
+	VideoCodec    string `json:"video_codec"`
+	AudioCodec    string `json:"audio_codec"`
+	FragmentedMP4 bool   `json:"fragmented_mp4"`
+	Profile       string `json:"profile,omitempty"`
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+const (
+	PollerOffline   = "offline"
+	PollerBackoff   = "backoff"
+	PollerRecording = "recording"
+	PollerRefused   = "refused"
+	PollerStopped   = "stopped"
+	PollerScheduled = "scheduled"
+	PollerQueued    = "queued"
+	PollerPreempted = "preempted"
+)
+
+// PollerStatus is what the checker of a streamer is doing. Interval is the wait before NextCheck in
+// seconds, Hot is set around the times the streamer usually goes live. Reason tells why the streamer
+// is not recorded.
+type PollerStatus struct {
+	Platform  string    `json:"platform"`
+	Username  string    `json:"username"`
+	State     string    `json:"state"`
+	Interval  float64   `json:"interval"`
+	Hot       bool      `json:"hot"`
+	Reason    string    `json:"reason,omitempty"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error,omitempty"`
+	LastCheck time.Time `json:"last_check"`
+	NextCheck time.Time `json:"next_check"`
+}
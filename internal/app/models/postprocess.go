@@ -0,0 +1,36 @@
+package models
+
+const (
+	StepTranscode    = "transcode"
+	StepLoudnorm     = "loudnorm"
+	StepExtractAudio = "extract_audio"
+	StepThumbnail    = "thumbnail"
+	StepMove         = "move"
+	StepCommand      = "command"
+)
+
+// PostProcessStep is a step of the per streamer pipeline that runs after a file is finalized.
+// Only the fields of its type are used.
+type PostProcessStep struct {
+	Type string `json:"type"`
+
+	// transcode
+	VideoCodec string `json:"video_codec,omitempty"`
+	AudioCodec string `json:"audio_codec,omitempty"`
+	CRF        int    `json:"crf,omitempty"`
+	Preset     string `json:"preset,omitempty"`
+
+	// loudnorm, integrated loudness in LUFS
+	Loudness float64 `json:"loudness,omitempty"`
+
+	// extract_audio and thumbnail output format, thumbnail position in seconds
+	Format string  `json:"format,omitempty"`
+	At     float64 `json:"at,omitempty"`
+
+	// move target directory, {platform} and {username} are expanded
+	Path string `json:"path,omitempty"`
+
+	// command with {file}, {dir}, {name}, {platform} and {username} expanded in the arguments
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+}
@@ -0,0 +1,17 @@
+package models
+
+// EncodingProfiles is a named set of codec and container settings that replaces the global
+// ones for the streamers it is assigned to. The encoder settings only apply when the stream is re-encoded.
+type EncodingProfiles struct {
+	ID            int    `gorm:"primaryKey;column:id" json:"id"`
+	Name          string `gorm:"column:name;type:varchar(100);not null;uniqueIndex" json:"name"`
+	VideoCodec    string `gorm:"column:video_codec;type:varchar(50);not null" json:"video_codec"`
+	AudioCodec    string `gorm:"column:audio_codec;type:varchar(50);not null" json:"audio_codec"`
+	FileFormat    string `gorm:"column:file_format;type:varchar(20);not null" json:"file_format"`
+	FragmentedMP4 bool   `gorm:"column:fragmented_mp4;not null" json:"fragmented_mp4"`
+	Preset        string `gorm:"column:preset;type:varchar(50)" json:"preset,omitempty"`
+	CRF           int    `gorm:"column:crf;not null;default:0" json:"crf,omitempty"`
+	VideoBitrate  string `gorm:"column:video_bitrate;type:varchar(20)" json:"video_bitrate,omitempty"`
+	Scale         string `gorm:"column:scale;type:varchar(20)" json:"scale,omitempty"`
+	AudioBitrate  string `gorm:"column:audio_bitrate;type:varchar(20)" json:"audio_bitrate,omitempty"`
+}
@@ -0,0 +1,96 @@
+package models
+
+import "time"
+
+const (
+	RecordingStatusRecording = "recording"
+	RecordingStatusStopped   = "stopped"
+
+	PartStatusPending = "pending"
+	PartStatusDone    = "done"
+	PartStatusFailed  = "failed"
+
+	VerificationPassed  = "passed"
+	VerificationFailed  = "failed"
+	VerificationSkipped = "skipped"
+)
+
+// Recordings is the journal entry of a single recording session
+type Recordings struct {
+	ID            int        `gorm:"primaryKey;column:id"`
+	Platform      string     `gorm:"column:platform;type:varchar(50);not null"`
+	Username      string     `gorm:"column:username;type:varchar(100);not null"`
+	StreamDir     string     `gorm:"column:stream_dir;not null"`
+	Quality       string     `gorm:"column:quality;type:varchar(20)"`
+	Variant       Variant    `gorm:"embedded;embeddedPrefix:variant_"`
+	FileFormat    string     `gorm:"column:file_format;type:varchar(20);not null"`
+	VideoCodec    string     `gorm:"column:video_codec;type:varchar(50);not null"`
+	AudioCodec    string     `gorm:"column:audio_codec;type:varchar(50);not null"`
+	FragmentedMP4 bool       `gorm:"column:fragmented_mp4;not null"`
+	PostProcess   string     `gorm:"column:post_process"`
+	Profile       string     `gorm:"column:profile;type:varchar(100)"`
+	Storage       string     `gorm:"column:storage;type:varchar(100)"`
+	KeepLocal     bool       `gorm:"column:keep_local;not null;default:false"`
+	ReplayMinutes int        `gorm:"column:replay_minutes;not null;default:0"`
+	PartTempPath  string     `gorm:"column:part_temp_path"`
+	PartMediaPath string     `gorm:"column:part_media_path"`
+	Status        string     `gorm:"column:status;type:varchar(20);not null;index"`
+	StartedAt     time.Time  `gorm:"column:started_at;not null"`
+	FinishedAt    *time.Time `gorm:"column:finished_at"`
+}
+
+// RecordingSegments is a segment file written to the temp directory. PartID stays 0
+// until the segment is assigned to a part at a split point.
+type RecordingSegments struct {
+	ID          int     `gorm:"primaryKey;column:id"`
+	RecordingID int     `gorm:"column:recording_id;not null;index"`
+	PartID      int     `gorm:"column:part_id;not null;index"`
+	SegmentID   int     `gorm:"column:segment_id;not null"`
+	VideoFile   string  `gorm:"column:video_file;not null"`
+	AudioFile   string  `gorm:"column:audio_file"`
+	Size        int64   `gorm:"column:size;not null"`
+	Duration    float64 `gorm:"column:duration;not null"`
+
+	FirstSequence int64     `gorm:"column:first_sequence;not null"`
+	LastSequence  int64     `gorm:"column:last_sequence;not null"`
+	SkippedAds    int       `gorm:"column:skipped_ads;not null"`
+	StreamOffset  float64   `gorm:"column:stream_offset;not null"`
+	StartedAt     time.Time `gorm:"column:started_at"`
+	CreatedAt     time.Time `gorm:"column:created_at"`
+}
+
+// RecordingParts is an output file of a session together with its finalization status
+type RecordingParts struct {
+	ID          int    `gorm:"primaryKey;column:id"`
+	RecordingID int    `gorm:"column:recording_id;not null;index"`
+	TempPath    string `gorm:"column:temp_path;not null;uniqueIndex"`
+	MediaPath   string `gorm:"column:media_path;not null"`
+	Status      string `gorm:"column:status;type:varchar(20);not null;index"`
+	Error       string `gorm:"column:error"`
+	Title       string `gorm:"column:title"`
+	Category    string `gorm:"column:category"`
+	Sha256      string `gorm:"column:sha256;type:varchar(64)"`
+
+	ExpectedDuration float64 `gorm:"column:expected_duration;not null"`
+	Verification     string  `gorm:"column:verification;type:varchar(20)"`
+	Report           string  `gorm:"column:report"`
+
+	CreatedAt time.Time `gorm:"column:created_at"`
+	UpdatedAt time.Time `gorm:"column:updated_at"`
+}
+
+// VerificationReport is the result of probing a finished file, stored as JSON on its part
+type VerificationReport struct {
+	Status           string    `json:"status"`
+	File             string    `json:"file"`
+	Format           string    `json:"format,omitempty"`
+	Duration         float64   `json:"duration"`
+	ExpectedDuration float64   `json:"expected_duration,omitempty"`
+	VideoCodec       string    `json:"video_codec,omitempty"`
+	AudioCodec       string    `json:"audio_codec,omitempty"`
+	Width            int       `json:"width,omitempty"`
+	Height           int       `json:"height,omitempty"`
+	AVDesync         float64   `json:"av_desync"`
+	Problems         []string  `json:"problems,omitempty"`
+	CheckedAt        time.Time `json:"checked_at"`
+}
@@ -0,0 +1,8 @@
+package models
+
+// StreamInfo is the channel metadata used in file names and split decisions
+type StreamInfo struct {
+	DisplayName string `json:"display_name"`
+	Title       string `json:"title"`
+	Category    string `json:"category"`
+}
@@ -1,5 +1,10 @@
 package models
 
+const (
+	ScheduleFinish = "finish"
+	ScheduleCut    = "cut"
+)
+
 type Streamers struct {
 	ID            int    `gorm:"primaryKey;column:id"`
 	Platform      string `gorm:"column:platform;type:varchar(50);not null"`
@@ -7,4 +12,45 @@ type Streamers struct {
 	Quality       string `gorm:"column:quality;type:varchar(20);not null"`
 	SplitSegments bool   `gorm:"column:split_segments;not null"`
 	TimeSegment   int    `gorm:"column:time_segment;not null"`
+	DirTemplate   string `gorm:"column:dir_template"`
+	FileTemplate  string `gorm:"column:file_template"`
+	Timezone      string `gorm:"column:timezone;type:varchar(64)"`
+
+	SplitSize       int  `gorm:"column:split_size;not null;default:0"`
+	SplitClock      int  `gorm:"column:split_clock;not null;default:0"`
+	SplitOnCategory bool `gorm:"column:split_on_category;not null;default:false"`
+	SplitOnTitle    bool `gorm:"column:split_on_title;not null;default:false"`
+
+	PostProcess string `gorm:"column:post_process"`
+	Profile     string `gorm:"column:profile;type:varchar(100)"`
+
+	// Storage is the backend finished files are uploaded to, the local file is removed afterwards unless KeepLocal is set
+	Storage   string `gorm:"column:storage;type:varchar(100)"`
+	KeepLocal bool   `gorm:"column:keep_local;not null;default:false"`
+
+	// CheckInterval and HotInterval are the seconds between checks while the streamer is offline,
+	// the hot one is used around the times the streamer usually goes live. 0 selects the global setting.
+	CheckInterval int `gorm:"column:check_interval;not null;default:0"`
+	HotInterval   int `gorm:"column:hot_interval;not null;default:0"`
+
+	// Priority decides which streamers are recorded first when the recordings exceed max_recordings or
+	// the bandwidth budget, the higher one wins
+	Priority int `gorm:"column:priority;not null;default:0"`
+
+	// Schedule limits the recording to time windows in the streamer's timezone, see pkg/schedule, empty records
+	// at any time. ScheduleEnd tells what happens to a running recording when its window closes: it is either
+	// recorded to the end of the stream (finish, the default) or cut and stopped.
+	Schedule    string `gorm:"column:schedule"`
+	ScheduleEnd string `gorm:"column:schedule_end;type:varchar(10)"`
+
+	// RetainCount, RetainSize (megabytes) and RetainDays limit the finished recordings kept for the streamer, 0 is no limit.
+	// Pinned recordings are never deleted and do not count against the limits.
+	RetainCount int `gorm:"column:retain_count;not null;default:0"`
+	RetainSize  int `gorm:"column:retain_size;not null;default:0"`
+	RetainDays  int `gorm:"column:retain_days;not null;default:0"`
+
+	// ReplayMinutes switches the streamer to the instant-replay mode: only the last minutes are kept
+	// and clips are saved on request or when a chat message contains one of the comma separated keywords
+	ReplayMinutes  int    `gorm:"column:replay_minutes;not null;default:0"`
+	ReplayKeywords string `gorm:"column:replay_keywords"`
 }
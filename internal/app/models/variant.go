@@ -0,0 +1,11 @@
+package models
+
+// Variant is a media playlist of the master playlist as it was advertised by the platform
+type Variant struct {
+	URL        string  `gorm:"-" json:"-"`
+	Name       string  `gorm:"column:name" json:"name,omitempty"`
+	Resolution string  `gorm:"column:resolution" json:"resolution,omitempty"`
+	Bandwidth  int     `gorm:"column:bandwidth" json:"bandwidth,omitempty"`
+	Codecs     string  `gorm:"column:codecs" json:"codecs,omitempty"`
+	FrameRate  float64 `gorm:"column:frame_rate" json:"frame_rate,omitempty"`
+}
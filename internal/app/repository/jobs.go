@@ -0,0 +1,217 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"log/slog"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/pkg/logger"
+	"time"
+)
+
+// JobsRepository stores the post-processing queue
+type JobsRepository struct {
+	log *logger.Logger
+	db  *gorm.DB
+}
+
+// JobsFilter narrows down the list of jobs, empty fields match everything
+type JobsFilter struct {
+	Status, Type, Key, Platform, Username string
+}
+
+func NewJobs(log *logger.Logger, db *gorm.DB) *JobsRepository {
+	return &JobsRepository{
+		log: log,
+		db:  db,
+	}
+}
+
+func (jr *JobsRepository) Create(j *models.Jobs) error {
+	jr.log.Trace("Entering Create method", slog.String("type", j.Type), slog.String("key", j.Key))
+
+	if j.Status == "" {
+		j.Status = models.JobStatusQueued
+	}
+	if j.NextRunAt.IsZero() {
+		j.NextRunAt = time.Now()
+	}
+	if err := jr.db.Create(j).Error; err != nil {
+		jr.log.Error("Failed to create job", err, slog.String("type", j.Type), slog.String("key", j.Key))
+		return err
+	}
+
+	jr.log.Debug("Job created", slog.Int("id", j.ID), slog.String("type", j.Type))
+	return nil
+}
+
+// HasKey reports whether any job was ever created for the key
+func (jr *JobsRepository) HasKey(key string) (bool, error) {
+	jr.log.Trace("Entering HasKey method", slog.String("key", key))
+
+	var count int64
+	if err := jr.db.Model(&models.Jobs{}).Where("job_key = ?", key).Count(&count).Error; err != nil {
+		jr.log.Error("Failed to count jobs", err, slog.String("key", key))
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Claim takes the oldest queued job that is due and marks it as running. It returns nil when nothing is due.
+func (jr *JobsRepository) Claim(types []string) (*models.Jobs, error) {
+	jr.log.Trace("Entering Claim method")
+
+	var job models.Jobs
+	err := jr.db.Transaction(func(tx *gorm.DB) error {
+		// Find instead of First, an empty queue is the normal case and must not be logged as an error
+		result := tx.Where("status = ? AND next_run_at <= ? AND type IN ?", models.JobStatusQueued, time.Now(), types).
+			Order("next_run_at, id").
+			Limit(1).
+			Find(&job)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		now := time.Now()
+		job.Status = models.JobStatusRunning
+		job.Attempts++
+		job.StartedAt = &now
+		return tx.Model(&models.Jobs{}).Where("id = ?", job.ID).
+			Updates(map[string]interface{}{"status": job.Status, "attempts": job.Attempts, "started_at": job.StartedAt}).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		jr.log.Error("Failed to claim job", err)
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Finish closes the job with a final status
+func (jr *JobsRepository) Finish(id int, status, errMsg string) error {
+	jr.log.Trace("Entering Finish method", slog.Int("id", id), slog.String("status", status))
+
+	now := time.Now()
+	err := jr.db.Model(&models.Jobs{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{"status": status, "error": errMsg, "finished_at": &now}).Error
+	if err != nil {
+		jr.log.Error("Failed to finish job", err, slog.Int("id", id))
+		return err
+	}
+	return nil
+}
+
+// Reschedule puts a failed job back into the queue to be retried at the given time
+func (jr *JobsRepository) Reschedule(id int, nextRunAt time.Time, errMsg string) error {
+	jr.log.Trace("Entering Reschedule method", slog.Int("id", id), slog.Time("next_run_at", nextRunAt))
+
+	err := jr.db.Model(&models.Jobs{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{"status": models.JobStatusQueued, "error": errMsg, "next_run_at": nextRunAt}).Error
+	if err != nil {
+		jr.log.Error("Failed to reschedule job", err, slog.Int("id", id))
+		return err
+	}
+	return nil
+}
+
+func (jr *JobsRepository) AppendLog(id int, line string) error {
+	err := jr.db.Model(&models.Jobs{}).
+		Where("id = ?", id).
+		Update("log", gorm.Expr("COALESCE(log, '') || ?", line+"\n")).Error
+	if err != nil {
+		jr.log.Error("Failed to append job log", err, slog.Int("id", id))
+		return err
+	}
+	return nil
+}
+
+func (jr *JobsRepository) Get(id int) (*models.Jobs, error) {
+	jr.log.Trace("Entering Get method", slog.Int("id", id))
+
+	var job models.Jobs
+	if err := jr.db.First(&job, id).Error; err != nil {
+		jr.log.Error("Failed to fetch job", err, slog.Int("id", id))
+		return nil, err
+	}
+	return &job, nil
+}
+
+// List returns a page of jobs, newest first, together with the total number of matching jobs
+func (jr *JobsRepository) List(filter JobsFilter, limit, offset int) ([]models.Jobs, int64, error) {
+	jr.log.Trace("Entering List method", slog.Any("filter", filter), slog.Int("limit", limit), slog.Int("offset", offset))
+
+	query := jr.db.Model(&models.Jobs{})
+	for column, value := range map[string]string{"status": filter.Status, "type": filter.Type, "job_key": filter.Key, "platform": filter.Platform, "username": filter.Username} {
+		if value != "" {
+			query = query.Where(fmt.Sprintf("%s = ?", column), value)
+		}
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		jr.log.Error("Failed to count jobs", err)
+		return nil, 0, err
+	}
+
+	var jobs []models.Jobs
+	if err := query.Order("id DESC").Limit(limit).Offset(offset).Find(&jobs).Error; err != nil {
+		jr.log.Error("Failed to fetch jobs", err)
+		return nil, 0, err
+	}
+	return jobs, total, nil
+}
+
+// Requeue resets a failed or cancelled job so that it runs again with a fresh attempt budget
+func (jr *JobsRepository) Requeue(id int) (bool, error) {
+	jr.log.Trace("Entering Requeue method", slog.Int("id", id))
+
+	result := jr.db.Model(&models.Jobs{}).
+		Where("id = ? AND status IN ?", id, []string{models.JobStatusFailed, models.JobStatusCancelled}).
+		Updates(map[string]interface{}{"status": models.JobStatusQueued, "attempts": 0, "error": "", "next_run_at": time.Now(), "finished_at": nil})
+	if result.Error != nil {
+		jr.log.Error("Failed to requeue job", result.Error, slog.Int("id", id))
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// CancelQueued cancels a job that has not started yet
+func (jr *JobsRepository) CancelQueued(id int) (bool, error) {
+	jr.log.Trace("Entering CancelQueued method", slog.Int("id", id))
+
+	now := time.Now()
+	result := jr.db.Model(&models.Jobs{}).
+		Where("id = ? AND status = ?", id, models.JobStatusQueued).
+		Updates(map[string]interface{}{"status": models.JobStatusCancelled, "finished_at": &now})
+	if result.Error != nil {
+		jr.log.Error("Failed to cancel job", result.Error, slog.Int("id", id))
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// ResetRunning returns the jobs interrupted by a crash to the queue, the interrupted attempt is not counted
+func (jr *JobsRepository) ResetRunning() error {
+	jr.log.Trace("Entering ResetRunning method")
+
+	result := jr.db.Model(&models.Jobs{}).
+		Where("status = ?", models.JobStatusRunning).
+		Updates(map[string]interface{}{"status": models.JobStatusQueued, "attempts": gorm.Expr("MAX(attempts - 1, 0)"), "next_run_at": time.Now()})
+	if result.Error != nil {
+		jr.log.Error("Failed to reset running jobs", result.Error)
+		return result.Error
+	}
+
+	if result.RowsAffected > 0 {
+		jr.log.Info("Interrupted jobs returned to the queue", slog.Int64("count", result.RowsAffected))
+	}
+	return nil
+}
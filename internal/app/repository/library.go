@@ -0,0 +1,197 @@
+package repository
+
+import (
+	"gorm.io/gorm"
+	"log/slog"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/pkg/logger"
+	"time"
+)
+
+// LibraryRepository is the index of the media files in MediaPATH
+type LibraryRepository struct {
+	log *logger.Logger
+	db  *gorm.DB
+}
+
+// LibraryFilter narrows down the library, empty fields match everything. Title matches a part of the title.
+type LibraryFilter struct {
+	Platform, Username, Title string
+	From, To                  time.Time
+}
+
+func NewLibrary(log *logger.Logger, db *gorm.DB) *LibraryRepository {
+	return &LibraryRepository{
+		log: log,
+		db:  db,
+	}
+}
+
+func (lr *LibraryRepository) Get(id int) (*models.LibraryItems, error) {
+	lr.log.Trace("Entering Get method", slog.Int("id", id))
+
+	var item models.LibraryItems
+	if err := lr.db.First(&item, id).Error; err != nil {
+		lr.log.Debug("Library item not found", slog.Int("id", id), slog.String("error", err.Error()))
+		return nil, err
+	}
+	return &item, nil
+}
+
+// GetByPath returns the entry of the file, nil when it is not indexed
+func (lr *LibraryRepository) GetByPath(path string) (*models.LibraryItems, error) {
+	lr.log.Trace("Entering GetByPath method", slog.String("path", path))
+
+	var items []models.LibraryItems
+	if err := lr.db.Where("path = ?", path).Limit(1).Find(&items).Error; err != nil {
+		lr.log.Error("Failed to fetch library item", err, slog.String("path", path))
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	return &items[0], nil
+}
+
+// All returns every entry without the manifest and probe data
+func (lr *LibraryRepository) All() ([]models.LibraryItems, error) {
+	lr.log.Trace("Entering All method")
+
+	var items []models.LibraryItems
+	if err := lr.db.Omit("manifest", "probe").Find(&items).Error; err != nil {
+		lr.log.Error("Failed to fetch library", err)
+		return nil, err
+	}
+	return items, nil
+}
+
+// List returns a page of entries, newest first, together with the total number of matching entries
+func (lr *LibraryRepository) List(filter LibraryFilter, limit, offset int) ([]models.LibraryItems, int64, error) {
+	lr.log.Trace("Entering List method", slog.Any("filter", filter), slog.Int("limit", limit), slog.Int("offset", offset))
+
+	query := lr.db.Model(&models.LibraryItems{})
+	if filter.Platform != "" {
+		query = query.Where("platform = ?", filter.Platform)
+	}
+	if filter.Username != "" {
+		query = query.Where("username = ?", filter.Username)
+	}
+	if filter.Title != "" {
+		query = query.Where("title LIKE ?", "%"+filter.Title+"%")
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("started_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("started_at < ?", filter.To)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		lr.log.Error("Failed to count library items", err)
+		return nil, 0, err
+	}
+
+	var items []models.LibraryItems
+	if err := query.Omit("manifest", "probe").Order("started_at DESC, id DESC").Limit(limit).Offset(offset).Find(&items).Error; err != nil {
+		lr.log.Error("Failed to fetch library items", err)
+		return nil, 0, err
+	}
+	return items, total, nil
+}
+
+// Oldest returns the entries that are not pinned in the order they are purged, oldest recording first,
+// without the manifest and probe data
+func (lr *LibraryRepository) Oldest(limit int) ([]models.LibraryItems, error) {
+	lr.log.Trace("Entering Oldest method", slog.Int("limit", limit))
+
+	var items []models.LibraryItems
+	if err := lr.db.Omit("manifest", "probe").Where("pinned = ?", false).Order("started_at ASC, id ASC").Limit(limit).Find(&items).Error; err != nil {
+		lr.log.Error("Failed to fetch oldest library items", err)
+		return nil, err
+	}
+	return items, nil
+}
+
+// Unpinned returns the entries retention may delete, newest recording first, without the manifest and probe data
+func (lr *LibraryRepository) Unpinned() ([]models.LibraryItems, error) {
+	lr.log.Trace("Entering Unpinned method")
+
+	var items []models.LibraryItems
+	if err := lr.db.Omit("manifest", "probe").Where("pinned = ?", false).Order("started_at DESC, id DESC").Find(&items).Error; err != nil {
+		lr.log.Error("Failed to fetch unpinned library items", err)
+		return nil, err
+	}
+	return items, nil
+}
+
+func (lr *LibraryRepository) UpdatePinned(id int, pinned bool) error {
+	lr.log.Trace("Entering UpdatePinned method", slog.Int("id", id), slog.Bool("pinned", pinned))
+
+	if err := lr.db.Model(&models.LibraryItems{}).Where("id = ?", id).Update("pinned", pinned).Error; err != nil {
+		lr.log.Error("Failed to update pinned flag", err, slog.Int("id", id))
+		return err
+	}
+	return nil
+}
+
+// DueForScrub returns the entries that were not checked since the given time, the never checked ones first
+func (lr *LibraryRepository) DueForScrub(before time.Time, limit int) ([]models.LibraryItems, error) {
+	lr.log.Trace("Entering DueForScrub method", slog.Time("before", before), slog.Int("limit", limit))
+
+	var items []models.LibraryItems
+	err := lr.db.Omit("manifest", "probe").
+		Where("checked_at IS NULL OR checked_at < ?", before).
+		Order("checked_at IS NOT NULL, checked_at ASC, id ASC").
+		Limit(limit).Find(&items).Error
+	if err != nil {
+		lr.log.Error("Failed to fetch library items to scrub", err)
+		return nil, err
+	}
+	return items, nil
+}
+
+// ListIntegrity returns the entries whose last check ended with one of the given results
+func (lr *LibraryRepository) ListIntegrity(results ...string) ([]models.LibraryItems, error) {
+	lr.log.Trace("Entering ListIntegrity method", slog.Any("results", results))
+
+	var items []models.LibraryItems
+	if err := lr.db.Omit("manifest", "probe").Where("integrity IN ?", results).Order("checked_at DESC, id DESC").Find(&items).Error; err != nil {
+		lr.log.Error("Failed to fetch library items by integrity", err)
+		return nil, err
+	}
+	return items, nil
+}
+
+// UpdateIntegrity stores the result of a check, sum is the checksum the file is compared with from now on
+func (lr *LibraryRepository) UpdateIntegrity(id int, sum, result string, checkedAt time.Time) error {
+	lr.log.Trace("Entering UpdateIntegrity method", slog.Int("id", id), slog.String("result", result))
+
+	err := lr.db.Model(&models.LibraryItems{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"sha256": sum, "integrity": result, "checked_at": checkedAt}).Error
+	if err != nil {
+		lr.log.Error("Failed to update integrity", err, slog.Int("id", id))
+		return err
+	}
+	return nil
+}
+
+func (lr *LibraryRepository) Save(item *models.LibraryItems) error {
+	lr.log.Trace("Entering Save method", slog.String("path", item.Path))
+
+	if err := lr.db.Save(item).Error; err != nil {
+		lr.log.Error("Failed to save library item", err, slog.String("path", item.Path))
+		return err
+	}
+	return nil
+}
+
+func (lr *LibraryRepository) Delete(id int) error {
+	lr.log.Trace("Entering Delete method", slog.Int("id", id))
+
+	if err := lr.db.Delete(&models.LibraryItems{}, id).Error; err != nil {
+		lr.log.Error("Failed to delete library item", err, slog.Int("id", id))
+		return err
+	}
+	return nil
+}
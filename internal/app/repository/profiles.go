@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"gorm.io/gorm"
+	"log/slog"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/pkg/logger"
+)
+
+type ProfilesRepository struct {
+	log *logger.Logger
+	db  *gorm.DB
+}
+
+func NewProfiles(log *logger.Logger, db *gorm.DB) *ProfilesRepository {
+	return &ProfilesRepository{
+		log: log,
+		db:  db,
+	}
+}
+
+func (pr *ProfilesRepository) Get() ([]models.EncodingProfiles, error) {
+	pr.log.Trace("Entering Get method")
+
+	var profiles []models.EncodingProfiles
+	if err := pr.db.Order("name").Find(&profiles).Error; err != nil {
+		pr.log.Error("Failed to fetch encoding profiles", err)
+		return nil, err
+	}
+	return profiles, nil
+}
+
+func (pr *ProfilesRepository) GetByName(name string) (*models.EncodingProfiles, error) {
+	pr.log.Trace("Entering GetByName method", slog.String("name", name))
+
+	var profile models.EncodingProfiles
+	if err := pr.db.Where("name = ?", name).First(&profile).Error; err != nil {
+		pr.log.Debug("Encoding profile not found", slog.String("name", name), slog.String("error", err.Error()))
+		return nil, err
+	}
+	return &profile, nil
+}
+
+func (pr *ProfilesRepository) Add(p *models.EncodingProfiles) error {
+	pr.log.Trace("Entering Add method", slog.String("name", p.Name))
+
+	if err := pr.db.Create(p).Error; err != nil {
+		pr.log.Error("Failed to add encoding profile", err, slog.String("name", p.Name))
+		return err
+	}
+
+	pr.log.Debug("Encoding profile added", slog.String("name", p.Name))
+	return nil
+}
+
+func (pr *ProfilesRepository) Update(p *models.EncodingProfiles) error {
+	pr.log.Trace("Entering Update method", slog.String("name", p.Name))
+
+	if err := pr.db.Save(p).Error; err != nil {
+		pr.log.Error("Failed to update encoding profile", err, slog.String("name", p.Name))
+		return err
+	}
+
+	pr.log.Debug("Encoding profile updated", slog.String("name", p.Name))
+	return nil
+}
+
+// Delete removes a profile unless a streamer still uses it
+func (pr *ProfilesRepository) Delete(name string) (bool, error) {
+	pr.log.Trace("Entering Delete method", slog.String("name", name))
+
+	var used int64
+	if err := pr.db.Model(&models.Streamers{}).Where("profile = ?", name).Count(&used).Error; err != nil {
+		pr.log.Error("Failed to check encoding profile usage", err, slog.String("name", name))
+		return false, err
+	}
+	if used > 0 {
+		return false, nil
+	}
+
+	if err := pr.db.Where("name = ?", name).Delete(&models.EncodingProfiles{}).Error; err != nil {
+		pr.log.Error("Failed to delete encoding profile", err, slog.String("name", name))
+		return false, err
+	}
+
+	pr.log.Debug("Encoding profile deleted", slog.String("name", name))
+	return true, nil
+}
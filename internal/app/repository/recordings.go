@@ -0,0 +1,328 @@
+package repository
+
+import (
+	"gorm.io/gorm"
+	"log/slog"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/pkg/logger"
+	"time"
+)
+
+// RecordingsRepository is the journal of recording sessions, their segments and output parts
+type RecordingsRepository struct {
+	log *logger.Logger
+	db  *gorm.DB
+}
+
+func NewRecordings(log *logger.Logger, db *gorm.DB) *RecordingsRepository {
+	return &RecordingsRepository{
+		log: log,
+		db:  db,
+	}
+}
+
+func (rr *RecordingsRepository) Start(r *models.Recordings) error {
+	rr.log.Trace("Entering Start method", slog.String("platform", r.Platform), slog.String("username", r.Username))
+
+	r.Status = models.RecordingStatusRecording
+	if r.StartedAt.IsZero() {
+		r.StartedAt = time.Now()
+	}
+	if err := rr.db.Create(r).Error; err != nil {
+		rr.log.Error("Failed to start recording journal", err, slog.String("platform", r.Platform), slog.String("username", r.Username))
+		return err
+	}
+
+	rr.log.Debug("Recording journal started", slog.Int("id", r.ID), slog.String("stream_dir", r.StreamDir))
+	return nil
+}
+
+func (rr *RecordingsRepository) UpdatePartPaths(id int, tempPath, mediaPath string) error {
+	rr.log.Trace("Entering UpdatePartPaths method", slog.Int("id", id), slog.String("temp_path", tempPath))
+
+	err := rr.db.Model(&models.Recordings{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{"part_temp_path": tempPath, "part_media_path": mediaPath}).Error
+	if err != nil {
+		rr.log.Error("Failed to update part paths", err, slog.Int("id", id))
+		return err
+	}
+	return nil
+}
+
+func (rr *RecordingsRepository) AddSegment(s *models.RecordingSegments) error {
+	rr.log.Trace("Entering AddSegment method", slog.Int("recording_id", s.RecordingID), slog.String("video_file", s.VideoFile))
+
+	if err := rr.db.Create(s).Error; err != nil {
+		rr.log.Error("Failed to journal segment", err, slog.Int("recording_id", s.RecordingID), slog.String("video_file", s.VideoFile))
+		return err
+	}
+	return nil
+}
+
+// AddPart records a split point: the part is created and the given segments are assigned to it
+func (rr *RecordingsRepository) AddPart(p *models.RecordingParts, segmentIDs []int) error {
+	rr.log.Trace("Entering AddPart method", slog.Int("recording_id", p.RecordingID), slog.String("temp_path", p.TempPath))
+
+	if p.Status == "" {
+		p.Status = models.PartStatusPending
+	}
+	err := rr.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(p).Error; err != nil {
+			return err
+		}
+		if len(segmentIDs) == 0 {
+			return nil
+		}
+		return tx.Model(&models.RecordingSegments{}).Where("id IN ?", segmentIDs).Update("part_id", p.ID).Error
+	})
+	if err != nil {
+		rr.log.Error("Failed to journal part", err, slog.Int("recording_id", p.RecordingID), slog.String("temp_path", p.TempPath))
+		return err
+	}
+
+	rr.log.Debug("Part journaled", slog.Int("id", p.ID), slog.Int("segments", len(segmentIDs)))
+	return nil
+}
+
+func (rr *RecordingsRepository) UpdatePartStatus(tempPath, status, errMsg string) error {
+	rr.log.Trace("Entering UpdatePartStatus method", slog.String("temp_path", tempPath), slog.String("status", status))
+
+	result := rr.db.Model(&models.RecordingParts{}).
+		Where("temp_path = ?", tempPath).
+		Updates(map[string]interface{}{"status": status, "error": errMsg})
+	if result.Error != nil {
+		rr.log.Error("Failed to update part status", result.Error, slog.String("temp_path", tempPath))
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		rr.log.Warn("No part found to update status", slog.String("temp_path", tempPath))
+	}
+	return nil
+}
+
+func (rr *RecordingsRepository) GetPart(tempPath string) (*models.RecordingParts, error) {
+	rr.log.Trace("Entering GetPart method", slog.String("temp_path", tempPath))
+
+	var part models.RecordingParts
+	if err := rr.db.Where("temp_path = ?", tempPath).First(&part).Error; err != nil {
+		rr.log.Error("Failed to fetch part", err, slog.String("temp_path", tempPath))
+		return nil, err
+	}
+	return &part, nil
+}
+
+func (rr *RecordingsRepository) UpdatePartVerification(tempPath, verification, report string) error {
+	rr.log.Trace("Entering UpdatePartVerification method", slog.String("temp_path", tempPath), slog.String("verification", verification))
+
+	err := rr.db.Model(&models.RecordingParts{}).
+		Where("temp_path = ?", tempPath).
+		Updates(map[string]interface{}{"verification": verification, "report": report}).Error
+	if err != nil {
+		rr.log.Error("Failed to update part verification", err, slog.String("temp_path", tempPath))
+		return err
+	}
+	return nil
+}
+
+func (rr *RecordingsRepository) UpdatePartChecksum(tempPath, sum string) error {
+	rr.log.Trace("Entering UpdatePartChecksum method", slog.String("temp_path", tempPath), slog.String("sha256", sum))
+
+	err := rr.db.Model(&models.RecordingParts{}).
+		Where("temp_path = ?", tempPath).
+		Update("sha256", sum).Error
+	if err != nil {
+		rr.log.Error("Failed to update part checksum", err, slog.String("temp_path", tempPath))
+		return err
+	}
+	return nil
+}
+
+func (rr *RecordingsRepository) Finish(id int) error {
+	rr.log.Trace("Entering Finish method", slog.Int("id", id))
+
+	now := time.Now()
+	err := rr.db.Model(&models.Recordings{}).
+		Where("id = ? AND status = ?", id, models.RecordingStatusRecording).
+		Updates(map[string]interface{}{"status": models.RecordingStatusStopped, "finished_at": &now}).Error
+	if err != nil {
+		rr.log.Error("Failed to finish recording journal", err, slog.Int("id", id))
+		return err
+	}
+	return nil
+}
+
+// GetUnfinished returns the sessions that were interrupted while recording or have parts waiting for finalization
+func (rr *RecordingsRepository) GetUnfinished() ([]models.Recordings, error) {
+	rr.log.Trace("Entering GetUnfinished method")
+
+	var recordings []models.Recordings
+	err := rr.db.
+		Where("status = ?", models.RecordingStatusRecording).
+		Or("id IN (?)", rr.db.Model(&models.RecordingParts{}).Select("recording_id").Where("status = ?", models.PartStatusPending)).
+		Order("id").
+		Find(&recordings).Error
+	if err != nil {
+		rr.log.Error("Failed to fetch unfinished recordings", err)
+		return nil, err
+	}
+
+	rr.log.Debug("Unfinished recordings fetched", slog.Int("count", len(recordings)))
+	return recordings, nil
+}
+
+func (rr *RecordingsRepository) GetUnassignedSegments(recordingID int) ([]models.RecordingSegments, error) {
+	rr.log.Trace("Entering GetUnassignedSegments method", slog.Int("recording_id", recordingID))
+
+	var segments []models.RecordingSegments
+	err := rr.db.Where("recording_id = ? AND part_id = 0", recordingID).Order("segment_id, id").Find(&segments).Error
+	if err != nil {
+		rr.log.Error("Failed to fetch unassigned segments", err, slog.Int("recording_id", recordingID))
+		return nil, err
+	}
+	return segments, nil
+}
+
+func (rr *RecordingsRepository) GetRecording(id int) (*models.Recordings, error) {
+	rr.log.Trace("Entering GetRecording method", slog.Int("id", id))
+
+	var recording models.Recordings
+	if err := rr.db.First(&recording, id).Error; err != nil {
+		rr.log.Error("Failed to fetch recording", err, slog.Int("id", id))
+		return nil, err
+	}
+	return &recording, nil
+}
+
+// DeleteSegments forgets segments whose files were removed from the temp directory
+func (rr *RecordingsRepository) DeleteSegments(ids []int) error {
+	rr.log.Trace("Entering DeleteSegments method", slog.Int("count", len(ids)))
+
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := rr.db.Where("id IN ?", ids).Delete(&models.RecordingSegments{}).Error; err != nil {
+		rr.log.Error("Failed to delete segments", err, slog.Int("count", len(ids)))
+		return err
+	}
+	return nil
+}
+
+func (rr *RecordingsRepository) GetPartSegments(partID int) ([]models.RecordingSegments, error) {
+	rr.log.Trace("Entering GetPartSegments method", slog.Int("part_id", partID))
+
+	var segments []models.RecordingSegments
+	err := rr.db.Where("part_id = ?", partID).Order("segment_id, id").Find(&segments).Error
+	if err != nil {
+		rr.log.Error("Failed to fetch part segments", err, slog.Int("part_id", partID))
+		return nil, err
+	}
+	return segments, nil
+}
+
+// HasPart reports whether a part of any session was journaled with the temp path
+func (rr *RecordingsRepository) HasPart(tempPath string) (bool, error) {
+	rr.log.Trace("Entering HasPart method", slog.String("temp_path", tempPath))
+
+	var count int64
+	if err := rr.db.Model(&models.RecordingParts{}).Where("temp_path = ?", tempPath).Count(&count).Error; err != nil {
+		rr.log.Error("Failed to count parts", err, slog.String("temp_path", tempPath))
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// HasMediaPath reports whether a part of any session was journaled with the media path
+func (rr *RecordingsRepository) HasMediaPath(mediaPath string) (bool, error) {
+	rr.log.Trace("Entering HasMediaPath method", slog.String("media_path", mediaPath))
+
+	var count int64
+	if err := rr.db.Model(&models.RecordingParts{}).Where("media_path = ?", mediaPath).Count(&count).Error; err != nil {
+		rr.log.Error("Failed to count parts", err, slog.String("media_path", mediaPath))
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// HasStreamDir reports whether any session was journaled with the temp directory
+func (rr *RecordingsRepository) HasStreamDir(streamDir string) (bool, error) {
+	rr.log.Trace("Entering HasStreamDir method", slog.String("stream_dir", streamDir))
+
+	var count int64
+	if err := rr.db.Model(&models.Recordings{}).Where("stream_dir = ?", streamDir).Count(&count).Error; err != nil {
+		rr.log.Error("Failed to count recordings", err, slog.String("stream_dir", streamDir))
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (rr *RecordingsRepository) GetPendingParts(recordingID int) ([]models.RecordingParts, error) {
+	rr.log.Trace("Entering GetPendingParts method", slog.Int("recording_id", recordingID))
+
+	var parts []models.RecordingParts
+	err := rr.db.Where("recording_id = ? AND status = ?", recordingID, models.PartStatusPending).Order("id").Find(&parts).Error
+	if err != nil {
+		rr.log.Error("Failed to fetch pending parts", err, slog.Int("recording_id", recordingID))
+		return nil, err
+	}
+	return parts, nil
+}
+
+// GetSegments returns every journaled segment of a session in recording order
+func (rr *RecordingsRepository) GetSegments(recordingID int) ([]models.RecordingSegments, error) {
+	rr.log.Trace("Entering GetSegments method", slog.Int("recording_id", recordingID))
+
+	var segments []models.RecordingSegments
+	err := rr.db.Where("recording_id = ?", recordingID).Order("segment_id, id").Find(&segments).Error
+	if err != nil {
+		rr.log.Error("Failed to fetch segments", err, slog.Int("recording_id", recordingID))
+		return nil, err
+	}
+	return segments, nil
+}
+
+func (rr *RecordingsRepository) GetParts(recordingID int) ([]models.RecordingParts, error) {
+	rr.log.Trace("Entering GetParts method", slog.Int("recording_id", recordingID))
+
+	var parts []models.RecordingParts
+	err := rr.db.Where("recording_id = ?", recordingID).Order("id").Find(&parts).Error
+	if err != nil {
+		rr.log.Error("Failed to fetch parts", err, slog.Int("recording_id", recordingID))
+		return nil, err
+	}
+	return parts, nil
+}
+
+// StartTimes returns when the sessions of a streamer started since the given time
+func (rr *RecordingsRepository) StartTimes(platform, username string, since time.Time) ([]time.Time, error) {
+	rr.log.Trace("Entering StartTimes method", slog.String("platform", platform), slog.String("username", username), slog.Time("since", since))
+
+	var starts []time.Time
+	err := rr.db.Model(&models.Recordings{}).
+		Where("platform = ? AND username = ? AND started_at >= ?", platform, username, since).
+		Order("started_at").Pluck("started_at", &starts).Error
+	if err != nil {
+		rr.log.Error("Failed to fetch start times", err, slog.String("platform", platform), slog.String("username", username))
+		return nil, err
+	}
+	return starts, nil
+}
+
+// FindRecording returns the latest session of a streamer that started before the given time,
+// a zero time returns the latest session
+func (rr *RecordingsRepository) FindRecording(platform, username string, at time.Time) (*models.Recordings, error) {
+	rr.log.Trace("Entering FindRecording method", slog.String("platform", platform), slog.String("username", username), slog.Time("at", at))
+
+	query := rr.db.Where("platform = ? AND username = ?", platform, username)
+	if !at.IsZero() {
+		query = query.Where("started_at <= ?", at)
+	}
+
+	var recording models.Recordings
+	if err := query.Order("started_at DESC, id DESC").First(&recording).Error; err != nil {
+		rr.log.Debug("Recording not found", slog.String("platform", platform), slog.String("username", username), slog.String("error", err.Error()))
+		return nil, err
+	}
+	return &recording, nil
+}
@@ -20,6 +20,15 @@ func NewStreamers(log *logger.Logger, db *gorm.DB) *StreamersRepository {
 	}
 }
 
+// Transaction runs fn with a repository whose updates are committed together, or not at all when fn fails
+func (sr *StreamersRepository) Transaction(fn func(tx *StreamersRepository) error) error {
+	sr.log.Trace("Entering Transaction method")
+
+	return sr.db.Transaction(func(db *gorm.DB) error {
+		return fn(&StreamersRepository{log: sr.log, db: db})
+	})
+}
+
 func (sr *StreamersRepository) Get() ([]models.Streamers, error) {
 	sr.log.Trace("Entering Get method")
 
@@ -138,3 +147,203 @@ func (sr *StreamersRepository) UpdateSegmentSettings(platform, username string,
 	}
 	return nil
 }
+
+func (sr *StreamersRepository) UpdateNaming(platform, username string, updateData map[string]interface{}) error {
+	sr.log.Trace("Entering UpdateNaming method", slog.String("platform", platform), slog.String("username", username), slog.Any("updateData", updateData))
+
+	result := sr.db.Model(&models.Streamers{}).
+		Where("platform = ? AND username = ?", platform, username).
+		Updates(updateData)
+
+	if result.Error != nil {
+		sr.log.Error("Failed to update naming settings", result.Error, slog.Any("updateData", updateData))
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		sr.log.Warn("No streamer found to update naming settings", slog.String("platform", platform), slog.String("username", username))
+	} else {
+		sr.log.Debug("Naming settings updated successfully", slog.String("platform", platform), slog.String("username", username))
+	}
+	return nil
+}
+
+func (sr *StreamersRepository) UpdateSplitPolicy(platform, username string, updateData map[string]interface{}) error {
+	sr.log.Trace("Entering UpdateSplitPolicy method", slog.String("platform", platform), slog.String("username", username), slog.Any("updateData", updateData))
+
+	result := sr.db.Model(&models.Streamers{}).
+		Where("platform = ? AND username = ?", platform, username).
+		Updates(updateData)
+
+	if result.Error != nil {
+		sr.log.Error("Failed to update split policy", result.Error, slog.Any("updateData", updateData))
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		sr.log.Warn("No streamer found to update split policy", slog.String("platform", platform), slog.String("username", username))
+	} else {
+		sr.log.Debug("Split policy updated successfully", slog.String("platform", platform), slog.String("username", username))
+	}
+	return nil
+}
+
+func (sr *StreamersRepository) UpdateReplay(platform, username string, updateData map[string]interface{}) error {
+	sr.log.Trace("Entering UpdateReplay method", slog.String("platform", platform), slog.String("username", username), slog.Any("updateData", updateData))
+
+	result := sr.db.Model(&models.Streamers{}).
+		Where("platform = ? AND username = ?", platform, username).
+		Updates(updateData)
+
+	if result.Error != nil {
+		sr.log.Error("Failed to update replay settings", result.Error, slog.Any("updateData", updateData))
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		sr.log.Warn("No streamer found to update replay settings", slog.String("platform", platform), slog.String("username", username))
+	} else {
+		sr.log.Debug("Replay settings updated successfully", slog.String("platform", platform), slog.String("username", username))
+	}
+	return nil
+}
+
+func (sr *StreamersRepository) UpdatePostProcess(platform, username, pipeline string) error {
+	sr.log.Trace("Entering UpdatePostProcess method", slog.String("platform", platform), slog.String("username", username), slog.String("pipeline", pipeline))
+
+	result := sr.db.Model(&models.Streamers{}).
+		Where("platform = ? AND username = ?", platform, username).
+		Update("post_process", pipeline)
+
+	if result.Error != nil {
+		sr.log.Error("Failed to update post-processing pipeline", result.Error)
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		sr.log.Warn("No streamer found to update post-processing pipeline", slog.String("platform", platform), slog.String("username", username))
+	} else {
+		sr.log.Debug("Post-processing pipeline updated successfully", slog.String("platform", platform), slog.String("username", username))
+	}
+	return nil
+}
+
+func (sr *StreamersRepository) UpdateProfile(platform, username, profile string) error {
+	sr.log.Trace("Entering UpdateProfile method", slog.String("platform", platform), slog.String("username", username), slog.String("profile", profile))
+
+	result := sr.db.Model(&models.Streamers{}).
+		Where("platform = ? AND username = ?", platform, username).
+		Update("profile", profile)
+
+	if result.Error != nil {
+		sr.log.Error("Failed to update encoding profile", result.Error)
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		sr.log.Warn("No streamer found to update encoding profile", slog.String("platform", platform), slog.String("username", username))
+	} else {
+		sr.log.Debug("Encoding profile updated successfully", slog.String("platform", platform), slog.String("username", username))
+	}
+	return nil
+}
+
+func (sr *StreamersRepository) UpdateStorage(platform, username string, updateData map[string]interface{}) error {
+	sr.log.Trace("Entering UpdateStorage method", slog.String("platform", platform), slog.String("username", username), slog.Any("updateData", updateData))
+
+	result := sr.db.Model(&models.Streamers{}).
+		Where("platform = ? AND username = ?", platform, username).
+		Updates(updateData)
+
+	if result.Error != nil {
+		sr.log.Error("Failed to update storage settings", result.Error, slog.Any("updateData", updateData))
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		sr.log.Warn("No streamer found to update storage settings", slog.String("platform", platform), slog.String("username", username))
+	} else {
+		sr.log.Debug("Storage settings updated successfully", slog.String("platform", platform), slog.String("username", username))
+	}
+	return nil
+}
+
+func (sr *StreamersRepository) UpdateRetention(platform, username string, updateData map[string]interface{}) error {
+	sr.log.Trace("Entering UpdateRetention method", slog.String("platform", platform), slog.String("username", username), slog.Any("updateData", updateData))
+
+	result := sr.db.Model(&models.Streamers{}).
+		Where("platform = ? AND username = ?", platform, username).
+		Updates(updateData)
+
+	if result.Error != nil {
+		sr.log.Error("Failed to update retention rules", result.Error, slog.Any("updateData", updateData))
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		sr.log.Warn("No streamer found to update retention rules", slog.String("platform", platform), slog.String("username", username))
+	} else {
+		sr.log.Debug("Retention rules updated successfully", slog.String("platform", platform), slog.String("username", username))
+	}
+	return nil
+}
+
+func (sr *StreamersRepository) UpdatePolling(platform, username string, updateData map[string]interface{}) error {
+	sr.log.Trace("Entering UpdatePolling method", slog.String("platform", platform), slog.String("username", username), slog.Any("updateData", updateData))
+
+	result := sr.db.Model(&models.Streamers{}).
+		Where("platform = ? AND username = ?", platform, username).
+		Updates(updateData)
+
+	if result.Error != nil {
+		sr.log.Error("Failed to update polling intervals", result.Error, slog.Any("updateData", updateData))
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		sr.log.Warn("No streamer found to update polling intervals", slog.String("platform", platform), slog.String("username", username))
+	} else {
+		sr.log.Debug("Polling intervals updated successfully", slog.String("platform", platform), slog.String("username", username))
+	}
+	return nil
+}
+
+func (sr *StreamersRepository) UpdateSchedule(platform, username string, updateData map[string]interface{}) error {
+	sr.log.Trace("Entering UpdateSchedule method", slog.String("platform", platform), slog.String("username", username), slog.Any("updateData", updateData))
+
+	result := sr.db.Model(&models.Streamers{}).
+		Where("platform = ? AND username = ?", platform, username).
+		Updates(updateData)
+
+	if result.Error != nil {
+		sr.log.Error("Failed to update schedule", result.Error, slog.Any("updateData", updateData))
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		sr.log.Warn("No streamer found to update schedule", slog.String("platform", platform), slog.String("username", username))
+	} else {
+		sr.log.Debug("Schedule updated successfully", slog.String("platform", platform), slog.String("username", username))
+	}
+	return nil
+}
+
+func (sr *StreamersRepository) UpdatePriority(platform, username string, priority int) error {
+	sr.log.Trace("Entering UpdatePriority method", slog.String("platform", platform), slog.String("username", username), slog.Int("priority", priority))
+
+	result := sr.db.Model(&models.Streamers{}).
+		Where("platform = ? AND username = ?", platform, username).
+		Update("priority", priority)
+
+	if result.Error != nil {
+		sr.log.Error("Failed to update priority", result.Error, slog.Int("priority", priority))
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		sr.log.Warn("No streamer found to update priority", slog.String("platform", platform), slog.String("username", username))
+	} else {
+		sr.log.Debug("Priority updated successfully", slog.String("platform", platform), slog.String("username", username))
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package capacity
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/pkg/logger"
+	"sync"
+	"time"
+)
+
+// ErrNoCapacity is returned by Acquire when the recording does not fit into the limits
+var ErrNoCapacity = errors.New("no capacity for another recording")
+
+// Session is a running recording. Bandwidth is what the platform advertised for the variant in bits
+// per second, 0 when it is unknown.
+type Session struct {
+	Platform  string    `json:"platform"`
+	Username  string    `json:"username"`
+	Priority  int       `json:"priority"`
+	Bandwidth int       `json:"bandwidth"`
+	StartedAt time.Time `json:"started_at"`
+
+	stop func()
+}
+
+// Waiter is a live streamer that is queued until a recording ends
+type Waiter struct {
+	Platform string    `json:"platform"`
+	Username string    `json:"username"`
+	Priority int       `json:"priority"`
+	Reason   string    `json:"reason"`
+	Since    time.Time `json:"since"`
+}
+
+type Status struct {
+	MaxRecordings int       `json:"max_recordings"`
+	Budget        int       `json:"bandwidth_budget"`
+	Used          int       `json:"bandwidth_used"`
+	Preempt       bool      `json:"preempt"`
+	Preempted     int       `json:"preempted"`
+	Queued        int       `json:"queued"`
+	Sessions      []Session `json:"sessions"`
+	Waiting       []Waiter  `json:"waiting"`
+}
+
+// Limiter keeps the recordings within MaxRecordings and the bandwidth budget. A recording that does not
+// fit is queued, or with Preempt it cuts recordings of a lower priority. Queued streamers of a higher
+// priority get the next free slot first.
+type Limiter struct {
+	log *logger.Logger
+	cfg *config.Config
+
+	mu        sync.Mutex
+	sessions  map[string]*Session
+	waiting   map[string]*Waiter
+	preempted int
+	queued    int
+}
+
+func New(log *logger.Logger, cfg *config.Config) *Limiter {
+	return &Limiter{
+		log:      log,
+		cfg:      cfg,
+		sessions: make(map[string]*Session),
+		waiting:  make(map[string]*Waiter),
+	}
+}
+
+// Acquire takes a slot for the recording and returns the function that frees it. stop is called when the
+// recording is pre-empted, it has to cut the recording cleanly.
+func (l *Limiter) Acquire(platform, username string, priority, bandwidth int, stop func()) (func(), error) {
+	key := platform + "/" + username
+
+	l.mu.Lock()
+	var victims []*Session
+	reason := l.blocked(key, priority)
+	if reason == "" {
+		reason = l.fits(bandwidth, nil)
+		if reason != "" && l.cfg.Preempt {
+			if victims = l.victims(priority, bandwidth); victims != nil {
+				reason = ""
+			}
+		}
+	}
+
+	if reason != "" {
+		if w, ok := l.waiting[key]; ok {
+			w.Priority, w.Reason = priority, reason
+		} else {
+			l.waiting[key] = &Waiter{Platform: platform, Username: username, Priority: priority, Reason: reason, Since: time.Now()}
+			l.queued++
+		}
+		l.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrNoCapacity, reason)
+	}
+
+	for _, v := range victims {
+		delete(l.sessions, v.Platform+"/"+v.Username)
+		l.preempted++
+	}
+	s := &Session{Platform: platform, Username: username, Priority: priority, Bandwidth: bandwidth, StartedAt: time.Now(), stop: stop}
+	l.sessions[key] = s
+	delete(l.waiting, key)
+	l.mu.Unlock()
+
+	for _, v := range victims {
+		l.log.Warn(fmt.Sprintf("[%s/%s] The recording is pre-empted by a streamer of a higher priority", v.Username, v.Platform),
+			slog.String("by", key), slog.Int("priority", v.Priority))
+		v.stop()
+	}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		// a pre-empted session may already be replaced by a new one of the same streamer
+		if l.sessions[key] == s {
+			delete(l.sessions, key)
+		}
+	}, nil
+}
+
+// Leave forgets a queued streamer that went offline or is not checked anymore
+func (l *Limiter) Leave(platform, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.waiting, platform+"/"+username)
+}
+
+func (l *Limiter) Status() Status {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := Status{
+		MaxRecordings: l.cfg.MaxRecordings,
+		Budget:        l.cfg.BandwidthBudget,
+		Used:          l.used(nil),
+		Preempt:       l.cfg.Preempt,
+		Preempted:     l.preempted,
+		Queued:        l.queued,
+		Sessions:      make([]Session, 0, len(l.sessions)),
+		Waiting:       make([]Waiter, 0, len(l.waiting)),
+	}
+	for _, s := range l.sessions {
+		status.Sessions = append(status.Sessions, *s)
+	}
+	for _, w := range l.waiting {
+		status.Waiting = append(status.Waiting, *w)
+	}
+	sort.Slice(status.Sessions, func(i, j int) bool { return status.Sessions[i].StartedAt.Before(status.Sessions[j].StartedAt) })
+	sort.Slice(status.Waiting, func(i, j int) bool {
+		if status.Waiting[i].Priority != status.Waiting[j].Priority {
+			return status.Waiting[i].Priority > status.Waiting[j].Priority
+		}
+		return status.Waiting[i].Since.Before(status.Waiting[j].Since)
+	})
+	return status
+}
+
+// blocked returns why a queued streamer of a higher priority goes first
+func (l *Limiter) blocked(key string, priority int) string {
+	for k, w := range l.waiting {
+		if k != key && w.Priority > priority {
+			return fmt.Sprintf("queued behind %s (priority %d)", k, w.Priority)
+		}
+	}
+	return ""
+}
+
+// fits returns why a recording of that bandwidth does not fit next to the sessions that are not excluded
+func (l *Limiter) fits(bandwidth int, excluded map[*Session]bool) string {
+	count := len(l.sessions) - len(excluded)
+	if l.cfg.MaxRecordings > 0 && count >= l.cfg.MaxRecordings {
+		return fmt.Sprintf("%d of %d recordings are running", count, l.cfg.MaxRecordings)
+	}
+
+	// a single recording is never refused, even when it is larger than the whole budget
+	used := l.used(excluded)
+	if budget := l.cfg.BandwidthBudget * 1000 * 1000; budget > 0 && count > 0 && used+bandwidth > budget {
+		return fmt.Sprintf("%.1f of %d Mbit/s are in use, the stream needs %.1f", float64(used)/1e6, l.cfg.BandwidthBudget, float64(bandwidth)/1e6)
+	}
+	return ""
+}
+
+func (l *Limiter) used(excluded map[*Session]bool) int {
+	var used int
+	for _, s := range l.sessions {
+		if !excluded[s] {
+			used += s.Bandwidth
+		}
+	}
+	return used
+}
+
+// victims picks the sessions of a lower priority whose cut makes room, the lowest priority and
+// the youngest recording go first. nil means cutting all of them would not be enough.
+func (l *Limiter) victims(priority, bandwidth int) []*Session {
+	var candidates []*Session
+	for _, s := range l.sessions {
+		if s.Priority < priority {
+			candidates = append(candidates, s)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Priority != candidates[j].Priority {
+			return candidates[i].Priority < candidates[j].Priority
+		}
+		return candidates[i].StartedAt.After(candidates[j].StartedAt)
+	})
+
+	excluded := make(map[*Session]bool)
+	for i, s := range candidates {
+		excluded[s] = true
+		if l.fits(bandwidth, excluded) == "" {
+			return candidates[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package capacity
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/pkg/logger"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// the logger writes to logs/ in the working directory
+	dir, err := os.MkdirTemp("", "capacity")
+	if err != nil {
+		panic(err)
+	}
+	os.Chdir(dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// recorder acquires slots and remembers which recordings were pre-empted
+type recorder struct {
+	t       *testing.T
+	l       *Limiter
+	stopped []string
+}
+
+func newRecorder(t *testing.T, cfg config.Config) *recorder {
+	return &recorder{t: t, l: New(logger.New(), &cfg)}
+}
+
+func (r *recorder) acquire(username string, priority, bandwidth int) (func(), error) {
+	return r.l.Acquire("twitch", username, priority, bandwidth, func() { r.stopped = append(r.stopped, username) })
+}
+
+func (r *recorder) mustAcquire(username string, priority, bandwidth int) func() {
+	r.t.Helper()
+
+	release, err := r.acquire(username, priority, bandwidth)
+	if err != nil {
+		r.t.Fatalf("Acquire(%s) = %v", username, err)
+	}
+	return release
+}
+
+func (r *recorder) sessions() []string {
+	var names []string
+	for _, s := range r.l.Status().Sessions {
+		names = append(names, s.Username)
+	}
+	return names
+}
+
+func TestMaxRecordings(t *testing.T) {
+	r := newRecorder(t, config.Config{MaxRecordings: 2})
+
+	releaseA := r.mustAcquire("a", 0, 0)
+	r.mustAcquire("b", 0, 0)
+	if _, err := r.acquire("c", 0, 0); !errors.Is(err, ErrNoCapacity) {
+		t.Fatalf("Acquire(c) = %v with 2 of 2 recordings, want ErrNoCapacity", err)
+	}
+	// the next check of the queued streamer does not count twice
+	r.acquire("c", 0, 0)
+	if status := r.l.Status(); status.Queued != 1 || len(status.Waiting) != 1 {
+		t.Fatalf("%d are queued and %d are waiting, want 1 of each", status.Queued, len(status.Waiting))
+	}
+
+	releaseA()
+	r.mustAcquire("c", 0, 0)
+	if got, want := r.sessions(), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sessions = %v, want %v", got, want)
+	}
+	if status := r.l.Status(); len(status.Waiting) != 0 {
+		t.Errorf("%d are still waiting after c started", len(status.Waiting))
+	}
+}
+
+func TestPriorityQueue(t *testing.T) {
+	r := newRecorder(t, config.Config{MaxRecordings: 1})
+
+	release := r.mustAcquire("a", 0, 0)
+	for _, w := range []struct {
+		name     string
+		priority int
+	}{{"low", 1}, {"high", 5}, {"mid", 3}} {
+		if _, err := r.acquire(w.name, w.priority, 0); err == nil {
+			t.Fatalf("Acquire(%s) succeeded without a free slot", w.name)
+		}
+	}
+	var order []string
+	for _, w := range r.l.Status().Waiting {
+		order = append(order, w.Username)
+	}
+	if want := []string{"high", "mid", "low"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("waiting = %v, want %v", order, want)
+	}
+
+	// the free slot goes to the highest priority even when a lower one checks first
+	release()
+	if _, err := r.acquire("low", 1, 0); err == nil {
+		t.Fatal("Acquire(low) took the slot before the queued high priority streamer")
+	}
+	r.mustAcquire("high", 5, 0)
+
+	// a streamer that went offline does not block the queue
+	r.l.Leave("twitch", "mid")
+	if status := r.l.Status(); len(status.Waiting) != 1 || status.Waiting[0].Username != "low" {
+		t.Errorf("waiting = %+v after mid left, want only low", status.Waiting)
+	}
+	if len(r.stopped) != 0 {
+		t.Errorf("%v were pre-empted although pre-emption is disabled", r.stopped)
+	}
+}
+
+func TestPreempt(t *testing.T) {
+	r := newRecorder(t, config.Config{MaxRecordings: 2, Preempt: true})
+
+	releaseOld := r.mustAcquire("old", 0, 0)
+	releaseYoung := r.mustAcquire("young", 0, 0)
+	if _, err := r.acquire("same", 0, 0); err == nil {
+		t.Fatal("Acquire(same) pre-empted a recording of the same priority")
+	}
+	r.l.Leave("twitch", "same")
+
+	// the youngest recording of the lowest priority is cut
+	r.mustAcquire("vip", 1, 0)
+	if want := []string{"young"}; !reflect.DeepEqual(r.stopped, want) {
+		t.Errorf("pre-empted %v, want %v", r.stopped, want)
+	}
+	if got, want := r.sessions(), []string{"old", "vip"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sessions = %v, want %v", got, want)
+	}
+
+	// the late release of the cut recording does not free the slot of its next session
+	releaseOld()
+	r.mustAcquire("young", 0, 0)
+	releaseYoung()
+	if got := r.l.Status(); got.Preempted != 1 || len(got.Sessions) != 2 {
+		t.Errorf("%d pre-empted and %d sessions, want 1 and 2", got.Preempted, len(got.Sessions))
+	}
+}
+
+func TestPreemptBandwidth(t *testing.T) {
+	r := newRecorder(t, config.Config{BandwidthBudget: 10, Preempt: true})
+
+	// a single recording is never refused
+	release := r.mustAcquire("huge", 0, 12e6)
+	release()
+
+	r.mustAcquire("a", 0, 6e6)
+	r.mustAcquire("b", 1, 3e6)
+	if _, err := r.acquire("c", 0, 2e6); err == nil {
+		t.Fatal("Acquire(c) exceeded the budget")
+	}
+	r.l.Leave("twitch", "c")
+
+	// cutting a is enough, b of a higher priority keeps recording
+	r.mustAcquire("d", 2, 5e6)
+	if want := []string{"a"}; !reflect.DeepEqual(r.stopped, want) {
+		t.Errorf("pre-empted %v, want %v", r.stopped, want)
+	}
+	if status := r.l.Status(); status.Used != 8e6 {
+		t.Errorf("%d bit/s are in use, want 8e6", status.Used)
+	}
+
+	// nothing is cut when even all the lower priorities do not make room
+	if _, err := r.acquire("e", 2, 6e6); err == nil {
+		t.Fatal("Acquire(e) exceeded the budget")
+	}
+	if len(r.stopped) != 1 {
+		t.Errorf("pre-empted %v, want only a", r.stopped)
+	}
+}
@@ -0,0 +1,184 @@
+package clips
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/jobs"
+	"stream-recorder/internal/app/services/library"
+	"stream-recorder/pkg/logger"
+	"strings"
+	"sync"
+	"time"
+)
+
+// naming serializes the enqueues that pick an output name, the name is reserved by the key of the job
+var naming sync.Mutex
+
+// Point is a position in a recording, either a wall-clock time or an offset in the stream
+// as used by the {offset} placeholder of the file names
+type Point struct {
+	Time   time.Time `json:"time,omitempty"`
+	Offset float64   `json:"offset,omitempty"`
+}
+
+// Request is the payload of a clip job
+type Request struct {
+	Start    Point  `json:"start"`
+	End      Point  `json:"end"`
+	Reencode bool   `json:"reencode"`
+	Output   string `json:"output"`
+}
+
+// ParsePoint reads a clip boundary: an RFC 3339 time, a time relative to now ("-2m", "now"),
+// or a stream offset given as seconds, [hh:]mm:ss or a duration such as 1h2m3s
+func ParsePoint(value string, now time.Time) (Point, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "":
+		return Point{}, errors.New("the value is empty")
+	case value == "now":
+		return Point{Time: now}, nil
+	case strings.HasPrefix(value, "-"):
+		d, err := time.ParseDuration(value[1:])
+		if err != nil {
+			return Point{}, fmt.Errorf("%q is not a valid relative time", value)
+		}
+		return Point{Time: now.Add(-d)}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return Point{Time: t}, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return Point{Offset: seconds}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return Point{Offset: d.Seconds()}, nil
+	}
+
+	var seconds float64
+	fields := strings.Split(value, ":")
+	if len(fields) > 3 {
+		return Point{}, fmt.Errorf("%q is not a valid time or offset", value)
+	}
+	for _, field := range fields {
+		n, err := strconv.ParseFloat(field, 64)
+		if err != nil || n < 0 {
+			return Point{}, fmt.Errorf("%q is not a valid time or offset", value)
+		}
+		seconds = seconds*60 + n
+	}
+	return Point{Offset: seconds}, nil
+}
+
+// Enqueue queues a clip of the recording and returns the job. The clip is cut when the job runs,
+// so a range that ends a moment ago is taken from the segments of the live session.
+func Enqueue(q *jobs.Queue, cfg *config.Config, rec *models.Recordings, r Request) (*models.Jobs, error) {
+	if r.Output == "" {
+		naming.Lock()
+		defer naming.Unlock()
+		output, err := outputPath(q, cfg, rec)
+		if err != nil {
+			return nil, err
+		}
+		r.Output = output
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	job := models.Jobs{
+		Type:        models.JobTypeClip,
+		Key:         r.Output,
+		Label:       filepath.Base(r.Output),
+		Platform:    rec.Platform,
+		Username:    rec.Username,
+		RecordingID: rec.ID,
+		Payload:     string(data),
+	}
+	if err := q.Enqueue(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// outputPath names a clip after the streamer and the time it was requested. A name is taken when
+// the file exists or a job was queued for it, the clips of one second get a counter.
+func outputPath(q *jobs.Queue, cfg *config.Config, rec *models.Recordings) (string, error) {
+	base := filepath.Join(cfg.MediaPATH, "clips", fmt.Sprintf("%s_%s_clip_%s", rec.Platform, rec.Username, time.Now().Format("2006-01-02_15-04-05")))
+	candidate := base + "." + rec.FileFormat
+	for i := 2; ; i++ {
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			known, err := q.Known(candidate)
+			if err != nil {
+				return "", err
+			}
+			if !known {
+				return candidate, nil
+			}
+		}
+		candidate = fmt.Sprintf("%s_%d.%s", base, i, rec.FileFormat)
+	}
+}
+
+// Extract cuts a range of the recording into the output file, the container follows its extension.
+// The timestamps of the output start at offset, cuts of one recording made with their stream offset line up.
+func Extract(ctx context.Context, cfg *config.Config, rr *repository.RecordingsRepository, rec *models.Recordings, start, end Point, reencode bool, offset time.Duration, output string) error {
+	tl, err := load(cfg, rr, rec)
+	if err != nil {
+		return err
+	}
+	pieces, err := tl.cut(start, end)
+	if err != nil {
+		return err
+	}
+	return produce(ctx, cfg, pieces, reencode, offset, output)
+}
+
+// Register adds the clip handler to the queue
+func Register(q *jobs.Queue, log *logger.Logger, cfg *config.Config, rr *repository.RecordingsRepository) {
+	q.Register(models.JobTypeClip, func(ctx context.Context, job *models.Jobs) error {
+		var r Request
+		if err := json.Unmarshal([]byte(job.Payload), &r); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+
+		rec, err := rr.GetRecording(job.RecordingID)
+		if err != nil {
+			return err
+		}
+		tl, err := load(cfg, rr, rec)
+		if err != nil {
+			return err
+		}
+
+		pieces, err := tl.cut(r.Start, r.End)
+		if err != nil {
+			return err
+		}
+		for _, p := range pieces {
+			q.Log(job.ID, fmt.Sprintf("source %s: %d files, seek %s, length %s", p.kind, len(p.video), p.seek, p.length))
+		}
+
+		if err := produce(ctx, cfg, pieces, r.Reencode, 0, r.Output); err != nil {
+			return err
+		}
+		log.Info(fmt.Sprintf("[%s/%s] Clip saved", job.Username, job.Platform), slog.String("file", r.Output))
+		q.Log(job.ID, "clip written: "+r.Output)
+		if err := library.Enqueue(q, *job, r.Output); err != nil {
+			log.Error(fmt.Sprintf("[%s/%s] Failed to queue library update", job.Username, job.Platform), err, slog.String("file", r.Output))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,292 @@
+package clips
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/pkg/ffmpeg"
+	"strings"
+	"time"
+)
+
+// entry is a segment placed on the media timeline of the session, which is the sum of
+// the durations of the segments before it and has no gaps for ads or reconnects
+type entry struct {
+	seg      models.RecordingSegments
+	position time.Duration
+	duration time.Duration
+}
+
+type timeline struct {
+	cfg       *config.Config
+	rec       *models.Recordings
+	entries   []entry
+	parts     map[int]models.RecordingParts
+	partStart map[int]time.Duration
+}
+
+// piece is a run of consecutive source files of the same kind, cut with a single ffmpeg call
+type piece struct {
+	kind         string
+	video, audio []string
+	start, end   time.Duration
+	seek, length time.Duration
+}
+
+func load(cfg *config.Config, rr *repository.RecordingsRepository, rec *models.Recordings) (*timeline, error) {
+	segments, err := rr.GetSegments(rec.ID)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := rr.GetParts(rec.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	tl := &timeline{
+		cfg:       cfg,
+		rec:       rec,
+		parts:     make(map[int]models.RecordingParts),
+		partStart: make(map[int]time.Duration),
+	}
+	for _, part := range parts {
+		tl.parts[part.ID] = part
+	}
+
+	var position time.Duration
+	for _, seg := range segments {
+		// a clip saved from a replay buffer journals its segments a second time under other names
+		if n := len(tl.entries); n > 0 && tl.entries[n-1].seg.SegmentID == seg.SegmentID {
+			if tl.available(seg) && !tl.available(tl.entries[n-1].seg) {
+				tl.entries[n-1].seg = seg
+			}
+			continue
+		}
+
+		duration := time.Duration(seg.Duration * float64(time.Second))
+		tl.entries = append(tl.entries, entry{seg: seg, position: position, duration: duration})
+		position += duration
+	}
+	if len(tl.entries) == 0 {
+		return nil, errors.New("the recording has no segments")
+	}
+
+	for _, e := range tl.entries {
+		if _, ok := tl.partStart[e.seg.PartID]; !ok && e.seg.PartID != 0 {
+			tl.partStart[e.seg.PartID] = e.position
+		}
+	}
+	return tl, nil
+}
+
+// finalized returns the media file of the part the segment belongs to, once the part is done
+func (tl *timeline) finalized(seg models.RecordingSegments) (string, bool) {
+	part, ok := tl.parts[seg.PartID]
+	if !ok || part.Status != models.PartStatusDone {
+		return "", false
+	}
+	file := fmt.Sprintf("%s.%s", part.MediaPath, tl.rec.FileFormat)
+	_, err := os.Stat(file)
+	return file, err == nil
+}
+
+func (tl *timeline) tempFile(name string) string {
+	return filepath.Join(tl.cfg.TempPATH, tl.rec.StreamDir, name)
+}
+
+func (tl *timeline) available(seg models.RecordingSegments) bool {
+	if _, ok := tl.finalized(seg); ok {
+		return true
+	}
+	_, err := os.Stat(tl.tempFile(seg.VideoFile))
+	return err == nil
+}
+
+// locate maps a point onto the media timeline, a point in a gap moves to the next segment
+func (tl *timeline) locate(p Point) time.Duration {
+	for _, e := range tl.entries {
+		var into time.Duration
+		if !p.Time.IsZero() {
+			into = p.Time.Sub(e.seg.StartedAt)
+		} else {
+			into = time.Duration((p.Offset - e.seg.StreamOffset) * float64(time.Second))
+		}
+		if into < e.duration {
+			return e.position + max(into, 0)
+		}
+	}
+
+	last := tl.entries[len(tl.entries)-1]
+	return last.position + last.duration
+}
+
+// cut returns the pieces that cover the range: finalized parts are read from their media
+// files, everything else from the segments still in the temp directory
+func (tl *timeline) cut(start, end Point) ([]piece, error) {
+	from, to := tl.locate(start), tl.locate(end)
+	if to <= from {
+		return nil, errors.New("the range is empty or was not recorded")
+	}
+
+	var pieces []piece
+	for _, e := range tl.entries {
+		if e.position+e.duration <= from || e.position >= to {
+			continue
+		}
+
+		kind, video, audio, fileStart := "part", "", "", e.position
+		if file, ok := tl.finalized(e.seg); ok {
+			video, fileStart = file, tl.partStart[e.seg.PartID]
+		} else {
+			kind, video = "segments", tl.tempFile(e.seg.VideoFile)
+			if _, err := os.Stat(video); err != nil {
+				return nil, fmt.Errorf("segment %s is no longer on disk", e.seg.VideoFile)
+			}
+			if e.seg.AudioFile != "" {
+				audio = tl.tempFile(e.seg.AudioFile)
+			}
+		}
+
+		n := len(pieces)
+		if n == 0 || pieces[n-1].kind != kind || (len(pieces[n-1].audio) > 0) != (audio != "") {
+			pieces = append(pieces, piece{kind: kind, start: fileStart})
+			n++
+		}
+		p := &pieces[n-1]
+		if len(p.video) == 0 || p.video[len(p.video)-1] != video {
+			p.video = append(p.video, video)
+		}
+		if audio != "" {
+			p.audio = append(p.audio, audio)
+		}
+		p.end = e.position + e.duration
+	}
+
+	for i := range pieces {
+		begin := max(from, pieces[i].start)
+		pieces[i].seek = begin - pieces[i].start
+		pieces[i].length = min(to, pieces[i].end) - begin
+	}
+	return pieces, nil
+}
+
+// produce cuts the pieces and joins them into the clip. A single piece is written directly.
+// The timestamps of the output start at the offset.
+func produce(ctx context.Context, cfg *config.Config, pieces []piece, reencode bool, offset time.Duration, output string) error {
+	dir, err := os.MkdirTemp(cfg.TempPATH, "clip-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return err
+	}
+	ext := filepath.Ext(output)
+	download := strings.TrimSuffix(output, ext) + "_download" + ext
+	defer os.Remove(download)
+
+	if len(pieces) == 1 {
+		err = cutPiece(ctx, cfg, dir, 0, pieces[0], reencode, offset, download)
+	} else {
+		err = joinPieces(ctx, cfg, dir, pieces, reencode, offset, download)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(download, output)
+}
+
+func joinPieces(ctx context.Context, cfg *config.Config, dir string, pieces []piece, reencode bool, offset time.Duration, output string) error {
+	files := make([]string, 0, len(pieces))
+	for i, p := range pieces {
+		file := filepath.Join(dir, fmt.Sprintf("piece%d.mkv", i))
+		if err := cutPiece(ctx, cfg, dir, i, p, reencode, 0, file); err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+
+	list, err := writeList(filepath.Join(dir, "pieces.txt"), files)
+	if err != nil {
+		return err
+	}
+
+	ff, err := ffmpeg.NewFfmpeg(cfg.FFmpegPATH)
+	if err != nil {
+		return err
+	}
+	ff.Yes().
+		LogLevel("error").
+		Format("concat").
+		Safe(0).
+		VideoCodec("copy").
+		AudioCodec("copy")
+	timestamps(ff, offset)
+	return ff.Execute(ctx, []string{list}, output)
+}
+
+// cutPiece seeks in the concatenated files of the piece. A stream copy starts at the keyframe
+// before the requested time, a re-encode starts exactly at it.
+func cutPiece(ctx context.Context, cfg *config.Config, dir string, index int, p piece, reencode bool, offset time.Duration, output string) error {
+	videoList, err := writeList(filepath.Join(dir, fmt.Sprintf("%d_video.txt", index)), p.video)
+	if err != nil {
+		return err
+	}
+	inputs := []string{videoList}
+	if len(p.audio) > 0 {
+		audioList, err := writeList(filepath.Join(dir, fmt.Sprintf("%d_audio.txt", index)), p.audio)
+		if err != nil {
+			return err
+		}
+		inputs = append(inputs, audioList)
+	}
+
+	ff, err := ffmpeg.NewFfmpeg(cfg.FFmpegPATH)
+	if err != nil {
+		return err
+	}
+	ff.Yes().
+		LogLevel("error").
+		Format("concat").
+		Safe(0).
+		Seek(seconds(p.seek)).
+		Duration(seconds(p.length))
+	if reencode {
+		ff.VideoCodec("libx264").Preset("veryfast").CRF(18).AudioCodec("aac")
+	} else {
+		ff.VideoCodec("copy").AudioCodec("copy")
+	}
+	timestamps(ff, offset)
+	return ff.Execute(ctx, inputs, output)
+}
+
+// timestamps starts the output at the offset, without the delay the muxer adds by default
+func timestamps(ff *ffmpeg.FFmpeg, offset time.Duration) {
+	ff.ExtraArgs([]string{"-muxdelay", "0", "-muxpreload", "0"})
+	if offset > 0 {
+		ff.ExtraArgs([]string{"-output_ts_offset", seconds(offset)})
+	}
+}
+
+// writeList writes a concat list with absolute paths, so it can live outside the directory of the files
+func writeList(path string, files []string) (string, error) {
+	var b strings.Builder
+	for _, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "file '%s'\n", strings.ReplaceAll(abs, "'", `'\''`))
+	}
+	return path, os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
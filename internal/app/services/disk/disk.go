@@ -0,0 +1,332 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/library"
+	"stream-recorder/internal/app/services/retention"
+	"stream-recorder/pkg/logger"
+	"sync"
+	"time"
+)
+
+// Levels of a watched path, each one is reached when the free space drops below its threshold
+const (
+	LevelOK       = "ok"
+	LevelWarning  = "warning"
+	LevelPurge    = "purge"
+	LevelCritical = "critical"
+)
+
+const (
+	maxEvents = 100
+	// files this fresh may still be used by the jobs that finalized them
+	purgeMinAge = time.Hour
+	purgeBatch  = 50
+)
+
+// ErrDiskFull is returned by Allow while a watched path is at the critical level
+var ErrDiskFull = errors.New("not enough free disk space to start a recording")
+
+// Usage is what the filesystem reports for a path. Device tells apart paths on the same filesystem.
+type Usage struct {
+	Total  uint64 `json:"total"`
+	Free   uint64 `json:"free"`
+	Device string `json:"-"`
+}
+
+// FreePercent returns the share of the filesystem that is still available
+func (u Usage) FreePercent() float64 {
+	if u.Total == 0 {
+		return 100
+	}
+	return float64(u.Free) * 100 / float64(u.Total)
+}
+
+type PathStatus struct {
+	Name        string  `json:"name"`
+	Path        string  `json:"path"`
+	Level       string  `json:"level"`
+	FreePercent float64 `json:"free_percent"`
+	Usage
+}
+
+type Event struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Path    string    `json:"path,omitempty"`
+	Message string    `json:"message"`
+}
+
+// Status is the metrics snapshot of the monitor, the counters grow for the lifetime of the process
+type Status struct {
+	Level       string       `json:"level"`
+	Paths       []PathStatus `json:"paths"`
+	LastCheck   time.Time    `json:"last_check"`
+	Checks      int          `json:"checks"`
+	Warnings    int          `json:"warnings"`
+	Purged      int          `json:"purged"`
+	PurgedBytes int64        `json:"purged_bytes"`
+	Refused     int          `json:"refused"`
+	Events      []Event      `json:"events"`
+}
+
+// Monitor watches the free space of TempPATH and MediaPATH. It warns first, then purges
+// finished recordings and, when that is not enough, refuses new recordings so the
+// space that is left goes to the active ones.
+type Monitor struct {
+	log *logger.Logger
+	cfg *config.Config
+	lr  *repository.LibraryRepository
+	l   *library.Library
+	r   *retention.Retention
+
+	// usage reads what the filesystem of a path reports
+	usage func(path string) (Usage, error)
+
+	mu     sync.Mutex
+	status Status
+}
+
+func New(log *logger.Logger, cfg *config.Config, lr *repository.LibraryRepository, l *library.Library, r *retention.Retention) *Monitor {
+	return &Monitor{
+		log:   log,
+		cfg:   cfg,
+		lr:    lr,
+		l:     l,
+		r:     r,
+		usage: usage,
+		status: Status{
+			Level: LevelOK,
+		},
+	}
+}
+
+// Run checks the paths every DiskCheckInterval seconds until ctx is done
+func (m *Monitor) Run(ctx context.Context) {
+	t := time.NewTicker(time.Duration(m.cfg.DiskCheckInterval) * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		m.Check(ctx)
+	}
+}
+
+// Check measures the paths once and acts on the worst level
+func (m *Monitor) Check(ctx context.Context) {
+	paths := m.measure()
+	purged := make(map[string]PathStatus)
+	for i := range paths {
+		if paths[i].Level != LevelPurge && paths[i].Level != LevelCritical {
+			continue
+		}
+		// TempPATH and MediaPATH often share the filesystem, it is purged once
+		if p, ok := purged[paths[i].Device]; ok {
+			paths[i] = m.pathStatus(paths[i].Name, paths[i].Path, p.Usage)
+			continue
+		}
+		paths[i] = m.purge(ctx, paths[i])
+		purged[paths[i].Device] = paths[i]
+	}
+
+	level := LevelOK
+	for _, p := range paths {
+		if rank(p.Level) > rank(level) {
+			level = p.Level
+		}
+		m.log.Debug("Disk usage", slog.String("path", p.Path), slog.String("level", p.Level),
+			slog.Float64("free_percent", p.FreePercent), slog.Uint64("free", p.Free), slog.Uint64("total", p.Total))
+	}
+
+	m.mu.Lock()
+	previous := m.status.Level
+	m.status.Level = level
+	m.status.Paths = paths
+	m.status.LastCheck = time.Now()
+	m.status.Checks++
+	if level != LevelOK && previous == LevelOK {
+		m.status.Warnings++
+	}
+	m.mu.Unlock()
+
+	if level == previous {
+		return
+	}
+	msg := fmt.Sprintf("Free disk space level changed from %s to %s", previous, level)
+	switch level {
+	case LevelOK:
+		m.log.Info(msg)
+	case LevelCritical:
+		m.log.Error(msg, ErrDiskFull)
+	default:
+		m.log.Warn(msg)
+	}
+	m.event(level, "", msg)
+}
+
+// Allow reports whether a new recording may start, it fails only at the critical level
+func (m *Monitor) Allow(platform, username string) error {
+	m.mu.Lock()
+	level := m.status.Level
+	if level == LevelCritical {
+		m.status.Refused++
+	}
+	m.mu.Unlock()
+
+	if level != LevelCritical {
+		return nil
+	}
+	m.event(level, "", fmt.Sprintf("Refused to start the recording of %s/%s", username, platform))
+	return ErrDiskFull
+}
+
+// Status returns a copy of the current metrics and the recent events
+func (m *Monitor) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := m.status
+	status.Paths = append([]PathStatus(nil), m.status.Paths...)
+	status.Events = append([]Event(nil), m.status.Events...)
+	return status
+}
+
+func (m *Monitor) measure() []PathStatus {
+	var paths []PathStatus
+	for _, p := range []struct{ name, path string }{{"temp", m.cfg.TempPATH}, {"media", m.cfg.MediaPATH}} {
+		u, err := m.usage(p.path)
+		if err != nil {
+			m.log.Error("Failed to read disk usage", err, slog.String("path", p.path))
+			m.event(LevelWarning, p.path, fmt.Sprintf("Failed to read disk usage: %s", err))
+			continue
+		}
+		paths = append(paths, m.pathStatus(p.name, p.path, u))
+	}
+	return paths
+}
+
+func (m *Monitor) pathStatus(name, path string, u Usage) PathStatus {
+	free := u.FreePercent()
+	level := LevelOK
+	switch {
+	case free < float64(m.cfg.DiskCriticalFree):
+		level = LevelCritical
+	case free < float64(m.cfg.DiskPurgeFree):
+		level = LevelPurge
+	case free < float64(m.cfg.DiskWarnFree):
+		level = LevelWarning
+	}
+	return PathStatus{Name: name, Path: path, Level: level, FreePercent: free, Usage: u}
+}
+
+// purge applies the retention rules first, then deletes the oldest finished recordings that are not
+// pinned until the path is back above the warning threshold. It only helps when the path shares the
+// filesystem with MediaPATH and AutoCleanMediaPATH is enabled.
+func (m *Monitor) purge(ctx context.Context, p PathStatus) PathStatus {
+	if !m.cfg.AutoCleanMediaPATH {
+		m.event(p.Level, p.Path, "Purging is disabled, enable auto_clean_media_path to free space automatically")
+		return p
+	}
+	media, err := m.usage(m.cfg.MediaPATH)
+	if err != nil || media.Device != p.Device {
+		m.event(p.Level, p.Path, "The path is not on the filesystem of the media path, nothing can be purged")
+		return p
+	}
+
+	var purged int
+	var bytes int64
+	defer func() {
+		if purged == 0 {
+			if p.FreePercent < float64(m.cfg.DiskWarnFree) {
+				m.event(p.Level, p.Path, "No finished recording could be purged")
+			}
+			return
+		}
+		msg := fmt.Sprintf("Purged %d finished recordings, %d bytes", purged, bytes)
+		m.log.Warn(msg, slog.String("path", p.Path))
+		m.event(p.Level, p.Path, msg)
+	}()
+
+	if deleted, err := m.r.Apply(ctx); err != nil {
+		m.log.Error("Failed to apply retention", err)
+	} else {
+		for _, candidate := range deleted {
+			purged++
+			bytes += candidate.Item.Size
+		}
+		m.mu.Lock()
+		m.status.Purged += len(deleted)
+		m.status.PurgedBytes += bytes
+		m.mu.Unlock()
+		if u, err := m.usage(p.Path); err == nil {
+			p = m.pathStatus(p.Name, p.Path, u)
+		}
+	}
+
+	skip := 0
+	for ctx.Err() == nil && p.FreePercent < float64(m.cfg.DiskWarnFree) {
+		items, err := m.lr.Oldest(skip + purgeBatch)
+		if err != nil || len(items) <= skip {
+			return p
+		}
+
+		for _, item := range items[skip:] {
+			if time.Since(item.ModifiedAt) < purgeMinAge {
+				skip++
+				continue
+			}
+			if err := m.l.Delete(&item); err != nil {
+				m.log.Error("Failed to purge recording", err, slog.String("file", item.Path))
+				skip++
+				continue
+			}
+			purged++
+			bytes += item.Size
+			m.log.Info("Purged recording to free disk space", slog.String("file", item.Path))
+
+			m.mu.Lock()
+			m.status.Purged++
+			m.status.PurgedBytes += item.Size
+			m.mu.Unlock()
+
+			if u, err := m.usage(p.Path); err == nil {
+				p = m.pathStatus(p.Name, p.Path, u)
+			}
+			if p.FreePercent >= float64(m.cfg.DiskWarnFree) || ctx.Err() != nil {
+				return p
+			}
+		}
+	}
+	return p
+}
+
+func (m *Monitor) event(level, path, msg string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.status.Events = append(m.status.Events, Event{Time: time.Now(), Level: level, Path: path, Message: msg})
+	if len(m.status.Events) > maxEvents {
+		m.status.Events = m.status.Events[len(m.status.Events)-maxEvents:]
+	}
+}
+
+func rank(level string) int {
+	switch level {
+	case LevelWarning:
+		return 1
+	case LevelPurge:
+		return 2
+	case LevelCritical:
+		return 3
+	}
+	return 0
+}
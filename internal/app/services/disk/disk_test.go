@@ -0,0 +1,159 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/library"
+	"stream-recorder/internal/app/services/retention"
+	"stream-recorder/pkg/logger"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMain(m *testing.M) {
+	// the logger writes to logs/ in the working directory
+	dir, err := os.MkdirTemp("", "disk")
+	if err != nil {
+		panic(err)
+	}
+	os.Chdir(dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// capacity is the size of the fake filesystem in bytes, the files of MediaPATH take its space
+const capacity = 100
+
+func newTestMonitor(t *testing.T, autoClean bool) (*Monitor, *repository.LibraryRepository) {
+	t.Helper()
+
+	dir := t.TempDir()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "db.sqlite")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(models.Streamers{}, models.LibraryItems{}); err != nil {
+		t.Fatal(err)
+	}
+
+	log := logger.New()
+	cfg := &config.Config{
+		TempPATH:           filepath.Join(dir, "temp"),
+		MediaPATH:          filepath.Join(dir, "media"),
+		AutoCleanMediaPATH: autoClean,
+		DiskWarnFree:       15,
+		DiskPurgeFree:      10,
+		DiskCriticalFree:   5,
+	}
+	if err := os.MkdirAll(cfg.MediaPATH, 0755); err != nil {
+		t.Fatal(err)
+	}
+	lr := repository.NewLibrary(log, db)
+	l := library.New(log, cfg, lr)
+	m := New(log, cfg, lr, l, retention.New(log, cfg, repository.NewStreamers(log, db), lr, l))
+	m.usage = func(path string) (Usage, error) {
+		var used uint64
+		err := filepath.Walk(cfg.MediaPATH, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				used += uint64(info.Size())
+			}
+			return err
+		})
+		return Usage{Total: capacity, Free: capacity - used, Device: "fs"}, err
+	}
+	return m, lr
+}
+
+// addRecording writes a file of size bytes to MediaPATH and adds it to the library
+func addRecording(t *testing.T, m *Monitor, lr *repository.LibraryRepository, name string, size int, startedAt, modifiedAt time.Time, pinned bool) {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(m.cfg.MediaPATH, name), make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	item := &models.LibraryItems{Path: name, Platform: "twitch", Username: "foo", Size: int64(size), StartedAt: startedAt, ModifiedAt: modifiedAt, Pinned: pinned}
+	if err := lr.Save(item); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func remaining(t *testing.T, lr *repository.LibraryRepository) map[string]bool {
+	t.Helper()
+
+	items, err := lr.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make(map[string]bool)
+	for _, item := range items {
+		paths[item.Path] = true
+	}
+	return paths
+}
+
+func TestPurge(t *testing.T) {
+	m, lr := newTestMonitor(t, true)
+
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	addRecording(t, m, lr, "pinned.mp4", 20, now.Add(-96*time.Hour), old, true)
+	addRecording(t, m, lr, "fresh.mp4", 20, now.Add(-72*time.Hour), now, false)
+	addRecording(t, m, lr, "oldest.mp4", 20, now.Add(-48*time.Hour), old, false)
+	addRecording(t, m, lr, "older.mp4", 20, now.Add(-24*time.Hour), old, false)
+	addRecording(t, m, lr, "newest.mp4", 12, now.Add(-3*time.Hour), old, false)
+
+	// 8% is free, the oldest recordings go until 15% are free again
+	m.Check(context.Background())
+
+	got := remaining(t, lr)
+	for path, want := range map[string]bool{"pinned.mp4": true, "fresh.mp4": true, "oldest.mp4": false, "older.mp4": true, "newest.mp4": true} {
+		if got[path] != want {
+			t.Errorf("%s kept = %v, want %v", path, got[path], want)
+		}
+		if _, err := os.Stat(filepath.Join(m.cfg.MediaPATH, path)); (err == nil) != want {
+			t.Errorf("the file %s exists = %v, want %v", path, err == nil, want)
+		}
+	}
+
+	status := m.Status()
+	if status.Level != LevelOK || status.Purged != 1 || status.PurgedBytes != 20 {
+		t.Errorf("status is %s after purging %d recordings of %d bytes, want ok after 1 of 20 bytes", status.Level, status.Purged, status.PurgedBytes)
+	}
+	if err := m.Allow("twitch", "foo"); err != nil {
+		t.Errorf("Allow() = %v after the purge", err)
+	}
+}
+
+func TestPurgeDisabled(t *testing.T) {
+	m, lr := newTestMonitor(t, false)
+
+	old := time.Now().Add(-2 * time.Hour)
+	addRecording(t, m, lr, "a.mp4", 48, old, old, false)
+	addRecording(t, m, lr, "b.mp4", 48, old, old, false)
+
+	// 4% is free, nothing may be purged so new recordings are refused
+	m.Check(context.Background())
+
+	if got := remaining(t, lr); len(got) != 2 {
+		t.Errorf("%d recordings are left, want both kept while purging is disabled", len(got))
+	}
+	status := m.Status()
+	if status.Level != LevelCritical || status.Purged != 0 {
+		t.Errorf("status is %s after purging %d recordings, want critical without a purge", status.Level, status.Purged)
+	}
+	if err := m.Allow("twitch", "foo"); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("Allow() = %v at the critical level, want ErrDiskFull", err)
+	}
+	if status := m.Status(); status.Refused != 1 {
+		t.Errorf("Refused = %d, want 1", status.Refused)
+	}
+}
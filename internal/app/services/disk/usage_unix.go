@@ -0,0 +1,20 @@
+//go:build !windows
+
+package disk
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func usage(path string) (Usage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return Usage{}, err
+	}
+	return Usage{
+		Total:  uint64(st.Blocks) * uint64(st.Bsize),
+		Free:   uint64(st.Bavail) * uint64(st.Bsize),
+		Device: fmt.Sprint(st.Fsid),
+	}, nil
+}
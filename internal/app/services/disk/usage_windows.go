@@ -0,0 +1,29 @@
+//go:build windows
+
+package disk
+
+import (
+	"golang.org/x/sys/windows"
+	"path/filepath"
+)
+
+func usage(path string) (Usage, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return Usage{}, err
+	}
+	name, err := windows.UTF16PtrFromString(abs)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	var free, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &free, &total, &totalFree); err != nil {
+		return Usage{}, err
+	}
+	return Usage{
+		Total:  total,
+		Free:   free,
+		Device: filepath.VolumeName(abs),
+	}, nil
+}
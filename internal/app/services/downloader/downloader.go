@@ -0,0 +1,288 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/time/rate"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/pkg/logger"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("segment not found")
+
+type Result struct {
+	Data []byte
+	Err  error
+}
+
+type job struct {
+	ctx      context.Context
+	url      string
+	host     string
+	deadline time.Time
+	result   chan Result
+	stop     func() bool
+}
+
+// host holds the downloads queued for a host and the number of them that are running
+type host struct {
+	queue  []*job
+	active int
+}
+
+// Pool downloads segments for every recording session with a fixed number of
+// workers, a concurrency limit per host and a shared bandwidth cap. Downloads wait
+// in a queue per host, so a worker only takes one whose host has a free slot.
+type Pool struct {
+	log    *logger.Logger
+	client *http.Client
+
+	limiter *rate.Limiter
+	// queued bounds the downloads waiting for a worker, Submit blocks while it is full
+	queued chan struct{}
+
+	hostLimit int
+	mu        sync.Mutex
+	ready     *sync.Cond
+	hosts     map[string]*host
+}
+
+func New(log *logger.Logger, cfg *config.Config) *Pool {
+	p := &Pool{
+		log: log,
+		client: &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: cfg.DownloadHostLimit,
+			},
+		},
+		queued:    make(chan struct{}, cfg.DownloadWorkers*16),
+		hostLimit: cfg.DownloadHostLimit,
+		hosts:     make(map[string]*host),
+	}
+	p.ready = sync.NewCond(&p.mu)
+
+	if cfg.DownloadBandwidthLimit > 0 {
+		bytesPerSecond := cfg.DownloadBandwidthLimit * 1024
+		p.limiter = rate.NewLimiter(rate.Limit(bytesPerSecond), max(bytesPerSecond, 32*1024))
+	}
+
+	for i := 0; i < cfg.DownloadWorkers; i++ {
+		go p.worker()
+	}
+
+	log.Debug("Download pool started",
+		slog.Int("workers", cfg.DownloadWorkers),
+		slog.Int("host_limit", cfg.DownloadHostLimit),
+		slog.Int("bandwidth_limit_kb", cfg.DownloadBandwidthLimit),
+	)
+	return p
+}
+
+// Submit queues a segment download that has to finish within timeout (including retries)
+// and is abandoned as soon as ctx is done. The result is delivered on the returned channel.
+func (p *Pool) Submit(ctx context.Context, segmentURL string, timeout time.Duration) <-chan Result {
+	j := &job{
+		ctx:      ctx,
+		url:      segmentURL,
+		host:     hostOf(segmentURL),
+		deadline: time.Now().Add(timeout),
+		result:   make(chan Result, 1),
+	}
+	select {
+	case p.queued <- struct{}{}:
+	case <-ctx.Done():
+		j.result <- Result{Err: ctx.Err()}
+		return j.result
+	}
+
+	// a download that is still queued when ctx is done is answered right away
+	j.stop = context.AfterFunc(ctx, func() {
+		if p.dequeue(j) {
+			j.result <- Result{Err: ctx.Err()}
+		}
+	})
+
+	p.mu.Lock()
+	h, ok := p.hosts[j.host]
+	if !ok {
+		h = &host{}
+		p.hosts[j.host] = h
+	}
+	h.queue = append(h.queue, j)
+	p.mu.Unlock()
+	p.ready.Signal()
+
+	return j.result
+}
+
+func (p *Pool) worker() {
+	for {
+		j := p.next()
+
+		switch {
+		case j.ctx.Err() != nil:
+			j.result <- Result{Err: j.ctx.Err()}
+		case time.Now().After(j.deadline):
+			j.result <- Result{Err: fmt.Errorf("segment deadline exceeded while queued")}
+		default:
+			data, err := p.download(j)
+			j.result <- Result{Data: data, Err: err}
+		}
+
+		j.stop()
+		p.release(j.host)
+	}
+}
+
+// next waits for a queued download whose host has a free slot and takes the slot
+func (p *Pool) next() *job {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		// the map order spreads the workers over the hosts
+		for _, h := range p.hosts {
+			if len(h.queue) == 0 || h.active >= p.hostLimit {
+				continue
+			}
+			j := h.queue[0]
+			h.queue = h.queue[1:]
+			h.active++
+			<-p.queued
+			return j
+		}
+		p.ready.Wait()
+	}
+}
+
+// release frees the slot of a finished download, a queued download of the host can start
+func (p *Pool) release(name string) {
+	p.mu.Lock()
+	h := p.hosts[name]
+	h.active--
+	if h.active == 0 && len(h.queue) == 0 {
+		delete(p.hosts, name)
+	}
+	p.mu.Unlock()
+	p.ready.Signal()
+}
+
+// dequeue removes a download that no worker has taken yet
+func (p *Pool) dequeue(j *job) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h, ok := p.hosts[j.host]
+	if !ok {
+		return false
+	}
+	for i, queued := range h.queue {
+		if queued != j {
+			continue
+		}
+		h.queue = append(h.queue[:i], h.queue[i+1:]...)
+		if h.active == 0 && len(h.queue) == 0 {
+			delete(p.hosts, j.host)
+		}
+		<-p.queued
+		return true
+	}
+	return false
+}
+
+func (p *Pool) download(j *job) ([]byte, error) {
+	ctx, cancel := context.WithDeadline(j.ctx, j.deadline)
+	defer cancel()
+
+	var attempt int
+	for {
+		attempt++
+		p.log.Trace("Starting download segment", slog.String("url", j.url), slog.Int("attempt", attempt))
+
+		data, err := p.fetch(ctx, j.url)
+		if err == nil {
+			return data, nil
+		}
+		if errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+
+		p.log.Warn("Failed to download segment", slog.String("url", j.url), slog.Int("attempt", attempt), slog.String("error", err.Error()))
+
+		backoff := time.Duration(attempt) * 500 * time.Millisecond
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("segment deadline exceeded after %d attempts: %w", attempt, err)
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (p *Pool) fetch(ctx context.Context, segmentURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, segmentURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var body io.Reader = resp.Body
+	if p.limiter != nil {
+		body = &limitedReader{ctx: ctx, r: resp.Body, limiter: p.limiter}
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty segment")
+	}
+	return data, nil
+}
+
+func hostOf(segmentURL string) string {
+	if u, err := url.Parse(segmentURL); err == nil {
+		return u.Host
+	}
+	return segmentURL
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (l *limitedReader) Read(b []byte) (int, error) {
+	if burst := l.limiter.Burst(); len(b) > burst {
+		b = b[:burst]
+	}
+
+	n, err := l.r.Read(b)
+	if n > 0 {
+		if waitErr := l.limiter.WaitN(l.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,82 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/pkg/logger"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// the logger writes to logs/ in the working directory
+	dir, err := os.MkdirTemp("", "downloader")
+	if err != nil {
+		panic(err)
+	}
+	os.Chdir(dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestHostLimit(t *testing.T) {
+	unblock := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	defer close(unblock)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	p := New(logger.New(), &config.Config{DownloadWorkers: 2, DownloadHostLimit: 1})
+	ctx := context.Background()
+
+	// the second download of the slow host waits for its slot without holding a worker
+	p.Submit(ctx, slow.URL+"/1.ts", time.Minute)
+	queuedCtx, cancel := context.WithCancel(ctx)
+	queued := p.Submit(queuedCtx, slow.URL+"/2.ts", time.Minute)
+
+	select {
+	case res := <-p.Submit(ctx, fast.URL+"/1.ts", time.Minute):
+		if res.Err != nil || string(res.Data) != "fast" {
+			t.Fatalf("the download of the other host = %q, %v", res.Data, res.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the download of the other host waits for the busy host")
+	}
+
+	// a queued download is answered as soon as its context is done
+	cancel()
+	select {
+	case res := <-queued:
+		if !errors.Is(res.Err, context.Canceled) {
+			t.Errorf("the cancelled download = %v, want context.Canceled", res.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cancelled download is still queued")
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	p := New(logger.New(), &config.Config{DownloadWorkers: 1, DownloadHostLimit: 1})
+	res := <-p.Submit(context.Background(), srv.URL+"/1.ts", time.Minute)
+	if !errors.Is(res.Err, ErrNotFound) || requests != 1 {
+		t.Errorf("a missing segment = %v after %d requests, want ErrNotFound without a retry", res.Err, requests)
+	}
+}
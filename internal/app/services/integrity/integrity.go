@@ -0,0 +1,200 @@
+package integrity
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/pkg/logger"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const scrubBatch = 100
+
+// Sum hashes the file with SHA-256 in a single streaming pass and returns its size and checksum
+func Sum(ctx context.Context, file string) (int64, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, ContextReader(ctx, f))
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FromManifest returns the checksum the manifest sidecar holds for the file. It is only trusted while
+// the size matches and the file was not written after the manifest.
+func FromManifest(file string) (string, bool) {
+	manifestPath := strings.TrimSuffix(file, filepath.Ext(file)) + ".json"
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return "", false
+	}
+	var manifest models.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil || manifest.Sha256 == "" {
+		return "", false
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", false
+	}
+	manifestInfo, err := os.Stat(manifestPath)
+	if err != nil || info.Size() != manifest.Size || info.ModTime().After(manifestInfo.ModTime()) {
+		return "", false
+	}
+	return manifest.Sha256, true
+}
+
+// Report is the outcome of a scrub run
+type Report struct {
+	Checked    int                   `json:"checked"`
+	Baseline   int                   `json:"baseline"`
+	Mismatches int                   `json:"mismatches"`
+	Missing    int                   `json:"missing"`
+	Problems   []models.LibraryItems `json:"problems"`
+	StartedAt  time.Time             `json:"started_at"`
+	FinishedAt time.Time             `json:"finished_at"`
+}
+
+// Scrubber re-hashes the library and compares every file with the checksum taken when it was
+// written. A file indexed without a checksum gets its first one as the baseline.
+type Scrubber struct {
+	log *logger.Logger
+	cfg *config.Config
+	lr  *repository.LibraryRepository
+
+	running atomic.Bool
+	last    atomic.Pointer[Report]
+}
+
+func New(log *logger.Logger, cfg *config.Config, lr *repository.LibraryRepository) *Scrubber {
+	return &Scrubber{
+		log: log,
+		cfg: cfg,
+		lr:  lr,
+	}
+}
+
+// Running reports whether a scrub is in progress
+func (s *Scrubber) Running() bool {
+	return s.running.Load()
+}
+
+// Last returns the report of the last finished scrub, nil before the first one
+func (s *Scrubber) Last() *Report {
+	return s.last.Load()
+}
+
+// Scrub checks every file that was not checked within ScrubInterval hours. An interrupted
+// run continues where it stopped because every result is stored right away.
+func (s *Scrubber) Scrub(ctx context.Context) (*Report, error) {
+	if !s.running.CompareAndSwap(false, true) {
+		return nil, fmt.Errorf("a scrub is already running")
+	}
+	defer s.running.Store(false)
+
+	report := &Report{StartedAt: time.Now(), Problems: []models.LibraryItems{}}
+	before := report.StartedAt.Add(-time.Duration(s.cfg.ScrubInterval) * time.Hour)
+	for {
+		items, err := s.lr.DueForScrub(before, scrubBatch)
+		if err != nil {
+			return report, err
+		}
+		if len(items) == 0 {
+			break
+		}
+
+		for _, item := range items {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			if err := s.check(ctx, &item, report); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	report.FinishedAt = time.Now()
+	s.last.Store(report)
+	s.log.Info("Library scrubbed", slog.Int("checked", report.Checked), slog.Int("baseline", report.Baseline),
+		slog.Int("mismatches", report.Mismatches), slog.Int("missing", report.Missing))
+	return report, nil
+}
+
+// Check re-hashes a single file right away
+func (s *Scrubber) Check(ctx context.Context, item *models.LibraryItems) (*Report, error) {
+	report := &Report{StartedAt: time.Now(), Problems: []models.LibraryItems{}}
+	err := s.check(ctx, item, report)
+	report.FinishedAt = time.Now()
+	return report, err
+}
+
+func (s *Scrubber) check(ctx context.Context, item *models.LibraryItems, report *Report) error {
+	file := filepath.Join(s.cfg.MediaPATH, item.Path)
+	now := time.Now()
+
+	_, sum, err := Sum(ctx, file)
+	switch {
+	case os.IsNotExist(err):
+		item.Integrity = models.IntegrityMissing
+		report.Missing++
+		s.log.Warn("Recording is missing", slog.String("path", item.Path))
+	case err != nil:
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// an unreadable file is as good as a damaged one
+		item.Integrity = models.IntegrityMismatch
+		report.Mismatches++
+		s.log.Error("Failed to read recording", err, slog.String("path", item.Path))
+	case item.Sha256 == "":
+		item.Sha256, item.Integrity = sum, models.IntegrityOK
+		report.Baseline++
+	case sum != item.Sha256:
+		item.Integrity = models.IntegrityMismatch
+		report.Mismatches++
+		s.log.Error("Recording does not match its checksum", fmt.Errorf("sha256 %s, expected %s", sum, item.Sha256), slog.String("path", item.Path))
+	default:
+		item.Integrity = models.IntegrityOK
+	}
+	report.Checked++
+	item.CheckedAt = &now
+	if item.Integrity != models.IntegrityOK {
+		report.Problems = append(report.Problems, *item)
+	}
+
+	return s.lr.UpdateIntegrity(item.ID, item.Sha256, item.Integrity, now)
+}
+
+// ContextReader wraps r so that a long read or copy stops as soon as the context is done
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,287 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/tracker"
+	"stream-recorder/pkg/logger"
+	"sync"
+	"time"
+)
+
+// maxRetryDelay caps the exponential backoff between attempts
+const maxRetryDelay = time.Hour
+
+var ErrNotFound = errors.New("job not found or not in a state that allows this action")
+
+// Handler runs a single attempt of a job. The job log receives the lines written through Queue.Log.
+type Handler func(ctx context.Context, job *models.Jobs) error
+
+// Queue runs the persisted post-processing jobs with a fixed number of workers.
+// Failed attempts are retried with an exponential backoff, jobs interrupted by
+// a crash are returned to the queue on the next start.
+type Queue struct {
+	log *logger.Logger
+	cfg *config.Config
+	jr  *repository.JobsRepository
+	tr  *tracker.Tracker
+
+	handlers map[string]Handler
+	wake     chan struct{}
+
+	// ctx is the parent of every attempt, Stop cancels it
+	ctx  context.Context
+	stop context.CancelFunc
+
+	mu       sync.Mutex
+	running  map[int]running
+	draining bool
+	drained  []string
+}
+
+type running struct {
+	jobType string
+	cancel  context.CancelFunc
+}
+
+func New(log *logger.Logger, cfg *config.Config, jr *repository.JobsRepository, tr *tracker.Tracker) *Queue {
+	ctx, stop := context.WithCancel(context.Background())
+	return &Queue{
+		log:      log,
+		cfg:      cfg,
+		jr:       jr,
+		tr:       tr,
+		handlers: make(map[string]Handler),
+		wake:     make(chan struct{}, 1),
+		ctx:      ctx,
+		stop:     stop,
+		running:  make(map[int]running),
+	}
+}
+
+// Register sets the handler of a job type, it has to be called before Run
+func (q *Queue) Register(jobType string, h Handler) {
+	q.handlers[jobType] = h
+}
+
+// Run returns the interrupted jobs to the queue and starts the workers, they keep running until Drain
+func (q *Queue) Run() {
+	q.jr.ResetRunning()
+
+	for i := 0; i < q.cfg.JobWorkers; i++ {
+		q.tr.Go(fmt.Sprintf("job worker %d", i+1), q.worker)
+	}
+}
+
+// Drain makes the workers finish the due jobs of the given types and exit afterwards instead of
+// waiting for new ones. Running jobs of the other types are interrupted, they stay queued for the
+// next start together with the jobs waiting for a retry.
+func (q *Queue) Drain(jobTypes ...string) {
+	q.mu.Lock()
+	q.draining = true
+	q.drained = jobTypes
+	for _, r := range q.running {
+		if !q.drainable(r.jobType) {
+			r.cancel()
+		}
+	}
+	q.mu.Unlock()
+
+	q.notify()
+}
+
+// Stop interrupts every running attempt, the interrupted jobs are returned to the queue on the next start
+func (q *Queue) Stop() {
+	q.stop()
+}
+
+// drainable reports whether a job of that type still runs while draining, q.mu has to be held
+func (q *Queue) drainable(jobType string) bool {
+	if !q.draining || len(q.drained) == 0 {
+		return true
+	}
+	for _, t := range q.drained {
+		if t == jobType {
+			return true
+		}
+	}
+	return false
+}
+
+// Enqueue adds a job and wakes up an idle worker
+func (q *Queue) Enqueue(job *models.Jobs) error {
+	if job.MaxAttempts == 0 {
+		job.MaxAttempts = q.cfg.JobMaxAttempts
+	}
+	if err := q.jr.Create(job); err != nil {
+		return err
+	}
+
+	q.Log(job.ID, "queued")
+	q.notify()
+	return nil
+}
+
+// Known reports whether a job was ever created for the key
+func (q *Queue) Known(key string) (bool, error) {
+	return q.jr.HasKey(key)
+}
+
+// Retry queues a failed or cancelled job again
+func (q *Queue) Retry(id int) error {
+	ok, err := q.jr.Requeue(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotFound
+	}
+
+	q.Log(id, "retry requested")
+	q.notify()
+	return nil
+}
+
+// Cancel cancels a queued job or interrupts a running one
+func (q *Queue) Cancel(id int) error {
+	q.mu.Lock()
+	r, ok := q.running[id]
+	q.mu.Unlock()
+	if ok {
+		q.Log(id, "cancel requested")
+		r.cancel()
+		return nil
+	}
+
+	ok, err := q.jr.CancelQueued(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotFound
+	}
+	q.Log(id, "cancelled")
+	return nil
+}
+
+// Log appends a timestamped line to the log of the job
+func (q *Queue) Log(id int, msg string) {
+	q.jr.AppendLog(id, fmt.Sprintf("%s %s", time.Now().Format(time.RFC3339), msg))
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// types lists the job types the workers claim, q.mu has to be held
+func (q *Queue) types() []string {
+	types := make([]string, 0, len(q.handlers))
+	for t := range q.handlers {
+		if q.drainable(t) {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+func (q *Queue) worker() {
+	for {
+		q.mu.Lock()
+		draining := q.draining
+		types := q.types()
+		q.mu.Unlock()
+
+		job, err := q.jr.Claim(types)
+		if err == nil && job != nil {
+			q.execute(job)
+			// the next worker may be waiting for the job that just finished
+			q.notify()
+			continue
+		}
+		if draining {
+			return
+		}
+
+		t := time.NewTimer(time.Second)
+		select {
+		case <-q.wake:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// execute runs one attempt. An attempt is interrupted by cancelling the job, by Drain when its
+// type is not drained and by Stop.
+func (q *Queue) execute(job *models.Jobs) {
+	ctx, cancel := context.WithCancel(q.ctx)
+	defer cancel()
+
+	q.mu.Lock()
+	q.running[job.ID] = running{jobType: job.Type, cancel: cancel}
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.running, job.ID)
+		q.mu.Unlock()
+	}()
+
+	q.Log(job.ID, fmt.Sprintf("attempt %d of %d started", job.Attempts, job.MaxAttempts))
+	q.log.Debug(fmt.Sprintf("[%s/%s] Job started", job.Username, job.Platform), slog.Int("id", job.ID), slog.String("type", job.Type), slog.Int("attempt", job.Attempts))
+
+	err := q.run(ctx, job)
+	q.mu.Lock()
+	interrupted := q.ctx.Err() != nil || !q.drainable(job.Type)
+	q.mu.Unlock()
+
+	switch {
+	case err != nil && interrupted:
+		// the job stays running in the DB, Run returns it to the queue on the next start
+		q.Log(job.ID, "interrupted by shutdown")
+	case err == nil:
+		q.Log(job.ID, "done")
+		q.jr.Finish(job.ID, models.JobStatusDone, "")
+	case ctx.Err() != nil:
+		q.Log(job.ID, "cancelled while running")
+		q.jr.Finish(job.ID, models.JobStatusCancelled, err.Error())
+	case job.LastAttempt():
+		q.Log(job.ID, "failed: "+err.Error())
+		q.log.Error(fmt.Sprintf("[%s/%s] Job failed", job.Username, job.Platform), err, slog.Int("id", job.ID), slog.String("type", job.Type))
+		q.jr.Finish(job.ID, models.JobStatusFailed, err.Error())
+	default:
+		delay := q.retryDelay(job.Attempts)
+		q.Log(job.ID, fmt.Sprintf("failed: %s, retrying in %s", err, delay))
+		q.log.Warn(fmt.Sprintf("[%s/%s] Job failed, retrying", job.Username, job.Platform), slog.Int("id", job.ID), slog.String("type", job.Type), slog.String("error", err.Error()), slog.Duration("delay", delay))
+		q.jr.Reschedule(job.ID, time.Now().Add(delay), err.Error())
+	}
+}
+
+func (q *Queue) run(ctx context.Context, job *models.Jobs) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	h, ok := q.handlers[job.Type]
+	if !ok {
+		return fmt.Errorf("no handler for job type %q", job.Type)
+	}
+	return h(ctx, job)
+}
+
+func (q *Queue) retryDelay(attempt int) time.Duration {
+	delay := time.Duration(q.cfg.JobRetryDelay) * time.Second
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
@@ -0,0 +1,219 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/tracker"
+	"stream-recorder/pkg/logger"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMain(m *testing.M) {
+	// the logger writes to logs/ in the working directory
+	dir, err := os.MkdirTemp("", "jobs")
+	if err != nil {
+		panic(err)
+	}
+	os.Chdir(dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func newTestQueue(t *testing.T) (*Queue, *gorm.DB) {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "db.sqlite")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(models.Jobs{}); err != nil {
+		t.Fatal(err)
+	}
+
+	log := logger.New()
+	cfg := &config.Config{JobWorkers: 1, JobMaxAttempts: 3, JobRetryDelay: 30}
+	return New(log, cfg, repository.NewJobs(log, db), tracker.New()), db
+}
+
+// claim runs the next due job of the type like a worker does and returns its stored state
+func claim(t *testing.T, q *Queue, jobType string) *models.Jobs {
+	t.Helper()
+
+	job, err := q.jr.Claim([]string{jobType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil {
+		t.Fatal("no job is due")
+	}
+	q.execute(job)
+
+	stored, err := q.jr.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestRetryDelay(t *testing.T) {
+	q, _ := newTestQueue(t)
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{50, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := q.retryDelay(tt.attempt); got != tt.want {
+			t.Errorf("retryDelay(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryUntilLastAttempt(t *testing.T) {
+	q, db := newTestQueue(t)
+
+	fail := true
+	var attempts []int
+	q.Register("test", func(ctx context.Context, job *models.Jobs) error {
+		attempts = append(attempts, job.Attempts)
+		if fail {
+			return errors.New("boom")
+		}
+		return nil
+	})
+
+	job := &models.Jobs{Type: "test", Key: "a"}
+	if err := q.Enqueue(job); err != nil {
+		t.Fatal(err)
+	}
+	if job.MaxAttempts != 3 {
+		t.Fatalf("MaxAttempts = %d, want the configured 3", job.MaxAttempts)
+	}
+
+	for i := 1; i < 3; i++ {
+		before := time.Now()
+		stored := claim(t, q, "test")
+		if stored.Status != models.JobStatusQueued || stored.Error != "boom" {
+			t.Fatalf("attempt %d left the job %s with error %q, want it queued with the error", i, stored.Status, stored.Error)
+		}
+		if delay := stored.NextRunAt.Sub(before); delay < q.retryDelay(i) || delay > q.retryDelay(i)+time.Minute {
+			t.Errorf("attempt %d is retried after %s, want %s", i, delay, q.retryDelay(i))
+		}
+
+		// the backoff is not waited for
+		if err := db.Model(&models.Jobs{}).Where("id = ?", job.ID).Update("next_run_at", time.Now()).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stored := claim(t, q, "test")
+	if stored.Status != models.JobStatusFailed || stored.Attempts != 3 || stored.FinishedAt == nil {
+		t.Fatalf("the last attempt left the job %s after %d attempts, want it failed after 3", stored.Status, stored.Attempts)
+	}
+
+	// a retry gets a fresh attempt budget
+	if err := q.Retry(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	fail = false
+	stored = claim(t, q, "test")
+	if stored.Status != models.JobStatusDone || stored.Attempts != 1 || stored.Error != "" {
+		t.Fatalf("the retried job is %s after %d attempts with error %q, want it done after 1", stored.Status, stored.Attempts, stored.Error)
+	}
+	if want := []int{1, 2, 3, 1}; !reflect.DeepEqual(attempts, want) {
+		t.Errorf("the handler saw the attempts %v, want %v", attempts, want)
+	}
+
+	if err := q.Retry(job.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Retry of a finished job = %v, want ErrNotFound", err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	q, _ := newTestQueue(t)
+
+	started := make(chan struct{})
+	q.Register("test", func(ctx context.Context, job *models.Jobs) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	job := &models.Jobs{Type: "test", Key: "a"}
+	if err := q.Enqueue(job); err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, err := q.jr.Claim([]string{"test"})
+	if err != nil || claimed == nil {
+		t.Fatalf("Claim() = %v, %v", claimed, err)
+	}
+	done := make(chan struct{})
+	go func() {
+		q.execute(claimed)
+		close(done)
+	}()
+	<-started
+	if err := q.Cancel(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if stored, _ := q.jr.Get(job.ID); stored.Status != models.JobStatusCancelled {
+		t.Errorf("a cancelled running job is %s, want %s", stored.Status, models.JobStatusCancelled)
+	}
+
+	// a cancelled job is retried like a failed one
+	if err := q.Retry(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	queued := &models.Jobs{Type: "test", Key: "b"}
+	if err := q.Enqueue(queued); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Cancel(queued.ID); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := q.jr.Get(queued.ID); stored.Status != models.JobStatusCancelled {
+		t.Errorf("a cancelled queued job is %s, want %s", stored.Status, models.JobStatusCancelled)
+	}
+}
+
+func TestKnown(t *testing.T) {
+	q, db := newTestQueue(t)
+
+	if err := q.Enqueue(&models.Jobs{Type: "test", Key: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"a": true, "b": false} {
+		if known, err := q.Known(key); err != nil || known != want {
+			t.Errorf("Known(%q) = %v, %v, want %v", key, known, err, want)
+		}
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.Close()
+	if _, err := q.Known("b"); err == nil {
+		t.Error("Known succeeded on a closed database, want the error")
+	}
+}
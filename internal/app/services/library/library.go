@@ -0,0 +1,312 @@
+package library
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/integrity"
+	"stream-recorder/internal/app/services/jobs"
+	"stream-recorder/pkg/ffmpeg"
+	"stream-recorder/pkg/logger"
+	"strings"
+	"time"
+)
+
+var ErrOutside = errors.New("the file is outside of the media directory")
+
+// mediaExtensions are the files the library lists, the other files of MediaPATH are sidecars
+var mediaExtensions = map[string]bool{".mp4": true, ".mkv": true, ".ts": true, ".mov": true, ".flv": true, ".webm": true, ".m4v": true}
+
+// Library keeps the index of MediaPATH. It is filled by a scan and updated by an index job
+// whenever a recording, a clip or a post-processing pipeline writes or moves a file.
+type Library struct {
+	log *logger.Logger
+	cfg *config.Config
+	lr  *repository.LibraryRepository
+}
+
+type payload struct {
+	File string `json:"file"`
+}
+
+func New(log *logger.Logger, cfg *config.Config, lr *repository.LibraryRepository) *Library {
+	return &Library{
+		log: log,
+		cfg: cfg,
+		lr:  lr,
+	}
+}
+
+// Scan indexes the media files of MediaPATH and drops the entries of the files that are gone.
+// A file whose size and modification time did not change is not probed again.
+func (l *Library) Scan(ctx context.Context) (int, int, error) {
+	items, err := l.lr.All()
+	if err != nil {
+		return 0, 0, err
+	}
+	known := make(map[string]models.LibraryItems, len(items))
+	for _, item := range items {
+		known[item.Path] = item
+	}
+
+	var indexed int
+	seen := make(map[string]bool)
+	err = filepath.WalkDir(l.cfg.MediaPATH, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() || !isMedia(path) {
+			return nil
+		}
+
+		rel, err := l.relative(path)
+		if err != nil {
+			return err
+		}
+		seen[rel] = true
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if item, ok := known[rel]; ok && item.Size == info.Size() && item.ModifiedAt.Equal(info.ModTime()) {
+			return nil
+		}
+
+		if err := l.index(ctx, path, "", "", false); err != nil {
+			l.log.Warn("Failed to index media file", slog.String("file", path), slog.String("error", err.Error()))
+			return nil
+		}
+		indexed++
+		return nil
+	})
+	if err != nil {
+		// an unmounted media directory must not empty the library
+		return indexed, 0, err
+	}
+
+	var removed int
+	for path, item := range known {
+		if seen[path] {
+			continue
+		}
+		if err := l.lr.Delete(item.ID); err == nil {
+			removed++
+		}
+	}
+
+	l.log.Info("Library scanned", slog.Int("indexed", indexed), slog.Int("removed", removed), slog.Int("files", len(seen)))
+	return indexed, removed, nil
+}
+
+// Index adds or refreshes the entry of a file, the entry is dropped when the file no longer exists.
+// The platform and the username are used when the file has no manifest to take them from.
+func (l *Library) Index(ctx context.Context, file, platform, username string) error {
+	return l.index(ctx, file, platform, username, true)
+}
+
+// index refreshes the entry of a file. Only a file the recorder wrote itself (trusted) gets a new
+// checksum, a file changed behind its back keeps the old one so the scrubber reports the change.
+func (l *Library) index(ctx context.Context, file, platform, username string, trusted bool) error {
+	rel, err := l.relative(file)
+	if err != nil {
+		return err
+	}
+	item, err := l.lr.GetByPath(rel)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		if item != nil {
+			return l.lr.Delete(item.ID)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !isMedia(file) {
+		return fmt.Errorf("%s is not a media file", filepath.Base(file))
+	}
+
+	if item == nil {
+		item = &models.LibraryItems{Path: rel, Platform: platform, Username: username}
+	}
+	unchanged := item.Size == info.Size() && item.ModifiedAt.Equal(info.ModTime())
+	checked := false
+	if sum, ok := integrity.FromManifest(file); ok && (trusted || item.Sha256 == "") {
+		item.Sha256, checked = sum, trusted
+	} else if trusted && (item.Sha256 == "" || !unchanged) {
+		_, sum, err := integrity.Sum(ctx, file)
+		if err != nil {
+			return err
+		}
+		item.Sha256, checked = sum, true
+	}
+	if checked {
+		now := time.Now()
+		item.Integrity, item.CheckedAt = models.IntegrityOK, &now
+	} else if !unchanged {
+		// changed outside the recorder, the scrubber checks it on its next run
+		item.CheckedAt = nil
+	}
+	item.Format = strings.TrimPrefix(filepath.Ext(file), ".")
+	item.Size = info.Size()
+	item.ModifiedAt = info.ModTime()
+	item.IndexedAt = time.Now()
+
+	l.readManifest(item, file)
+	l.probe(ctx, item, file)
+	if item.StartedAt.IsZero() {
+		// the file was written until its modification time
+		item.StartedAt = item.ModifiedAt.Add(-time.Duration(item.Duration * float64(time.Second)))
+	}
+	return l.lr.Save(item)
+}
+
+// Delete removes the media file of the entry together with its sidecars (manifest, thumbnails, extracted audio)
+func (l *Library) Delete(item *models.LibraryItems) error {
+	file := l.File(item)
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	dir, name := filepath.Split(file)
+	prefix := strings.TrimSuffix(name, filepath.Ext(name)) + "."
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), prefix) || isMedia(e.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			l.log.Warn("Failed to remove sidecar file", slog.String("file", e.Name()), slog.String("error", err.Error()))
+		}
+	}
+	return l.lr.Delete(item.ID)
+}
+
+// File returns the absolute path of the media file of the entry
+func (l *Library) File(item *models.LibraryItems) string {
+	return filepath.Join(l.cfg.MediaPATH, item.Path)
+}
+
+// readManifest takes the stream details from the manifest written next to the file
+func (l *Library) readManifest(item *models.LibraryItems, file string) {
+	data, err := os.ReadFile(strings.TrimSuffix(file, filepath.Ext(file)) + ".json")
+	if err != nil {
+		item.Manifest = ""
+		return
+	}
+
+	var manifest models.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil || manifest.Platform == "" {
+		// some other JSON file with the same name
+		item.Manifest = ""
+		return
+	}
+	item.Manifest = string(data)
+	item.Platform, item.Username = manifest.Platform, manifest.Username
+	item.Title, item.Category = manifest.Title, manifest.Category
+	item.StartedAt = manifest.StartedAt
+	item.Duration = manifest.Duration
+}
+
+// probe takes the streams and the real duration from ffprobe, it is skipped when ffprobe is missing
+func (l *Library) probe(ctx context.Context, item *models.LibraryItems, file string) {
+	ffprobe, err := ffmpeg.NewFfprobe(l.cfg.FFprobePATH)
+	if err != nil {
+		l.log.Debug("The library is indexed without ffprobe", slog.String("error", err.Error()))
+		return
+	}
+
+	result, err := ffprobe.Probe(ctx, file)
+	if err != nil {
+		l.log.Warn("Failed to probe media file", slog.String("file", file), slog.String("error", err.Error()))
+		return
+	}
+	data, err := json.Marshal(result)
+	if err == nil {
+		item.Probe = string(data)
+	}
+
+	if d := result.DurationSeconds(); d > 0 {
+		item.Duration = d
+	}
+	if v := result.Stream("video"); v != nil {
+		item.VideoCodec, item.Width, item.Height = v.CodecName, v.Width, v.Height
+	}
+	if a := result.Stream("audio"); a != nil {
+		item.AudioCodec = a.CodecName
+	}
+}
+
+func (l *Library) relative(file string) (string, error) {
+	root, err := filepath.Abs(l.cfg.MediaPATH)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrOutside
+	}
+	return rel, nil
+}
+
+// isMedia reports whether the file is listed by the library, unfinished outputs of ffmpeg are not
+func isMedia(file string) bool {
+	ext := filepath.Ext(file)
+	base := strings.TrimSuffix(filepath.Base(file), ext)
+	return mediaExtensions[strings.ToLower(ext)] && !strings.HasSuffix(base, "_download") && !strings.HasSuffix(base, ".postprocess")
+}
+
+// Enqueue queues the indexing of a file that was written, changed or moved away
+func Enqueue(q *jobs.Queue, base models.Jobs, file string) error {
+	data, err := json.Marshal(payload{File: file})
+	if err != nil {
+		return err
+	}
+
+	return q.Enqueue(&models.Jobs{
+		Type:        models.JobTypeIndex,
+		Key:         file,
+		Label:       filepath.Base(file),
+		Platform:    base.Platform,
+		Username:    base.Username,
+		RecordingID: base.RecordingID,
+		Payload:     string(data),
+	})
+}
+
+// Register adds the index handler to the queue
+func Register(q *jobs.Queue, l *Library) {
+	q.Register(models.JobTypeIndex, func(ctx context.Context, job *models.Jobs) error {
+		var p payload
+		if err := json.Unmarshal([]byte(job.Payload), &p); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+
+		err := l.Index(ctx, p.File, job.Platform, job.Username)
+		if errors.Is(err, ErrOutside) {
+			q.Log(job.ID, "not indexed: "+err.Error())
+			return nil
+		}
+		return err
+	})
+}
@@ -0,0 +1,164 @@
+package live
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/clips"
+	"stream-recorder/internal/app/services/preview"
+	"stream-recorder/pkg/logger"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound  = errors.New("segment not found")
+	ErrNotActive = errors.New("the streamer is not being recorded")
+)
+
+// Publisher serves the latest session of a streamer as an HLS playlist built from the journal.
+// Every segment is cut into MPEG-TS on request, from the temp directory or the finalized part,
+// with timestamps that start at its stream offset. A segment keeps its timestamps when its part
+// is finalized, so entries of an EVENT playlist never change.
+type Publisher struct {
+	log *logger.Logger
+	cfg *config.Config
+	rr  *repository.RecordingsRepository
+}
+
+func New(log *logger.Logger, cfg *config.Config, rr *repository.RecordingsRepository) *Publisher {
+	return &Publisher{
+		log: log,
+		cfg: cfg,
+		rr:  rr,
+	}
+}
+
+// Playlist returns the media playlist of the latest session. It grows while the session is
+// recorded and covers it from the start, so players can seek back; it ends once the session stops.
+func (p *Publisher) Playlist(platform, username string) (string, error) {
+	rec, segments, err := p.session(platform, username)
+	if err != nil {
+		return "", err
+	}
+
+	target := 1.0
+	for _, seg := range segments {
+		target = math.Max(target, math.Ceil(seg.Duration))
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(target))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	if rec.Status == models.RecordingStatusRecording {
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	} else {
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	}
+
+	for i, seg := range segments {
+		// only skipped ads and lost media sequences leave a gap in the stream
+		if i > 0 && (seg.SkippedAds > 0 || seg.FirstSequence != segments[i-1].LastSequence+1) {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if !seg.StartedAt.IsZero() {
+			fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.StartedAt.UTC().Format("2006-01-02T15:04:05.000Z"))
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%d.ts\n", seg.Duration, seg.SegmentID)
+	}
+
+	if rec.Status != models.RecordingStatusRecording {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.String(), nil
+}
+
+// Segment returns the MPEG-TS file of a segment of the latest session. The file is cut for this
+// request and has to be deleted once it is served.
+func (p *Publisher) Segment(ctx context.Context, platform, username string, segmentID int) (string, error) {
+	rec, segments, err := p.session(platform, username)
+	if err != nil {
+		return "", err
+	}
+
+	for _, seg := range segments {
+		if seg.SegmentID != segmentID {
+			continue
+		}
+
+		f, err := os.CreateTemp(p.cfg.TempPATH, "live-*.ts")
+		if err != nil {
+			return "", err
+		}
+		f.Close()
+
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+
+		start := clips.Point{Offset: seg.StreamOffset}
+		end := clips.Point{Offset: seg.StreamOffset + seg.Duration}
+		offset := time.Duration(seg.StreamOffset * float64(time.Second))
+		if err := clips.Extract(ctx, p.cfg, p.rr, rec, start, end, false, offset, f.Name()); err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+		return f.Name(), nil
+	}
+	return "", ErrNotFound
+}
+
+// Snapshot returns the latest frame of the active session, decoded from the newest segment on disk
+func (p *Publisher) Snapshot(ctx context.Context, platform, username string) ([]byte, error) {
+	rec, segments, err := p.session(platform, username)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Status != models.RecordingStatusRecording {
+		return nil, ErrNotActive
+	}
+
+	for i := len(segments) - 1; i >= 0; i-- {
+		file := p.tempFile(rec, segments[i].VideoFile)
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		return preview.Snapshot(ctx, p.cfg, file)
+	}
+	return nil, ErrNotFound
+}
+
+// session returns the latest recording of the streamer with its segments, a segment journaled
+// twice (by a clip saved from a replay buffer) is listed once
+func (p *Publisher) session(platform, username string) (*models.Recordings, []models.RecordingSegments, error) {
+	rec, err := p.rr.FindRecording(platform, username, time.Time{})
+	if err != nil {
+		return nil, nil, err
+	}
+	segments, err := p.rr.GetSegments(rec.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	unique := segments[:0]
+	for _, seg := range segments {
+		if n := len(unique); n > 0 && unique[n-1].SegmentID == seg.SegmentID {
+			continue
+		}
+		unique = append(unique, seg)
+	}
+	return rec, unique, nil
+}
+
+func (p *Publisher) tempFile(rec *models.Recordings, name string) string {
+	return filepath.Join(p.cfg.TempPATH, rec.StreamDir, name)
+}
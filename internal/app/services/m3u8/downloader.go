@@ -2,15 +2,34 @@ package m3u8
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	"io"
 	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func (m *M3u8) fetchPlaylist(url string) ([]string, error) {
-	resp, err := m.HTTPClient.Get(url)
+// playlistSegment is a media segment of the playlist with its media sequence number,
+// its EXTINF duration and the wall-clock time it starts at (zero when the playlist has no PROGRAM-DATE-TIME)
+type playlistSegment struct {
+	url             string
+	sequence        int64
+	duration        time.Duration
+	programDateTime time.Time
+}
+
+// fetchPlaylist returns the segments of the media playlist. The sequence numbers of the
+// skipped ad segments are remembered so that the ad breaks end up in the manifest.
+func (m *M3u8) fetchPlaylist(ctx context.Context, url string) ([]playlistSegment, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := m.HTTPClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -25,21 +44,57 @@ func (m *M3u8) fetchPlaylist(url string) ([]string, error) {
 		return nil, fmt.Errorf("failed to fetch master playlist with status code %d", resp.StatusCode)
 	}
 
-	var segments []string
+	var segments []playlistSegment
 	var skipCount int
+	var sequence int64
+	var next playlistSegment
+	var lastEnd time.Time
+
+	// the tags describe the segment URI that follows them, a date only has to be present
+	// on the first one and the following segments continue from it
+	nextSegment := func() playlistSegment {
+		seg := next
+		if seg.programDateTime.IsZero() && !lastEnd.IsZero() {
+			seg.programDateTime = lastEnd
+		}
+		if !seg.programDateTime.IsZero() {
+			lastEnd = seg.programDateTime.Add(seg.duration)
+		}
+		seg.sequence = sequence
+		sequence++
+		next = playlistSegment{}
+		return seg
+	}
 
 	scanner := bufio.NewScanner(resp.Body)
 	for scanner.Scan() {
 		line := scanner.Text()
 
+		if value, ok := strings.CutPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"); ok {
+			sequence, _ = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "#EXTINF:"); ok {
+			next.duration = parseExtinf(value)
+		}
+		if value, ok := strings.CutPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:"); ok {
+			next.programDateTime = parseProgramDateTime(value)
+			continue
+		}
+
 		if skipCount > 0 {
 			skipCount--
+			if line != "" && !strings.HasPrefix(line, "#") {
+				m.adSequences[nextSegment().sequence] = true
+			}
 			continue
 		}
 
 		skip, isSegment, segmentURL := m.sl.Platform.ParseM3u8(line, m.sm)
 		if isSegment {
-			segments = append(segments, segmentURL)
+			seg := nextSegment()
+			seg.url = segmentURL
+			segments = append(segments, seg)
 		}
 		skipCount = skip
 	}
@@ -52,45 +107,29 @@ func (m *M3u8) fetchPlaylist(url string) ([]string, error) {
 	return segments, nil
 }
 
-func (m *M3u8) downloadSegment(url string) ([]byte, error) {
-	const maxAttempts = 10
-	var attempt int
-
-	for {
-		attempt++
-		m.log.Debug(fmt.Sprintf("[%s/%s] Starting download segment", m.sm.Username, m.sm.Platform), slog.String("url", url), slog.Int("attempt", attempt))
-
-		resp, err := m.HTTPClient.Get(url)
-		if err != nil {
-			if attempt > maxAttempts {
-				return nil, fmt.Errorf("reached max attempts (%d) to download segment", maxAttempts)
-			}
-
-			m.log.Error(fmt.Sprintf("[%s/%s] Failed to download segment", m.sm.Username, m.sm.Platform), err, slog.String("url", url), slog.Int("attempt", attempt))
-			time.Sleep(3 * time.Second * time.Duration(attempt))
-			continue
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			m.log.Error(fmt.Sprintf("[%s/%s] Received non-OK status code while downloading segment", m.sm.Username, m.sm.Platform), nil, slog.String("url", url), slog.Int("status_code", resp.StatusCode), slog.Int("attempt", attempt))
-			_ = resp.Body.Close()
-			return nil, fmt.Errorf("segment not found (404)")
-		}
-
-		data, err := io.ReadAll(resp.Body)
-		if err != nil {
-			if attempt > maxAttempts {
-				return nil, fmt.Errorf("reached max attempts (%d) to download segment", maxAttempts)
-			}
+// parseExtinf reads the duration of "#EXTINF:<duration>,[<title>]", zero if it is malformed
+func parseExtinf(value string) time.Duration {
+	value, _, _ = strings.Cut(value, ",")
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(math.Round(seconds * float64(time.Second)))
+}
 
-			m.log.Error(fmt.Sprintf("[%s/%s] Failed to read segment data", m.sm.Username, m.sm.Platform), err, slog.String("url", url), slog.Int("attempt", attempt))
-			_ = resp.Body.Close()
-			time.Sleep(3 * time.Second * time.Duration(attempt))
-			continue
+// parseProgramDateTime reads an ISO 8601 date, some servers omit the colon in the zone offset
+func parseProgramDateTime(value string) time.Time {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999Z0700"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
 		}
-		_ = resp.Body.Close()
-
-		m.log.Debug(fmt.Sprintf("[%s/%s] Successfully downloaded segment", m.sm.Username, m.sm.Platform), slog.String("url", url), slog.Int("attempt", attempt))
-		return data, nil
 	}
+	return time.Time{}
+}
+
+// segmentDeadline is the time budget for a single segment download including retries.
+// A segment that takes longer than a few target durations is already outside the live window.
+func (m *M3u8) segmentDeadline() time.Duration {
+	return max(3**m.sm.WaitingTime, 10*time.Second)
 }
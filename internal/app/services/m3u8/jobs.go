@@ -0,0 +1,167 @@
+package m3u8
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/downloader"
+	"stream-recorder/internal/app/services/jobs"
+	"stream-recorder/internal/app/services/library"
+	"stream-recorder/internal/app/services/postprocess"
+	"stream-recorder/internal/app/services/preview"
+	"stream-recorder/internal/app/services/tracker"
+	"stream-recorder/internal/app/services/utils"
+	"stream-recorder/pkg/logger"
+)
+
+// partJob is the payload of the finalization jobs of a part
+type partJob struct {
+	TempPath  string `json:"temp_path"`
+	MediaPath string `json:"media_path"`
+}
+
+// RegisterJobs adds the finalization steps of a part to the queue: concat produces the media
+// file and queues verify, which checks it, writes the manifest and removes the temp inputs. Verify
+// rebuilds a file that is missing or failed its last verification first.
+// Every job restores the settings its recording was made with.
+func RegisterJobs(q *jobs.Queue, log *logger.Logger, c *config.Config, u *utils.Utils, dp *downloader.Pool, tr *tracker.Tracker, rr *repository.RecordingsRepository) {
+	restore := func(job *models.Jobs) (*M3u8, partJob, error) {
+		var p partJob
+		if err := json.Unmarshal([]byte(job.Payload), &p); err != nil {
+			return nil, p, fmt.Errorf("invalid payload: %w", err)
+		}
+		rec, err := rr.GetRecording(job.RecordingID)
+		if err != nil {
+			return nil, p, err
+		}
+		m, err := New(log, rec.Platform, rec.Username, false, 0, c, u, dp, tr, rr, q)
+		if err != nil {
+			return nil, p, err
+		}
+		m.restore(*rec)
+		return m, p, nil
+	}
+
+	q.Register(models.JobTypeConcat, func(ctx context.Context, job *models.Jobs) error {
+		m, p, err := restore(job)
+		if err != nil {
+			return err
+		}
+
+		if _, err := m.produce(ctx, p.TempPath, p.MediaPath); err != nil {
+			if job.LastAttempt() {
+				m.journalPartResult(p.TempPath, err)
+			}
+			return err
+		}
+		q.Log(job.ID, "media file written: "+filepath.Base(p.MediaPath))
+		return m.enqueuePartJob(models.JobTypeVerify, p.TempPath, p.MediaPath)
+	})
+
+	q.Register(models.JobTypeVerify, func(ctx context.Context, job *models.Jobs) error {
+		m, p, err := restore(job)
+		if err != nil {
+			return err
+		}
+
+		// the temp inputs are kept for a file that failed, so it is rebuilt from them. A file that is kept
+		// was written by the concat job, which left its checksum in the journal.
+		var sum string
+		if m.needsRebuild(p.TempPath, p.MediaPath) {
+			os.Remove(fmt.Sprintf("%s.%s", p.MediaPath, m.c.FileFormat))
+			if sum, err = m.produce(ctx, p.TempPath, p.MediaPath); err != nil {
+				if job.LastAttempt() {
+					m.journalPartResult(p.TempPath, err)
+				}
+				return err
+			}
+			q.Log(job.ID, "media file rebuilt: "+filepath.Base(p.MediaPath))
+		}
+
+		err = m.finalize(ctx, p.TempPath, p.MediaPath, sum)
+		if err == nil || job.LastAttempt() {
+			m.journalPartResult(p.TempPath, err)
+		}
+		return err
+	})
+}
+
+// needsRebuild reports whether the media file of a part has to be produced again before it is verified,
+// which is the case when it is missing or the journal holds a failed verification for it
+func (m *M3u8) needsRebuild(pathTempWithoutExt, pathMediaWithoutExt string) bool {
+	if _, err := os.Stat(fmt.Sprintf("%s.%s", pathMediaWithoutExt, m.c.FileFormat)); err != nil {
+		return true
+	}
+
+	part, err := m.rr.GetPart(pathTempWithoutExt)
+	return err == nil && part.Verification == models.VerificationFailed
+}
+
+// enqueueFinalize hands a part over to the job queue. The parts of a recording that is not
+// journaled cannot be restored by a job, so they are finalized right away.
+func (m *M3u8) enqueueFinalize(ctx context.Context, pathTempWithoutExt, pathMediaWithoutExt string) {
+	if m.recording != nil && m.enqueuePartJob(models.JobTypeConcat, pathTempWithoutExt, pathMediaWithoutExt) == nil {
+		return
+	}
+
+	// finalization must outlive the recording, otherwise a stop would discard the last part
+	m.tr.Go("finalize "+filepath.Base(pathMediaWithoutExt), func() {
+		m.ConcatAndCleanup(context.WithoutCancel(ctx), pathTempWithoutExt, pathMediaWithoutExt)
+	})
+}
+
+// startLibrary queues the update of the media library of a finalized file, and its previews when
+// there is no pipeline. A pipeline queues them for its result, a step may move or replace the file.
+func (m *M3u8) startLibrary(outputPath string) {
+	base := models.Jobs{Platform: m.sm.Platform, Username: m.sm.Username}
+	if m.recording != nil {
+		base.RecordingID = m.recording.ID
+	}
+	if err := library.Enqueue(m.q, base, outputPath); err != nil {
+		m.log.Error(fmt.Sprintf("[%s/%s] Failed to queue library update", m.sm.Username, m.sm.Platform), err, slog.String("file", outputPath))
+	}
+	if steps, _ := postprocess.Parse(m.postProcess); len(steps) > 0 {
+		return
+	}
+	if err := preview.Enqueue(m.q, base, outputPath); err != nil {
+		m.log.Error(fmt.Sprintf("[%s/%s] Failed to queue previews", m.sm.Username, m.sm.Platform), err, slog.String("file", outputPath))
+	}
+}
+
+// startPostProcess queues the post-processing pipeline of the recording for a finalized file,
+// the upload to the storage backend runs after the last step
+func (m *M3u8) startPostProcess(pathTempWithoutExt, outputPath string) {
+	if m.postProcess == "" && m.upload == nil {
+		return
+	}
+
+	base := models.Jobs{Key: pathTempWithoutExt, Platform: m.sm.Platform, Username: m.sm.Username}
+	if m.recording != nil {
+		base.RecordingID = m.recording.ID
+	}
+	if err := postprocess.Start(m.q, base, m.postProcess, outputPath, m.upload); err != nil {
+		m.log.Error(fmt.Sprintf("[%s/%s] Failed to queue post-processing", m.sm.Username, m.sm.Platform), err, slog.String("file", outputPath))
+	}
+}
+
+func (m *M3u8) enqueuePartJob(jobType, pathTempWithoutExt, pathMediaWithoutExt string) error {
+	payload, err := json.Marshal(partJob{TempPath: pathTempWithoutExt, MediaPath: pathMediaWithoutExt})
+	if err != nil {
+		return err
+	}
+
+	return m.q.Enqueue(&models.Jobs{
+		Type:        jobType,
+		Key:         pathTempWithoutExt,
+		Platform:    m.sm.Platform,
+		Username:    m.sm.Username,
+		RecordingID: m.recording.ID,
+		Payload:     string(payload),
+	})
+}
@@ -0,0 +1,219 @@
+package m3u8
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/services/profiles"
+	"time"
+)
+
+// startJournal opens the journal entry of the session together with the settings
+// the segments are written with, so that recovery finalizes them the same way
+func (m *M3u8) startJournal() {
+	rec := &models.Recordings{
+		Platform:      m.sm.Platform,
+		Username:      m.sm.Username,
+		StreamDir:     m.streamDir,
+		Quality:       m.quality,
+		Variant:       m.variant,
+		FileFormat:    m.c.FileFormat,
+		VideoCodec:    m.c.VideoCodec,
+		AudioCodec:    m.c.AudioCodec,
+		FragmentedMP4: m.c.FragmentedMP4,
+		PostProcess:   m.postProcess,
+		Profile:       m.profile.Name,
+		ReplayMinutes: int(m.replay / time.Minute),
+	}
+	if m.upload != nil {
+		rec.Storage, rec.KeepLocal = m.upload.Storage, m.upload.KeepLocal
+	}
+	if err := m.rr.Start(rec); err != nil {
+		m.log.Warn(fmt.Sprintf("[%s/%s] The recording is not journaled and cannot be recovered after a crash", m.sm.Username, m.sm.Platform))
+		return
+	}
+	m.recording = rec
+}
+
+func (m *M3u8) finishJournal() {
+	if m.recording == nil {
+		return
+	}
+	m.rr.Finish(m.recording.ID)
+}
+
+// journalSegment remembers a segment written to disk. The file names of a part are
+// fixed by its first segment, so a crash does not change them.
+func (m *M3u8) journalSegment(videoFile, audioFile string, size int64, duration time.Duration) {
+	startedAt := m.buffer.startedAt
+	if startedAt.IsZero() {
+		// without PROGRAM-DATE-TIME the segment is assumed to have just ended
+		startedAt = time.Now().Add(-duration)
+	}
+	offset := *m.sm.StartDurationStream + m.mediaTime
+
+	// the replay buffer has no parts, every saved clip gets its own file names
+	if len(m.pendingSegments) == 0 && m.replay == 0 {
+		m.partNumber++
+		m.partBytes = 0
+		m.partDuration = 0
+		m.partStartedAt = startedAt
+		m.partTempPath, m.partMediaPath = m.generateFilePaths(m.streamDir, startedAt, offset)
+		if m.recording != nil {
+			m.rr.UpdatePartPaths(m.recording.ID, m.partTempPath, m.partMediaPath)
+		}
+	}
+
+	seg := models.RecordingSegments{
+		SegmentID: m.segmentId,
+		VideoFile: videoFile,
+		AudioFile: audioFile,
+		Size:      size,
+		Duration:  duration.Seconds(),
+
+		FirstSequence: m.buffer.firstSequence,
+		LastSequence:  m.buffer.lastSequence,
+		SkippedAds:    m.buffer.skippedAds,
+		StreamOffset:  offset.Seconds(),
+		StartedAt:     startedAt,
+		CreatedAt:     time.Now(),
+	}
+	if m.recording != nil {
+		seg.RecordingID = m.recording.ID
+		m.rr.AddSegment(&seg)
+	}
+	m.pendingSegments = append(m.pendingSegments, seg)
+	m.partBytes += size
+	m.partDuration += duration
+	m.mediaTime += duration
+	m.wallClock = startedAt.Add(duration)
+}
+
+// splitPart writes the segment lists of the current part and journals the split point.
+// It reports false when no segments were written since the previous split.
+func (m *M3u8) splitPart() (string, string, bool, error) {
+	if len(m.pendingSegments) == 0 {
+		return "", "", false, nil
+	}
+
+	pathTempWithoutExtHash, err := m.writePart(m.partTempPath, m.partMediaPath, m.pendingSegments)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	pathMediaWithoutExt := m.partMediaPath
+	m.pendingSegments = m.pendingSegments[:0]
+	return pathTempWithoutExtHash, pathMediaWithoutExt, true, nil
+}
+
+// writePart writes the segment lists of a part, journals it and returns the base path of the lists
+func (m *M3u8) writePart(pathTempWithoutExt, pathMediaWithoutExt string, segments []models.RecordingSegments) (string, error) {
+	pathTempWithoutExtHash, err := m.FlushTxtToDisk(pathTempWithoutExt, segments)
+	if err != nil {
+		return "", err
+	}
+
+	if m.recording != nil {
+		var segmentIDs []int
+		var expected float64
+		for _, seg := range segments {
+			if seg.ID != 0 {
+				segmentIDs = append(segmentIDs, seg.ID)
+			}
+			expected += seg.Duration
+		}
+
+		// the stream info of the next part is only applied after the split
+		m.muInfo.Lock()
+		info := m.info
+		m.muInfo.Unlock()
+
+		m.rr.AddPart(&models.RecordingParts{
+			RecordingID:      m.recording.ID,
+			TempPath:         pathTempWithoutExtHash,
+			MediaPath:        pathMediaWithoutExt,
+			Title:            info.Title,
+			Category:         info.Category,
+			ExpectedDuration: expected,
+		}, segmentIDs)
+	}
+	return pathTempWithoutExtHash, nil
+}
+
+func (m *M3u8) journalPartResult(pathTempWithoutExt string, err error) {
+	if m.recording == nil {
+		return
+	}
+
+	if err != nil {
+		m.rr.UpdatePartStatus(pathTempWithoutExt, models.PartStatusFailed, err.Error())
+		return
+	}
+	m.rr.UpdatePartStatus(pathTempWithoutExt, models.PartStatusDone, "")
+}
+
+// journalChecksum records the checksum of the media file of a part, an empty sum clears it
+func (m *M3u8) journalChecksum(pathTempWithoutExt, sum string) {
+	if m.recording == nil {
+		return
+	}
+	_ = m.rr.UpdatePartChecksum(pathTempWithoutExt, sum)
+}
+
+// restore switches to the settings and the journal entry of a recorded session
+func (m *M3u8) restore(rec models.Recordings) {
+	c := *m.c
+	c.FileFormat = rec.FileFormat
+	c.VideoCodec = rec.VideoCodec
+	c.AudioCodec = rec.AudioCodec
+	c.FragmentedMP4 = rec.FragmentedMP4
+	m.c = &c
+	m.profile = profiles.FromConfig(m.c)
+	m.profile.Name = rec.Profile
+
+	m.recording = &rec
+	m.postProcess = rec.PostProcess
+	m.SetStorage(rec.Storage, rec.KeepLocal)
+	m.replay = time.Duration(rec.ReplayMinutes) * time.Minute
+	m.streamDir = rec.StreamDir
+	m.partTempPath, m.partMediaPath = rec.PartTempPath, rec.PartMediaPath
+}
+
+// Recover finalizes a session left behind by a crash: the segments written after the last
+// split become its final part and every part that was not finalized and has no job yet is queued.
+// The buffer of a replay session is dropped instead, only its saved clips are finalized.
+func (m *M3u8) Recover(ctx context.Context, rec models.Recordings) {
+	m.restore(rec)
+
+	segments, err := m.rr.GetUnassignedSegments(rec.ID)
+	if err != nil {
+		return
+	}
+	m.pendingSegments = segments
+	if m.replay > 0 {
+		// the content of a replay buffer is only kept when a clip was saved from it
+		m.discardReplay()
+	} else if _, _, _, err := m.splitPart(); err != nil {
+		m.log.Error(fmt.Sprintf("[%s/%s] Error flush txt to disk", m.sm.Username, m.sm.Platform), err)
+		return
+	}
+	m.finishJournal()
+
+	parts, err := m.rr.GetPendingParts(rec.ID)
+	if err != nil {
+		return
+	}
+	for _, part := range parts {
+		known, err := m.q.Known(part.TempPath)
+		if err != nil {
+			m.log.Error(fmt.Sprintf("[%s/%s] Failed to look up the jobs of a part", m.sm.Username, m.sm.Platform), err, slog.String("path", part.TempPath))
+			continue
+		}
+		if known {
+			continue
+		}
+		m.log.Info(fmt.Sprintf("[%s/%s] Finalizing interrupted part", m.sm.Username, m.sm.Platform), slog.String("path", part.MediaPath))
+		m.enqueueFinalize(ctx, part.TempPath, part.MediaPath)
+	}
+}
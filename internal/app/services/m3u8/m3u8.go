@@ -1,6 +1,7 @@
 package m3u8
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -10,10 +11,18 @@ import (
 	"sort"
 	"stream-recorder/internal/app/config"
 	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/downloader"
+	"stream-recorder/internal/app/services/jobs"
+	"stream-recorder/internal/app/services/profiles"
+	"stream-recorder/internal/app/services/storage"
 	"stream-recorder/internal/app/services/streamlink"
+	"stream-recorder/internal/app/services/tracker"
 	"stream-recorder/internal/app/services/utils"
 	"stream-recorder/pkg/ffmpeg"
 	"stream-recorder/pkg/logger"
+	"stream-recorder/pkg/pathtemplate"
+	"stream-recorder/pkg/remux"
 	"strings"
 	"sync"
 	"time"
@@ -24,30 +33,101 @@ type M3u8 struct {
 	c   *config.Config
 	sl  *streamlink.Streamlink
 	u   *utils.Utils
+	dp  *downloader.Pool
+	tr  *tracker.Tracker
+	rr  *repository.RecordingsRepository
+	q   *jobs.Queue
 
 	HTTPClient *http.Client
 	sm         *models.StreamMetadata
 
 	muCut, muCancel     sync.Mutex
 	isNeedCut, isCancel bool
+	cancel              context.CancelFunc
 	segmentId           int
 	streamDir           string
 
+	recording                   *models.Recordings
+	pendingSegments             []models.RecordingSegments
+	partTempPath, partMediaPath string
+
+	quality     string
+	variant     models.Variant
+	postProcess string
+	profile     models.EncodingProfiles
+	upload      *storage.Upload
+
+	replay         time.Duration
+	replayKeywords []string
+	muReplay       sync.Mutex
+	replayRequests []replayRequest
+	lastKeywordAt  time.Time
+
+	muInfo   sync.Mutex
+	info     models.StreamInfo
+	nextInfo *models.StreamInfo
+
+	splitSize                     int64
+	splitClock                    time.Duration
+	splitOnCategory, splitOnTitle bool
+	partBytes                     int64
+	partStartedAt                 time.Time
+
+	// the timeline of the session: media time sums the durations of the written segments,
+	// wall clock is where the last written segment ends
+	mediaTime, partDuration time.Duration
+	wallClock               time.Time
+
+	dirTemplate, fileTemplate *pathtemplate.Template
+	loc                       *time.Location
+	partNumber                int
+	usedMediaPaths            map[string]bool
+
 	dataSegments       []byte
 	downloadedSegments *OrderedSet
+	inflight           []pendingSegment
+	buffer             segmentBuffer
+	adSequences        map[int64]bool
+	lastSequence       int64
+}
+
+// segmentBuffer describes the playlist segments collected in dataSegments
+type segmentBuffer struct {
+	url                         string
+	firstSequence, lastSequence int64
+	skippedAds                  int
+	duration                    time.Duration
+	startedAt                   time.Time
 }
 
-func New(log *logger.Logger, platform, username string, splitSegments bool, timeSegment int, c *config.Config, u *utils.Utils) (*M3u8, error) {
+func New(log *logger.Logger, platform, username string, splitSegments bool, timeSegment int, c *config.Config, u *utils.Utils, dp *downloader.Pool, tr *tracker.Tracker, rr *repository.RecordingsRepository, q *jobs.Queue) (*M3u8, error) {
 	skipTargetDuration := false
 	totalDurationStream := time.Duration(0)
 	startDurationStream := time.Duration(0)
 	waitingTime := time.Duration(1)
 
+	dirTemplate, err := pathtemplate.Parse(c.DirTemplate, config.TemplatePlaceholders...)
+	if err != nil {
+		return nil, err
+	}
+	fileTemplate, err := pathtemplate.Parse(c.FileTemplate, config.TemplatePlaceholders...)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return nil, err
+	}
+
 	return &M3u8{
 		log: log,
 		c:   c,
 		sl:  streamlink.New(log, u, "twitch"),
 		u:   u,
+		dp:  dp,
+		tr:  tr,
+		rr:  rr,
+		q:   q,
 		HTTPClient: &http.Client{
 			Transport: &http.Transport{
 				MaxIdleConns:        100,
@@ -68,69 +148,251 @@ func New(log *logger.Logger, platform, username string, splitSegments bool, time
 		isNeedCut:          false,
 		isCancel:           false,
 		downloadedSegments: NewOrderedSet(),
+		adSequences:        make(map[int64]bool),
+		lastSequence:       -1,
+		dirTemplate:        dirTemplate,
+		fileTemplate:       fileTemplate,
+		loc:                loc,
+		usedMediaPaths:     make(map[string]bool),
+		profile:            profiles.FromConfig(c),
 	}, nil
 }
 
-func (m *M3u8) Run(playlistURL string) error {
+// SetProfile replaces the global codec and container settings with an encoding profile
+func (m *M3u8) SetProfile(p models.EncodingProfiles) {
+	c := *m.c
+	c.VideoCodec = p.VideoCodec
+	c.AudioCodec = p.AudioCodec
+	c.FileFormat = p.FileFormat
+	c.FragmentedMP4 = p.FragmentedMP4
+	m.c = &c
+	m.profile = p
+}
+
+// SetPostProcess sets the pipeline that runs on every finalized file of the recording
+func (m *M3u8) SetPostProcess(pipeline string) {
+	m.postProcess = pipeline
+}
+
+// SetStorage uploads every finalized file of the recording to the storage backend once it is post-processed
+func (m *M3u8) SetStorage(name string, keepLocal bool) {
+	m.upload = nil
+	if name != "" {
+		m.upload = &storage.Upload{Storage: name, KeepLocal: keepLocal}
+	}
+}
+
+// SetVariant remembers the requested quality and the variant it was resolved to for the manifest
+func (m *M3u8) SetVariant(quality string, variant models.Variant) {
+	m.quality = quality
+	m.variant = variant
+}
+
+// Run records the media playlist until the stream ends or ctx is cancelled.
+// Segments already on disk are finalized in both cases.
+func (m *M3u8) Run(ctx context.Context, playlistURL string) error {
 	m.log.Debug(fmt.Sprintf("[%s/%s] Starting playlist monitoring", m.sm.Username, m.sm.Platform), slog.String("playlistURL", playlistURL))
 	if playlistURL == "" {
 		return errors.New("playlistURL is empty")
 	}
 
+	defer m.tr.Add(fmt.Sprintf("recording %s/%s", m.sm.Platform, m.sm.Username))()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m.muCancel.Lock()
+	m.cancel = cancel
+	if m.isCancel {
+		cancel()
+	}
+	m.muCancel.Unlock()
+
 	m.streamDir = fmt.Sprintf("%s_%s_%s", m.sm.Platform, m.sm.Username, time.Now().Format("2006-01-02"))
 	if err := m.u.CreateDirectoryIfNotExist(filepath.Join(m.c.TempPATH, m.streamDir)); err != nil {
 		return err
 	}
-	if err := m.u.CreateDirectoryIfNotExist(filepath.Join(m.c.MediaPATH, m.streamDir)); err != nil {
-		return err
-	}
 
-	for {
-		segments, err := m.fetchPlaylist(playlistURL)
-		if err != nil {
-			if !strings.Contains(err.Error(), "404") {
-				m.log.Error(fmt.Sprintf("[%s/%s] Error fetching playlist", m.sm.Username, m.sm.Platform), err, slog.String("playlistURL", playlistURL))
-				time.Sleep(*m.sm.WaitingTime)
-				continue
-			}
+	m.startJournal()
+	defer m.finishJournal()
 
+	go m.watchStreamInfo(ctx)
+	go m.watchChat(ctx)
+
+	for {
+		segments, err := m.fetchPlaylist(ctx, playlistURL)
+		switch {
+		case ctx.Err() != nil:
+			m.log.Info(fmt.Sprintf("[%s/%s] The recording has been stopped, and I'm starting the final processing...", m.sm.Username, m.sm.Platform))
+			m.ChangeIsCancel(true)
+		case err != nil && !strings.Contains(err.Error(), "404"):
+			m.log.Error(fmt.Sprintf("[%s/%s] Error fetching playlist", m.sm.Username, m.sm.Platform), err, slog.String("playlistURL", playlistURL))
+			m.sleep(ctx, *m.sm.WaitingTime)
+			continue
+		case err != nil:
 			m.log.Info(fmt.Sprintf("[%s/%s] The streamer has finished the live broadcast, and I'm starting the final processing...", m.sm.Username, m.sm.Platform))
-			m.isCancel = true
+			m.ChangeIsCancel(true)
 		}
-		isErrDownload := m.processSegments(segments, filepath.Join(m.c.TempPATH, m.streamDir))
+		isErrDownload := m.processSegments(ctx, segments, filepath.Join(m.c.TempPATH, m.streamDir))
 		m.downloadedSegments.TrimToLast(50)
 
-		isSplit := m.sm.SplitSegments && *m.sm.TotalDurationStream-*m.sm.StartDurationStream > time.Duration(m.sm.TimeSegment)*time.Second
-		if isSplit || m.GetIsNeedCut() || m.GetIsCancel() || isErrDownload {
-			pathTempWithoutExt, pathMediaWithoutExt := m.generateFilePaths(m.streamDir)
+		if m.replay > 0 {
+			if m.GetIsNeedCut() {
+				m.requestReplay(m.replay, "cut")
+				m.ChangeIsNeedCut(false)
+			}
+			m.saveReplays(ctx, filepath.Join(m.c.TempPATH, m.streamDir))
+			m.trimReplay()
+			if m.GetIsCancel() {
+				m.discardReplay()
+				break
+			}
+			m.sleep(ctx, *m.sm.WaitingTime)
+			continue
+		}
+
+		reason := m.splitReason()
+		if reason != "" || m.GetIsNeedCut() || m.GetIsCancel() || isErrDownload {
+			if reason != "" {
+				m.log.Info(fmt.Sprintf("[%s/%s] Splitting the recording", m.sm.Username, m.sm.Platform), slog.String("reason", reason), slog.Int("part", m.partNumber))
+			}
+			// the last part ends with the segments that are still buffered
+			if m.GetIsCancel() {
+				m.flushBuffer(ctx, filepath.Join(m.c.TempPATH, m.streamDir))
+			}
 
-			pathTempWithoutExtHash, err := m.FlushTxtToDisk(pathTempWithoutExt)
+			pathTempWithoutExtHash, pathMediaWithoutExt, ok, err := m.splitPart()
 			if err != nil {
 				m.log.Error(fmt.Sprintf("[%s/%s] Error flush txt to disk", m.sm.Username, m.sm.Platform), err)
 				return err
 			}
 
-			go func(pathTempWithoutExt, pathMediaWithoutExt string) {
-				m.ConcatAndCleanup(pathTempWithoutExt, pathMediaWithoutExt)
-			}(pathTempWithoutExtHash, pathMediaWithoutExt)
+			if ok {
+				m.enqueueFinalize(ctx, pathTempWithoutExtHash, pathMediaWithoutExt)
+			}
 
+			m.applyStreamInfo()
 			m.ChangeIsNeedCut(false)
 			if m.GetIsCancel() {
 				break
 			}
 		}
-		time.Sleep(*m.sm.WaitingTime)
+		m.sleep(ctx, *m.sm.WaitingTime)
+	}
+
+	return nil
+}
+
+func (m *M3u8) sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// ConcatAndCleanup muxes the segments listed for a part into the media file, verifies the result
+// and records it in the journal. The temp inputs are only removed once the file passed verification.
+// It is only used for recordings that are not journaled, the others are finalized by the job queue.
+func (m *M3u8) ConcatAndCleanup(ctx context.Context, pathTempWithoutExt, pathMediaWithoutExt string) {
+	sum, err := m.produce(ctx, pathTempWithoutExt, pathMediaWithoutExt)
+	if err == nil {
+		err = m.finalize(ctx, pathTempWithoutExt, pathMediaWithoutExt, sum)
+	}
+	m.journalPartResult(pathTempWithoutExt, err)
+}
+
+// ConcatLegacy finalizes a part left by a session recorded before the journal. Those parts list
+// separate video and audio segments, which only the ffmpeg concat can join.
+func (m *M3u8) ConcatLegacy(ctx context.Context, pathTempWithoutExt, pathMediaWithoutExt string) {
+	err := m.concat(ctx, pathTempWithoutExt, pathMediaWithoutExt)
+	if err == nil {
+		err = m.finalize(ctx, pathTempWithoutExt, pathMediaWithoutExt, "")
+	}
+	m.journalPartResult(pathTempWithoutExt, err)
+}
+
+// produce muxes the segments listed for a part into the media file. It returns the checksum the remuxer
+// took while writing, which is empty for the ffmpeg output, and keeps it in the journal for the verify job.
+func (m *M3u8) produce(ctx context.Context, pathTempWithoutExt, pathMediaWithoutExt string) (string, error) {
+	// a sum of an earlier build must not outlive the file it was taken from
+	m.journalChecksum(pathTempWithoutExt, "")
+
+	format, ok := m.remuxFormat()
+	if !ok {
+		return "", m.concat(ctx, pathTempWithoutExt, pathMediaWithoutExt)
+	}
+	sum, err := m.remux(pathTempWithoutExt, pathMediaWithoutExt, format)
+	if err != nil {
+		return "", err
+	}
+	m.journalChecksum(pathTempWithoutExt, sum)
+	return sum, nil
+}
+
+// finalize verifies the media file of a part, writes its manifest and removes the temp inputs once the file is accepted.
+// sum is the checksum taken while the file was written, if any.
+func (m *M3u8) finalize(ctx context.Context, pathTempWithoutExt, pathMediaWithoutExt, sum string) error {
+	outputPath := fmt.Sprintf("%s.%s", pathMediaWithoutExt, m.c.FileFormat)
+	if _, err := os.Stat(outputPath); err != nil {
+		return err
 	}
 
+	report, err := m.verify(ctx, pathTempWithoutExt, outputPath)
+	sum = m.checksum(ctx, pathTempWithoutExt, outputPath, sum)
+	m.writeManifest(pathTempWithoutExt, outputPath, report, sum)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range m.partInputs(pathTempWithoutExt) {
+		os.Remove(file)
+	}
+
+	m.log.Info("Segment is recorded")
+	m.startLibrary(outputPath)
+	m.startPostProcess(pathTempWithoutExt, outputPath)
 	return nil
 }
 
-func (m *M3u8) ConcatAndCleanup(pathTempWithoutExt, pathMediaWithoutExt string) {
-	runConcat := func(inputTxt, outputFile, vCodec, aCodec string) {
+// partInputs lists the segments and intermediate files a part is produced from
+func (m *M3u8) partInputs(pathTempWithoutExt string) []string {
+	// remuxed parts only have a video list, legacy parts always have both
+	txts := []string{pathTempWithoutExt + "_video.txt"}
+	if _, err := os.Stat(pathTempWithoutExt + "_audio.txt"); err == nil {
+		txts = append(txts, pathTempWithoutExt+"_audio.txt")
+	}
+
+	var inputs []string
+	dir := filepath.Dir(pathTempWithoutExt)
+	for _, txt := range txts {
+		segments, err := m.u.ExtractFilenamesFromTxt(txt)
+		if err != nil {
+			m.log.Error("Extract segments failed", err)
+			continue
+		}
+		for _, file := range segments {
+			inputs = append(inputs, filepath.Join(dir, file))
+		}
+	}
+
+	if len(txts) > 1 {
+		inputs = append(inputs,
+			fmt.Sprintf("%s.%s", pathTempWithoutExt, m.c.FileFormat),
+			fmt.Sprintf("%s.%s", pathTempWithoutExt, m.getRecommendedAudioFormat(m.c.AudioCodec)))
+	}
+	return append(inputs, txts...)
+}
+
+// concat splits the part into a video and an audio track with ffmpeg and muxes them back together
+func (m *M3u8) concat(ctx context.Context, pathTempWithoutExt, pathMediaWithoutExt string) error {
+	runConcat := func(inputTxt, outputFile, vCodec, aCodec string) error {
 		ff, err := ffmpeg.NewFfmpeg(m.c.FFmpegPATH)
 		if err != nil {
 			m.log.Error(fmt.Sprintf("[%s/%s] Initialize ffmpeg", m.sm.Username, m.sm.Platform), err)
-			return
+			return err
 		}
 
 		err = ff.Yes().
@@ -138,85 +400,144 @@ func (m *M3u8) ConcatAndCleanup(pathTempWithoutExt, pathMediaWithoutExt string)
 			Format("concat").
 			VideoCodec(vCodec).
 			AudioCodec(aCodec).
-			Execute([]string{inputTxt}, outputFile)
+			Execute(ctx, []string{inputTxt}, outputFile)
 		if err != nil {
 			m.log.Error(fmt.Sprintf("[%s/%s] Failed run ffmpeg", m.sm.Username, m.sm.Platform), err)
-			return
-		}
-
-		segments, err := m.u.ExtractFilenamesFromTxt(inputTxt)
-		if err != nil {
-			m.log.Error("Extract segments failed", err)
-			return
-		}
-
-		dir := filepath.Dir(pathTempWithoutExt)
-		for _, file := range segments {
-			os.Remove(filepath.Join(dir, file))
+			return err
 		}
+		return nil
 	}
 
+	videoTxt, audioTxt := pathTempWithoutExt+"_video.txt", pathTempWithoutExt+"_audio.txt"
+	videoPath := fmt.Sprintf("%s.%s", pathTempWithoutExt, m.c.FileFormat)
+	audioPath := fmt.Sprintf("%s.%s", pathTempWithoutExt, m.getRecommendedAudioFormat(m.c.AudioCodec))
+
 	var wg sync.WaitGroup
+	var errVideo, errAudio error
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		runConcat(pathTempWithoutExt+"_video.txt", fmt.Sprintf("%s.%s", pathTempWithoutExt, m.c.FileFormat), "copy", "none")
+		errVideo = runConcat(videoTxt, videoPath, "copy", "none")
 	}()
 
 	go func() {
 		defer wg.Done()
-		runConcat(pathTempWithoutExt+"_audio.txt", fmt.Sprintf("%s.%s", pathTempWithoutExt, m.getRecommendedAudioFormat(m.c.AudioCodec)), "none", "copy")
+		errAudio = runConcat(audioTxt, audioPath, "none", "copy")
 	}()
 	wg.Wait()
+	if err := errors.Join(errVideo, errAudio); err != nil {
+		return err
+	}
 
-	if err := m.u.CreateDirectoryIfNotExist(filepath.Join(m.c.MediaPATH, m.streamDir)); err != nil {
+	if err := m.u.CreateDirectoryIfNotExist(filepath.Dir(pathMediaWithoutExt)); err != nil {
 		m.log.Error(fmt.Sprintf("[%s/%s] Failed create media directory", m.sm.Username, m.sm.Platform), err)
 	}
 
 	ffConcat, err := ffmpeg.NewFfmpeg(m.c.FFmpegPATH)
 	if err != nil {
 		m.log.Error(fmt.Sprintf("[%s/%s] Failed initialize ffmpeg", m.sm.Username, m.sm.Platform), err)
+		return err
 	}
 
+	downloadPath := fmt.Sprintf("%s_download.%s", pathMediaWithoutExt, m.c.FileFormat)
 	err = ffConcat.Yes().
 		LogLevel("warning").
 		VideoCodec("copy").
 		AudioCodec("copy").
-		Execute([]string{
-			fmt.Sprintf("%s.%s", pathTempWithoutExt, m.c.FileFormat),
-			fmt.Sprintf("%s.%s", pathTempWithoutExt, m.getRecommendedAudioFormat(m.c.AudioCodec)),
-		}, fmt.Sprintf("%s_download.%s", pathMediaWithoutExt, m.c.FileFormat))
+		Execute(ctx, []string{videoPath, audioPath}, downloadPath)
 	if err != nil {
 		m.log.Error(fmt.Sprintf("[%s/%s] Failed run ffmpeg", m.sm.Username, m.sm.Platform), err)
+		os.Remove(downloadPath)
+		return err
 	}
 
-	err = os.Rename(fmt.Sprintf("%s_download.%s", pathMediaWithoutExt, m.c.FileFormat), fmt.Sprintf("%s.%s", pathMediaWithoutExt, m.c.FileFormat))
+	err = os.Rename(downloadPath, fmt.Sprintf("%s.%s", pathMediaWithoutExt, m.c.FileFormat))
 	if err != nil {
 		m.log.Error("Failed to rename ffmpeg", err)
+		return err
 	}
+	return nil
+}
 
-	intermediates := []string{
-		fmt.Sprintf("%s.%s", pathTempWithoutExt, m.c.FileFormat),
-		fmt.Sprintf("%s.%s", pathTempWithoutExt, m.getRecommendedAudioFormat(m.c.AudioCodec)),
-		pathTempWithoutExt + "_video.txt",
-		pathTempWithoutExt + "_audio.txt",
+// remux muxes the raw MPEG-TS segments listed in the video txt straight into the output container
+// and returns the checksum of the output
+func (m *M3u8) remux(pathTempWithoutExt, pathMediaWithoutExt string, format remux.Format) (string, error) {
+	inputTxt := pathTempWithoutExt + "_video.txt"
+	segments, err := m.u.ExtractFilenamesFromTxt(inputTxt)
+	if err != nil {
+		m.log.Error("Extract segments failed", err)
+		return "", err
 	}
-	for _, file := range intermediates {
-		os.Remove(file)
+
+	dir := filepath.Dir(pathTempWithoutExt)
+	inputs := make([]string, 0, len(segments))
+	for _, file := range segments {
+		inputs = append(inputs, filepath.Join(dir, file))
 	}
 
-	m.log.Info("Segment is recorded")
+	if err := m.u.CreateDirectoryIfNotExist(filepath.Dir(pathMediaWithoutExt)); err != nil {
+		m.log.Error(fmt.Sprintf("[%s/%s] Failed create media directory", m.sm.Username, m.sm.Platform), err)
+	}
+
+	downloadPath := fmt.Sprintf("%s_download.%s", pathMediaWithoutExt, m.c.FileFormat)
+	sum, err := remux.Remux(inputs, downloadPath, format)
+	if err != nil {
+		m.log.Error(fmt.Sprintf("[%s/%s] Failed to remux segments", m.sm.Username, m.sm.Platform), err, slog.String("output", downloadPath))
+		os.Remove(downloadPath)
+		return "", err
+	}
+
+	if err := os.Rename(downloadPath, fmt.Sprintf("%s.%s", pathMediaWithoutExt, m.c.FileFormat)); err != nil {
+		m.log.Error("Failed to rename remuxed file", err)
+		return "", err
+	}
+	return sum, nil
 }
 
-func (m *M3u8) FlushTxtToDisk(pathWithoutExtension string) (string, error) {
+// FlushTxtToDisk writes the concat lists of the segments and returns the base path of the lists
+func (m *M3u8) FlushTxtToDisk(pathWithoutExtension string, pending []models.RecordingSegments) (string, error) {
 	mediaTypes := []struct {
 		fileSuffix string
-		segmentExt string
+		file       func(seg models.RecordingSegments) string
 	}{
-		{"video.txt", fmt.Sprintf(".%s", m.c.FileFormat)},
-		{"audio.txt", fmt.Sprintf(".%s", m.getRecommendedAudioFormat(m.c.AudioCodec))},
+		{"video.txt", func(seg models.RecordingSegments) string { return seg.VideoFile }},
+		{"audio.txt", func(seg models.RecordingSegments) string { return seg.AudioFile }},
+	}
+	if _, ok := m.remuxFormat(); ok {
+		// raw MPEG-TS segments carry both tracks, so a single list is enough
+		mediaTypes = mediaTypes[:1]
 	}
 
+	hash, _ := m.u.RandomToken(32, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789")
+	for _, mt := range mediaTypes {
+		filePath := pathWithoutExtension + "_" + hash + "_" + mt.fileSuffix
+		f, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			m.log.Error("Error creating segment list file", err, slog.String("path", filePath), slog.String("username", m.sm.Username), slog.String("platform", m.sm.Platform))
+			return "", err
+		}
+
+		segments := make([]string, 0, len(pending))
+		for _, seg := range pending {
+			if name := mt.file(seg); name != "" {
+				segments = append(segments, name)
+			}
+		}
+		if err := m.writeSegmentsList(f, segments); err != nil {
+			m.log.Error("Error writing segments list", err, slog.String("path", filePath), slog.String("username", m.sm.Username), slog.String("platform", m.sm.Platform))
+			f.Close()
+			return "", err
+		}
+		f.Close()
+	}
+
+	return pathWithoutExtension + "_" + hash, nil
+}
+
+// FlushDirToDisk writes the concat lists of the loose segments in the directory of the path that
+// no other list references, which is what a session recorded before the segment lists leaves behind.
+// It returns an empty path when there are no loose video segments.
+func (m *M3u8) FlushDirToDisk(pathWithoutExtension string) (string, error) {
 	dir := filepath.Dir(pathWithoutExtension)
 	entries, err := os.ReadDir(dir)
 	if err != nil {
@@ -224,6 +545,32 @@ func (m *M3u8) FlushTxtToDisk(pathWithoutExtension string) (string, error) {
 		return "", err
 	}
 
+	listed := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".txt" {
+			continue
+		}
+		files, err := m.u.ExtractFilenamesFromTxt(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			m.log.Error("Extract segments failed", err)
+			continue
+		}
+		for _, file := range files {
+			listed[file] = true
+		}
+	}
+
+	mediaTypes := []struct {
+		fileSuffix string
+		segments   []string
+	}{
+		{"video.txt", m.looseSegments(entries, fmt.Sprintf(".%s", m.c.FileFormat), listed)},
+		{"audio.txt", m.looseSegments(entries, fmt.Sprintf(".%s", m.getRecommendedAudioFormat(m.c.AudioCodec)), listed)},
+	}
+	if len(mediaTypes[0].segments) == 0 {
+		return "", nil
+	}
+
 	hash, _ := m.u.RandomToken(32, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789")
 	for _, mt := range mediaTypes {
 		filePath := pathWithoutExtension + "_" + hash + "_" + mt.fileSuffix
@@ -233,8 +580,7 @@ func (m *M3u8) FlushTxtToDisk(pathWithoutExtension string) (string, error) {
 			return "", err
 		}
 
-		segments := m.filterAndSortSegments(entries, mt.segmentExt)
-		if err := m.writeSegmentsList(f, segments); err != nil {
+		if err := m.writeSegmentsList(f, mt.segments); err != nil {
 			m.log.Error("Error writing segments list", err, slog.String("path", filePath), slog.String("username", m.sm.Username), slog.String("platform", m.sm.Platform))
 			f.Close()
 			return "", err
@@ -242,22 +588,23 @@ func (m *M3u8) FlushTxtToDisk(pathWithoutExtension string) (string, error) {
 		f.Close()
 	}
 
-	return pathWithoutExtension + "_" + hash, err
+	return pathWithoutExtension + "_" + hash, nil
 }
 
-func (m *M3u8) filterAndSortSegments(entries []os.DirEntry, ext string) []string {
+// looseSegments returns the numbered segments with the extension that are not listed, in recording order
+func (m *M3u8) looseSegments(entries []os.DirEntry, ext string, listed map[string]bool) []string {
 	var segments []string
-
 	for _, entry := range entries {
-		if !entry.IsDir() && filepath.Ext(entry.Name()) == ext {
-			segments = append(segments, entry.Name())
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ext || listed[name] || m.u.ExtractNumber(name) <= 0 {
+			continue
 		}
+		segments = append(segments, name)
 	}
 
 	sort.Slice(segments, func(i, j int) bool {
 		return m.u.ExtractNumber(segments[i]) < m.u.ExtractNumber(segments[j])
 	})
-
 	return segments
 }
 
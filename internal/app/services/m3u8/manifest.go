@@ -0,0 +1,142 @@
+package m3u8
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/services/integrity"
+	"strings"
+	"time"
+)
+
+// writeManifest writes the JSON sidecar of an output file from the journal of its part
+func (m *M3u8) writeManifest(pathTempWithoutExt, outputPath string, report *models.VerificationReport, sum string) {
+	if m.recording == nil {
+		m.log.Debug(fmt.Sprintf("[%s/%s] The recording is not journaled, manifest skipped", m.sm.Username, m.sm.Platform), slog.String("file", outputPath))
+		return
+	}
+
+	manifest, err := m.buildManifest(pathTempWithoutExt, outputPath)
+	if err != nil {
+		m.log.Error(fmt.Sprintf("[%s/%s] Failed to build manifest", m.sm.Username, m.sm.Platform), err, slog.String("file", outputPath))
+		return
+	}
+	manifest.Verification = report
+	if info, err := os.Stat(outputPath); err == nil && sum != "" {
+		manifest.Size, manifest.Sha256 = info.Size(), sum
+	}
+	if report != nil {
+		manifest.VideoCodec, manifest.AudioCodec = report.VideoCodec, report.AudioCodec
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		m.log.Error(fmt.Sprintf("[%s/%s] Failed to encode manifest", m.sm.Username, m.sm.Platform), err)
+		return
+	}
+
+	manifestPath := strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".json"
+	if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+		m.log.Error(fmt.Sprintf("[%s/%s] Failed to write manifest", m.sm.Username, m.sm.Platform), err, slog.String("path", manifestPath))
+	}
+}
+
+// checksum returns the checksum of the finished file, the manifest, the journal, the library and the upload all use
+// this sum. The remuxer hashes what it writes and the journal keeps that sum for the verify job, so only the
+// ffmpeg output and MKV, whose header is patched after writing, are read again.
+func (m *M3u8) checksum(ctx context.Context, pathTempWithoutExt, outputPath, sum string) string {
+	if sum == "" && m.recording != nil {
+		if part, err := m.rr.GetPart(pathTempWithoutExt); err == nil {
+			sum = part.Sha256
+		}
+	}
+	if sum != "" {
+		return sum
+	}
+
+	_, sum, err := integrity.Sum(ctx, outputPath)
+	if err != nil {
+		m.log.Error(fmt.Sprintf("[%s/%s] Failed to compute checksum", m.sm.Username, m.sm.Platform), err, slog.String("file", outputPath))
+		return ""
+	}
+	m.journalChecksum(pathTempWithoutExt, sum)
+	return sum
+}
+
+func (m *M3u8) buildManifest(pathTempWithoutExt, outputPath string) (*models.Manifest, error) {
+	part, err := m.rr.GetPart(pathTempWithoutExt)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := m.rr.GetRecording(part.RecordingID)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := m.rr.GetPartSegments(part.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	muxer := "ffmpeg"
+	if _, ok := m.remuxFormat(); ok {
+		muxer = "remux"
+	}
+
+	manifest := &models.Manifest{
+		Platform:         rec.Platform,
+		Username:         rec.Username,
+		Title:            part.Title,
+		Category:         part.Category,
+		File:             filepath.Base(outputPath),
+		RequestedVariant: rec.Quality,
+		Variant:          rec.Variant,
+		SegmentCount:     len(segments),
+		AdBreaks:         []models.ManifestRange{},
+		Gaps:             []models.ManifestRange{},
+		Settings: models.ManifestSettings{
+			Muxer:         muxer,
+			FileFormat:    rec.FileFormat,
+			VideoCodec:    rec.VideoCodec,
+			AudioCodec:    rec.AudioCodec,
+			FragmentedMP4: rec.FragmentedMP4,
+			Profile:       rec.Profile,
+		},
+	}
+	if len(segments) == 0 {
+		return manifest, nil
+	}
+
+	first, last := segments[0], segments[len(segments)-1]
+	manifest.StartedAt = first.StartedAt
+	manifest.EndedAt = last.StartedAt.Add(time.Duration(last.Duration * float64(time.Second)))
+	manifest.StreamOffset = first.StreamOffset
+	manifest.MediaSequence = models.ManifestRange{First: first.FirstSequence, Last: last.LastSequence}
+
+	var offset float64
+	for i, seg := range segments {
+		if seg.SkippedAds > 0 {
+			manifest.AdBreaks = append(manifest.AdBreaks, models.ManifestRange{
+				First:  seg.FirstSequence - int64(seg.SkippedAds),
+				Last:   seg.FirstSequence - 1,
+				Offset: offset,
+			})
+		}
+		if i > 0 {
+			if missing := seg.FirstSequence - segments[i-1].LastSequence - 1 - int64(seg.SkippedAds); missing > 0 {
+				manifest.Gaps = append(manifest.Gaps, models.ManifestRange{
+					First:  segments[i-1].LastSequence + 1,
+					Last:   segments[i-1].LastSequence + missing,
+					Offset: offset,
+				})
+			}
+		}
+		offset += seg.Duration
+	}
+	manifest.Duration = offset
+
+	return manifest, nil
+}
@@ -0,0 +1,63 @@
+package m3u8
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/utils"
+	"stream-recorder/pkg/logger"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestChecksum(t *testing.T) {
+	dir := t.TempDir()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "db.sqlite")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(models.Recordings{}, models.RecordingParts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	log := logger.New()
+	rr := repository.NewRecordings(log, db)
+	m, err := New(log, "twitch", "foo", false, 0, &config.Config{MediaPATH: dir, FileFormat: "mp4", DirTemplate: config.DefaultDirTemplate, FileTemplate: config.DefaultFileTemplate}, utils.New(log), nil, nil, rr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.recording = &models.Recordings{Platform: "twitch", Username: "foo", StreamDir: "s", FileFormat: "mp4", VideoCodec: "copy", AudioCodec: "copy", Status: models.RecordingStatusStopped}
+	if err := rr.Start(m.recording); err != nil {
+		t.Fatal(err)
+	}
+	tempPath, outputPath := filepath.Join(dir, "foo_temp"), filepath.Join(dir, "foo.mp4")
+	if err := rr.AddPart(&models.RecordingParts{RecordingID: m.recording.ID, TempPath: tempPath, MediaPath: filepath.Join(dir, "foo")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(outputPath, []byte("media"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileSum := sha256.Sum256([]byte("media"))
+
+	// the sum taken while the file was written is trusted and kept for the verify job
+	m.journalChecksum(tempPath, "written")
+	if got := m.checksum(context.Background(), tempPath, outputPath, ""); got != "written" {
+		t.Errorf("checksum() = %s with a journaled sum, want it without reading the file", got)
+	}
+
+	// the ffmpeg output has none, so the file is read
+	m.journalChecksum(tempPath, "")
+	if got, want := m.checksum(context.Background(), tempPath, outputPath, ""), hex.EncodeToString(fileSum[:]); got != want {
+		t.Errorf("checksum() = %s, want %s", got, want)
+	}
+	if part, err := rr.GetPart(tempPath); err != nil || part.Sha256 != hex.EncodeToString(fileSum[:]) {
+		t.Errorf("the journal holds %q, want the sum of the file", part.Sha256)
+	}
+}
@@ -1,84 +1,163 @@
 package m3u8
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"stream-recorder/internal/app/services/downloader"
+	"stream-recorder/internal/app/services/profiles"
 	"stream-recorder/pkg/ffmpeg"
-	"sync"
+	"stream-recorder/pkg/remux"
+	"time"
 )
 
-func (m *M3u8) processSegments(segments []string, baseDir string) bool {
-	if len(segments) == 0 {
+// flushTimeout bounds writing out the last buffer once the recording was stopped
+const flushTimeout = 2 * time.Minute
+
+// pendingSegment is a segment whose download was submitted but that is not written yet
+type pendingSegment struct {
+	playlistSegment
+	name   string
+	result <-chan downloader.Result
+}
+
+// processSegments downloads the new segments of the playlist and writes them in the order of their
+// sequence numbers. A stalled download does not hold up the playlist: the segments that are not done
+// after a target duration stay in flight and are written after the next refresh. Once the recording
+// is stopped every download is waited for. It reports a failed download or write.
+func (m *M3u8) processSegments(ctx context.Context, segments []playlistSegment, baseDir string) bool {
+	m.submitSegments(ctx, segments)
+	if len(m.inflight) == 0 {
 		return false
 	}
 
-	var wg sync.WaitGroup
-	var dataMap = make([][]byte, len(segments))
-	var urlMap = make([]string, len(segments))
+	var wait <-chan time.Time
+	if !m.GetIsCancel() {
+		t := time.NewTimer(*m.sm.WaitingTime)
+		defer t.Stop()
+		wait = t.C
+	}
 
-	for index, segment := range segments {
-		url := m.u.GetShortFileName(segment)
-		if m.downloadedSegments.Has(url) {
-			urlMap[index] = ""
-			continue
+	for len(m.inflight) > 0 {
+		segment := m.inflight[0]
+		var res downloader.Result
+		select {
+		case res = <-segment.result:
+		case <-wait:
+			return false
 		}
-		urlMap[index] = url
-
-		wg.Add(1)
-		go func(index int, segment string) {
-			defer wg.Done()
+		m.inflight = m.inflight[1:]
 
-			data, err := m.downloadSegment(segment)
-			if err != nil || len(data) == 0 {
-				m.log.Error(fmt.Sprintf("[%s/%s] Error downloading segment", m.sm.Username, m.sm.Platform), err, slog.String("segmentURL", segment))
-				return
+		if res.Err != nil || len(res.Data) == 0 {
+			m.log.Error(fmt.Sprintf("[%s/%s] Error downloading segment", m.sm.Username, m.sm.Platform), res.Err, slog.String("segmentURL", segment.url))
+			if err := m.u.CreateDirectoryIfNotExist(filepath.Join(m.c.TempPATH, m.streamDir)); err != nil {
+				m.log.Error(fmt.Sprintf("[%s/%s] Failed create temp directory", m.sm.Username, m.sm.Platform), err)
 			}
-			dataMap[index] = data
-		}(index, segment)
-	}
-	wg.Wait()
 
-	var isErrDownload bool
-	for i, url := range urlMap {
-		if url == "" {
-			continue
+			m.flushBuffer(ctx, baseDir)
+			return true
 		}
 
-		if len(dataMap[i]) == 0 {
-			if err := m.u.CreateDirectoryIfNotExist(filepath.Join(m.c.TempPATH, m.streamDir)); err != nil {
-				m.log.Error(fmt.Sprintf("[%s/%s] Failed create temp directory", m.sm.Username, m.sm.Platform), err)
+		// a buffer only covers consecutive sequence numbers, so that ad breaks and gaps stay visible in the journal
+		ads := m.takeAdSequences(segment.sequence)
+		if len(m.dataSegments) > 0 && (ads > 0 || segment.sequence != m.buffer.lastSequence+1) {
+			if err := m.flushBuffer(ctx, baseDir); err != nil {
+				return true
 			}
+		}
+		if len(m.dataSegments) == 0 {
+			m.buffer = segmentBuffer{firstSequence: segment.sequence, skippedAds: ads, startedAt: segment.programDateTime}
+		}
+		m.buffer.lastSequence = segment.sequence
+		m.buffer.duration += segment.duration
+		m.buffer.url = segment.name
 
-			err := m.flushSegmentToDisk(baseDir, url)
-			if err == nil {
-				m.segmentId++
-				m.dataSegments = m.dataSegments[:0]
+		m.dataSegments = append(m.dataSegments, res.Data...)
+		if len(m.dataSegments) >= m.c.BufferSize {
+			if err := m.flushBuffer(ctx, baseDir); err != nil {
+				return true
 			}
+		}
 
-			isErrDownload = true
-			break
+		m.downloadedSegments.Add(segment.name)
+	}
+	return false
+}
+
+// submitSegments starts the downloads of the segments that are neither written nor in flight
+func (m *M3u8) submitSegments(ctx context.Context, segments []playlistSegment) {
+	deadline := m.segmentDeadline()
+	for _, segment := range segments {
+		name := m.u.GetShortFileName(segment.url)
+		if m.downloadedSegments.Has(name) || slices.ContainsFunc(m.inflight, func(p pendingSegment) bool { return p.name == name }) {
+			continue
 		}
 
-		m.dataSegments = append(m.dataSegments, dataMap[i]...)
-		if len(m.dataSegments) >= m.c.BufferSize {
-			err := m.flushSegmentToDisk(baseDir, url)
-			if err != nil {
-				isErrDownload = true
-				break
+		// a segment that failed before is tried again in its place
+		i := sort.Search(len(m.inflight), func(i int) bool { return m.inflight[i].sequence > segment.sequence })
+		m.inflight = slices.Insert(m.inflight, i, pendingSegment{
+			playlistSegment: segment,
+			name:            name,
+			result:          m.dp.Submit(ctx, segment.url, deadline),
+		})
+	}
+}
+
+// takeAdSequences returns how many ad segments were skipped right before the sequence and forgets them
+func (m *M3u8) takeAdSequences(sequence int64) int {
+	var ads int
+	for seq := range m.adSequences {
+		if seq < sequence {
+			delete(m.adSequences, seq)
+			if seq > m.lastSequence {
+				ads++
 			}
-			m.segmentId++
-			m.dataSegments = m.dataSegments[:0]
 		}
+	}
+	m.lastSequence = sequence
+	return ads
+}
 
-		m.downloadedSegments.Add(url)
+// flushBuffer writes the buffered segments to disk and starts a new buffer. A buffer that could not
+// be written is kept, the next flush writes it together with the segments added in the meantime.
+func (m *M3u8) flushBuffer(ctx context.Context, baseDir string) error {
+	if len(m.dataSegments) == 0 {
+		return nil
 	}
 
-	return isErrDownload
+	if err := m.flushSegmentToDisk(ctx, baseDir); err != nil {
+		return err
+	}
+	m.segmentId++
+	m.dataSegments = m.dataSegments[:0]
+	return nil
 }
 
-func (m *M3u8) flushSegmentToDisk(baseDir, url string) error {
+// flushSegmentToDisk writes the buffer under the name of its last segment and journals the files.
+// The buffer holds media that was already downloaded, so a stopped recording still writes it out.
+func (m *M3u8) flushSegmentToDisk(ctx context.Context, baseDir string) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), flushTimeout)
+	defer cancel()
+
+	duration := m.bufferDuration()
+	url := m.buffer.url
+
+	if _, ok := m.remuxFormat(); ok {
+		tsPath := filepath.Join(baseDir, fmt.Sprintf("%d_%s.ts", m.segmentId, url))
+		if err := os.WriteFile(tsPath, m.dataSegments, 0644); err != nil {
+			m.log.Error(fmt.Sprintf("[%s/%s] Failed to write segment to file", m.sm.Username, m.sm.Platform), err, slog.String("filePath", tsPath))
+			return err
+		}
+		m.journalSegment(filepath.Base(tsPath), "", int64(len(m.dataSegments)), duration)
+		return nil
+	}
+
 	tsPath := filepath.Join(baseDir, fmt.Sprintf("%d_%s_temp.ts", m.segmentId, url))
 	videoPath := filepath.Join(baseDir, fmt.Sprintf("%d_%s.%s", m.segmentId, url, m.c.FileFormat))
 	audioPath := filepath.Join(baseDir, fmt.Sprintf("%d_%s.%s", m.segmentId, url, m.getRecommendedAudioFormat(m.c.AudioCodec)))
@@ -95,29 +174,53 @@ func (m *M3u8) flushSegmentToDisk(baseDir, url string) error {
 		return err
 	}
 
-	err = segmentFFmpeg.Yes().
-		LogLevel("error").
-		VideoCodec(m.c.VideoCodec).
-		AudioCodec("none").
-		Execute([]string{tsPath}, videoPath)
-	if err != nil {
-		m.log.Error(fmt.Sprintf("[%s/%s] Failed run ffmpeg", m.sm.Username, m.sm.Platform), err)
+	segmentFFmpeg.Yes().LogLevel("error").AudioCodec("none")
+	errVideo := profiles.ApplyVideo(segmentFFmpeg, m.profile).Execute(ctx, []string{tsPath}, videoPath)
+	if errVideo != nil {
+		m.log.Error(fmt.Sprintf("[%s/%s] Failed run ffmpeg", m.sm.Username, m.sm.Platform), errVideo)
 	}
 
 	segmentFFmpeg.Clear()
 
-	err = segmentFFmpeg.Yes().
-		LogLevel("error").
-		VideoCodec("none").
-		AudioCodec(m.c.AudioCodec).
-		Execute([]string{tsPath}, audioPath)
-	if err != nil {
-		m.log.Error(fmt.Sprintf("[%s/%s] Failed run ffmpeg", m.sm.Username, m.sm.Platform), err)
+	segmentFFmpeg.Yes().LogLevel("error").VideoCodec("none")
+	errAudio := profiles.ApplyAudio(segmentFFmpeg, m.profile).Execute(ctx, []string{tsPath}, audioPath)
+	if errAudio != nil {
+		m.log.Error(fmt.Sprintf("[%s/%s] Failed run ffmpeg", m.sm.Username, m.sm.Platform), errAudio)
 	}
 
 	if err := os.Remove(tsPath); err != nil {
 		m.log.Error(fmt.Sprintf("[%s/%s] Failed to remove temp file", m.sm.Username, m.sm.Platform), err)
 	}
 
+	// a half written pair must not be journaled, the buffer is written again by the next flush
+	if err := errors.Join(errVideo, errAudio); err != nil {
+		os.Remove(videoPath)
+		os.Remove(audioPath)
+		return err
+	}
+
+	m.journalSegment(filepath.Base(videoPath), filepath.Base(audioPath), fileSize(videoPath)+fileSize(audioPath), duration)
 	return nil
 }
+
+// bufferDuration is the EXTINF duration of the buffered segments, the media is only measured
+// when the playlist does not provide it
+func (m *M3u8) bufferDuration() time.Duration {
+	if m.buffer.duration > 0 {
+		return m.buffer.duration
+	}
+
+	duration, err := remux.Duration(bytes.NewReader(m.dataSegments))
+	if err != nil {
+		m.log.Warn(fmt.Sprintf("[%s/%s] Failed to measure segment duration", m.sm.Username, m.sm.Platform), slog.String("error", err.Error()))
+	}
+	return duration
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
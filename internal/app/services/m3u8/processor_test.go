@@ -0,0 +1,61 @@
+package m3u8
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/services/downloader"
+	"stream-recorder/internal/app/services/utils"
+	"stream-recorder/pkg/logger"
+	"testing"
+	"time"
+)
+
+func TestProcessSegmentsInFlight(t *testing.T) {
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/1.ts" {
+			<-unblock
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	log := logger.New()
+	cfg := &config.Config{TempPATH: t.TempDir(), BufferSize: 1 << 20, DownloadWorkers: 4, DownloadHostLimit: 4,
+		DirTemplate: config.DefaultDirTemplate, FileTemplate: config.DefaultFileTemplate}
+	m, err := New(log, "twitch", "foo", false, 0, cfg, utils.New(log), downloader.New(log, cfg), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*m.sm.WaitingTime = 100 * time.Millisecond
+
+	segments := []playlistSegment{{url: srv.URL + "/1.ts", sequence: 1}, {url: srv.URL + "/2.ts", sequence: 2}}
+
+	// the stalled first segment holds up the playlist for a target duration at most
+	start := time.Now()
+	if m.processSegments(context.Background(), segments, cfg.TempPATH) {
+		t.Fatal("processSegments() reported an error for a slow download")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("processSegments() waited %s for the stalled segment", elapsed)
+	}
+	if len(m.dataSegments) != 0 || len(m.inflight) != 2 {
+		t.Fatalf("%d bytes are buffered and %d segments in flight, want nothing written and both in flight", len(m.dataSegments), len(m.inflight))
+	}
+
+	// the next refresh does not download them again and writes them in order
+	close(unblock)
+	segments = append(segments, playlistSegment{url: srv.URL + "/3.ts", sequence: 3})
+	m.ChangeIsCancel(true)
+	if m.processSegments(context.Background(), segments, cfg.TempPATH) {
+		t.Fatal("processSegments() reported an error")
+	}
+	if got, want := string(m.dataSegments), "/1.ts/2.ts/3.ts"; got != want {
+		t.Errorf("buffered %q, want %q", got, want)
+	}
+	if len(m.inflight) != 0 || m.buffer.firstSequence != 1 || m.buffer.lastSequence != 3 {
+		t.Errorf("%d segments are in flight and the buffer covers %d-%d, want none and 1-3", len(m.inflight), m.buffer.firstSequence, m.buffer.lastSequence)
+	}
+}
@@ -0,0 +1,242 @@
+package m3u8
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/services/streamlink"
+	"strings"
+	"time"
+)
+
+var ErrNotReplay = errors.New("the recording is not in replay mode")
+
+// replayRequest asks the recording loop to save the end of the replay buffer as a clip
+type replayRequest struct {
+	length time.Duration
+	reason string
+}
+
+// SetReplay switches the recording to the instant-replay mode: only the last minutes stay on disk
+// and a clip is saved when SaveReplay is called or a chat message contains one of the comma separated keywords
+func (m *M3u8) SetReplay(minutes int, keywords string) {
+	m.replay = time.Duration(max(minutes, 0)) * time.Minute
+
+	m.replayKeywords = m.replayKeywords[:0]
+	for _, keyword := range strings.Split(keywords, ",") {
+		if keyword = strings.ToLower(strings.TrimSpace(keyword)); keyword != "" {
+			m.replayKeywords = append(m.replayKeywords, keyword)
+		}
+	}
+}
+
+// SaveReplay requests a clip of the last minutes of the replay buffer, the whole buffer is saved
+// when minutes is zero or longer than the buffer
+func (m *M3u8) SaveReplay(minutes int) error {
+	if m.replay == 0 {
+		return ErrNotReplay
+	}
+
+	length := time.Duration(minutes) * time.Minute
+	if length <= 0 || length > m.replay {
+		length = m.replay
+	}
+	m.requestReplay(length, "api")
+	return nil
+}
+
+func (m *M3u8) requestReplay(length time.Duration, reason string) {
+	m.muReplay.Lock()
+	defer m.muReplay.Unlock()
+
+	m.replayRequests = append(m.replayRequests, replayRequest{length: length, reason: reason})
+}
+
+// saveReplays writes out the clips requested since the previous pass of the recording loop
+func (m *M3u8) saveReplays(ctx context.Context, baseDir string) {
+	m.muReplay.Lock()
+	requests := m.replayRequests
+	m.replayRequests = nil
+	m.muReplay.Unlock()
+
+	if len(requests) == 0 {
+		return
+	}
+
+	// the newest data is still in memory
+	m.flushBuffer(ctx, baseDir)
+
+	for _, r := range requests {
+		if err := m.saveReplay(ctx, baseDir, r.length); err != nil {
+			m.log.Error(fmt.Sprintf("[%s/%s] Failed to save replay", m.sm.Username, m.sm.Platform), err, slog.String("reason", r.reason))
+			continue
+		}
+		m.log.Info(fmt.Sprintf("[%s/%s] Replay saved", m.sm.Username, m.sm.Platform), slog.String("reason", r.reason), slog.Duration("length", r.length))
+	}
+}
+
+// saveReplay links the newest segments that cover the length under names of their own and finalizes
+// them as a part, so the clip keeps its files when the buffer moves on
+func (m *M3u8) saveReplay(ctx context.Context, baseDir string, length time.Duration) error {
+	start := len(m.pendingSegments)
+	var covered time.Duration
+	for start > 0 && covered < length {
+		start--
+		covered += segmentDuration(m.pendingSegments[start])
+	}
+	if start == len(m.pendingSegments) {
+		return errors.New("the replay buffer is empty")
+	}
+
+	first := m.pendingSegments[start]
+	m.partNumber++
+	pathTempWithoutExt, pathMediaWithoutExt := m.generateFilePaths(m.streamDir, first.StartedAt, time.Duration(first.StreamOffset*float64(time.Second)))
+
+	prefix := fmt.Sprintf("clip%d_", m.partNumber)
+	clip := make([]models.RecordingSegments, 0, len(m.pendingSegments)-start)
+	for _, seg := range m.pendingSegments[start:] {
+		if err := linkSegment(baseDir, seg.VideoFile, prefix+seg.VideoFile); err != nil {
+			return err
+		}
+		seg.VideoFile = prefix + seg.VideoFile
+		if seg.AudioFile != "" {
+			if err := linkSegment(baseDir, seg.AudioFile, prefix+seg.AudioFile); err != nil {
+				return err
+			}
+			seg.AudioFile = prefix + seg.AudioFile
+		}
+
+		seg.ID, seg.PartID = 0, 0
+		if m.recording != nil {
+			m.rr.AddSegment(&seg)
+		}
+		clip = append(clip, seg)
+	}
+
+	pathTempWithoutExtHash, err := m.writePart(pathTempWithoutExt, pathMediaWithoutExt, clip)
+	if err != nil {
+		return err
+	}
+	m.enqueueFinalize(ctx, pathTempWithoutExtHash, pathMediaWithoutExt)
+	return nil
+}
+
+// trimReplay drops the oldest segments of the buffer as long as the remaining ones still cover it
+func (m *M3u8) trimReplay() {
+	var total time.Duration
+	for _, seg := range m.pendingSegments {
+		total += segmentDuration(seg)
+	}
+
+	n := 0
+	for n < len(m.pendingSegments) && total-segmentDuration(m.pendingSegments[n]) >= m.replay {
+		total -= segmentDuration(m.pendingSegments[n])
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	m.dropSegments(m.pendingSegments[:n])
+	m.pendingSegments = append(m.pendingSegments[:0], m.pendingSegments[n:]...)
+}
+
+// discardReplay removes the whole buffer, the clips saved from it are not affected
+func (m *M3u8) discardReplay() {
+	m.dropSegments(m.pendingSegments)
+	m.pendingSegments = m.pendingSegments[:0]
+}
+
+func (m *M3u8) dropSegments(segments []models.RecordingSegments) {
+	dir := filepath.Join(m.c.TempPATH, m.streamDir)
+
+	ids := make([]int, 0, len(segments))
+	for _, seg := range segments {
+		os.Remove(filepath.Join(dir, seg.VideoFile))
+		if seg.AudioFile != "" {
+			os.Remove(filepath.Join(dir, seg.AudioFile))
+		}
+		if seg.ID != 0 {
+			ids = append(ids, seg.ID)
+		}
+	}
+	m.rr.DeleteSegments(ids)
+}
+
+// watchChat saves the replay buffer when a chat message contains one of the keywords.
+// The keywords are ignored for ReplayCooldown seconds after a clip, a highlight is usually spammed.
+func (m *M3u8) watchChat(ctx context.Context) {
+	if m.replay == 0 || len(m.replayKeywords) == 0 {
+		return
+	}
+
+	reader, ok := m.sl.Platform.(streamlink.ChatReader)
+	if !ok {
+		m.log.Warn(fmt.Sprintf("[%s/%s] The chat of the platform cannot be read, the replay keywords are ignored", m.sm.Username, m.sm.Platform))
+		return
+	}
+
+	for ctx.Err() == nil {
+		err := reader.ReadChat(ctx, m.sm.Username, m.matchKeywords)
+		if ctx.Err() != nil {
+			return
+		}
+		m.log.Warn(fmt.Sprintf("[%s/%s] Lost the chat connection, reconnecting", m.sm.Username, m.sm.Platform), slog.String("error", err.Error()))
+		m.sleep(ctx, 10*time.Second)
+	}
+}
+
+func (m *M3u8) matchKeywords(text string) {
+	text = strings.ToLower(text)
+	for _, keyword := range m.replayKeywords {
+		if !strings.Contains(text, keyword) {
+			continue
+		}
+
+		m.muReplay.Lock()
+		ready := time.Since(m.lastKeywordAt) >= time.Duration(m.c.ReplayCooldown)*time.Second
+		if ready {
+			m.lastKeywordAt = time.Now()
+		}
+		m.muReplay.Unlock()
+
+		if ready {
+			m.requestReplay(m.replay, "keyword "+keyword)
+		}
+		return
+	}
+}
+
+func segmentDuration(seg models.RecordingSegments) time.Duration {
+	return time.Duration(seg.Duration * float64(time.Second))
+}
+
+// linkSegment gives a segment a second name in the same directory, it is copied when the file system has no hard links
+func linkSegment(dir, name, link string) error {
+	src, dst := filepath.Join(dir, name), filepath.Join(dir, link)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
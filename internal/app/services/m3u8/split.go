@@ -0,0 +1,112 @@
+package m3u8
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"stream-recorder/internal/app/models"
+	"time"
+)
+
+// SetSplitPolicy enables the per streamer split rules on top of the duration based split:
+// a maximum part size, wall-clock boundaries aligned to local midnight and metadata changes
+func (m *M3u8) SetSplitPolicy(maxSizeMB, clockMinutes int, onCategory, onTitle bool) {
+	m.splitSize = int64(maxSizeMB) * 1024 * 1024
+	m.splitClock = time.Duration(min(max(clockMinutes, 0), 24*60)) * time.Minute
+	m.splitOnCategory = onCategory
+	m.splitOnTitle = onTitle
+}
+
+// splitReason reports why the current part has to be closed, an empty string means it goes on
+func (m *M3u8) splitReason() string {
+	if len(m.pendingSegments) == 0 {
+		// nothing is recorded yet, so the new metadata applies to the coming part right away
+		m.applyStreamInfo()
+		return ""
+	}
+
+	if m.sm.SplitSegments && m.partDuration >= time.Duration(m.sm.TimeSegment)*time.Second {
+		return "duration"
+	}
+	if m.splitSize > 0 && m.partBytes >= m.splitSize {
+		return "size"
+	}
+	if m.splitClock > 0 && !m.wallClock.Before(nextBoundary(m.partStartedAt, m.splitClock, m.loc)) {
+		return "wall-clock boundary"
+	}
+
+	m.muInfo.Lock()
+	defer m.muInfo.Unlock()
+	if m.nextInfo != nil {
+		return "stream info change"
+	}
+	return ""
+}
+
+// nextBoundary returns the first multiple of interval counted from local midnight that comes after t
+func nextBoundary(t time.Time, interval time.Duration, loc *time.Location) time.Time {
+	local := t.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	n := local.Sub(midnight)/interval + 1
+	return midnight.Add(n * interval)
+}
+
+// applyStreamInfo switches to the metadata that caused the split, so that the next part is named after it
+func (m *M3u8) applyStreamInfo() {
+	m.muInfo.Lock()
+	defer m.muInfo.Unlock()
+
+	if m.nextInfo != nil {
+		m.info = *m.nextInfo
+		m.nextInfo = nil
+	}
+}
+
+// watchStreamInfo polls the channel metadata while recording and requests a split
+// when the category or the title changes
+func (m *M3u8) watchStreamInfo(ctx context.Context) {
+	if !m.splitOnCategory && !m.splitOnTitle {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(m.c.TimeCheck) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := m.sl.Platform.GetStreamInfo(ctx, m.sm.Username)
+		if err != nil {
+			continue
+		}
+		m.compareStreamInfo(info)
+	}
+}
+
+func (m *M3u8) compareStreamInfo(info models.StreamInfo) {
+	m.muInfo.Lock()
+	defer m.muInfo.Unlock()
+
+	if m.info == (models.StreamInfo{}) {
+		m.info = info
+		return
+	}
+
+	current := m.info
+	if m.nextInfo != nil {
+		current = *m.nextInfo
+	}
+	categoryChanged := m.splitOnCategory && info.Category != current.Category
+	titleChanged := m.splitOnTitle && info.Title != current.Title
+	if !categoryChanged && !titleChanged {
+		return
+	}
+
+	m.log.Info(fmt.Sprintf("[%s/%s] The stream info has changed, the recording will be split", m.sm.Username, m.sm.Platform),
+		slog.String("category", info.Category), slog.String("title", info.Title))
+	m.nextInfo = &info
+}
@@ -0,0 +1,93 @@
+package m3u8
+
+import (
+	"stream-recorder/internal/app/models"
+	"stream-recorder/pkg/logger"
+	"testing"
+	"time"
+)
+
+func TestNextBoundary(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		at       time.Time
+		interval time.Duration
+		want     time.Time
+	}{
+		{time.Date(2026, 1, 2, 10, 15, 0, 0, loc), time.Hour, time.Date(2026, 1, 2, 11, 0, 0, 0, loc)},
+		{time.Date(2026, 1, 2, 11, 0, 0, 0, loc), time.Hour, time.Date(2026, 1, 2, 12, 0, 0, 0, loc)},
+		{time.Date(2026, 1, 2, 10, 15, 0, 0, loc), 3 * time.Hour, time.Date(2026, 1, 2, 12, 0, 0, 0, loc)},
+		{time.Date(2026, 1, 2, 23, 30, 0, 0, loc), 24 * time.Hour, time.Date(2026, 1, 3, 0, 0, 0, 0, loc)},
+		// the boundaries are counted in the local time of loc
+		{time.Date(2026, 1, 2, 23, 30, 0, 0, time.UTC), 24 * time.Hour, time.Date(2026, 1, 4, 0, 0, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		if got := nextBoundary(tt.at, tt.interval, loc); !got.Equal(tt.want) {
+			t.Errorf("nextBoundary(%s, %s) = %s, want %s", tt.at, tt.interval, got, tt.want)
+		}
+	}
+}
+
+func TestSplitReason(t *testing.T) {
+	log := logger.New()
+	start := time.Date(2026, 1, 2, 10, 15, 0, 0, time.UTC)
+	newM3u8 := func() *M3u8 {
+		m := &M3u8{log: log, sm: &models.StreamMetadata{}, loc: time.UTC, partStartedAt: start, wallClock: start.Add(time.Minute)}
+		m.pendingSegments = []models.RecordingSegments{{}}
+		return m
+	}
+
+	tests := []struct {
+		name  string
+		setup func(m *M3u8)
+		want  string
+	}{
+		{"nothing is due", func(m *M3u8) { m.SetSplitPolicy(100, 60, true, true) }, ""},
+		{"duration", func(m *M3u8) {
+			m.sm.SplitSegments, m.sm.TimeSegment = true, 60
+			m.partDuration = time.Minute
+		}, "duration"},
+		{"size", func(m *M3u8) {
+			m.SetSplitPolicy(100, 0, false, false)
+			m.partBytes = 100 * 1024 * 1024
+		}, "size"},
+		{"below the size", func(m *M3u8) {
+			m.SetSplitPolicy(100, 0, false, false)
+			m.partBytes = 100*1024*1024 - 1
+		}, ""},
+		{"wall-clock boundary", func(m *M3u8) {
+			m.SetSplitPolicy(0, 60, false, false)
+			m.wallClock = time.Date(2026, 1, 2, 11, 0, 0, 0, time.UTC)
+		}, "wall-clock boundary"},
+		{"stream info change", func(m *M3u8) {
+			m.SetSplitPolicy(0, 0, true, false)
+			m.compareStreamInfo(models.StreamInfo{Category: "a", Title: "x"})
+			m.compareStreamInfo(models.StreamInfo{Category: "a", Title: "y"})
+			if m.nextInfo != nil {
+				t.Error("a title change requested a split although only category changes split")
+			}
+			m.compareStreamInfo(models.StreamInfo{Category: "b", Title: "y"})
+		}, "stream info change"},
+	}
+	for _, tt := range tests {
+		m := newM3u8()
+		tt.setup(m)
+		if got := m.splitReason(); got != tt.want {
+			t.Errorf("%s: splitReason() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// before the first segment the new metadata is taken over without a split
+	m := newM3u8()
+	m.pendingSegments = nil
+	m.SetSplitPolicy(0, 0, true, false)
+	m.info = models.StreamInfo{Category: "a"}
+	m.compareStreamInfo(models.StreamInfo{Category: "b"})
+	if got := m.splitReason(); got != "" || m.info.Category != "b" || m.nextInfo != nil {
+		t.Errorf("splitReason() without segments = %q with category %q, want no split and category b", got, m.info.Category)
+	}
+}
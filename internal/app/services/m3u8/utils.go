@@ -2,14 +2,122 @@ package m3u8
 
 import (
 	"fmt"
+	"log/slog"
+	"os"
 	"path/filepath"
+	"strconv"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/pkg/pathtemplate"
+	"stream-recorder/pkg/remux"
 	"strings"
+	"time"
 )
 
-func (m *M3u8) generateFilePaths(streamDir string) (string, string) {
-	fileName := fmt.Sprintf("%s_%s_%s", m.sm.Platform, m.sm.Username, m.u.FormatDuration(*m.sm.StartDurationStream))
+// generateFilePaths renders the directory and file templates for the part that starts at the
+// given wall-clock time and stream offset. The temp files keep living in the session directory under the same file name.
+func (m *M3u8) generateFilePaths(streamDir string, startedAt time.Time, offset time.Duration) (string, string) {
+	m.muInfo.Lock()
+	info := m.info
+	m.muInfo.Unlock()
 
-	return filepath.Join(m.c.TempPATH, streamDir, fileName), filepath.Join(m.c.MediaPATH, streamDir, fileName)
+	displayName := info.DisplayName
+	if displayName == "" {
+		displayName = m.sm.Username
+	}
+
+	vars := map[string]string{
+		"platform":     m.sm.Platform,
+		"username":     m.sm.Username,
+		"display_name": displayName,
+		"title":        info.Title,
+		"category":     info.Category,
+		"offset":       m.u.FormatDuration(offset),
+		"part":         strconv.Itoa(m.partNumber),
+		"quality":      m.quality,
+	}
+	at := startedAt.In(m.loc)
+
+	pathMedia := filepath.Join(m.c.MediaPATH, m.dirTemplate.Render(vars, at), m.fileTemplate.Render(vars, at))
+	pathMedia = m.uniqueMediaPath(pathMedia)
+	m.usedMediaPaths[pathMedia] = true
+
+	return filepath.Join(m.c.TempPATH, streamDir, filepath.Base(pathMedia)), pathMedia
+}
+
+// uniqueMediaPath adds a counter when a template renders a name that is already taken
+func (m *M3u8) uniqueMediaPath(pathMedia string) string {
+	candidate := pathMedia
+	for i := 2; ; i++ {
+		if !m.usedMediaPaths[candidate] && !m.mediaPathTaken(candidate) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s_%d", pathMedia, i)
+	}
+}
+
+// mediaPathTaken reports whether a file of any container or a sidecar carries the name, or the journal
+// holds a part with it. The journal covers parts that are still being finalized or were uploaded and removed.
+func (m *M3u8) mediaPathTaken(pathMediaWithoutExt string) bool {
+	dir, name := filepath.Split(pathMediaWithoutExt)
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), name+".") {
+			return true
+		}
+	}
+
+	journaled, err := m.rr.HasMediaPath(pathMediaWithoutExt)
+	if err != nil {
+		m.log.Warn(fmt.Sprintf("[%s/%s] Failed to look up the media path in the journal", m.sm.Username, m.sm.Platform), slog.String("path", pathMediaWithoutExt), slog.String("error", err.Error()))
+		return false
+	}
+	return journaled
+}
+
+// SetTemplates overrides the global directory and file templates and the timezone,
+// empty values keep the global settings
+func (m *M3u8) SetTemplates(dirTemplate, fileTemplate, timezone string) error {
+	if dirTemplate != "" {
+		t, err := pathtemplate.Parse(dirTemplate, config.TemplatePlaceholders...)
+		if err != nil {
+			return fmt.Errorf("invalid directory template: %w", err)
+		}
+		m.dirTemplate = t
+	}
+	if fileTemplate != "" {
+		t, err := pathtemplate.Parse(fileTemplate, config.TemplatePlaceholders...)
+		if err != nil {
+			return fmt.Errorf("invalid file template: %w", err)
+		}
+		m.fileTemplate = t
+	}
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone: %w", err)
+		}
+		m.loc = loc
+	}
+	return nil
+}
+
+// SetStreamInfo updates the channel metadata used by the templates of the next part
+func (m *M3u8) SetStreamInfo(info models.StreamInfo) {
+	m.muInfo.Lock()
+	defer m.muInfo.Unlock()
+
+	m.info = info
+}
+
+// remuxFormat reports whether segments can be remuxed natively instead of going through ffmpeg,
+// which is the case when no transcoding is requested and the container is supported
+func (m *M3u8) remuxFormat() (remux.Format, bool) {
+	if m.c.VideoCodec != "copy" || m.c.AudioCodec != "copy" {
+		return "", false
+	}
+
+	return remux.ParseFormat(m.c.FileFormat, m.c.FragmentedMP4)
 }
 
 func (m *M3u8) getRecommendedAudioFormat(codec string) string {
@@ -54,9 +162,13 @@ func (m *M3u8) GetIsCancel() bool {
 	return m.isCancel
 }
 
+// ChangeIsCancel marks the recording as cancelled and interrupts whatever Run is waiting on
 func (m *M3u8) ChangeIsCancel(value bool) {
 	m.muCancel.Lock()
 	defer m.muCancel.Unlock()
 
 	m.isCancel = value
+	if value && m.cancel != nil {
+		m.cancel()
+	}
 }
@@ -0,0 +1,70 @@
+package m3u8
+
+import (
+	"os"
+	"path/filepath"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/utils"
+	"stream-recorder/pkg/logger"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMain(m *testing.M) {
+	// the logger writes to logs/ in the working directory
+	dir, err := os.MkdirTemp("", "m3u8")
+	if err != nil {
+		panic(err)
+	}
+	os.Chdir(dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestUniqueMediaPath(t *testing.T) {
+	dir := t.TempDir()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "db.sqlite")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(models.Recordings{}, models.RecordingParts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	log := logger.New()
+	cfg := &config.Config{MediaPATH: dir, FileFormat: "mp4", DirTemplate: config.DefaultDirTemplate, FileTemplate: config.DefaultFileTemplate}
+	rr := repository.NewRecordings(log, db)
+	m, err := New(log, "twitch", "foo", false, 0, cfg, utils.New(log), nil, nil, rr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := filepath.Join(dir, "foo")
+	if got := m.uniqueMediaPath(base); got != base {
+		t.Fatalf("uniqueMediaPath() = %s for a free name, want %s", got, base)
+	}
+
+	// another container, a sidecar, a journaled part and a part of this recording take a name
+	for _, file := range []string{"foo.mkv", "foo_2.json", "foo_20.mp4"} {
+		if err := os.WriteFile(filepath.Join(dir, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec := &models.Recordings{Platform: "twitch", Username: "foo", StreamDir: "s", FileFormat: "mp4", VideoCodec: "copy", AudioCodec: "copy", Status: models.RecordingStatusStopped}
+	if err := rr.Start(rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := rr.AddPart(&models.RecordingParts{RecordingID: rec.ID, TempPath: "t", MediaPath: base + "_3"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	m.usedMediaPaths[base+"_4"] = true
+
+	if got, want := m.uniqueMediaPath(base), base+"_5"; got != want {
+		t.Errorf("uniqueMediaPath() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,212 @@
+package m3u8
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/pkg/ffmpeg"
+	"strings"
+	"time"
+)
+
+// verify probes the finished file and compares it with what was recorded: the tracks of the variant
+// with the expected codecs, the duration of the journaled segments and the A/V alignment
+func (m *M3u8) verify(ctx context.Context, pathTempWithoutExt, outputPath string) (*models.VerificationReport, error) {
+	if !m.c.VerifyRecordings {
+		return nil, nil
+	}
+
+	report := m.probeReport(ctx, outputPath, m.expectedDuration(pathTempWithoutExt))
+	if data, err := json.Marshal(report); err == nil && m.recording != nil {
+		m.rr.UpdatePartVerification(pathTempWithoutExt, report.Status, string(data))
+	}
+
+	switch report.Status {
+	case models.VerificationSkipped:
+		m.log.Warn(fmt.Sprintf("[%s/%s] Verification skipped", m.sm.Username, m.sm.Platform), slog.String("file", outputPath), slog.Any("problems", report.Problems))
+		return &report, nil
+	case models.VerificationFailed:
+		m.log.Error(fmt.Sprintf("[%s/%s] Verification failed, the temp files are kept for a retry", m.sm.Username, m.sm.Platform), nil,
+			slog.String("file", outputPath), slog.Any("problems", report.Problems))
+		return &report, fmt.Errorf("verification failed: %s", strings.Join(report.Problems, "; "))
+	}
+
+	m.log.Debug(fmt.Sprintf("[%s/%s] Verification passed", m.sm.Username, m.sm.Platform), slog.String("file", outputPath),
+		slog.Float64("duration", report.Duration), slog.Float64("expected_duration", report.ExpectedDuration), slog.Float64("av_desync", report.AVDesync))
+	return &report, nil
+}
+
+func (m *M3u8) expectedDuration(pathTempWithoutExt string) float64 {
+	if m.recording == nil {
+		return 0
+	}
+
+	part, err := m.rr.GetPart(pathTempWithoutExt)
+	if err != nil {
+		return 0
+	}
+	return part.ExpectedDuration
+}
+
+func (m *M3u8) probeReport(ctx context.Context, outputPath string, expected float64) models.VerificationReport {
+	report := models.VerificationReport{
+		Status:           models.VerificationPassed,
+		File:             outputPath,
+		ExpectedDuration: expected,
+		CheckedAt:        time.Now(),
+	}
+
+	ffprobe, err := ffmpeg.NewFfprobe(m.c.FFprobePATH)
+	if err != nil {
+		report.Status = models.VerificationSkipped
+		report.Problems = append(report.Problems, err.Error())
+		return report
+	}
+
+	result, err := ffprobe.Probe(ctx, outputPath)
+	if err != nil {
+		report.Status = models.VerificationFailed
+		report.Problems = append(report.Problems, fmt.Sprintf("file is not readable: %v", err))
+		return report
+	}
+
+	report.Format = result.Format.FormatName
+	report.Duration = result.DurationSeconds()
+	if report.Duration <= 0 {
+		report.Problems = append(report.Problems, "file has no duration")
+	}
+
+	video, audio := result.Stream("video"), result.Stream("audio")
+	wantVideo, wantAudio := m.expectedStreams()
+	if video == nil && audio == nil {
+		report.Problems = append(report.Problems, "file has no audio or video stream")
+	}
+	if video == nil {
+		if wantVideo {
+			report.Problems = append(report.Problems, "video stream is missing")
+		}
+	} else {
+		report.VideoCodec, report.Width, report.Height = video.CodecName, video.Width, video.Height
+		if !codecMatches(m.c.VideoCodec, video.CodecName, "h264", "hevc") {
+			report.Problems = append(report.Problems, fmt.Sprintf("video codec is %s, expected %s", video.CodecName, m.c.VideoCodec))
+		}
+	}
+	if audio == nil {
+		if wantAudio {
+			report.Problems = append(report.Problems, "audio stream is missing")
+		}
+	} else {
+		report.AudioCodec = audio.CodecName
+		if !codecMatches(m.c.AudioCodec, audio.CodecName, "aac") {
+			report.Problems = append(report.Problems, fmt.Sprintf("audio codec is %s, expected %s", audio.CodecName, m.c.AudioCodec))
+		}
+	}
+
+	// a couple of frames are lost or gained at segment joins, anything beyond that means missing media
+	if expected > 0 {
+		tolerance := max(2, expected*0.01)
+		if diff := math.Abs(report.Duration - expected); diff > tolerance {
+			report.Problems = append(report.Problems, fmt.Sprintf("duration is %.2fs, expected %.2fs", report.Duration, expected))
+		}
+	}
+
+	if video != nil && audio != nil {
+		report.AVDesync = avDesync(video, audio)
+		if limit := float64(m.c.MaxAVDesync) / 1000; report.AVDesync > limit {
+			report.Problems = append(report.Problems, fmt.Sprintf("audio and video drift apart by %.3fs", report.AVDesync))
+		}
+	}
+
+	if len(report.Problems) > 0 {
+		report.Status = models.VerificationFailed
+	}
+	return report
+}
+
+// expectedStreams tells which tracks the recorded variant carries. The codecs the playlist advertised
+// decide, without them the audio_only variant is the one without video. Nothing is expected of a part
+// whose variant is not known, like one recovered from the temp files alone.
+func (m *M3u8) expectedStreams() (video, audio bool) {
+	quality, variant := m.quality, m.variant
+	if m.recording != nil {
+		quality, variant = m.recording.Quality, m.recording.Variant
+	}
+
+	if variant.Codecs != "" {
+		for _, codec := range strings.Split(variant.Codecs, ",") {
+			switch strings.SplitN(strings.TrimSpace(codec), ".", 2)[0] {
+			case "avc1", "avc3", "hvc1", "hev1", "vp09", "av01":
+				video = true
+			case "mp4a", "ac-3", "ec-3", "opus", "fLaC":
+				audio = true
+			}
+		}
+		return video, audio
+	}
+
+	name := variant.Name
+	if name == "" {
+		name = quality
+	}
+	switch name {
+	case "":
+		return false, false
+	case "audio_only":
+		return false, true
+	}
+	return true, true
+}
+
+// avDesync is the largest offset between the tracks at the start or at the end of the file
+func avDesync(video, audio *ffmpeg.ProbeStream) float64 {
+	desync := math.Abs(video.StartSeconds() - audio.StartSeconds())
+
+	videoDuration, audioDuration := video.DurationSeconds(), audio.DurationSeconds()
+	if videoDuration > 0 && audioDuration > 0 {
+		videoEnd := video.StartSeconds() + videoDuration
+		audioEnd := audio.StartSeconds() + audioDuration
+		desync = max(desync, math.Abs(videoEnd-audioEnd))
+	}
+	return desync
+}
+
+// codecMatches compares the codec reported by ffprobe with the configured encoder,
+// a stream copy has to keep one of the codecs the platforms deliver
+func codecMatches(encoder, codecName string, copyCodecs ...string) bool {
+	encoder = strings.ToLower(strings.TrimSpace(encoder))
+	if encoder == "copy" {
+		for _, c := range copyCodecs {
+			if codecName == c {
+				return true
+			}
+		}
+		return false
+	}
+
+	return codecName == encoderCodecName(encoder)
+}
+
+func encoderCodecName(encoder string) string {
+	switch encoder {
+	case "libx264", "h264_nvenc", "h264_qsv", "h264_vaapi", "h264_videotoolbox", "h264_amf":
+		return "h264"
+	case "libx265", "hevc_nvenc", "hevc_qsv", "hevc_vaapi", "hevc_videotoolbox", "hevc_amf":
+		return "hevc"
+	case "libvpx-vp9", "vp9_qsv", "vp9_vaapi":
+		return "vp9"
+	case "libaom-av1", "libsvtav1", "av1_nvenc", "av1_qsv":
+		return "av1"
+	case "libmp3lame":
+		return "mp3"
+	case "libfdk_aac":
+		return "aac"
+	case "libvorbis":
+		return "vorbis"
+	case "libopus":
+		return "opus"
+	}
+	return encoder
+}
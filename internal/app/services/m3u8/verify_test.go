@@ -0,0 +1,34 @@
+package m3u8
+
+import (
+	"stream-recorder/internal/app/models"
+	"testing"
+)
+
+func TestExpectedStreams(t *testing.T) {
+	tests := []struct {
+		quality   string
+		variant   models.Variant
+		recording *models.Recordings
+		wantVideo bool
+		wantAudio bool
+	}{
+		{quality: "best", variant: models.Variant{Name: "1080p60", Codecs: "avc1.64002A,mp4a.40.2"}, wantVideo: true, wantAudio: true},
+		{quality: "audio_only", variant: models.Variant{Name: "audio_only", Codecs: "mp4a.40.2"}, wantAudio: true},
+		{quality: "720p", variant: models.Variant{Name: "720p", Codecs: "hvc1.2.4.L123.B0"}, wantVideo: true},
+		// without codecs the name of the variant decides
+		{quality: "audio_only", wantAudio: true},
+		{quality: "best", variant: models.Variant{Name: "audio_only"}, wantAudio: true},
+		{quality: "best", wantVideo: true, wantAudio: true},
+		// the journaled recording wins over the session
+		{recording: &models.Recordings{Quality: "audio_only", Variant: models.Variant{Codecs: "mp4a.40.2"}}, wantAudio: true},
+		// a recovered part does not know its variant
+		{},
+	}
+	for _, tt := range tests {
+		m := &M3u8{quality: tt.quality, variant: tt.variant, recording: tt.recording}
+		if video, audio := m.expectedStreams(); video != tt.wantVideo || audio != tt.wantAudio {
+			t.Errorf("expectedStreams() for %q %+v = %v, %v, want %v, %v", tt.quality, tt.variant, video, audio, tt.wantVideo, tt.wantAudio)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package postprocess
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/services/jobs"
+	"stream-recorder/internal/app/services/library"
+	"stream-recorder/internal/app/services/preview"
+	"stream-recorder/internal/app/services/storage"
+	"stream-recorder/pkg/logger"
+)
+
+// payload is the state of a pipeline carried from one step job to the next
+type payload struct {
+	Steps []models.PostProcessStep `json:"steps"`
+	Index int                      `json:"index"`
+	File  string                   `json:"file"`
+
+	Upload *storage.Upload `json:"upload,omitempty"`
+}
+
+var audioFormats = map[string]string{
+	"m4a":  "copy",
+	"aac":  "copy",
+	"mp3":  "libmp3lame",
+	"opus": "libopus",
+	"ogg":  "libvorbis",
+	"flac": "flac",
+	"wav":  "pcm_s16le",
+}
+
+var imageFormats = map[string]bool{"jpg": true, "png": true, "webp": true}
+
+// Parse reads a pipeline from its JSON form and validates every step, an empty string is an empty pipeline
+func Parse(raw string) ([]models.PostProcessStep, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var steps []models.PostProcessStep
+	if err := json.Unmarshal([]byte(raw), &steps); err != nil {
+		return nil, fmt.Errorf("post_process is not a valid JSON array of steps: %w", err)
+	}
+
+	for i, step := range steps {
+		if err := validate(step); err != nil {
+			return nil, fmt.Errorf("step %d (%s): %w", i+1, step.Type, err)
+		}
+	}
+	return steps, nil
+}
+
+func validate(step models.PostProcessStep) error {
+	switch step.Type {
+	case models.StepTranscode:
+		if step.CRF < 0 || step.CRF > 63 {
+			return fmt.Errorf("crf must be between 0 and 63")
+		}
+	case models.StepLoudnorm:
+		if step.Loudness != 0 && (step.Loudness < -70 || step.Loudness > -5) {
+			return fmt.Errorf("loudness must be between -70 and -5 LUFS")
+		}
+	case models.StepExtractAudio:
+		if _, ok := audioFormats[step.Format]; step.Format != "" && !ok {
+			return fmt.Errorf("unsupported audio format %q", step.Format)
+		}
+	case models.StepThumbnail:
+		if step.Format != "" && !imageFormats[step.Format] {
+			return fmt.Errorf("unsupported image format %q", step.Format)
+		}
+		if step.At < 0 {
+			return fmt.Errorf("at cannot be negative")
+		}
+	case models.StepMove:
+		if step.Path == "" {
+			return fmt.Errorf("path is empty")
+		}
+	case models.StepCommand:
+		if step.Command == "" {
+			return fmt.Errorf("command is empty")
+		}
+	default:
+		return fmt.Errorf("unknown step type")
+	}
+	return nil
+}
+
+// Start queues the first step of the pipeline for a finalized file. The pipeline is copied
+// into the job, so changing the streamer settings does not affect files already in progress.
+// The previews are made and the file is uploaded when the pipeline is done, the upload right away when it is empty.
+func Start(q *jobs.Queue, base models.Jobs, pipeline, file string, upload *storage.Upload) error {
+	steps, err := Parse(pipeline)
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		if upload != nil {
+			return storage.Enqueue(q, base, *upload, file)
+		}
+		return nil
+	}
+	return enqueue(q, base, payload{Steps: steps, File: file, Upload: upload})
+}
+
+func enqueue(q *jobs.Queue, base models.Jobs, p payload) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	job := models.Jobs{
+		Type:        models.JobTypePostProcess,
+		Key:         base.Key,
+		Label:       fmt.Sprintf("%d/%d %s", p.Index+1, len(p.Steps), p.Steps[p.Index].Type),
+		Platform:    base.Platform,
+		Username:    base.Username,
+		RecordingID: base.RecordingID,
+		Payload:     string(data),
+	}
+	return q.Enqueue(&job)
+}
+
+func (r *runner) index(base models.Jobs, file string) {
+	if err := library.Enqueue(r.q, base, file); err != nil {
+		r.log.Error(fmt.Sprintf("[%s/%s] Failed to queue library update", base.Username, base.Platform), err, slog.String("file", file))
+	}
+}
+
+// Register adds the post-processing step handler to the queue. Every step is a job of its own,
+// so its status, log and retries are tracked separately, and it queues the next step when it succeeds.
+func Register(q *jobs.Queue, log *logger.Logger, cfg *config.Config) {
+	r := &runner{log: log, cfg: cfg, q: q}
+
+	q.Register(models.JobTypePostProcess, func(ctx context.Context, job *models.Jobs) error {
+		var p payload
+		if err := json.Unmarshal([]byte(job.Payload), &p); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+		if p.Index < 0 || p.Index >= len(p.Steps) {
+			return fmt.Errorf("step %d is out of range", p.Index+1)
+		}
+
+		step := p.Steps[p.Index]
+		file, err := r.run(ctx, job, step, p.File)
+		if err != nil {
+			return err
+		}
+		log.Debug(fmt.Sprintf("[%s/%s] Post-processing step completed", job.Username, job.Platform), slog.String("step", step.Type), slog.String("file", file))
+
+		// the library drops the old path of a moved file and picks up the result of the pipeline
+		if file != p.File {
+			r.index(*job, p.File)
+		}
+		if p.Index+1 == len(p.Steps) {
+			r.index(*job, file)
+			if err := preview.Enqueue(q, *job, file); err != nil {
+				log.Error(fmt.Sprintf("[%s/%s] Failed to queue previews", job.Username, job.Platform), err, slog.String("file", file))
+			}
+			if p.Upload != nil {
+				if err := storage.Enqueue(q, *job, *p.Upload, file); err != nil {
+					log.Error(fmt.Sprintf("[%s/%s] Failed to queue upload", job.Username, job.Platform), err, slog.String("file", file))
+				}
+			}
+			return nil
+		}
+		p.Index++
+		p.File = file
+		return enqueue(q, *job, p)
+	})
+}
@@ -0,0 +1,256 @@
+package postprocess
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/services/jobs"
+	"stream-recorder/pkg/ffmpeg"
+	"stream-recorder/pkg/logger"
+	"stream-recorder/pkg/pathtemplate"
+	"strings"
+	"syscall"
+)
+
+// maxCommandOutput is how much of the output of an external command ends up in the job log
+const maxCommandOutput = 4096
+
+type runner struct {
+	log *logger.Logger
+	cfg *config.Config
+	q   *jobs.Queue
+}
+
+// run executes a step on the file and returns the path of the file the next step works on
+func (r *runner) run(ctx context.Context, job *models.Jobs, step models.PostProcessStep, file string) (string, error) {
+	if step.Type != models.StepMove {
+		if _, err := os.Stat(file); err != nil {
+			return "", err
+		}
+	}
+
+	switch step.Type {
+	case models.StepTranscode:
+		return file, r.transcode(ctx, step, file)
+	case models.StepLoudnorm:
+		return file, r.loudnorm(ctx, step, file)
+	case models.StepExtractAudio:
+		return file, r.extractAudio(ctx, job, step, file)
+	case models.StepThumbnail:
+		return file, r.thumbnail(ctx, job, step, file)
+	case models.StepMove:
+		return r.move(job, step, file)
+	case models.StepCommand:
+		return file, r.command(ctx, job, step, file)
+	}
+	return "", fmt.Errorf("unknown step type %q", step.Type)
+}
+
+// replace runs ffmpeg into a temporary file next to the input and swaps it in once ffmpeg succeeded
+func (r *runner) replace(ctx context.Context, ff *ffmpeg.FFmpeg, file string) error {
+	ext := filepath.Ext(file)
+	tmp := strings.TrimSuffix(file, ext) + ".postprocess" + ext
+	if err := ff.Execute(ctx, []string{file}, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func (r *runner) transcode(ctx context.Context, step models.PostProcessStep, file string) error {
+	ff, err := ffmpeg.NewFfmpeg(r.cfg.FFmpegPATH)
+	if err != nil {
+		return err
+	}
+
+	ff.Yes().LogLevel("error").
+		VideoCodec(withDefault(step.VideoCodec, "libx264")).
+		AudioCodec(withDefault(step.AudioCodec, "copy"))
+	if step.CRF > 0 {
+		ff.CRF(step.CRF)
+	}
+	if step.Preset != "" {
+		ff.Preset(step.Preset)
+	}
+	return r.replace(ctx, ff, file)
+}
+
+func (r *runner) loudnorm(ctx context.Context, step models.PostProcessStep, file string) error {
+	ff, err := ffmpeg.NewFfmpeg(r.cfg.FFmpegPATH)
+	if err != nil {
+		return err
+	}
+
+	loudness := step.Loudness
+	if loudness == 0 {
+		loudness = -16
+	}
+	ff.Yes().LogLevel("error").
+		VideoCodec("copy").
+		AudioCodec(withDefault(step.AudioCodec, "aac")).
+		AudioFilter(fmt.Sprintf("loudnorm=I=%g:TP=-1.5:LRA=11", loudness))
+	return r.replace(ctx, ff, file)
+}
+
+func (r *runner) extractAudio(ctx context.Context, job *models.Jobs, step models.PostProcessStep, file string) error {
+	ff, err := ffmpeg.NewFfmpeg(r.cfg.FFmpegPATH)
+	if err != nil {
+		return err
+	}
+
+	format := withDefault(step.Format, "m4a")
+	output := strings.TrimSuffix(file, filepath.Ext(file)) + "." + format
+	err = ff.Yes().LogLevel("error").
+		VideoCodec("none").
+		AudioCodec(withDefault(step.AudioCodec, audioFormats[format])).
+		Execute(ctx, []string{file}, output)
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+
+	r.q.Log(job.ID, "audio written: "+filepath.Base(output))
+	return nil
+}
+
+func (r *runner) thumbnail(ctx context.Context, job *models.Jobs, step models.PostProcessStep, file string) error {
+	ff, err := ffmpeg.NewFfmpeg(r.cfg.FFmpegPATH)
+	if err != nil {
+		return err
+	}
+
+	at := step.At
+	if at == 0 {
+		at = 10
+	}
+	output := strings.TrimSuffix(file, filepath.Ext(file)) + "." + withDefault(step.Format, "jpg")
+	err = ff.Yes().LogLevel("error").
+		Start(strconv.FormatFloat(at, 'f', 3, 64)).
+		VideoFrames(1).
+		AudioCodec("none").
+		Execute(ctx, []string{file}, output)
+	if err != nil {
+		return err
+	}
+
+	// ffmpeg succeeds without writing a frame when the position is past the end of the file
+	if info, err := os.Stat(output); err != nil || info.Size() == 0 {
+		os.Remove(output)
+		return fmt.Errorf("no frame at %gs, the file is shorter", at)
+	}
+
+	r.q.Log(job.ID, "thumbnail written: "+filepath.Base(output))
+	return nil
+}
+
+// move moves the file together with its sidecars (manifest, thumbnail, extracted audio)
+func (r *runner) move(job *models.Jobs, step models.PostProcessStep, file string) (string, error) {
+	dir := strings.NewReplacer(
+		"{platform}", pathtemplate.Sanitize(job.Platform),
+		"{username}", pathtemplate.Sanitize(job.Username),
+	).Replace(step.Path)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(r.cfg.MediaPATH, dir)
+	}
+
+	target := filepath.Join(dir, filepath.Base(file))
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		// a previous attempt was interrupted after the file itself was moved
+		if _, err := os.Stat(target); err == nil {
+			return target, nil
+		}
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	sidecars, _ := filepath.Glob(escapeGlob(strings.TrimSuffix(file, filepath.Ext(file))) + ".*")
+	for _, src := range sidecars {
+		if src == file {
+			continue
+		}
+		if err := moveFile(src, filepath.Join(dir, filepath.Base(src))); err != nil {
+			return "", err
+		}
+	}
+	if err := moveFile(file, target); err != nil {
+		return "", err
+	}
+
+	r.q.Log(job.ID, "moved to "+dir)
+	return target, nil
+}
+
+func (r *runner) command(ctx context.Context, job *models.Jobs, step models.PostProcessStep, file string) error {
+	replacer := strings.NewReplacer(
+		"{file}", file,
+		"{dir}", filepath.Dir(file),
+		"{name}", strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+		"{platform}", job.Platform,
+		"{username}", job.Username,
+	)
+
+	args := make([]string, len(step.Args))
+	for i, arg := range step.Args {
+		args[i] = replacer.Replace(arg)
+	}
+
+	// the arguments are passed as they are, no shell is involved
+	output, err := exec.CommandContext(ctx, step.Command, args...).CombinedOutput()
+	if len(output) > maxCommandOutput {
+		output = output[len(output)-maxCommandOutput:]
+	}
+	if len(output) > 0 {
+		r.q.Log(job.ID, "command output:\n"+strings.TrimSpace(string(output)))
+	}
+	return err
+}
+
+// moveFile renames src to dst and falls back to copying when they are on different filesystems
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+func escapeGlob(path string) string {
+	return strings.NewReplacer("*", `\*`, "?", `\?`, "[", `\[`).Replace(path)
+}
+
+func withDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
@@ -0,0 +1,209 @@
+package preview
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/services/jobs"
+	"stream-recorder/pkg/ffmpeg"
+	"stream-recorder/pkg/logger"
+	"strings"
+)
+
+// sheetWidth is the width of a single frame of the contact sheet
+const sheetWidth = 320
+
+type payload struct {
+	File string `json:"file"`
+}
+
+// PosterPath returns the sidecar the poster frame of a media file is written to
+func PosterPath(file string) string {
+	return strings.TrimSuffix(file, filepath.Ext(file)) + ".poster.jpg"
+}
+
+// SheetPath returns the sidecar the contact sheet of a media file is written to
+func SheetPath(file string) string {
+	return strings.TrimSuffix(file, filepath.Ext(file)) + ".sheet.jpg"
+}
+
+// Snapshot returns the last frame of the file as a JPEG. Only the last seconds are decoded,
+// so it is cheap enough to be taken from a live segment on every request.
+func Snapshot(ctx context.Context, cfg *config.Config, file string) ([]byte, error) {
+	tmp, err := os.CreateTemp(cfg.TempPATH, "snapshot-*.jpg")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	ff, err := ffmpeg.NewFfmpeg(cfg.FFmpegPATH)
+	if err != nil {
+		return nil, err
+	}
+	// every decoded frame overwrites the image, so the last one stays
+	err = ff.Yes().LogLevel("error").
+		SeekEOF("-3").
+		AudioCodec("none").
+		ExtraArgs([]string{"-update", "1", "-q:v", "3"}).
+		Execute(ctx, []string{file}, tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("the file has no video frame")
+	}
+	return data, nil
+}
+
+// Poster writes a frame taken at a tenth of the file, the start of a stream is often a countdown or a black screen
+func Poster(ctx context.Context, cfg *config.Config, file string) error {
+	duration, err := probeDuration(ctx, cfg, file)
+	if err != nil {
+		return err
+	}
+	return frame(ctx, cfg, file, duration/10, "", PosterPath(file))
+}
+
+// ContactSheet writes a grid of frames taken at even intervals over the file
+func ContactSheet(ctx context.Context, cfg *config.Config, file string, frames int) error {
+	duration, err := probeDuration(ctx, cfg, file)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp(cfg.TempPATH, "sheet-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// the image sequence must be numbered without gaps, a frame that cannot be decoded is left out
+	var taken int
+	for i := 0; i < frames; i++ {
+		at := duration * (float64(i) + 0.5) / float64(frames)
+		output := filepath.Join(dir, fmt.Sprintf("frame%03d.jpg", taken))
+		if err := frame(ctx, cfg, file, at, fmt.Sprintf("scale=%d:-2", sheetWidth), output); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+		taken++
+	}
+	if taken == 0 {
+		return errors.New("no frame could be decoded")
+	}
+
+	columns := int(math.Ceil(math.Sqrt(float64(frames))))
+	rows := (frames + columns - 1) / columns
+
+	ff, err := ffmpeg.NewFfmpeg(cfg.FFmpegPATH)
+	if err != nil {
+		return err
+	}
+	return ff.Yes().LogLevel("error").
+		VideoFilter(fmt.Sprintf("tile=%dx%d", columns, rows)).
+		VideoFrames(1).
+		ExtraArgs([]string{"-q:v", "3"}).
+		Execute(ctx, []string{filepath.Join(dir, "frame%03d.jpg")}, SheetPath(file))
+}
+
+// frame writes the first frame at the position, the input seek only decodes from the keyframe before it
+func frame(ctx context.Context, cfg *config.Config, file string, at float64, filter, output string) error {
+	ff, err := ffmpeg.NewFfmpeg(cfg.FFmpegPATH)
+	if err != nil {
+		return err
+	}
+
+	ff.Yes().LogLevel("error").
+		Seek(strconv.FormatFloat(at, 'f', 3, 64)).
+		VideoFrames(1).
+		AudioCodec("none").
+		ExtraArgs([]string{"-q:v", "2"})
+	if filter != "" {
+		ff.VideoFilter(filter)
+	}
+	if err := ff.Execute(ctx, []string{file}, output); err != nil {
+		return err
+	}
+
+	// ffmpeg succeeds without writing a frame when the position is past the end of the file
+	if info, err := os.Stat(output); err != nil || info.Size() == 0 {
+		os.Remove(output)
+		return fmt.Errorf("no frame at %.3fs", at)
+	}
+	return nil
+}
+
+func probeDuration(ctx context.Context, cfg *config.Config, file string) (float64, error) {
+	ffprobe, err := ffmpeg.NewFfprobe(cfg.FFprobePATH)
+	if err != nil {
+		return 0, err
+	}
+	result, err := ffprobe.Probe(ctx, file)
+	if err != nil {
+		return 0, err
+	}
+	return result.DurationSeconds(), nil
+}
+
+// Enqueue queues the poster frame and the contact sheet of a finished file
+func Enqueue(q *jobs.Queue, base models.Jobs, file string) error {
+	data, err := json.Marshal(payload{File: file})
+	if err != nil {
+		return err
+	}
+
+	return q.Enqueue(&models.Jobs{
+		Type:        models.JobTypePreview,
+		Key:         file,
+		Label:       filepath.Base(file),
+		Platform:    base.Platform,
+		Username:    base.Username,
+		RecordingID: base.RecordingID,
+		Payload:     string(data),
+	})
+}
+
+// Register adds the preview handler to the queue
+func Register(q *jobs.Queue, log *logger.Logger, cfg *config.Config) {
+	q.Register(models.JobTypePreview, func(ctx context.Context, job *models.Jobs) error {
+		var p payload
+		if err := json.Unmarshal([]byte(job.Payload), &p); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+
+		// the file may have been moved by a post-processing step in the meantime, the previews are then made on request
+		if _, err := os.Stat(p.File); os.IsNotExist(err) {
+			q.Log(job.ID, "the file is gone, skipped")
+			return nil
+		}
+
+		if err := Poster(ctx, cfg, p.File); err != nil {
+			return fmt.Errorf("poster frame: %w", err)
+		}
+		q.Log(job.ID, "poster written: "+filepath.Base(PosterPath(p.File)))
+
+		if err := ContactSheet(ctx, cfg, p.File, cfg.ContactSheetFrames); err != nil {
+			return fmt.Errorf("contact sheet: %w", err)
+		}
+		q.Log(job.ID, "contact sheet written: "+filepath.Base(SheetPath(p.File)))
+
+		log.Debug(fmt.Sprintf("[%s/%s] Previews generated", job.Username, job.Platform), slog.String("file", p.File))
+		return nil
+	})
+}
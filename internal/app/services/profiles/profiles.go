@@ -0,0 +1,216 @@
+package profiles
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/pkg/ffmpeg"
+	"stream-recorder/pkg/logger"
+	"sync"
+	"time"
+)
+
+// muxers maps the supported file formats to the ffmpeg muxer that writes them
+var muxers = map[string]string{
+	"mp4":  "mp4",
+	"mov":  "mov",
+	"mkv":  "matroska",
+	"webm": "webm",
+	"ts":   "mpegts",
+	"flv":  "flv",
+}
+
+var (
+	bitrateRe = regexp.MustCompile(`^\d+(\.\d+)?[kKmM]?$`)
+	scaleRe   = regexp.MustCompile(`^-?\d+:-?\d+$`)
+)
+
+// Validator checks encoding profiles against the ffmpeg binary, its capabilities are read once
+type Validator struct {
+	log *logger.Logger
+	cfg *config.Config
+
+	mu   sync.Mutex
+	caps *ffmpeg.Capabilities
+}
+
+func New(log *logger.Logger, cfg *config.Config) *Validator {
+	return &Validator{
+		log: log,
+		cfg: cfg,
+	}
+}
+
+// FromConfig is the profile of the global settings, used for streamers without a profile
+func FromConfig(c *config.Config) models.EncodingProfiles {
+	return models.EncodingProfiles{
+		VideoCodec:    c.VideoCodec,
+		AudioCodec:    c.AudioCodec,
+		FileFormat:    c.FileFormat,
+		FragmentedMP4: c.FragmentedMP4,
+	}
+}
+
+// ApplyVideo adds the video codec and, when the video is re-encoded, the encoder settings of the profile
+func ApplyVideo(ff *ffmpeg.FFmpeg, p models.EncodingProfiles) *ffmpeg.FFmpeg {
+	ff.VideoCodec(p.VideoCodec)
+	if p.VideoCodec == "copy" {
+		return ff
+	}
+
+	if p.Preset != "" {
+		ff.Preset(p.Preset)
+	}
+	if p.CRF > 0 {
+		ff.CRF(p.CRF)
+	}
+	if p.VideoBitrate != "" {
+		ff.VideoBitrate(p.VideoBitrate)
+	}
+	if p.Scale != "" {
+		ff.VideoFilter("scale=" + p.Scale)
+	}
+	return ff
+}
+
+// ApplyAudio adds the audio codec and, when the audio is re-encoded, its bitrate
+func ApplyAudio(ff *ffmpeg.FFmpeg, p models.EncodingProfiles) *ffmpeg.FFmpeg {
+	ff.AudioCodec(p.AudioCodec)
+	if p.AudioCodec != "copy" && p.AudioBitrate != "" {
+		ff.AudioBitrate(p.AudioBitrate)
+	}
+	return ff
+}
+
+// Validate fills in the defaults and checks the profile: the settings have to be consistent, the
+// binary has to provide its encoders and muxer, and a short test pattern has to encode with it,
+// which also catches codecs the container does not accept
+func (v *Validator) Validate(ctx context.Context, p *models.EncodingProfiles) error {
+	if err := normalize(p); err != nil {
+		return err
+	}
+
+	ff, err := ffmpeg.NewFfmpeg(v.cfg.FFmpegPATH)
+	if err != nil {
+		return fmt.Errorf("failed to initialize ffmpeg: %w", err)
+	}
+
+	caps, err := v.capabilities(ctx, ff)
+	if err != nil {
+		return fmt.Errorf("failed to read the ffmpeg capabilities: %w", err)
+	}
+	if p.VideoCodec != "copy" && !caps.Encoders[p.VideoCodec] {
+		return fmt.Errorf("ffmpeg has no %s encoder", p.VideoCodec)
+	}
+	if p.AudioCodec != "copy" && !caps.Encoders[p.AudioCodec] {
+		return fmt.Errorf("ffmpeg has no %s encoder", p.AudioCodec)
+	}
+	if !caps.Muxers[muxers[p.FileFormat]] {
+		return fmt.Errorf("ffmpeg cannot write %s files", p.FileFormat)
+	}
+
+	return v.trial(ctx, caps, *p)
+}
+
+func normalize(p *models.EncodingProfiles) error {
+	if p.Name == "" {
+		return fmt.Errorf("name is empty")
+	}
+	if p.VideoCodec == "" {
+		p.VideoCodec = "copy"
+	}
+	if p.AudioCodec == "" {
+		p.AudioCodec = "copy"
+	}
+	if p.FileFormat == "" {
+		p.FileFormat = "mp4"
+	}
+
+	if _, ok := muxers[p.FileFormat]; !ok {
+		return fmt.Errorf("unsupported file format %q", p.FileFormat)
+	}
+	if p.FragmentedMP4 && p.FileFormat != "mp4" {
+		return fmt.Errorf("fragmented_mp4 only applies to mp4")
+	}
+	if p.VideoCodec == "copy" && (p.Preset != "" || p.CRF != 0 || p.VideoBitrate != "" || p.Scale != "") {
+		return fmt.Errorf("preset, crf, video_bitrate and scale require a video encoder instead of copy")
+	}
+	if p.AudioCodec == "copy" && p.AudioBitrate != "" {
+		return fmt.Errorf("audio_bitrate requires an audio encoder instead of copy")
+	}
+	if p.CRF < 0 || p.CRF > 63 {
+		return fmt.Errorf("crf must be between 0 and 63")
+	}
+	if p.CRF != 0 && p.VideoBitrate != "" {
+		return fmt.Errorf("crf and video_bitrate cannot be combined")
+	}
+	if p.VideoBitrate != "" && !bitrateRe.MatchString(p.VideoBitrate) {
+		return fmt.Errorf("video_bitrate must look like 6000k or 6M")
+	}
+	if p.AudioBitrate != "" && !bitrateRe.MatchString(p.AudioBitrate) {
+		return fmt.Errorf("audio_bitrate must look like 160k")
+	}
+	if p.Scale != "" && !scaleRe.MatchString(p.Scale) {
+		return fmt.Errorf("scale must look like 1280:720 or 1280:-2")
+	}
+	return nil
+}
+
+func (v *Validator) capabilities(ctx context.Context, ff *ffmpeg.FFmpeg) (*ffmpeg.Capabilities, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.caps != nil {
+		return v.caps, nil
+	}
+	caps, err := ff.Capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v.caps = caps
+	return caps, nil
+}
+
+// trial encodes half a second of a test pattern with the profile. A stream that is copied
+// is encoded the way the platforms deliver it (H.264 and AAC) to check the container accepts it.
+func (v *Validator) trial(ctx context.Context, caps *ffmpeg.Capabilities, p models.EncodingProfiles) error {
+	if p.VideoCodec == "copy" {
+		p.VideoCodec = firstAvailable(caps, "libx264", "h264")
+	}
+	if p.AudioCodec == "copy" {
+		p.AudioCodec = firstAvailable(caps, "aac")
+	}
+
+	ff, err := ffmpeg.NewFfmpeg(v.cfg.FFmpegPATH)
+	if err != nil {
+		return err
+	}
+
+	output := filepath.Join(os.TempDir(), fmt.Sprintf("profile-check-%d.%s", time.Now().UnixNano(), p.FileFormat))
+	defer os.Remove(output)
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	ff.Yes().LogLevel("error").Format("lavfi").Duration("0.5")
+	ApplyVideo(ff, p)
+	ApplyAudio(ff, p)
+	if err := ff.Execute(ctx, []string{"testsrc=duration=0.5:size=320x240:rate=25[out0];sine=duration=0.5[out1]"}, output); err != nil {
+		return fmt.Errorf("test encode failed: %w", err)
+	}
+	return nil
+}
+
+// firstAvailable returns the first encoder the binary has, or "none" to leave the stream out
+func firstAvailable(caps *ffmpeg.Capabilities, encoders ...string) string {
+	for _, name := range encoders {
+		if caps.Encoders[name] {
+			return name
+		}
+	}
+	return "none"
+}
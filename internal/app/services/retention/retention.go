@@ -0,0 +1,144 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/library"
+	"stream-recorder/pkg/logger"
+	"time"
+)
+
+// files this fresh may still be used by the jobs that finalized them
+const minAge = time.Hour
+
+// Candidate is a recording the rules delete and the rule that selected it
+type Candidate struct {
+	Item   models.LibraryItems `json:"recording"`
+	Reason string              `json:"reason"`
+}
+
+// Retention deletes finished recordings of the library by the rules of their streamer. A streamer
+// without a maximum age falls back to TimeAutoCleanMediaPATH only when RetentionFallback is enabled.
+type Retention struct {
+	log *logger.Logger
+	cfg *config.Config
+	sr  *repository.StreamersRepository
+	lr  *repository.LibraryRepository
+	l   *library.Library
+}
+
+func New(log *logger.Logger, cfg *config.Config, sr *repository.StreamersRepository, lr *repository.LibraryRepository, l *library.Library) *Retention {
+	return &Retention{
+		log: log,
+		cfg: cfg,
+		sr:  sr,
+		lr:  lr,
+		l:   l,
+	}
+}
+
+// Plan returns the recordings the rules would delete now, nothing is deleted
+func (r *Retention) Plan() ([]Candidate, error) {
+	streamers, err := r.sr.Get()
+	if err != nil {
+		return nil, err
+	}
+	rules := make(map[string]models.Streamers, len(streamers))
+	for _, s := range streamers {
+		rules[s.Platform+"/"+s.Username] = s
+	}
+
+	items, err := r.lr.Unpinned()
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]models.LibraryItems)
+	var keys []string
+	for _, item := range items {
+		key := item.Platform + "/" + item.Username
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], item)
+	}
+
+	var candidates []Candidate
+	for _, key := range keys {
+		candidates = append(candidates, r.plan(rules[key], groups[key])...)
+	}
+	return candidates, nil
+}
+
+// Apply deletes what Plan returns and reports what was deleted
+func (r *Retention) Apply(ctx context.Context) ([]Candidate, error) {
+	candidates, err := r.Plan()
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []Candidate
+	for _, candidate := range candidates {
+		if ctx.Err() != nil {
+			return deleted, ctx.Err()
+		}
+		if err := r.l.Delete(&candidate.Item); err != nil {
+			r.log.Error("Failed to delete recording", err, slog.String("path", candidate.Item.Path))
+			continue
+		}
+		r.log.Info("Recording deleted by retention", slog.String("path", candidate.Item.Path), slog.String("reason", candidate.Reason))
+		deleted = append(deleted, candidate)
+
+		// the directory made by the dir template goes with its last recording
+		if dir := filepath.Dir(r.l.File(&candidate.Item)); filepath.Clean(dir) != filepath.Clean(r.cfg.MediaPATH) {
+			_ = os.Remove(dir)
+		}
+	}
+	return deleted, nil
+}
+
+// plan applies the rules to the recordings of a streamer, items are sorted newest first
+func (r *Retention) plan(rule models.Streamers, items []models.LibraryItems) []Candidate {
+	days := rule.RetainDays
+	if days == 0 && r.cfg.RetentionFallback {
+		days = r.cfg.TimeAutoCleanMediaPATH
+	}
+	maxAge := time.Duration(days) * 24 * time.Hour
+	maxSize := int64(rule.RetainSize) * 1024 * 1024
+
+	var candidates []Candidate
+	var count int
+	var size int64
+	full := false
+	for _, item := range items {
+		if time.Since(item.ModifiedAt) < minAge {
+			count++
+			size += item.Size
+			continue
+		}
+
+		var reason string
+		switch {
+		case maxAge > 0 && time.Since(item.StartedAt) > maxAge:
+			reason = fmt.Sprintf("older than %d days", days)
+		case rule.RetainCount > 0 && count >= rule.RetainCount:
+			reason = fmt.Sprintf("more than %d recordings", rule.RetainCount)
+		case maxSize > 0 && (full || size+item.Size > maxSize):
+			// the older recordings go too, even the ones that would still fit
+			full = true
+			reason = fmt.Sprintf("more than %d MB in total", rule.RetainSize)
+		}
+		if reason != "" {
+			candidates = append(candidates, Candidate{Item: item, Reason: reason})
+			continue
+		}
+		count++
+		size += item.Size
+	}
+	return candidates
+}
@@ -0,0 +1,134 @@
+package retention
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/library"
+	"stream-recorder/pkg/logger"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMain(m *testing.M) {
+	// the logger writes to logs/ in the working directory
+	dir, err := os.MkdirTemp("", "retention")
+	if err != nil {
+		panic(err)
+	}
+	os.Chdir(dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// recordings returns items of the given sizes in megabytes that started the given number of days ago, newest first
+func recordings(days []int, sizes []int64) []models.LibraryItems {
+	now := time.Now()
+	items := make([]models.LibraryItems, len(days))
+	for i := range days {
+		items[i] = models.LibraryItems{
+			ID:         i + 1,
+			Size:       sizes[i] * 1024 * 1024,
+			StartedAt:  now.Add(-time.Duration(days[i]) * 24 * time.Hour),
+			ModifiedAt: now.Add(-time.Duration(days[i])*24*time.Hour + time.Hour),
+		}
+	}
+	return items
+}
+
+func TestPlan(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.Config
+		rule     models.Streamers
+		days     []int
+		sizes    []int64
+		want     []int
+		wantWhy  string
+		freshIDs []int
+	}{
+		{name: "no rules", days: []int{1, 10, 100}, sizes: []int64{1, 1, 1}},
+		{name: "count", rule: models.Streamers{RetainCount: 2}, days: []int{1, 2, 3, 4}, sizes: []int64{1, 1, 1, 1}, want: []int{3, 4}, wantWhy: "more than 2 recordings"},
+		{name: "days", rule: models.Streamers{RetainDays: 7}, days: []int{1, 6, 8, 30}, sizes: []int64{1, 1, 1, 1}, want: []int{3, 4}, wantWhy: "older than 7 days"},
+		// once the limit is reached the older recordings go too, even the small one that would still fit
+		{name: "size", rule: models.Streamers{RetainSize: 10}, days: []int{1, 2, 3, 4}, sizes: []int64{4, 4, 4, 1}, want: []int{3, 4}, wantWhy: "more than 10 MB in total"},
+		// fresh files are kept but count against the limits
+		{name: "fresh", rule: models.Streamers{RetainCount: 1}, days: []int{1, 2, 3}, sizes: []int64{1, 1, 1}, want: []int{3}, wantWhy: "more than 1 recordings", freshIDs: []int{1, 2}},
+		{name: "fallback is off", cfg: config.Config{AutoCleanMediaPATH: true, TimeAutoCleanMediaPATH: 7}, days: []int{1, 30}, sizes: []int64{1, 1}},
+		{name: "fallback", cfg: config.Config{RetentionFallback: true, TimeAutoCleanMediaPATH: 7}, days: []int{1, 30}, sizes: []int64{1, 1}, want: []int{2}, wantWhy: "older than 7 days"},
+		{name: "own days win over the fallback", cfg: config.Config{RetentionFallback: true, TimeAutoCleanMediaPATH: 7}, rule: models.Streamers{RetainDays: 60}, days: []int{1, 30}, sizes: []int64{1, 1}},
+	}
+	for _, tt := range tests {
+		r := &Retention{cfg: &tt.cfg}
+		items := recordings(tt.days, tt.sizes)
+		for _, id := range tt.freshIDs {
+			items[id-1].ModifiedAt = time.Now()
+		}
+
+		var got []int
+		for _, c := range r.plan(tt.rule, items) {
+			got = append(got, c.Item.ID)
+			if c.Reason != tt.wantWhy {
+				t.Errorf("%s: recording %d is deleted because %q, want %q", tt.name, c.Item.ID, c.Reason, tt.wantWhy)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: plan() deletes %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPlanByStreamer(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "db.sqlite")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(models.Streamers{}, models.LibraryItems{}); err != nil {
+		t.Fatal(err)
+	}
+
+	log := logger.New()
+	cfg := &config.Config{MediaPATH: t.TempDir()}
+	sr := repository.NewStreamers(log, db)
+	lr := repository.NewLibrary(log, db)
+	r := New(log, cfg, sr, lr, library.New(log, cfg, lr))
+
+	if err := sr.Add(models.Streamers{Platform: "twitch", Username: "foo", Quality: "best", RetainCount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	for i, item := range []models.LibraryItems{
+		{Path: "foo_1.mp4", Username: "foo"},
+		{Path: "foo_2.mp4", Username: "foo", Pinned: true},
+		{Path: "foo_3.mp4", Username: "foo"},
+		{Path: "bar_1.mp4", Username: "bar"},
+		{Path: "bar_2.mp4", Username: "bar"},
+	} {
+		item.Platform = "twitch"
+		item.StartedAt = old.Add(-time.Duration(i) * time.Hour)
+		item.ModifiedAt = old
+		if err := lr.Save(&item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	candidates, err := r.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range candidates {
+		got = append(got, c.Item.Path)
+	}
+	// the pinned recording neither goes nor counts, bar has no rules
+	if want := []string{"foo_3.mp4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Plan() = %v, want %v", got, want)
+	}
+}
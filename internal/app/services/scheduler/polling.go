@@ -0,0 +1,219 @@
+package scheduler
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/pkg/schedule"
+	"time"
+)
+
+const (
+	// how far back the recordings are looked at to find when a streamer usually goes live
+	hotHistory = 28 * 24 * time.Hour
+	// a time of day is hot once the streamer went live around it this many times
+	hotStarts = 2
+	// the start times, the intervals and the schedule of the streamer are reloaded this often
+	refresh = 10 * time.Minute
+)
+
+// poller decides how long the checker of a streamer waits between two checks
+type poller struct {
+	s      *Scheduler
+	stream models.Streamers
+	loc    *time.Location
+	sched  *schedule.Schedule
+
+	starts    []time.Time
+	refreshed time.Time
+	status    models.PollerStatus
+}
+
+func (s *Scheduler) newPoller(stream models.Streamers) *poller {
+	loc, err := time.LoadLocation(stream.Timezone)
+	if stream.Timezone == "" || err != nil {
+		loc, err = time.LoadLocation(s.cfg.Timezone)
+		if err != nil {
+			loc = time.Local
+		}
+	}
+
+	p := &poller{
+		s:      s,
+		stream: stream,
+		loc:    loc,
+		status: models.PollerStatus{Platform: stream.Platform, Username: stream.Username, State: models.PollerOffline},
+	}
+	p.parseSchedule()
+	return p
+}
+
+// parseSchedule builds the windows of the streamer, a broken schedule does not keep it from being recorded
+func (p *poller) parseSchedule() {
+	p.sched = nil
+	if p.stream.Schedule == "" {
+		return
+	}
+
+	sched, err := schedule.Parse(p.stream.Schedule)
+	if err != nil {
+		p.s.log.Warn(fmt.Sprintf("[%s/%s] Invalid schedule, the streamer is recorded at any time", p.stream.Username, p.stream.Platform), slog.String("error", err.Error()))
+		return
+	}
+	p.sched = sched
+}
+
+// closed reports whether the schedule of the streamer is outside its windows now and when the next one opens
+func (p *poller) closed(now time.Time) (time.Time, bool) {
+	if now.Sub(p.refreshed) > refresh {
+		p.reload(now)
+	}
+	if p.sched == nil || p.sched.Allowed(now.In(p.loc)) {
+		return time.Time{}, false
+	}
+	return p.sched.Next(now.In(p.loc)), true
+}
+
+// wait records that the streamer is outside its schedule and returns how long to wait. The wait ends
+// with the next window, but not later than the next reload so a changed schedule is picked up.
+func (p *poller) wait(now, open time.Time) time.Duration {
+	d := refresh
+	if !open.IsZero() && open.Sub(now) < d {
+		d = open.Sub(now)
+	}
+
+	p.status.State = models.PollerScheduled
+	p.status.Reason = "outside the recording schedule, no window opens within a year"
+	if !open.IsZero() {
+		p.status.Reason = "outside the recording schedule until " + open.Format(time.RFC3339)
+	}
+	p.status.Interval = d.Seconds()
+	p.status.LastCheck = now
+	p.status.NextCheck = now.Add(d)
+	p.publish()
+	return d
+}
+
+// cutAt returns when a recording started now has to be stopped, the zero time lets it finish
+func (p *poller) cutAt() time.Time {
+	if p.sched == nil || p.stream.ScheduleEnd != models.ScheduleCut {
+		return time.Time{}
+	}
+	return p.sched.End(time.Now().In(p.loc))
+}
+
+// interval is the wait between two checks of an offline streamer, the hot one applies around its usual start times
+func (p *poller) interval(now time.Time) (time.Duration, bool) {
+	if now.Sub(p.refreshed) > refresh {
+		p.reload(now)
+	}
+
+	hot := p.hot(now)
+	if hot {
+		if p.stream.HotInterval > 0 {
+			return time.Duration(p.stream.HotInterval) * time.Second, true
+		}
+		return time.Duration(p.s.cfg.HotCheck) * time.Second, true
+	}
+	if p.stream.CheckInterval > 0 {
+		return time.Duration(p.stream.CheckInterval) * time.Second, false
+	}
+	return time.Duration(p.s.cfg.TimeCheck) * time.Second, false
+}
+
+// reload picks up the settings changed through the API and the recordings made since the last reload
+func (p *poller) reload(now time.Time) {
+	p.refreshed = now
+	if starts, err := p.s.rr.StartTimes(p.stream.Platform, p.stream.Username, now.Add(-hotHistory)); err == nil {
+		p.starts = starts
+	}
+
+	streamers, err := p.s.sr.Get()
+	if err != nil {
+		return
+	}
+	for _, stream := range streamers {
+		if stream.Platform == p.stream.Platform && stream.Username == p.stream.Username {
+			p.stream.CheckInterval = stream.CheckInterval
+			p.stream.HotInterval = stream.HotInterval
+			if stream.Schedule != p.stream.Schedule {
+				p.stream.Schedule = stream.Schedule
+				p.parseSchedule()
+			}
+			p.stream.ScheduleEnd = stream.ScheduleEnd
+			p.stream.Priority = stream.Priority
+			return
+		}
+	}
+}
+
+// hot reports whether the streamer went live around this time of day often enough in the last weeks
+func (p *poller) hot(now time.Time) bool {
+	window := time.Duration(p.s.cfg.HotWindow) * time.Minute
+	clock := sinceMidnight(now.In(p.loc))
+	var count int
+	for _, start := range p.starts {
+		diff := clock - sinceMidnight(start.In(p.loc))
+		if diff < 0 {
+			diff = -diff
+		}
+		// the window can cross midnight
+		if diff > 12*time.Hour {
+			diff = 24*time.Hour - diff
+		}
+		if diff <= window {
+			count++
+		}
+	}
+	return count >= hotStarts
+}
+
+// next records the outcome of a check and returns how long to wait before the next one. Failures
+// back off exponentially up to BackoffMax, every wait is jittered so checkers do not run in lockstep.
+func (p *poller) next(state, reason string, err error) time.Duration {
+	now := time.Now()
+	d, hot := p.interval(now)
+
+	if err != nil {
+		p.status.Failures++
+		p.status.LastError = err.Error()
+		state, reason = models.PollerBackoff, "the platform cannot be checked"
+
+		d <<= min(p.status.Failures-1, 10)
+		if limit := time.Duration(p.s.cfg.BackoffMax) * time.Second; d > limit {
+			d = limit
+		}
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	} else {
+		p.status.Failures = 0
+		p.status.LastError = ""
+		d += time.Duration(rand.Int63n(int64(d/5)+1)) - d/10
+	}
+
+	p.status.State = state
+	p.status.Reason = reason
+	p.status.Hot = hot
+	p.status.Interval = d.Seconds()
+	p.status.LastCheck = now
+	p.status.NextCheck = now.Add(d)
+	p.publish()
+	return d
+}
+
+// set records a state that has no next check, like a running recording
+func (p *poller) set(state, reason string) {
+	p.status.State = state
+	p.status.Reason = reason
+	p.status.LastCheck = time.Now()
+	p.status.NextCheck = time.Time{}
+	p.publish()
+}
+
+func (p *poller) publish() {
+	p.s.st.UpdatePoller(fmt.Sprintf("%s-%s", p.stream.Platform, p.stream.Username), p.status)
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
@@ -0,0 +1,113 @@
+package scheduler
+
+import (
+	"errors"
+	"stream-recorder/internal/app/models"
+	"testing"
+	"time"
+)
+
+func TestPollerInterval(t *testing.T) {
+	s := newTestScheduler(t)
+	s.cfg.TimeCheck, s.cfg.HotCheck, s.cfg.HotWindow = 15, 5, 30
+
+	day := func(d, hour, minute int) time.Time { return time.Date(2026, 1, d, hour, minute, 0, 0, time.UTC) }
+	tests := []struct {
+		name    string
+		stream  models.Streamers
+		starts  []time.Time
+		now     time.Time
+		want    time.Duration
+		wantHot bool
+	}{
+		{name: "global", starts: []time.Time{day(1, 20, 0), day(2, 20, 0)}, now: day(3, 12, 0), want: 15 * time.Second},
+		{name: "own", stream: models.Streamers{CheckInterval: 60}, now: day(3, 12, 0), want: time.Minute},
+		{name: "hot", starts: []time.Time{day(1, 20, 0), day(2, 19, 45)}, now: day(3, 20, 10), want: 5 * time.Second, wantHot: true},
+		{name: "own hot", stream: models.Streamers{HotInterval: 10}, starts: []time.Time{day(1, 20, 0), day(2, 20, 0)}, now: day(3, 20, 30), want: 10 * time.Second, wantHot: true},
+		{name: "a single start is not hot", starts: []time.Time{day(1, 20, 0)}, now: day(3, 20, 0), want: 15 * time.Second},
+		{name: "outside the window", starts: []time.Time{day(1, 20, 0), day(2, 20, 0)}, now: day(3, 20, 31), want: 15 * time.Second},
+		{name: "across midnight", starts: []time.Time{day(1, 23, 50), day(2, 23, 40)}, now: day(3, 0, 5), want: 5 * time.Second, wantHot: true},
+	}
+	for _, tt := range tests {
+		tt.stream.Platform, tt.stream.Username, tt.stream.Timezone = "twitch", "foo", "UTC"
+		p := s.newPoller(tt.stream)
+		p.starts, p.refreshed = tt.starts, tt.now
+
+		if got, hot := p.interval(tt.now); got != tt.want || hot != tt.wantHot {
+			t.Errorf("%s: interval() = %s, %v, want %s, %v", tt.name, got, hot, tt.want, tt.wantHot)
+		}
+	}
+}
+
+func TestPollerBackoff(t *testing.T) {
+	s := newTestScheduler(t)
+	s.cfg.TimeCheck, s.cfg.BackoffMax = 10, 60
+
+	p := s.newPoller(models.Streamers{Platform: "twitch", Username: "foo", Timezone: "UTC"})
+	p.refreshed = time.Now()
+
+	// every failure doubles the wait up to BackoffMax, the jitter takes up to half of it
+	for i, limit := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute} {
+		d := p.next(models.PollerOffline, "", errors.New("timeout"))
+		if d < limit/2 || d > limit {
+			t.Errorf("failure %d waits %s, want between %s and %s", i+1, d, limit/2, limit)
+		}
+	}
+	status := s.st.Pollers()
+	if len(status) != 1 || status[0].State != models.PollerBackoff || status[0].Failures != 5 || status[0].LastError != "timeout" {
+		t.Fatalf("the published status after 5 failures is %+v", status)
+	}
+
+	// a successful check resets the backoff, the wait is jittered by 10%
+	d := p.next(models.PollerOffline, "the stream is offline", nil)
+	if d < 9*time.Second || d > 11*time.Second {
+		t.Errorf("the check after a success waits %s, want 10s ± 1s", d)
+	}
+	status = s.st.Pollers()
+	if status[0].State != models.PollerOffline || status[0].Failures != 0 || status[0].LastError != "" {
+		t.Errorf("the published status after a success is %+v", status[0])
+	}
+}
+
+func TestPollerSchedule(t *testing.T) {
+	s := newTestScheduler(t)
+
+	// 2026-01-05 is a Monday
+	p := s.newPoller(models.Streamers{Platform: "twitch", Username: "foo", Timezone: "Europe/Berlin", Schedule: "mon-fri 18:00-23:00"})
+	berlin := p.loc
+
+	tests := []struct {
+		now        time.Time
+		wantClosed bool
+		wantOpen   time.Time
+	}{
+		{time.Date(2026, 1, 5, 19, 0, 0, 0, berlin), false, time.Time{}},
+		// the windows are in the timezone of the streamer
+		{time.Date(2026, 1, 5, 17, 30, 0, 0, time.UTC), false, time.Time{}},
+		{time.Date(2026, 1, 5, 12, 0, 0, 0, berlin), true, time.Date(2026, 1, 5, 18, 0, 0, 0, berlin)},
+		{time.Date(2026, 1, 9, 23, 30, 0, 0, berlin), true, time.Date(2026, 1, 12, 18, 0, 0, 0, berlin)},
+	}
+	for _, tt := range tests {
+		p.refreshed = tt.now
+		open, closed := p.closed(tt.now)
+		if closed != tt.wantClosed || !open.Equal(tt.wantOpen) {
+			t.Errorf("closed(%s) = %s, %v, want %s, %v", tt.now, open, closed, tt.wantOpen, tt.wantClosed)
+		}
+	}
+
+	// the wait ends with the window but not after the next reload
+	now := time.Date(2026, 1, 5, 17, 55, 0, 0, berlin)
+	if d := p.wait(now, now.Add(5*time.Minute)); d != 5*time.Minute {
+		t.Errorf("wait() for a window in 5 minutes = %s", d)
+	}
+	if d := p.wait(now, now.Add(time.Hour)); d != refresh {
+		t.Errorf("wait() for a window in an hour = %s, want %s", d, refresh)
+	}
+	if status := s.st.Pollers(); len(status) != 1 || status[0].State != models.PollerScheduled {
+		t.Errorf("the published status is %+v, want %s", status, models.PollerScheduled)
+	}
+
+	if at := p.cutAt(); !at.IsZero() {
+		t.Errorf("cutAt() = %s for a recording that finishes with the stream", at)
+	}
+}
@@ -1,77 +1,145 @@
 package scheduler
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"stream-recorder/internal/app/services/m3u8"
 	"strings"
 )
 
-func (s *Scheduler) Recovery() {
+// Recovery finalizes the sessions the journal marks as interrupted, using the segment
+// lists and file names that were recorded for them. Part lists in the temp directory that
+// no journal row references are finalized by their file names, and the loose segments of
+// directories no session was journaled for are joined into a recovery file.
+func (s *Scheduler) Recovery(ctx context.Context) {
 	s.log.Warn("Recovering streams...")
-	var files = make(map[string][]string)
-	var txtFiles = make(map[string][]string)
 
-	err := filepath.Walk(s.cfg.TempPATH, func(path string, info os.FileInfo, err error) error {
-		if info.Size() == 0 {
-			os.Remove(path)
-		}
+	// the lists are collected first, the recovery of the journal writes new ones
+	legacy := s.unjournaledParts()
+	loose := s.loosePartsOf(s.unjournaledDirs())
+
+	recordings, err := s.rr.GetUnfinished()
+	if err != nil {
+		s.log.Error("Error reading recording journal", err)
+	}
 
-		if info.IsDir() || info.Name() == "ffmpeg" {
+	for _, rec := range recordings {
+		s.tr.Go(fmt.Sprintf("recover %s/%s #%d", rec.Platform, rec.Username, rec.ID), func() {
+			m, err := m3u8.New(s.log, rec.Platform, rec.Username, false, 0, s.cfg, s.u, s.dp, s.tr, s.rr, s.q)
+			if err != nil {
+				s.log.Error("Error creating m3u8", err)
+				return
+			}
+
+			m.Recover(ctx, rec)
+		})
+	}
+
+	for _, tempPath := range legacy {
+		mediaPath := filepath.Join(s.cfg.MediaPATH, filepath.Base(filepath.Dir(tempPath)), filepath.Base(tempPath))
+
+		s.tr.Go("recover "+filepath.Base(mediaPath), func() {
+			m, err := m3u8.New(s.log, "", "", false, 0, s.cfg, s.u, s.dp, s.tr, s.rr, s.q)
+			if err != nil {
+				s.log.Error("Error creating m3u8", err)
+				return
+			}
+
+			m.ConcatLegacy(ctx, tempPath, mediaPath)
+		})
+	}
+
+	for _, m := range loose {
+		s.tr.Go("recover "+filepath.Base(m.mediaPath), func() {
+			m.m.ConcatLegacy(ctx, m.tempPath, m.mediaPath)
+		})
+	}
+
+	s.log.Warn(fmt.Sprintf("Recovering %d streams and %d unjournaled parts in the background", len(recordings), len(legacy)+len(loose)))
+}
+
+// unjournaledParts returns the temp paths of the part lists left by sessions that were recorded
+// before the journal or whose journal could not be written
+func (s *Scheduler) unjournaledParts() []string {
+	var parts []string
+	err := filepath.WalkDir(s.cfg.TempPATH, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
 			return nil
 		}
-
-		if strings.HasSuffix(info.Name(), "_video.txt") {
-			txtFiles[filepath.Dir(path)] = append(txtFiles[filepath.Dir(path)], info.Name())
+		// the working directories of clips are not sessions
+		if d.IsDir() && strings.HasPrefix(d.Name(), "clip-") {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), "_video.txt") {
 			return nil
 		}
 
-		files[filepath.Dir(path)] = append(files[filepath.Dir(path)], info.Name())
+		tempPath := strings.TrimSuffix(path, "_video.txt")
+		if journaled, err := s.rr.HasPart(tempPath); err != nil || journaled {
+			return nil
+		}
+		if known, err := s.q.Known(tempPath); err != nil || known {
+			return nil
+		}
+		parts = append(parts, tempPath)
 		return nil
 	})
 	if err != nil {
 		s.log.Error("Error reading temp path", err)
-		return
 	}
+	return parts
+}
 
-	for path, f := range txtFiles {
-		for _, file := range f {
-			tempPath := filepath.Join(s.cfg.TempPATH, filepath.Base(path), strings.TrimSuffix(file, "_video.txt"))
-			mediaPath := filepath.Join(s.cfg.MediaPATH, filepath.Base(path), strings.TrimSuffix(file, "_video.txt"))
+// loosePart is a recovery file of segments that no list references
+type loosePart struct {
+	m                   *m3u8.M3u8
+	tempPath, mediaPath string
+}
 
-			go func(tempPath, mediaPath string) {
-				m, err := m3u8.New(s.log, "", "", false, 0, s.cfg, s.u)
-				if err != nil {
-					s.log.Error("Error creating m3u8", err)
-					return
-				}
+// loosePartsOf lists the loose segments of each directory. The lists are written before any part
+// is finalized, a finalized part removes its list before its segments.
+func (s *Scheduler) loosePartsOf(dirs []string) []loosePart {
+	var parts []loosePart
+	for _, dir := range dirs {
+		m, err := m3u8.New(s.log, "", "", false, 0, s.cfg, s.u, s.dp, s.tr, s.rr, s.q)
+		if err != nil {
+			s.log.Error("Error creating m3u8", err)
+			continue
+		}
 
-				m.ConcatAndCleanup(tempPath, mediaPath)
-			}(tempPath, mediaPath)
+		name := s.u.RemoveDateFromPath(filepath.Base(dir)) + "_recovery"
+		tempPath, err := m.FlushDirToDisk(filepath.Join(dir, name))
+		if err != nil {
+			s.log.Error("Error flush txt to disk", err)
+			continue
+		}
+		if tempPath == "" {
+			continue
 		}
+		parts = append(parts, loosePart{m: m, tempPath: tempPath, mediaPath: filepath.Join(s.cfg.MediaPATH, filepath.Base(dir), name)})
 	}
+	return parts
+}
 
-	for path := range files {
-		tempPath := filepath.Join(s.cfg.TempPATH, filepath.Base(path), s.u.RemoveDateFromPath(filepath.Base(path))+"_recovery")
-		mediaPath := filepath.Join(s.cfg.MediaPATH, filepath.Base(path), s.u.RemoveDateFromPath(filepath.Base(path))+"_recovery")
-
-		go func(tempPath, mediaPath string) {
-			m, err := m3u8.New(s.log, "", "", false, 0, s.cfg, s.u)
-			if err != nil {
-				s.log.Error("Error creating m3u8", err)
-				return
-			}
-
-			pathTempWithoutExtHash, err := m.FlushTxtToDisk(tempPath)
-			if err != nil {
-				s.log.Error("Error flush txt to disk", err)
-				return
-			}
-			m.ConcatAndCleanup(pathTempWithoutExtHash, mediaPath)
-		}(tempPath, mediaPath)
+// unjournaledDirs returns the session directories in the temp directory that no journal row refers to
+func (s *Scheduler) unjournaledDirs() []string {
+	entries, err := os.ReadDir(s.cfg.TempPATH)
+	if err != nil {
+		s.log.Error("Error reading temp path", err)
+		return nil
 	}
 
-	files = make(map[string][]string)
-	txtFiles = make(map[string][]string)
-	s.log.Warn("Successfully recovered streams")
+	var dirs []string
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), "clip-") {
+			continue
+		}
+		if journaled, err := s.rr.HasStreamDir(entry.Name()); err != nil || journaled {
+			continue
+		}
+		dirs = append(dirs, filepath.Join(s.cfg.TempPATH, entry.Name()))
+	}
+	return dirs
 }
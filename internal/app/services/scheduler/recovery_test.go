@@ -0,0 +1,182 @@
+package scheduler
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/jobs"
+	"stream-recorder/internal/app/services/state"
+	"stream-recorder/internal/app/services/tracker"
+	"stream-recorder/internal/app/services/utils"
+	"stream-recorder/pkg/logger"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMain(m *testing.M) {
+	// the logger writes to logs/ in the working directory
+	dir, err := os.MkdirTemp("", "scheduler")
+	if err != nil {
+		panic(err)
+	}
+	os.Chdir(dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func newTestScheduler(t *testing.T) *Scheduler {
+	t.Helper()
+
+	dir := t.TempDir()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "db.sqlite")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(models.Streamers{}, models.Recordings{}, models.RecordingParts{}, models.Jobs{}); err != nil {
+		t.Fatal(err)
+	}
+
+	log := logger.New()
+	cfg := &config.Config{
+		TempPATH:     filepath.Join(dir, "temp"),
+		MediaPATH:    filepath.Join(dir, "media"),
+		FileFormat:   "mp4",
+		VideoCodec:   "copy",
+		AudioCodec:   "copy",
+		DirTemplate:  config.DefaultDirTemplate,
+		FileTemplate: config.DefaultFileTemplate,
+	}
+	tr := tracker.New()
+	return &Scheduler{
+		log: log,
+		sr:  repository.NewStreamers(log, db),
+		cfg: cfg,
+		st:  state.New(),
+		u:   utils.New(log),
+		tr:  tr,
+		rr:  repository.NewRecordings(log, db),
+		q:   jobs.New(log, cfg, repository.NewJobs(log, db), tr),
+	}
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUnjournaledParts(t *testing.T) {
+	s := newTestScheduler(t)
+
+	session := filepath.Join(s.cfg.TempPATH, "twitch_foo_2026-01-02")
+	writeFiles(t, session, map[string]string{
+		"legacy_video.txt":    "file '1_a.mp4'\n",
+		"legacy_audio.txt":    "file '1_a.aac'\n",
+		"journaled_video.txt": "file '2_a.ts'\n",
+		"queued_video.txt":    "file '3_a.ts'\n",
+	})
+	writeFiles(t, filepath.Join(s.cfg.TempPATH, "clip-1"), map[string]string{"clip_video.txt": "file '1_a.ts'\n"})
+
+	rec := &models.Recordings{Platform: "twitch", Username: "foo", StreamDir: "other", FileFormat: "mp4", VideoCodec: "copy", AudioCodec: "copy", Status: models.RecordingStatusStopped}
+	if err := s.rr.Start(rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.rr.AddPart(&models.RecordingParts{RecordingID: rec.ID, TempPath: filepath.Join(session, "journaled"), MediaPath: "m", Status: models.PartStatusPending}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.q.Enqueue(&models.Jobs{Type: models.JobTypeConcat, Key: filepath.Join(session, "queued")}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := s.unjournaledParts()
+	want := []string{filepath.Join(session, "legacy")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unjournaledParts() = %v, want %v", got, want)
+	}
+}
+
+func TestUnjournaledDirs(t *testing.T) {
+	s := newTestScheduler(t)
+
+	for _, dir := range []string{"twitch_foo_2026-01-02", "twitch_bar_2026-01-02", "clip-7"} {
+		writeFiles(t, filepath.Join(s.cfg.TempPATH, dir), nil)
+	}
+	rec := &models.Recordings{Platform: "twitch", Username: "bar", StreamDir: "twitch_bar_2026-01-02", FileFormat: "mp4", VideoCodec: "copy", AudioCodec: "copy", Status: models.RecordingStatusRecording}
+	if err := s.rr.Start(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	got := s.unjournaledDirs()
+	want := []string{filepath.Join(s.cfg.TempPATH, "twitch_foo_2026-01-02")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unjournaledDirs() = %v, want %v", got, want)
+	}
+}
+
+func TestLoosePartsOf(t *testing.T) {
+	s := newTestScheduler(t)
+
+	loose := filepath.Join(s.cfg.TempPATH, "twitch_foo_2026-01-02")
+	writeFiles(t, loose, map[string]string{
+		"10_c.mp4":         "",
+		"2_b.mp4":          "",
+		"2_b.aac":          "",
+		"10_c.aac":         "",
+		"1_a.mp4":          "",
+		"1_a.aac":          "",
+		"part_video.txt":   "file '1_a.mp4'\n",
+		"part_audio.txt":   "file '1_a.aac'\n",
+		"foo_recovery.mp4": "",
+	})
+	listed := filepath.Join(s.cfg.TempPATH, "twitch_bar_2026-01-02")
+	writeFiles(t, listed, map[string]string{
+		"1_a.mp4":        "",
+		"part_video.txt": "file '1_a.mp4'\n",
+	})
+
+	parts := s.loosePartsOf([]string{loose, listed})
+	if len(parts) != 1 {
+		t.Fatalf("loosePartsOf() returned %d parts, want 1", len(parts))
+	}
+
+	p := parts[0]
+	if filepath.Dir(p.tempPath) != loose {
+		t.Errorf("temp path %s is not in %s", p.tempPath, loose)
+	}
+	if want := filepath.Join(s.cfg.MediaPATH, "twitch_foo_2026-01-02", "twitch_foo_recovery"); p.mediaPath != want {
+		t.Errorf("media path = %s, want %s", p.mediaPath, want)
+	}
+
+	for suffix, want := range map[string][]string{
+		"_video.txt": {"2_b.mp4", "10_c.mp4"},
+		"_audio.txt": {"2_b.aac", "10_c.aac"},
+	} {
+		got, err := s.u.ExtractFilenamesFromTxt(p.tempPath + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s lists %v, want %v", suffix, got, want)
+		}
+	}
+
+	lists, _ := filepath.Glob(filepath.Join(listed, "*.txt"))
+	sort.Strings(lists)
+	if want := []string{filepath.Join(listed, "part_video.txt")}; !reflect.DeepEqual(lists, want) {
+		t.Errorf("lists in a directory without loose segments = %v, want %v", lists, want)
+	}
+}
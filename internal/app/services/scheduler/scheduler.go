@@ -1,105 +1,257 @@
 package scheduler
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"stream-recorder/internal/app/config"
 	"stream-recorder/internal/app/models"
 	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/capacity"
+	"stream-recorder/internal/app/services/disk"
+	"stream-recorder/internal/app/services/downloader"
+	"stream-recorder/internal/app/services/jobs"
 	"stream-recorder/internal/app/services/m3u8"
 	"stream-recorder/internal/app/services/state"
+	"stream-recorder/internal/app/services/storage"
 	"stream-recorder/internal/app/services/streamlink"
+	"stream-recorder/internal/app/services/tracker"
 	"stream-recorder/internal/app/services/utils"
 	"stream-recorder/pkg/logger"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type Scheduler struct {
 	log *logger.Logger
 	sr  *repository.StreamersRepository
+	pr  *repository.ProfilesRepository
 	sl  *streamlink.Streamlink
 	cfg *config.Config
 	st  *state.State
 	u   *utils.Utils
+	dp  *downloader.Pool
+	tr  *tracker.Tracker
+	rr  *repository.RecordingsRepository
+	q   *jobs.Queue
+	dm  *disk.Monitor
+	cp  *capacity.Limiter
 }
 
-func New(log *logger.Logger, sr *repository.StreamersRepository, sl *streamlink.Streamlink, cfg *config.Config, st *state.State, u *utils.Utils) *Scheduler {
+func New(log *logger.Logger, sr *repository.StreamersRepository, pr *repository.ProfilesRepository, sl *streamlink.Streamlink, cfg *config.Config, st *state.State, u *utils.Utils, dp *downloader.Pool, tr *tracker.Tracker, rr *repository.RecordingsRepository, q *jobs.Queue, dm *disk.Monitor, cp *capacity.Limiter) *Scheduler {
 	return &Scheduler{
 		log: log,
 		sr:  sr,
+		pr:  pr,
 		sl:  sl,
 		cfg: cfg,
 		st:  st,
 		u:   u,
+		dp:  dp,
+		tr:  tr,
+		rr:  rr,
+		q:   q,
+		dm:  dm,
+		cp:  cp,
 	}
 }
 
-func (s *Scheduler) CheckingForStreams() {
+// CheckingForStreams starts a checker for every streamer from the DB until ctx is cancelled
+func (s *Scheduler) CheckingForStreams(ctx context.Context) {
 	for {
 		streamers, err := s.sr.Get()
 		if err != nil {
 			s.log.Error("Error getting streamers", err)
-			time.Sleep(time.Duration(s.cfg.TimeCheck) * time.Second)
-			continue
 		}
 
 		for _, stream := range streamers {
 			key := fmt.Sprintf("%s-%s", stream.Platform, stream.Username)
 			if !s.st.GetActiveStreamers(key) {
 				s.st.UpdateActiveStreamers(key, true)
-				go s.checkingForStream(stream)
+
+				streamCtx, cancel := context.WithCancel(ctx)
+				s.st.UpdateCancelStreamer(key, cancel)
+				go s.checkingForStream(streamCtx, stream)
 			}
 		}
 
-		time.Sleep(time.Duration(s.cfg.TimeCheck) * time.Second)
+		if !s.sleep(ctx, time.Duration(s.cfg.TimeCheck)*time.Second) {
+			return
+		}
 	}
 }
 
-func (s *Scheduler) checkingForStream(stream models.Streamers) {
-	key := fmt.Sprintf("%s-%s", stream.Platform, stream.Username)
-	var masterHls, mediaHls string
-	var err error
-	masterHls, err = s.sl.Platform.GetMasterPlaylist(stream.Username)
-	if err != nil {
-		s.log.Error("Error getting master playlist", err)
-		s.st.UpdateActiveStreamers(key, false)
-		return
+// sleep waits for d and reports false if ctx was cancelled in the meantime
+func (s *Scheduler) sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
 	}
+}
 
+// checkingForStream polls the streamer until it goes live and records the stream. Platform errors
+// are retried with backoff, the checker only ends with a recording, a refusal or its context. A live
+// streamer waits in the checker while the capacity limits queue it.
+func (s *Scheduler) checkingForStream(ctx context.Context, stream models.Streamers) {
+	key := fmt.Sprintf("%s-%s", stream.Platform, stream.Username)
+	defer s.st.UpdateActiveStreamers(key, false)
+	defer s.st.CancelStreamer(key)
+
+	p := s.newPoller(stream)
+	defer func() {
+		// a removed streamer has no poller anymore, otherwise the next sweep picks it up again
+		if ctx.Err() != nil {
+			s.st.UpdatePoller(key, models.PollerStatus{})
+		} else if p.status.State != models.PollerRefused && p.status.State != models.PollerPreempted {
+			p.set(models.PollerStopped, "")
+		}
+	}()
+	defer s.cp.Leave(stream.Platform, stream.Username)
+
+	// a pre-empted recording is stopped through its own context, the checker keeps running until Run returns
+	recCtx, stopRec := context.WithCancel(ctx)
+	defer stopRec()
+	var preempted atomic.Bool
+
+	var masterHls string
+	var variant models.Variant
+	var release func()
+	var err error
 	for {
 		if !s.st.GetActiveStreamers(key) {
 			return
 		}
 
-		mediaHls, err = s.sl.Platform.FindMediaPlaylist(masterHls, stream.Quality)
-		if err == nil {
-			break
-		} else if strings.Contains(err.Error(), "HTTP error: 403") {
-			masterHls, err = s.sl.Platform.GetMasterPlaylist(stream.Username)
+		if open, closed := p.closed(time.Now()); closed {
+			s.cp.Leave(stream.Platform, stream.Username)
+			d := p.wait(time.Now(), open)
+			s.log.Debug(fmt.Sprintf("[%s/%s] Outside the recording schedule, waiting...", stream.Username, stream.Platform), slog.Time("opens", open))
+			if !s.sleep(ctx, d) {
+				return
+			}
+			continue
+		}
+
+		if masterHls == "" {
+			masterHls, err = s.sl.Platform.GetMasterPlaylist(ctx, stream.Username)
 			if err != nil {
-				s.log.Error("Error getting master playlist", err)
-				s.st.UpdateActiveStreamers(key, false)
+				if ctx.Err() != nil {
+					return
+				}
+				d := p.next(models.PollerOffline, "", err)
+				s.log.Error(fmt.Sprintf("[%s/%s] Error getting master playlist", stream.Username, stream.Platform), err, slog.Int("failures", p.status.Failures), slog.Duration("retry", d))
+				if !s.sleep(ctx, d) {
+					return
+				}
+				continue
+			}
+		}
+
+		variant, err = s.sl.Platform.FindMediaPlaylist(ctx, masterHls, stream.Quality)
+		if err == nil {
+			// the checker ends here, the next sweep tries again once space was freed
+			if err := s.dm.Allow(stream.Platform, stream.Username); err != nil {
+				s.log.Warn(fmt.Sprintf("[%s/%s] The streamer is live, but the recording is not started", stream.Username, stream.Platform), slog.String("error", err.Error()))
+				p.set(models.PollerRefused, err.Error())
+				return
+			}
+
+			release, err = s.cp.Acquire(stream.Platform, stream.Username, p.stream.Priority, variant.Bandwidth, func() {
+				preempted.Store(true)
+				stopRec()
+			})
+			if err == nil {
+				break
+			}
+
+			wasQueued := p.status.State == models.PollerQueued
+			d := p.next(models.PollerQueued, err.Error(), nil)
+			if !wasQueued {
+				s.log.Info(fmt.Sprintf("[%s/%s] The streamer is live, the recording is queued", stream.Username, stream.Platform), slog.String("reason", err.Error()))
+			}
+			if !s.sleep(ctx, d) {
 				return
 			}
+			continue
+		}
+		if ctx.Err() != nil {
+			return
 		}
+		// a streamer that went offline gives up its place in the queue
+		s.cp.Leave(stream.Platform, stream.Username)
 
-		s.log.Debug(fmt.Sprintf("[%s/%s] The streamer is not broadcasting live, waiting...", stream.Username, stream.Platform))
-		time.Sleep(time.Duration(s.cfg.TimeCheck) * time.Second)
+		var d time.Duration
+		switch {
+		case strings.Contains(err.Error(), "HTTP error: 403"):
+			// the playlist token expired, a fresh one is fetched with the next check
+			masterHls = ""
+			d = p.next(models.PollerOffline, "the streamer is not live", nil)
+		case strings.Contains(err.Error(), "HTTP error: 404"):
+			d = p.next(models.PollerOffline, "the streamer is not live", nil)
+		default:
+			d = p.next(models.PollerOffline, "", err)
+			s.log.Warn(fmt.Sprintf("[%s/%s] Error checking the stream", stream.Username, stream.Platform), slog.String("error", err.Error()), slog.Int("failures", p.status.Failures), slog.Duration("retry", d))
+		}
+
+		s.log.Debug(fmt.Sprintf("[%s/%s] The streamer is not broadcasting live, waiting...", stream.Username, stream.Platform), slog.Duration("next", d))
+		if !s.sleep(ctx, d) {
+			return
+		}
 	}
 
+	defer release()
+	p.set(models.PollerRecording, "")
+
 	s.log.Info(fmt.Sprintf("[%s/%s] The streamer has started a live broadcast, I'm starting the recording...", stream.Username, stream.Platform))
 
-	val, err := m3u8.New(s.log, stream.Platform, stream.Username, stream.SplitSegments, stream.TimeSegment, s.cfg, s.u)
+	val, err := m3u8.New(s.log, stream.Platform, stream.Username, stream.SplitSegments, stream.TimeSegment, s.cfg, s.u, s.dp, s.tr, s.rr, s.q)
 	if err != nil {
 		s.log.Error("Error creating m3u8", err)
+		return
+	}
+	val.SetVariant(stream.Quality, variant)
+	val.SetPostProcess(stream.PostProcess)
+	if stream.Storage != "" && !storage.Known(s.cfg, stream.Storage) {
+		s.log.Warn(fmt.Sprintf("[%s/%s] Storage backend not configured, the files stay local", stream.Username, stream.Platform), slog.String("storage", stream.Storage))
+	} else {
+		val.SetStorage(stream.Storage, stream.KeepLocal)
+	}
+	val.SetReplay(stream.ReplayMinutes, stream.ReplayKeywords)
+	if stream.Profile != "" {
+		if profile, err := s.pr.GetByName(stream.Profile); err == nil {
+			val.SetProfile(*profile)
+		} else {
+			s.log.Warn(fmt.Sprintf("[%s/%s] Encoding profile not found, the global settings are used", stream.Username, stream.Platform), slog.String("profile", stream.Profile))
+		}
+	}
+	val.SetSplitPolicy(stream.SplitSize, stream.SplitClock, stream.SplitOnCategory, stream.SplitOnTitle)
+	if err := val.SetTemplates(stream.DirTemplate, stream.FileTemplate, stream.Timezone); err != nil {
+		s.log.Warn(fmt.Sprintf("[%s/%s] Invalid naming settings, the global ones are used", stream.Username, stream.Platform), slog.String("error", err.Error()))
+	}
+	if info, err := s.sl.Platform.GetStreamInfo(ctx, stream.Username); err == nil {
+		val.SetStreamInfo(info)
 	}
 	s.st.UpdateActiveM3u8(key, val)
 
-	err = s.st.GetActiveM3u8(key).Run(mediaHls)
+	if end := p.cutAt(); !end.IsZero() {
+		cut := time.AfterFunc(time.Until(end), func() {
+			s.log.Info(fmt.Sprintf("[%s/%s] The recording window has closed, I'm stopping the recording...", stream.Username, stream.Platform))
+			val.ChangeIsCancel(true)
+		})
+		defer cut.Stop()
+	}
+
+	err = val.Run(recCtx, variant.URL)
 	if err != nil {
 		s.log.Error("Error running m3u8", err)
-		s.st.UpdateActiveStreamers(key, false)
-		return
 	}
-	s.st.UpdateActiveStreamers(key, false)
+	if preempted.Load() && ctx.Err() == nil {
+		p.set(models.PollerPreempted, "the recording was cut for a streamer of a higher priority")
+	}
 }
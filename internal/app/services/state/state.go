@@ -1,6 +1,9 @@
 package state
 
 import (
+	"context"
+	"sort"
+	"stream-recorder/internal/app/models"
 	"stream-recorder/internal/app/services/m3u8"
 	"sync"
 )
@@ -8,15 +11,21 @@ import (
 type State struct {
 	am map[string]*m3u8.M3u8
 	as map[string]bool
+	cs map[string]context.CancelFunc
+	ps map[string]models.PollerStatus
 
 	muAm sync.Mutex
 	muAs sync.Mutex
+	muCs sync.Mutex
+	muPs sync.Mutex
 }
 
 func New() *State {
 	return &State{
 		am: make(map[string]*m3u8.M3u8),
 		as: make(map[string]bool),
+		cs: make(map[string]context.CancelFunc),
+		ps: make(map[string]models.PollerStatus),
 	}
 }
 
@@ -47,3 +56,68 @@ func (s *State) UpdateActiveM3u8(key string, value *m3u8.M3u8) {
 
 	s.am[key] = value
 }
+
+// UpdateCancelStreamer stores the function that stops the checker of a streamer
+func (s *State) UpdateCancelStreamer(key string, cancel context.CancelFunc) {
+	s.muCs.Lock()
+	defer s.muCs.Unlock()
+
+	if cancel == nil {
+		delete(s.cs, key)
+		return
+	}
+	s.cs[key] = cancel
+}
+
+// CancelStreamer immediately stops the checker (and with it the recording) of a streamer
+func (s *State) CancelStreamer(key string) {
+	s.muCs.Lock()
+	defer s.muCs.Unlock()
+
+	if cancel, ok := s.cs[key]; ok {
+		cancel()
+		delete(s.cs, key)
+	}
+}
+
+// CancelAllM3u8 marks every known recording as cancelled
+func (s *State) CancelAllM3u8() {
+	s.muAm.Lock()
+	defer s.muAm.Unlock()
+
+	for _, m := range s.am {
+		if m != nil {
+			m.ChangeIsCancel(true)
+		}
+	}
+}
+
+// UpdatePoller stores what the checker of a streamer is doing, an empty state removes it
+func (s *State) UpdatePoller(key string, status models.PollerStatus) {
+	s.muPs.Lock()
+	defer s.muPs.Unlock()
+
+	if status.State == "" {
+		delete(s.ps, key)
+		return
+	}
+	s.ps[key] = status
+}
+
+// Pollers returns the status of every checker sorted by platform and username
+func (s *State) Pollers() []models.PollerStatus {
+	s.muPs.Lock()
+	defer s.muPs.Unlock()
+
+	list := make([]models.PollerStatus, 0, len(s.ps))
+	for _, status := range s.ps {
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Platform != list[j].Platform {
+			return list[i].Platform < list[j].Platform
+		}
+		return list[i].Username < list[j].Username
+	})
+	return list
+}
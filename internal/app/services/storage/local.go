@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"stream-recorder/internal/app/services/integrity"
+)
+
+// localBackend copies the files to another directory, usually a different disk or a network mount
+type localBackend struct {
+	dir string
+}
+
+func (b *localBackend) Upload(ctx context.Context, o Object, progress func(msg string)) error {
+	target := filepath.Join(b.dir, filepath.FromSlash(o.Remote))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	in, err := os.Open(o.File)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	partial := target + ".part"
+	out, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	offset, err := resumeOffset(out, o.Size)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if offset > 0 {
+		progress(fmt.Sprintf("resuming %s at %d bytes", o.Remote, offset))
+		if _, err := in.Seek(offset, io.SeekStart); err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	if _, err := io.Copy(out, integrity.ContextReader(ctx, in)); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partial, target)
+}
+
+func (b *localBackend) Verify(ctx context.Context, o Object) error {
+	f, err := os.Open(filepath.Join(b.dir, filepath.FromSlash(o.Remote)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return verifyStream(ctx, f, o)
+}
+
+func (b *localBackend) Close() error {
+	return nil
+}
+
+// resumeOffset positions a partial file at its end, a partial file longer than the source is started over
+func resumeOffset(f interface {
+	io.Seeker
+	Truncate(size int64) error
+}, size int64) (int64, error) {
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if offset <= size {
+		return offset, nil
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return 0, err
+	}
+	return f.Seek(0, io.SeekStart)
+}
@@ -0,0 +1,491 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"stream-recorder/internal/app/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// emptySHA256 is the payload hash of a request without a body
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// s3UploadsFile keeps the unfinished multipart uploads in the temp directory
+	s3UploadsFile = "s3-uploads.json"
+)
+
+// s3UploadsMu serializes the upload jobs that update the file of unfinished uploads
+var s3UploadsMu sync.Mutex
+
+// s3Backend talks to any S3-compatible service with Signature Version 4. Files larger than a part
+// are sent as a multipart upload that a later attempt continues with the parts already stored.
+type s3Backend struct {
+	cfg      config.StorageConfig
+	endpoint *url.URL
+	client   *http.Client
+	partSize int64
+	uploads  string
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size,omitempty"`
+}
+
+// s3Upload is an unfinished multipart upload and the checksum it was created with. S3 does not list the
+// metadata of unfinished uploads, so the checksum is remembered locally to tell whether an upload may be continued.
+type s3Upload struct {
+	UploadID string `json:"upload_id"`
+	Sum      string `json:"sha256"`
+}
+
+func newS3(sc config.StorageConfig, tempDir string) (*s3Backend, error) {
+	endpoint, err := url.Parse(sc.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Backend{
+		cfg:      sc,
+		endpoint: endpoint,
+		client:   &http.Client{},
+		partSize: int64(sc.PartSize) * 1024 * 1024,
+		uploads:  filepath.Join(tempDir, s3UploadsFile),
+	}, nil
+}
+
+func (b *s3Backend) Upload(ctx context.Context, o Object, progress func(msg string)) error {
+	key := b.key(o.Remote)
+	if o.Size <= b.partSize {
+		data, err := os.ReadFile(o.File)
+		if err != nil {
+			return err
+		}
+		header := http.Header{"X-Amz-Meta-Sha256": {o.Sum}}
+		_, err = b.do(ctx, http.MethodPut, key, nil, header, data)
+		return err
+	}
+
+	uploadID, stored, err := b.resume(ctx, key, o.Sum, progress)
+	if err != nil {
+		return err
+	}
+	if uploadID == "" {
+		if uploadID, err = b.create(ctx, key, o.Sum); err != nil {
+			return err
+		}
+		if err := b.remember(key, s3Upload{UploadID: uploadID, Sum: o.Sum}); err != nil {
+			return err
+		}
+	} else {
+		progress(fmt.Sprintf("resuming multipart upload of %s, %d parts stored", o.Remote, len(stored)))
+	}
+
+	f, err := os.Open(o.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	count := int((o.Size + b.partSize - 1) / b.partSize)
+	parts := make([]s3Part, 0, count)
+	buf := make([]byte, b.partSize)
+	lastPercent := 0
+	for n := 1; n <= count; n++ {
+		size, err := io.ReadFull(f, buf)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		data := buf[:size]
+
+		// a stored part is reused only when it holds the same bytes, the ETag of a part is its MD5
+		sum := md5.Sum(data)
+		etag := `"` + hex.EncodeToString(sum[:]) + `"`
+		if part, ok := stored[n]; !ok || part.ETag != etag || part.Size != int64(size) {
+			query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+			header := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}
+			resp, err := b.do(ctx, http.MethodPut, key, query, header, data)
+			if err != nil {
+				return fmt.Errorf("part %d: %w", n, err)
+			}
+			if tag := resp.Header.Get("ETag"); tag != "" {
+				etag = tag
+			}
+		}
+		parts = append(parts, s3Part{PartNumber: n, ETag: etag})
+
+		if percent := n * 100 / count; percent/10 > lastPercent/10 {
+			lastPercent = percent
+			progress(fmt.Sprintf("%s: %d%% uploaded", o.Remote, percent))
+		}
+	}
+
+	if err := b.complete(ctx, key, uploadID, parts); err != nil {
+		return err
+	}
+	return b.remember(key, s3Upload{})
+}
+
+func (b *s3Backend) Verify(ctx context.Context, o Object) error {
+	resp, err := b.do(ctx, http.MethodHead, b.key(o.Remote), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength != o.Size {
+		return fmt.Errorf("size mismatch: %d bytes stored, %d expected", resp.ContentLength, o.Size)
+	}
+	if sum := resp.Header.Get("X-Amz-Meta-Sha256"); sum != o.Sum {
+		return fmt.Errorf("checksum mismatch: %q stored, %s expected", sum, o.Sum)
+	}
+	return nil
+}
+
+func (b *s3Backend) Close() error {
+	b.client.CloseIdleConnections()
+	return nil
+}
+
+// resume finds the unfinished multipart upload of the key that was created for the checksum and the parts it
+// already holds. The other uploads of the key would complete with the checksum of other content, they are aborted.
+func (b *s3Backend) resume(ctx context.Context, key, sum string, progress func(msg string)) (string, map[int]s3Part, error) {
+	resp, err := b.do(ctx, http.MethodGet, "", url.Values{"uploads": {""}, "prefix": {key}}, nil, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	var uploads struct {
+		Uploads []struct {
+			Key      string `xml:"Key"`
+			UploadID string `xml:"UploadId"`
+		} `xml:"Upload"`
+	}
+	if err := xml.Unmarshal(resp.body, &uploads); err != nil {
+		return "", nil, err
+	}
+
+	known, err := b.remembered(key)
+	if err != nil {
+		return "", nil, err
+	}
+	var uploadID string
+	for _, u := range uploads.Uploads {
+		if u.Key != key {
+			continue
+		}
+		if uploadID == "" && u.UploadID == known.UploadID && known.Sum == sum {
+			uploadID = u.UploadID
+			continue
+		}
+		if _, err := b.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {u.UploadID}}, nil, nil); err != nil {
+			return "", nil, fmt.Errorf("abort upload %s: %w", u.UploadID, err)
+		}
+		progress(fmt.Sprintf("aborted an unfinished multipart upload of %s that was started for other content", key))
+	}
+	if uploadID == "" {
+		return "", nil, b.remember(key, s3Upload{})
+	}
+
+	stored := make(map[int]s3Part)
+	marker := "0"
+	for {
+		query := url.Values{"uploadId": {uploadID}, "part-number-marker": {marker}}
+		resp, err := b.do(ctx, http.MethodGet, key, query, nil, nil)
+		if err != nil {
+			return "", nil, err
+		}
+		var list struct {
+			Parts       []s3Part `xml:"Part"`
+			IsTruncated bool     `xml:"IsTruncated"`
+			NextMarker  string   `xml:"NextPartNumberMarker"`
+		}
+		if err := xml.Unmarshal(resp.body, &list); err != nil {
+			return "", nil, err
+		}
+		for _, part := range list.Parts {
+			stored[part.PartNumber] = part
+		}
+		if !list.IsTruncated || list.NextMarker == "" {
+			return uploadID, stored, nil
+		}
+		marker = list.NextMarker
+	}
+}
+
+// create starts a multipart upload, the checksum of the whole file is kept in the object metadata
+func (b *s3Backend) create(ctx context.Context, key, sum string) (string, error) {
+	header := http.Header{"X-Amz-Meta-Sha256": {sum}}
+	resp, err := b.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp.body, &result); err != nil {
+		return "", err
+	}
+	if result.UploadID == "" {
+		return "", errors.New("the service returned no upload id")
+	}
+	return result.UploadID, nil
+}
+
+func (b *s3Backend) complete(ctx context.Context, key, uploadID string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	// the service may fail the request after it answered 200
+	if bytes.Contains(resp.body, []byte("<Error>")) {
+		return b.error(resp.body, resp.status)
+	}
+	return nil
+}
+
+// remembered returns the unfinished upload the file of the temp directory holds for the key
+func (b *s3Backend) remembered(key string) (s3Upload, error) {
+	s3UploadsMu.Lock()
+	defer s3UploadsMu.Unlock()
+
+	uploads, err := b.readUploads()
+	return uploads[b.uploadKey(key)], err
+}
+
+// remember keeps the unfinished upload of the key, an empty one forgets it
+func (b *s3Backend) remember(key string, u s3Upload) error {
+	s3UploadsMu.Lock()
+	defer s3UploadsMu.Unlock()
+
+	uploads, err := b.readUploads()
+	if err != nil {
+		return err
+	}
+	if u.UploadID == "" {
+		if _, ok := uploads[b.uploadKey(key)]; !ok {
+			return nil
+		}
+		delete(uploads, b.uploadKey(key))
+	} else {
+		uploads[b.uploadKey(key)] = u
+	}
+
+	data, err := json.MarshalIndent(uploads, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := b.uploads + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.uploads)
+}
+
+func (b *s3Backend) readUploads() (map[string]s3Upload, error) {
+	uploads := make(map[string]s3Upload)
+	data, err := os.ReadFile(b.uploads)
+	if errors.Is(err, os.ErrNotExist) {
+		return uploads, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &uploads); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.uploads, err)
+	}
+	return uploads, nil
+}
+
+// uploadKey names the object across the configured services and buckets
+func (b *s3Backend) uploadKey(key string) string {
+	return b.endpoint.Host + "/" + b.cfg.Bucket + "/" + key
+}
+
+type s3Response struct {
+	*http.Response
+	status string
+	body   []byte
+}
+
+// do sends a signed request, the body is small enough to be kept in memory (a single part at most)
+func (b *s3Backend) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*s3Response, error) {
+	u := b.url(key, query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL = u
+	req.ContentLength = int64(len(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	payloadHash := emptySHA256
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	b.sign(req, payloadHash, time.Now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, b.error(data, resp.Status)
+	}
+	return &s3Response{Response: resp, status: resp.Status, body: data}, nil
+}
+
+func (b *s3Backend) error(body []byte, status string) error {
+	var e s3Error
+	if err := xml.Unmarshal(body, &e); err != nil || e.Code == "" {
+		return fmt.Errorf("s3: %s", status)
+	}
+	return fmt.Errorf("s3: %s: %s", e.Code, e.Message)
+}
+
+func (b *s3Backend) key(remote string) string {
+	return strings.TrimPrefix(path.Join(b.cfg.Path, remote), "/")
+}
+
+// url addresses the object in the path style (endpoint/bucket/key) or the virtual-hosted style (bucket.endpoint/key)
+func (b *s3Backend) url(key string, query url.Values) *url.URL {
+	u := *b.endpoint
+	p := strings.TrimSuffix(u.Path, "/") + "/"
+	if b.cfg.PathStyle {
+		p += b.cfg.Bucket + "/"
+	} else {
+		u.Host = b.cfg.Bucket + "." + u.Host
+	}
+	p += key
+
+	u.Path = p
+	u.RawPath = s3Escape(p, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// sign adds the Signature Version 4 authorization header
+func (b *s3Backend) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-md5" || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + b.cfg.Region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+b.cfg.SecretKey), date)
+	key = hmacSHA256(key, b.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes the query sorted by name as the signature expects, it is sent in the same form
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, the slash is kept in paths
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
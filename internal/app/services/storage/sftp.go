@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"net"
+	"os"
+	"path"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/services/integrity"
+	"time"
+)
+
+// sftpBackend uploads over SFTP into a partial file that a later attempt appends to
+type sftpBackend struct {
+	dir    string
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func newSFTP(ctx context.Context, sc config.StorageConfig) (*sftpBackend, error) {
+	hostKey, err := knownhosts.New(sc.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("known_hosts: %w", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if sc.KeyFile != "" {
+		key, err := os.ReadFile(sc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("key_file: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if sc.Password != "" {
+		auth = append(auth, ssh.Password(sc.Password))
+	}
+
+	addr := sc.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            sc.User,
+		Auth:            auth,
+		HostKeyCallback: hostKey,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sshClient := ssh.NewClient(c, chans, reqs)
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	return &sftpBackend{dir: sc.Path, conn: sshClient, client: client}, nil
+}
+
+func (b *sftpBackend) Upload(ctx context.Context, o Object, progress func(msg string)) error {
+	target := path.Join(b.dir, o.Remote)
+	if err := b.client.MkdirAll(path.Dir(target)); err != nil {
+		return err
+	}
+
+	in, err := os.Open(o.File)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	partial := target + ".part"
+	out, err := b.client.OpenFile(partial, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+
+	offset, err := resumeOffset(out, o.Size)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if offset > 0 {
+		progress(fmt.Sprintf("resuming %s at %d bytes", o.Remote, offset))
+		if _, err := in.Seek(offset, io.SeekStart); err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	if _, err := io.Copy(out, integrity.ContextReader(ctx, in)); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// a plain SFTP rename fails when the target exists
+	if err := b.client.PosixRename(partial, target); err == nil {
+		return nil
+	}
+	b.client.Remove(target)
+	return b.client.Rename(partial, target)
+}
+
+func (b *sftpBackend) Verify(ctx context.Context, o Object) error {
+	f, err := b.client.Open(path.Join(b.dir, o.Remote))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return verifyStream(ctx, f, o)
+}
+
+func (b *sftpBackend) Close() error {
+	b.client.Close()
+	return b.conn.Close()
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/models"
+	"stream-recorder/internal/app/services/integrity"
+	"stream-recorder/internal/app/services/jobs"
+	"stream-recorder/internal/app/services/library"
+	"stream-recorder/pkg/logger"
+	"strings"
+)
+
+// Backend is a place finished recordings are uploaded to
+type Backend interface {
+	// Upload copies the file to the remote path. A partial upload left by a failed attempt is resumed where the backend allows it.
+	Upload(ctx context.Context, o Object, progress func(msg string)) error
+	// Verify checks that the remote file has the size and the SHA-256 checksum of the local one
+	Verify(ctx context.Context, o Object) error
+	Close() error
+}
+
+// Object is a local file together with the path it gets in the backend, relative to the configured path
+type Object struct {
+	File   string
+	Remote string
+	Size   int64
+	Sum    string
+}
+
+// Upload is where the finished files of a recording go, it is carried along by the post-processing jobs
+type Upload struct {
+	Storage   string `json:"storage"`
+	KeepLocal bool   `json:"keep_local"`
+}
+
+type payload struct {
+	Upload
+	File string `json:"file"`
+}
+
+// Known reports whether a storage backend of that name is configured
+func Known(cfg *config.Config, name string) bool {
+	_, ok := cfg.Storages[name]
+	return ok
+}
+
+// Open connects to the named storage backend
+func Open(ctx context.Context, cfg *config.Config, name string) (Backend, error) {
+	sc, ok := cfg.Storages[name]
+	if !ok {
+		return nil, fmt.Errorf("storage %q is not configured", name)
+	}
+
+	switch sc.Type {
+	case config.StorageLocal:
+		return &localBackend{dir: sc.Path}, nil
+	case config.StorageS3:
+		return newS3(sc, cfg.TempPATH)
+	case config.StorageSFTP:
+		return newSFTP(ctx, sc)
+	case config.StorageWebDAV:
+		return newWebDAV(sc)
+	}
+	return nil, fmt.Errorf("unknown storage type %q", sc.Type)
+}
+
+// Enqueue queues the upload of a finished file and its sidecars
+func Enqueue(q *jobs.Queue, base models.Jobs, u Upload, file string) error {
+	data, err := json.Marshal(payload{Upload: u, File: file})
+	if err != nil {
+		return err
+	}
+
+	return q.Enqueue(&models.Jobs{
+		Type:        models.JobTypeUpload,
+		Key:         file,
+		Label:       fmt.Sprintf("%s: %s", u.Storage, filepath.Base(file)),
+		Platform:    base.Platform,
+		Username:    base.Username,
+		RecordingID: base.RecordingID,
+		Payload:     string(data),
+	})
+}
+
+// Register adds the upload handler to the queue. Every file is verified against its checksum
+// before the local copy is removed.
+func Register(q *jobs.Queue, log *logger.Logger, cfg *config.Config) {
+	q.Register(models.JobTypeUpload, func(ctx context.Context, job *models.Jobs) error {
+		var p payload
+		if err := json.Unmarshal([]byte(job.Payload), &p); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+		if _, err := os.Stat(p.File); err != nil {
+			return err
+		}
+
+		backend, err := Open(ctx, cfg, p.Storage)
+		if err != nil {
+			return err
+		}
+		defer backend.Close()
+
+		files := withSidecars(p.File)
+		dir := remoteDir(cfg, p.File)
+		for _, file := range files {
+			size, sum, err := checksum(ctx, file)
+			if err != nil {
+				return err
+			}
+			o := Object{File: file, Remote: path.Join(dir, filepath.Base(file)), Size: size, Sum: sum}
+
+			q.Log(job.ID, fmt.Sprintf("uploading %s (%d bytes)", o.Remote, o.Size))
+			if err := backend.Upload(ctx, o, func(msg string) { q.Log(job.ID, msg) }); err != nil {
+				return fmt.Errorf("upload %s: %w", o.Remote, err)
+			}
+			if err := backend.Verify(ctx, o); err != nil {
+				return fmt.Errorf("verify %s: %w", o.Remote, err)
+			}
+			q.Log(job.ID, fmt.Sprintf("verified %s, sha256 %s", o.Remote, o.Sum))
+		}
+
+		if !p.KeepLocal {
+			for _, file := range files {
+				os.Remove(file)
+			}
+			q.Log(job.ID, "local copy removed")
+			if err := library.Enqueue(q, *job, p.File); err != nil {
+				log.Error(fmt.Sprintf("[%s/%s] Failed to queue library update", job.Username, job.Platform), err, slog.String("file", p.File))
+			}
+		}
+
+		log.Info(fmt.Sprintf("[%s/%s] Recording uploaded", job.Username, job.Platform), slog.String("storage", p.Storage), slog.String("file", p.File))
+		return nil
+	})
+}
+
+// withSidecars returns the file followed by the manifest, thumbnails and the other files that share its name
+func withSidecars(file string) []string {
+	files := []string{file}
+
+	dir, name := filepath.Split(file)
+	prefix := strings.TrimSuffix(name, filepath.Ext(name)) + "."
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == name || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		files = append(files, filepath.Join(dir, e.Name()))
+	}
+	return files
+}
+
+// remoteDir keeps the directory layout of MediaPATH in the backend, a file moved out of it is stored at the top
+func remoteDir(cfg *config.Config, file string) string {
+	rel, err := filepath.Rel(cfg.MediaPATH, filepath.Dir(file))
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// checksum takes the sum the recorder stored in the manifest, only files without one are hashed here
+func checksum(ctx context.Context, file string) (int64, string, error) {
+	if sum, ok := integrity.FromManifest(file); ok {
+		info, err := os.Stat(file)
+		if err != nil {
+			return 0, "", err
+		}
+		return info.Size(), sum, nil
+	}
+	return integrity.Sum(ctx, file)
+}
+
+// verifyStream compares what was read back from a backend with the local file
+func verifyStream(ctx context.Context, r io.Reader, o Object) error {
+	h := sha256.New()
+	size, err := io.Copy(h, integrity.ContextReader(ctx, r))
+	if err != nil {
+		return err
+	}
+	if size != o.Size {
+		return fmt.Errorf("size mismatch: %d bytes stored, %d expected", size, o.Size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != o.Sum {
+		return fmt.Errorf("checksum mismatch: %s stored, %s expected", sum, o.Sum)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"stream-recorder/internal/app/config"
+	"stream-recorder/internal/app/services/integrity"
+	"strings"
+)
+
+// webdavBackend uploads with PUT into a partial file that is moved into place once it is complete.
+// WebDAV has no standard way to append, so an interrupted upload starts over.
+type webdavBackend struct {
+	cfg      config.StorageConfig
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func newWebDAV(sc config.StorageConfig) (*webdavBackend, error) {
+	endpoint, err := url.Parse(sc.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &webdavBackend{cfg: sc, endpoint: endpoint, client: &http.Client{}}, nil
+}
+
+func (b *webdavBackend) Upload(ctx context.Context, o Object, progress func(msg string)) error {
+	target := path.Join(b.cfg.Path, o.Remote)
+	if err := b.mkdirAll(ctx, path.Dir(target)); err != nil {
+		return err
+	}
+
+	f, err := os.Open(o.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	partial := target + ".part"
+	req, err := b.request(ctx, http.MethodPut, partial, integrity.ContextReader(ctx, f))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = o.Size
+	if err := b.do(req, http.StatusOK, http.StatusCreated, http.StatusNoContent); err != nil {
+		return err
+	}
+
+	req, err = b.request(ctx, "MOVE", partial, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Destination", b.url(target).String())
+	req.Header.Set("Overwrite", "T")
+	return b.do(req, http.StatusCreated, http.StatusNoContent)
+}
+
+func (b *webdavBackend) Verify(ctx context.Context, o Object) error {
+	req, err := b.request(ctx, http.MethodGet, path.Join(b.cfg.Path, o.Remote), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webdav: GET: %s", resp.Status)
+	}
+	return verifyStream(ctx, resp.Body, o)
+}
+
+func (b *webdavBackend) Close() error {
+	b.client.CloseIdleConnections()
+	return nil
+}
+
+// mkdirAll creates the collections of the path one by one, an existing one answers 405
+func (b *webdavBackend) mkdirAll(ctx context.Context, dir string) error {
+	var current string
+	for _, name := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		current += "/" + name
+
+		req, err := b.request(ctx, "MKCOL", current+"/", nil)
+		if err != nil {
+			return err
+		}
+		if err := b.do(req, http.StatusCreated, http.StatusMethodNotAllowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *webdavBackend) request(ctx context.Context, method, p string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, b.url(p).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if b.cfg.User != "" {
+		req.SetBasicAuth(b.cfg.User, b.cfg.Password)
+	}
+	return req, nil
+}
+
+func (b *webdavBackend) do(req *http.Request, accepted ...int) error {
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	for _, status := range accepted {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	return fmt.Errorf("webdav: %s %s: %s", req.Method, req.URL.Path, resp.Status)
+}
+
+func (b *webdavBackend) url(p string) *url.URL {
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(p, "/")
+	u.RawPath = ""
+	return &u
+}
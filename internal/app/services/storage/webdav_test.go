@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"stream-recorder/internal/app/config"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestWebDAVUpload(t *testing.T) {
+	fs := webdav.NewMemFS()
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		methods = append(methods, r.Method)
+		(&webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	sc := config.StorageConfig{Type: config.StorageWebDAV, Endpoint: srv.URL + "/dav", Path: "recordings", User: "user", Password: "secret"}
+	b, err := newWebDAV(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// the file is written next to the target and moved over an older copy, the existing collections are accepted
+	if err := fs.Mkdir(ctx, "/dav", 0755); err != nil {
+		t.Fatal(err)
+	}
+	o := testObject(t, "0123456789")
+	for i, content := range []string{"old", "0123456789"} {
+		if err := b.Upload(ctx, testObject(t, content), func(string) {}); err != nil {
+			t.Fatalf("Upload() #%d = %v", i+1, err)
+		}
+	}
+	upload := []string{"MKCOL", "MKCOL", "PUT", "MOVE"}
+	if want := append(upload, upload...); !reflect.DeepEqual(methods, want) {
+		t.Errorf("requests = %v, want %v", methods, want)
+	}
+	if err := b.Verify(ctx, o); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+
+	f, err := fs.OpenFile(ctx, "/dav/recordings/foo/foo.mp4", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "0123456789" {
+		t.Errorf("the server holds %q", data)
+	}
+	if _, err := fs.Stat(ctx, "/dav/recordings/foo/foo.mp4.part"); !os.IsNotExist(err) {
+		t.Errorf("the partial upload was left behind: %v", err)
+	}
+
+	// a copy of other content fails the verification
+	if err := b.Verify(ctx, testObject(t, "0123456780")); err == nil {
+		t.Error("Verify() accepted a file of other content")
+	}
+}
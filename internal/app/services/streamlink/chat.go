@@ -0,0 +1,68 @@
+package streamlink
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// ChatReader is implemented by the platforms whose chat can be read anonymously
+type ChatReader interface {
+	ReadChat(ctx context.Context, channel string, onMessage func(text string)) error
+}
+
+const TwitchChatAddr = "irc.chat.twitch.tv:6697"
+
+// ReadChat joins the chat of the channel as an anonymous user and calls onMessage for every message
+// until ctx is cancelled or the connection drops
+func (t *TwitchAPI) ReadChat(ctx context.Context, channel string, onMessage func(text string)) error {
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: 30 * time.Second}}
+	conn, err := dialer.DialContext(ctx, "tcp", TwitchChatAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// a blocked read only returns when the connection is closed
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// justinfan users are read-only and need no token
+	_, err = fmt.Fprintf(conn, "NICK justinfan%d\r\nJOIN #%s\r\n", 10000+rand.Intn(90000), strings.ToLower(channel))
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "PING") {
+			if _, err := fmt.Fprintf(conn, "PONG%s\r\n", strings.TrimPrefix(line, "PING")); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// :nick!nick@nick.tmi.twitch.tv PRIVMSG #channel :text
+		_, rest, ok := strings.Cut(line, " PRIVMSG #")
+		if !ok {
+			continue
+		}
+		if _, text, ok := strings.Cut(rest, " :"); ok {
+			onMessage(text)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("chat connection closed")
+}
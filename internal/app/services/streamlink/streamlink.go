@@ -1,6 +1,7 @@
 package streamlink
 
 import (
+	"context"
 	"log/slog"
 	"stream-recorder/internal/app/models"
 	"stream-recorder/internal/app/services/utils"
@@ -8,8 +9,9 @@ import (
 )
 
 type PlaylistProvider interface {
-	GetMasterPlaylist(channel string) (string, error)
-	FindMediaPlaylist(masterURL, quality string) (string, error)
+	GetMasterPlaylist(ctx context.Context, channel string) (string, error)
+	FindMediaPlaylist(ctx context.Context, masterURL, quality string) (models.Variant, error)
+	GetStreamInfo(ctx context.Context, channel string) (models.StreamInfo, error)
 	ParseM3u8(line string, m *models.StreamMetadata) (skipCount int, isSegment bool, segmentURL string)
 }
 
@@ -3,6 +3,7 @@ package streamlink
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -46,10 +47,10 @@ func NewTwitch(log *logger.Logger, clientId, deviceId string) *TwitchAPI {
 	}
 }
 
-func (t *TwitchAPI) fetchIntegrity() (string, error) {
+func (t *TwitchAPI) fetchIntegrity(ctx context.Context) (string, error) {
 	t.log.Debug("Fetching client integrity token", slog.String("url", IntegrityURL))
 
-	req, err := http.NewRequest("POST", IntegrityURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", IntegrityURL, nil)
 	if err != nil {
 		t.log.Error("Failed to create request", err)
 		return "", err
@@ -98,10 +99,10 @@ func (t *TwitchAPI) gqlPersistedQuery(operationName, sha256Hash string, variable
 	}
 }
 
-func (t *TwitchAPI) call(data interface{}) (interface{}, error) {
+func (t *TwitchAPI) call(ctx context.Context, data interface{}) (interface{}, error) {
 	t.log.Debug("Making TwitchAPI call", slog.String("url", GqlURL))
 
-	ci, err := t.fetchIntegrity()
+	ci, err := t.fetchIntegrity(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -112,7 +113,7 @@ func (t *TwitchAPI) call(data interface{}) (interface{}, error) {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", GqlURL, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", GqlURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		t.log.Error("Failed to create request", err)
 		return nil, err
@@ -150,7 +151,7 @@ func (t *TwitchAPI) call(data interface{}) (interface{}, error) {
 	return result, nil
 }
 
-func (t *TwitchAPI) accessToken(channel string) (map[string]interface{}, error) {
+func (t *TwitchAPI) accessToken(ctx context.Context, channel string) (map[string]interface{}, error) {
 	t.log.Debug("Fetching access token", slog.String("channel", channel))
 
 	variables := map[string]interface{}{
@@ -162,7 +163,7 @@ func (t *TwitchAPI) accessToken(channel string) (map[string]interface{}, error)
 	}
 	query := t.gqlPersistedQuery("PlaybackAccessToken", "0828119ded1c13477966434e15800ff57ddacf13ba1911c129dc2200705b0712", variables)
 
-	response, err := t.call(query)
+	response, err := t.call(ctx, query)
 	if err != nil {
 		t.log.Error("Failed to get access token", nil, slog.String("channel", channel), err)
 		return nil, err
@@ -193,8 +194,60 @@ func (t *TwitchAPI) accessToken(channel string) (map[string]interface{}, error)
 	}, nil
 }
 
-func (t *TwitchAPI) GetMasterPlaylist(channel string) (string, error) {
-	accessToken, err := t.accessToken(channel)
+func (t *TwitchAPI) GetStreamInfo(ctx context.Context, channel string) (models.StreamInfo, error) {
+	t.log.Debug("Fetching stream info", slog.String("channel", channel))
+
+	query := map[string]interface{}{
+		"query":     `query StreamInfo($login: String!) { user(login: $login) { displayName broadcastSettings { title game { displayName } } } }`,
+		"variables": map[string]interface{}{"login": channel},
+	}
+
+	response, err := t.call(ctx, query)
+	if err != nil {
+		t.log.Error("Failed to get stream info", err, slog.String("channel", channel))
+		return models.StreamInfo{}, err
+	}
+
+	var result struct {
+		Data struct {
+			User *struct {
+				DisplayName       string `json:"displayName"`
+				BroadcastSettings struct {
+					Title string `json:"title"`
+					Game  *struct {
+						DisplayName string `json:"displayName"`
+					} `json:"game"`
+				} `json:"broadcastSettings"`
+			} `json:"user"`
+		} `json:"data"`
+	}
+	// call decodes into a generic value, so it is re-encoded into the typed response
+	data, err := json.Marshal(response)
+	if err != nil {
+		return models.StreamInfo{}, err
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.log.Error("Unexpected response format for stream info", err, slog.Any("response", response))
+		return models.StreamInfo{}, err
+	}
+	if result.Data.User == nil {
+		return models.StreamInfo{}, fmt.Errorf("channel %s not found", channel)
+	}
+
+	info := models.StreamInfo{
+		DisplayName: result.Data.User.DisplayName,
+		Title:       result.Data.User.BroadcastSettings.Title,
+	}
+	if game := result.Data.User.BroadcastSettings.Game; game != nil {
+		info.Category = game.DisplayName
+	}
+
+	t.log.Debug("Stream info fetched successfully", slog.String("channel", channel), slog.Any("info", info))
+	return info, nil
+}
+
+func (t *TwitchAPI) GetMasterPlaylist(ctx context.Context, channel string) (string, error) {
+	accessToken, err := t.accessToken(ctx, channel)
 	if err != nil {
 		t.log.Error("Failed to get access token", nil, slog.String("channel", channel), err)
 		return "", err
@@ -203,11 +256,17 @@ func (t *TwitchAPI) GetMasterPlaylist(channel string) (string, error) {
 	return fmt.Sprintf("%s/api/channel/hls/%s.m3u8?player=twitchweb&platform=web&supported_codecs=h265,h264&p=715347&type=any&allow_source=true&allow_audio_only=true&allow_spectre=false&sig=%s&token=%s", UsherURL, channel, accessToken["signature"].(string), url.QueryEscape(accessToken["value"].(string))), nil
 }
 
-func (t *TwitchAPI) FindMediaPlaylist(masterPlaylist, quality string) (string, error) {
-	resp, err := http.Get(masterPlaylist)
+func (t *TwitchAPI) FindMediaPlaylist(ctx context.Context, masterPlaylist, quality string) (models.Variant, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, masterPlaylist, nil)
+	if err != nil {
+		t.log.Error("Failed to create request", err)
+		return models.Variant{}, err
+	}
+
+	resp, err := t.HTTPClient.Do(req)
 	if err != nil {
 		t.log.Error("Failed to get master playlist", nil, slog.String("masterPlaylist", masterPlaylist), err)
-		return "", err
+		return models.Variant{}, err
 	}
 	defer resp.Body.Close()
 
@@ -216,17 +275,20 @@ func (t *TwitchAPI) FindMediaPlaylist(masterPlaylist, quality string) (string, e
 			t.log.Error("HTTP error in find media playlist", nil, slog.Int("status_code", resp.StatusCode))
 		}
 
-		return "", fmt.Errorf("HTTP error: %d", resp.StatusCode)
+		return models.Variant{}, fmt.Errorf("HTTP error: %d", resp.StatusCode)
 	}
 
 	scanner := bufio.NewScanner(resp.Body)
 	var resolution string
+	var variant models.Variant
 	resUri := make(map[string]string)
+	variants := make(map[string]models.Variant)
 	for scanner.Scan() {
 		line := scanner.Text()
 
 		if strings.HasPrefix(line, "#EXT-X-STREAM-INF") {
 			t.log.Debug("Found tag #EXT-X-STREAM-INF", slog.String("line", line))
+			variant = parseStreamInf(line)
 
 			if resStart := strings.Index(line, "RESOLUTION="); resStart != -1 {
 				resEnd := strings.Index(line[resStart:], ",")
@@ -243,21 +305,62 @@ func (t *TwitchAPI) FindMediaPlaylist(masterPlaylist, quality string) (string, e
 		if strings.HasPrefix(line, "http") {
 			t.log.Debug("Found URL resolution", slog.String("line", line))
 			resUri[resolution] = line
+			variant.URL = line
+			variants[line] = variant
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
 		t.log.Error("Buffer scanning error", err)
-		return "", err
+		return models.Variant{}, err
 	}
 
 	needUri, err := t.FindNeedQuality(resUri, quality)
 	if err != nil {
 		t.log.Error("Failed to find need quality", err, slog.String("quality", quality))
-		return "", err
+		return models.Variant{}, err
 	}
 
-	return needUri, nil
+	return variants[needUri], nil
+}
+
+// parseStreamInf reads the attributes of an #EXT-X-STREAM-INF tag, quoted values may contain commas
+func parseStreamInf(line string) models.Variant {
+	var v models.Variant
+
+	_, attrs, _ := strings.Cut(line, ":")
+	for attrs != "" {
+		key, rest, ok := strings.Cut(attrs, "=")
+		if !ok {
+			break
+		}
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end == -1 {
+				end = len(rest) - 1
+			}
+			value, rest = rest[1:end+1], rest[min(end+2, len(rest)):]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs = strings.TrimPrefix(rest, ",")
+
+		switch key {
+		case "BANDWIDTH":
+			v.Bandwidth, _ = strconv.Atoi(value)
+		case "RESOLUTION":
+			v.Resolution = value
+		case "CODECS":
+			v.Codecs = value
+		case "FRAME-RATE":
+			v.FrameRate, _ = strconv.ParseFloat(value, 64)
+		case "VIDEO":
+			v.Name = value
+		}
+	}
+	return v
 }
 
 func (t *TwitchAPI) FindNeedQuality(resUri map[string]string, quality string) (string, error) {
@@ -343,7 +446,7 @@ func (t *TwitchAPI) ParseM3u8(line string, m *models.StreamMetadata) (skipCount
 
 		*m.TotalDurationStream = time.Duration(parsedTime) * time.Second
 		if *m.StartDurationStream == 0 {
-			m.StartDurationStream = m.TotalDurationStream
+			*m.StartDurationStream = *m.TotalDurationStream
 		}
 		return
 	}
@@ -0,0 +1,117 @@
+package tracker
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracker keeps count of long-running background work (recordings and their
+// finalization) so that shutdown can wait for it
+type Tracker struct {
+	wg sync.WaitGroup
+
+	mu        sync.Mutex
+	nextID    int
+	active    map[int]string
+	completed int
+}
+
+func New() *Tracker {
+	return &Tracker{
+		active: make(map[int]string),
+	}
+}
+
+// Add registers a unit of work and returns the function that marks it as done
+func (t *Tracker) Add(name string) func() {
+	t.mu.Lock()
+	t.nextID++
+	id := t.nextID
+	t.active[id] = name
+	t.mu.Unlock()
+
+	t.wg.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			delete(t.active, id)
+			t.completed++
+			t.mu.Unlock()
+
+			t.wg.Done()
+		})
+	}
+}
+
+// Go runs fn in a new goroutine and tracks it until it returns
+func (t *Tracker) Go(name string, fn func()) {
+	done := t.Add(name)
+	go func() {
+		defer done()
+		fn()
+	}()
+}
+
+// Active returns the names of the work that is still running
+func (t *Tracker) Active() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	names := make([]string, 0, len(t.active))
+	for _, name := range t.active {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Completed returns how many units of work have finished so far
+func (t *Tracker) Completed() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.completed
+}
+
+// Wait blocks until all tracked work is done or timeout expires and reports whether everything finished
+func (t *Tracker) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// WaitPrefix blocks until no work whose name starts with prefix is running or timeout expires
+func (t *Tracker) WaitPrefix(prefix string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		running := false
+		for _, name := range t.Active() {
+			if strings.HasPrefix(name, prefix) {
+				running = true
+				break
+			}
+		}
+		if !running {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
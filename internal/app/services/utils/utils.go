@@ -61,7 +61,7 @@ func (u *Utils) CreateDirectoryIfNotExist(path string) error {
 	_, err := os.Stat(path)
 	if os.IsNotExist(err) {
 		u.log.Debug("Directory does not exist. Creating...", slog.String("outputDir", path))
-		if err := os.Mkdir(path, os.ModePerm); err != nil {
+		if err := os.MkdirAll(path, os.ModePerm); err != nil {
 			return fmt.Errorf("failed to create directory: %w", err)
 		}
 		u.log.Debug("Directory created successfully", slog.String("outputDir", path))
@@ -88,30 +88,6 @@ func (u *Utils) ExtractFilenamesFromTxt(path string) ([]string, error) {
 	return files, nil
 }
 
-func (u *Utils) ClearToTime(dirPath string, dur time.Duration) error {
-	entries, err := os.ReadDir(dirPath)
-	if err != nil {
-		return fmt.Errorf("failed to read directory: %w", err)
-	}
-
-	for _, entry := range entries {
-		entryPath := filepath.Join(dirPath, entry.Name())
-
-		info, err := entry.Info()
-		if err != nil {
-			return fmt.Errorf("failed to get info for %s: %w", entryPath, err)
-		}
-
-		if time.Since(info.ModTime()) > dur {
-			if err := os.RemoveAll(entryPath); err != nil {
-				return fmt.Errorf("failed to remove %s: %w", entryPath, err)
-			}
-		}
-	}
-
-	return nil
-}
-
 func (u *Utils) RemoveEmptyDirs(dir string) error {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
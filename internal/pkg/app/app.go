@@ -1,37 +1,77 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
 	"stream-recorder/internal/app/config"
 	"stream-recorder/internal/app/handlers"
 	"stream-recorder/internal/app/models"
 	"stream-recorder/internal/app/repository"
+	"stream-recorder/internal/app/services/capacity"
+	"stream-recorder/internal/app/services/clips"
+	"stream-recorder/internal/app/services/disk"
+	"stream-recorder/internal/app/services/downloader"
+	"stream-recorder/internal/app/services/integrity"
+	"stream-recorder/internal/app/services/jobs"
+	"stream-recorder/internal/app/services/library"
+	"stream-recorder/internal/app/services/live"
+	"stream-recorder/internal/app/services/m3u8"
+	"stream-recorder/internal/app/services/postprocess"
+	"stream-recorder/internal/app/services/preview"
+	"stream-recorder/internal/app/services/profiles"
+	"stream-recorder/internal/app/services/retention"
 	"stream-recorder/internal/app/services/scheduler"
 	"stream-recorder/internal/app/services/state"
+	"stream-recorder/internal/app/services/storage"
 	"stream-recorder/internal/app/services/streamlink"
+	"stream-recorder/internal/app/services/tracker"
 	"stream-recorder/internal/app/services/utils"
 	"stream-recorder/pkg/logger"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type App struct {
-	log           *logger.Logger
-	db            *gorm.DB
-	cfg           *config.Config
-	streamersRepo *repository.StreamersRepository
-	streamlink    *streamlink.Streamlink
-	scheduler     *scheduler.Scheduler
-	state         *state.State
-	utils         *utils.Utils
+	log            *logger.Logger
+	db             *gorm.DB
+	cfg            *config.Config
+	streamersRepo  *repository.StreamersRepository
+	recordingsRepo *repository.RecordingsRepository
+	jobsRepo       *repository.JobsRepository
+	profilesRepo   *repository.ProfilesRepository
+	libraryRepo    *repository.LibraryRepository
+	queue          *jobs.Queue
+	library        *library.Library
+	disk           *disk.Monitor
+	capacity       *capacity.Limiter
+	retention      *retention.Retention
+	scrubber       *integrity.Scrubber
+	streamlink     *streamlink.Streamlink
+	scheduler      *scheduler.Scheduler
+	downloader     *downloader.Pool
+	tracker        *tracker.Tracker
+	state          *state.State
+	utils          *utils.Utils
+
+	cancel   context.CancelFunc
+	draining atomic.Bool
 }
 
 func New(workMode string) error {
 	a := &App{
-		log:   logger.New(),
-		state: state.New(),
+		log:     logger.New(),
+		state:   state.New(),
+		tracker: tracker.New(),
 	}
 
 	var err error
@@ -39,10 +79,17 @@ func New(workMode string) error {
 	if err != nil {
 		return err
 	}
-	err = a.db.AutoMigrate(models.Streamers{})
+	err = a.db.AutoMigrate(models.Streamers{}, models.Recordings{}, models.RecordingSegments{}, models.RecordingParts{}, models.Jobs{}, models.EncodingProfiles{}, models.LibraryItems{})
+	if err != nil {
+		return err
+	}
+
+	// the journal is written from many recordings at once, sqlite handles that only with a single connection
+	sqlDB, err := a.db.DB()
 	if err != nil {
 		return err
 	}
+	sqlDB.SetMaxOpenConns(1)
 
 	a.cfg, err = config.New("config.json", a.log, workMode)
 	if err != nil {
@@ -52,12 +99,36 @@ func New(workMode string) error {
 	a.log.SetLogLevel(a.cfg.LoggerLevel)
 
 	a.streamersRepo = repository.NewStreamers(a.log, a.db)
+	a.recordingsRepo = repository.NewRecordings(a.log, a.db)
+	a.jobsRepo = repository.NewJobs(a.log, a.db)
+	a.profilesRepo = repository.NewProfiles(a.log, a.db)
+	a.libraryRepo = repository.NewLibrary(a.log, a.db)
 	a.streamlink = streamlink.New(a.log, a.utils, "twitch")
 	a.utils = utils.New(a.log)
-	a.scheduler = scheduler.New(a.log, a.streamersRepo, a.streamlink, a.cfg, a.state, a.utils)
+	a.downloader = downloader.New(a.log, a.cfg)
+	a.queue = jobs.New(a.log, a.cfg, a.jobsRepo, a.tracker)
+	a.library = library.New(a.log, a.cfg, a.libraryRepo)
+	a.retention = retention.New(a.log, a.cfg, a.streamersRepo, a.libraryRepo, a.library)
+	a.scrubber = integrity.New(a.log, a.cfg, a.libraryRepo)
+	a.disk = disk.New(a.log, a.cfg, a.libraryRepo, a.library, a.retention)
+	a.capacity = capacity.New(a.log, a.cfg)
+	a.scheduler = scheduler.New(a.log, a.streamersRepo, a.profilesRepo, a.streamlink, a.cfg, a.state, a.utils, a.downloader, a.tracker, a.recordingsRepo, a.queue, a.disk, a.capacity)
+
+	m3u8.RegisterJobs(a.queue, a.log, a.cfg, a.utils, a.downloader, a.tracker, a.recordingsRepo)
+	postprocess.Register(a.queue, a.log, a.cfg)
+	clips.Register(a.queue, a.log, a.cfg, a.recordingsRepo)
+	library.Register(a.queue, a.library)
+	preview.Register(a.queue, a.log, a.cfg)
+	storage.Register(a.queue, a.log, a.cfg)
+	a.queue.Run()
 
-	a.scheduler.Recovery()
-	go a.scheduler.CheckingForStreams()
+	var ctx context.Context
+	ctx, a.cancel = context.WithCancel(context.Background())
+	// the first check has to finish before any recording is started
+	a.disk.Check(ctx)
+	go a.disk.Run(ctx)
+	a.scheduler.Recovery(ctx)
+	go a.scheduler.CheckingForStreams(ctx)
 
 	go func() {
 		for {
@@ -70,20 +141,36 @@ func New(workMode string) error {
 		}
 	}()
 
+	// the index job keeps the library up to date, the scan picks up what was changed outside the recorder
 	go func() {
 		for {
-			if !a.cfg.AutoCleanMediaPATH {
-				break
+			if _, _, err := a.library.Scan(ctx); err != nil {
+				a.log.Error("Error scanning media library", err)
 			}
-			err = a.utils.ClearToTime(a.cfg.MediaPATH, time.Duration(a.cfg.TimeAutoCleanMediaPATH)*24*time.Hour)
-			if err != nil {
-				a.log.Error("Error clearing directory to time", err)
-				return
+			time.Sleep(3 * time.Hour)
+		}
+	}()
+
+	// retention works on the library, files it did not index are never deleted
+	go func() {
+		for {
+			if _, err := a.retention.Apply(ctx); err != nil {
+				a.log.Error("Error applying retention rules", err)
 			}
 			time.Sleep(3 * time.Hour)
 		}
 	}()
 
+	// every run only re-hashes the files that were not checked within ScrubInterval
+	go func() {
+		for {
+			if _, err := a.scrubber.Scrub(ctx); err != nil {
+				a.log.Error("Error scrubbing media library", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+
 	if workMode == "server" {
 		return setupServer(a)
 	}
@@ -95,6 +182,10 @@ func setupServer(a *App) error {
 	gin.SetMode(a.cfg.GinMode)
 	r := gin.Default()
 	r.Use(func(c *gin.Context) {
+		if a.draining.Load() {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "server is shutting down"})
+			return
+		}
 		c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
 		c.Header("Pragma", "no-cache")
 		c.Header("Expires", time.Now().Add(-1*time.Second).Format(time.RFC1123))
@@ -102,25 +193,126 @@ func setupServer(a *App) error {
 	})
 
 	// регистрируем эндпоинты
-	serviceStreamer := handlers.NewStreamer(a.log, a.streamersRepo, a.state)
-	serviceStream := handlers.NewStream(a.log, a.state, a.cfg, a.utils)
+	serviceStreamer := handlers.NewStreamer(a.log, a.cfg, a.streamersRepo, a.profilesRepo, a.state)
+	serviceStream := handlers.NewStream(a.log, a.state, a.cfg, a.utils, a.downloader, a.tracker, a.recordingsRepo, a.queue, a.disk, a.capacity)
+	serviceJobs := handlers.NewJobs(a.log, a.jobsRepo, a.queue)
+	serviceProfiles := handlers.NewProfiles(a.log, a.profilesRepo, profiles.New(a.log, a.cfg))
+	serviceLive := handlers.NewLive(a.log, live.New(a.log, a.cfg, a.recordingsRepo))
+	serviceLibrary := handlers.NewLibrary(a.log, a.cfg, a.libraryRepo, a.library)
+	serviceDisk := handlers.NewDisk(a.log, a.disk)
+	serviceRetention := handlers.NewRetention(a.log, a.retention)
+	serviceIntegrity := handlers.NewIntegrity(a.log, a.libraryRepo, a.scrubber)
+	serviceCapacity := handlers.NewCapacity(a.log, a.capacity)
 
 	// регистрируем маршруты
 	r.GET("/streamer/list", serviceStreamer.GetStreamersHandler)
+	r.GET("/streamer/status", serviceStreamer.GetStreamersStatusHandler)
 	r.GET("/streamer/add", serviceStreamer.AddStreamerHandler)
 	r.GET("/streamer/update", serviceStreamer.UpdateStreamerHandler)
 	r.GET("/streamer/delete", serviceStreamer.DeleteStreamerHandler)
 	r.GET("/stream/cut", serviceStream.CutStreamHandler)
 	r.GET("/stream/download_m3u8", serviceStream.DownloadM3u8Handler)
+	r.GET("/stream/replay", serviceStream.SaveReplayHandler)
+	r.GET("/stream/clip", serviceStream.ClipStreamHandler)
+	r.GET("/jobs/list", serviceJobs.ListJobsHandler)
+	r.GET("/jobs/log", serviceJobs.GetJobLogHandler)
+	r.GET("/jobs/retry", serviceJobs.RetryJobHandler)
+	r.GET("/jobs/cancel", serviceJobs.CancelJobHandler)
+	r.GET("/profile/list", serviceProfiles.GetProfilesHandler)
+	r.GET("/profile/add", serviceProfiles.AddProfileHandler)
+	r.GET("/profile/update", serviceProfiles.UpdateProfileHandler)
+	r.GET("/profile/delete", serviceProfiles.DeleteProfileHandler)
+	r.GET("/live/:platform/:username/:file", serviceLive.LiveHandler)
+	r.GET("/library/list", serviceLibrary.ListLibraryHandler)
+	r.GET("/library/get", serviceLibrary.GetLibraryItemHandler)
+	r.GET("/library/file", serviceLibrary.ServeLibraryFileHandler)
+	r.GET("/library/poster", serviceLibrary.PosterLibraryHandler)
+	r.GET("/library/sheet", serviceLibrary.SheetLibraryHandler)
+	r.GET("/library/delete", serviceLibrary.DeleteLibraryItemHandler)
+	r.GET("/library/pin", serviceLibrary.PinLibraryItemHandler)
+	r.GET("/library/scan", serviceLibrary.ScanLibraryHandler)
+	r.GET("/retention/plan", serviceRetention.PlanRetentionHandler)
+	r.GET("/retention/apply", serviceRetention.ApplyRetentionHandler)
+	r.GET("/integrity/report", serviceIntegrity.GetIntegrityReportHandler)
+	r.GET("/integrity/scrub", serviceIntegrity.ScrubIntegrityHandler)
+	r.GET("/integrity/check", serviceIntegrity.CheckIntegrityHandler)
+	r.GET("/disk/status", serviceDisk.GetDiskStatusHandler)
+	r.GET("/disk/check", serviceDisk.CheckDiskHandler)
+	r.GET("/capacity/status", serviceCapacity.GetCapacityStatusHandler)
 
-	return runServer(r, a.cfg.Port)
+	return runServer(a, r)
 }
 
-func runServer(router *gin.Engine, port int) error {
-	err := router.Run(fmt.Sprintf(":%d", port))
-	if err != nil {
+func runServer(a *App, router *gin.Engine) error {
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", a.cfg.Port),
+		Handler: router,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case err := <-errCh:
 		return err
+	case <-ctx.Done():
 	}
+	stop()
+
+	return a.shutdown(srv)
+}
+
+// shutdown stops accepting API calls, cancels every recording and waits for the
+// running finalizations before closing the HTTP server
+func (a *App) shutdown(srv *http.Server) error {
+	a.log.Info("Shutdown signal received, finishing active recordings...")
+	a.draining.Store(true)
 
+	var recordings int
+	for _, name := range a.tracker.Active() {
+		if strings.HasPrefix(name, "recording ") {
+			recordings++
+		}
+	}
+
+	a.cancel()
+	a.state.CancelAllM3u8()
+
+	// the stopped recordings queue their last parts, the job workers exit once those are finalized.
+	// Previews, post-processing and uploads stay queued for the next start.
+	timeout := time.Duration(a.cfg.ShutdownTimeout) * time.Second
+	deadline := time.Now().Add(timeout)
+	a.tracker.WaitPrefix("recording ", timeout)
+	a.queue.Drain(models.JobTypeConcat, models.JobTypeVerify)
+	finished := a.tracker.Wait(time.Until(deadline))
+	if !finished {
+		// the finalizations that did not make it are interrupted and resumed on the next start
+		a.queue.Stop()
+		a.tracker.Wait(5 * time.Second)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		a.log.Error("Error shutting down HTTP server", err)
+	}
+
+	pending := a.tracker.Active()
+	a.log.Info("Shutdown summary",
+		slog.Int("stopped_recordings", recordings),
+		slog.Int("completed_jobs", a.tracker.Completed()),
+		slog.Int("pending_jobs", len(pending)),
+	)
+
+	if !finished {
+		return fmt.Errorf("shutdown timeout of %s exceeded, unfinished jobs: %s", timeout, strings.Join(pending, ", "))
+	}
 	return nil
 }
@@ -0,0 +1,73 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Capabilities lists the encoders and muxers compiled into an ffmpeg binary
+type Capabilities struct {
+	Encoders map[string]bool
+	Muxers   map[string]bool
+}
+
+// Capabilities asks the binary for its encoders and muxers
+func (f *FFmpeg) Capabilities(ctx context.Context) (*Capabilities, error) {
+	encoders, err := f.list(ctx, "-encoders")
+	if err != nil {
+		return nil, err
+	}
+	muxers, err := f.list(ctx, "-muxers")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Capabilities{Encoders: encoders, Muxers: muxers}, nil
+}
+
+// list parses the table printed by -encoders or -muxers: a legend, a "--" separator
+// and one "<flags> <name> <description>" line per entry
+func (f *FFmpeg) list(ctx context.Context, flag string) (map[string]bool, error) {
+	out, err := f.Run(ctx, "-hide_banner", flag)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	var table bool
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if !table {
+			table = len(fields) == 1 && strings.HasPrefix(fields[0], "--")
+			continue
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		for _, name := range strings.Split(fields[1], ",") {
+			names[name] = true
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("ffmpeg %s returned no entries", flag)
+	}
+	return names, nil
+}
+
+// Run executes the binary with raw arguments and returns its combined output
+func (f *FFmpeg) Run(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, f.GetFileWithExt(), args...)
+	cmd.SysProcAttr = GetSysProcAttr()
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
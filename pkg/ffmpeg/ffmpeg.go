@@ -1,8 +1,10 @@
 package ffmpeg
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"os/exec"
@@ -71,32 +73,63 @@ func (f *FFmpeg) GetFileWithExt() string {
 	return "tmp/ffmpeg"
 }
 
-func (f *FFmpeg) Execute(inputPath []string, outputPath string) error {
+// Execute runs ffmpeg and kills the process as soon as ctx is done
+func (f *FFmpeg) Execute(ctx context.Context, inputPath []string, outputPath string) error {
 	if len(f.errs) > 0 {
 		return errors.New(strings.Join(f.errs, "\n"))
 	}
 
-	args := f.startArgs
+	// input options apply to every input
+	var args []string
 	for _, path := range inputPath {
+		args = append(args, f.startArgs...)
 		args = append(args, "-i", path)
 	}
 	args = append(args, f.endArgs...)
 	args = append(args, outputPath)
 
 	fmt.Println(args)
-	f.cmd = exec.Command(f.GetFileWithExt(), args...)
+	f.cmd = exec.CommandContext(ctx, f.GetFileWithExt(), args...)
 	f.cmd.SysProcAttr = GetSysProcAttr()
 
+	// the end of stderr is kept so that the error says why ffmpeg failed
+	var stderr tailBuffer
 	f.cmd.Stdout = os.Stdout
-	f.cmd.Stderr = os.Stderr
+	f.cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
 
 	if err := f.cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
 		return err
 	}
 
 	return nil
 }
 
+// tailSize is how much of stderr is kept for the error message
+const tailSize = 2048
+
+// tailBuffer keeps the last few kilobytes written to it
+type tailBuffer struct {
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > 2*tailSize {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-tailSize:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	if len(b.buf) > tailSize {
+		return string(b.buf[len(b.buf)-tailSize:])
+	}
+	return string(b.buf)
+}
+
 func (f *FFmpeg) Clear() *FFmpeg {
 	f.startArgs = f.startArgs[:0]
 	f.endArgs = f.endArgs[:0]
@@ -205,9 +238,22 @@ func (f *FFmpeg) Format(format string) *FFmpeg {
 	return f
 }
 
-// Safe is an analog of the -safe parameter in ffmpeg
+// Safe is an analog of the -safe parameter of the concat demuxer in ffmpeg
 func (f *FFmpeg) Safe(safe int) *FFmpeg {
-	f.endArgs = append(f.endArgs, "-safe", fmt.Sprint(safe))
+	f.startArgs = append(f.startArgs, "-safe", fmt.Sprint(safe))
+	return f
+}
+
+// Seek is an analog of the -ss input parameter in ffmpeg (seek in the input before decoding it).
+// With stream copy the cut starts at the preceding keyframe, with re-encoding it is frame accurate.
+func (f *FFmpeg) Seek(start string) *FFmpeg {
+	f.startArgs = append(f.startArgs, "-ss", start)
+	return f
+}
+
+// SeekEOF is an analog of the -sseof input parameter in ffmpeg (seek relative to the end of the input, the value is negative)
+func (f *FFmpeg) SeekEOF(offset string) *FFmpeg {
+	f.startArgs = append(f.startArgs, "-sseof", offset)
 	return f
 }
 
@@ -219,3 +265,53 @@ func (f *FFmpeg) ExtraArgs(extraArgs []string) *FFmpeg {
 	f.endArgs = append(f.endArgs, extraArgs...)
 	return f
 }
+
+// CRF is an analog of the -crf parameter in ffmpeg (constant rate factor of the video encoder)
+func (f *FFmpeg) CRF(crf int) *FFmpeg {
+	if crf < 0 || crf > 63 {
+		f.errs = append(f.errs, "crf must be between 0 and 63")
+	}
+	f.endArgs = append(f.endArgs, "-crf", fmt.Sprint(crf))
+
+	return f
+}
+
+// Preset is an analog of the -preset parameter in ffmpeg
+func (f *FFmpeg) Preset(preset string) *FFmpeg {
+	f.endArgs = append(f.endArgs, "-preset", preset)
+	return f
+}
+
+// AudioFilter is an analog of the -af parameter in ffmpeg
+func (f *FFmpeg) AudioFilter(filter string) *FFmpeg {
+	f.endArgs = append(f.endArgs, "-af", filter)
+	return f
+}
+
+// VideoFrames is an analog of the -frames:v parameter in ffmpeg
+func (f *FFmpeg) VideoFrames(frames int) *FFmpeg {
+	if frames < 1 {
+		f.errs = append(f.errs, "frames:v must be ≥ 1")
+	}
+	f.endArgs = append(f.endArgs, "-frames:v", fmt.Sprint(frames))
+
+	return f
+}
+
+// VideoBitrate is an analog of the -b:v parameter in ffmpeg
+func (f *FFmpeg) VideoBitrate(bitrate string) *FFmpeg {
+	f.endArgs = append(f.endArgs, "-b:v", bitrate)
+	return f
+}
+
+// AudioBitrate is an analog of the -b:a parameter in ffmpeg
+func (f *FFmpeg) AudioBitrate(bitrate string) *FFmpeg {
+	f.endArgs = append(f.endArgs, "-b:a", bitrate)
+	return f
+}
+
+// VideoFilter is an analog of the -vf parameter in ffmpeg
+func (f *FFmpeg) VideoFilter(filter string) *FFmpeg {
+	f.endArgs = append(f.endArgs, "-vf", filter)
+	return f
+}
@@ -0,0 +1,111 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+type FFprobe struct {
+	ffprobePath string
+}
+
+// ProbeStream is a stream entry of the ffprobe -show_streams output
+type ProbeStream struct {
+	Index      int    `json:"index"`
+	CodecName  string `json:"codec_name"`
+	CodecType  string `json:"codec_type"`
+	Profile    string `json:"profile"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	SampleRate string `json:"sample_rate"`
+	Channels   int    `json:"channels"`
+	StartTime  string `json:"start_time"`
+	Duration   string `json:"duration"`
+}
+
+// ProbeFormat is the container entry of the ffprobe -show_format output
+type ProbeFormat struct {
+	FormatName string `json:"format_name"`
+	StartTime  string `json:"start_time"`
+	Duration   string `json:"duration"`
+	Size       string `json:"size"`
+	BitRate    string `json:"bit_rate"`
+}
+
+type ProbeResult struct {
+	Streams []ProbeStream `json:"streams"`
+	Format  ProbeFormat   `json:"format"`
+}
+
+// NewFfprobe uses the binary at ffprobePath or, when it is empty, the one found in PATH
+func NewFfprobe(ffprobePath string) (*FFprobe, error) {
+	if ffprobePath == "" {
+		path, err := exec.LookPath("ffprobe")
+		if err != nil {
+			return nil, fmt.Errorf("ffprobe not found: %w", err)
+		}
+		ffprobePath = path
+	}
+
+	return &FFprobe{
+		ffprobePath: ffprobePath,
+	}, nil
+}
+
+// Probe returns the streams and the container information of the file
+func (f *FFprobe) Probe(ctx context.Context, path string) (*ProbeResult, error) {
+	cmd := exec.CommandContext(ctx, f.ffprobePath, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path)
+	cmd.SysProcAttr = GetSysProcAttr()
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var result ProbeResult
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+	return &result, nil
+}
+
+// Stream returns the first stream of the given type (video, audio, ...)
+func (r *ProbeResult) Stream(codecType string) *ProbeStream {
+	for i := range r.Streams {
+		if r.Streams[i].CodecType == codecType {
+			return &r.Streams[i]
+		}
+	}
+	return nil
+}
+
+// DurationSeconds returns the container duration, 0 when it is unknown
+func (r *ProbeResult) DurationSeconds() float64 {
+	return parseSeconds(r.Format.Duration)
+}
+
+// StartSeconds returns the stream start time, 0 when it is unknown
+func (s *ProbeStream) StartSeconds() float64 {
+	return parseSeconds(s.StartTime)
+}
+
+// DurationSeconds returns the stream duration, 0 when it is unknown
+func (s *ProbeStream) DurationSeconds() float64 {
+	return parseSeconds(s.Duration)
+}
+
+func parseSeconds(value string) float64 {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
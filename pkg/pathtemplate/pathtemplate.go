@@ -0,0 +1,173 @@
+package pathtemplate
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxComponentLength keeps every rendered path component within the common 255 byte filesystem limit
+const maxComponentLength = 200
+
+// Template is a path pattern with {placeholder} variables and strftime-like %X directives
+// expanded from the wall-clock time. A "/" in the pattern starts a new directory.
+type Template struct {
+	raw   string
+	names map[string]bool
+}
+
+// Parse checks that the pattern only uses the allowed placeholders and known time directives
+func Parse(pattern string, allowed ...string) (*Template, error) {
+	if strings.TrimSpace(pattern) == "" {
+		return nil, fmt.Errorf("template is empty")
+	}
+
+	names := make(map[string]bool, len(allowed))
+	for _, name := range allowed {
+		names[name] = true
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '{':
+			end := strings.IndexByte(pattern[i:], '}')
+			if end == -1 {
+				return nil, fmt.Errorf("unclosed placeholder at position %d", i)
+			}
+			name := pattern[i+1 : i+end]
+			if !names[name] {
+				return nil, fmt.Errorf("unknown placeholder {%s}", name)
+			}
+			i += end
+		case '%':
+			if i+1 >= len(pattern) {
+				return nil, fmt.Errorf("incomplete time directive at the end")
+			}
+			if !strings.ContainsRune(timeDirectives, rune(pattern[i+1])) {
+				return nil, fmt.Errorf("unknown time directive %%%c", pattern[i+1])
+			}
+			i++
+		}
+	}
+
+	for _, part := range strings.Split(pattern, "/") {
+		if part == "" || part == "." || part == ".." {
+			return nil, fmt.Errorf("template contains an empty or relative path element")
+		}
+	}
+
+	return &Template{raw: pattern, names: names}, nil
+}
+
+// Render expands the template. Values are sanitised before they are inserted, so they
+// can never introduce a directory separator, and every path element is sanitised again.
+func (t *Template) Render(vars map[string]string, at time.Time) string {
+	parts := strings.Split(t.raw, "/")
+	for i, part := range parts {
+		parts[i] = Sanitize(t.renderPart(part, vars, at))
+		if parts[i] == "" {
+			parts[i] = "_"
+		}
+	}
+	return filepath.Join(parts...)
+}
+
+func (t *Template) renderPart(part string, vars map[string]string, at time.Time) string {
+	var b strings.Builder
+	for i := 0; i < len(part); i++ {
+		switch part[i] {
+		case '{':
+			end := strings.IndexByte(part[i:], '}')
+			b.WriteString(Sanitize(vars[part[i+1:i+end]]))
+			i += end
+		case '%':
+			b.WriteString(formatDirective(part[i+1], at))
+			i++
+		default:
+			b.WriteByte(part[i])
+		}
+	}
+	return b.String()
+}
+
+const timeDirectives = "YymdHIMSpbBaAjzZs%"
+
+func formatDirective(d byte, at time.Time) string {
+	switch d {
+	case 'Y':
+		return at.Format("2006")
+	case 'y':
+		return at.Format("06")
+	case 'm':
+		return at.Format("01")
+	case 'd':
+		return at.Format("02")
+	case 'H':
+		return at.Format("15")
+	case 'I':
+		return at.Format("03")
+	case 'M':
+		return at.Format("04")
+	case 'S':
+		return at.Format("05")
+	case 'p':
+		return at.Format("PM")
+	case 'b':
+		return at.Format("Jan")
+	case 'B':
+		return at.Format("January")
+	case 'a':
+		return at.Format("Mon")
+	case 'A':
+		return at.Format("Monday")
+	case 'j':
+		return fmt.Sprintf("%03d", at.YearDay())
+	case 'z':
+		return at.Format("-0700")
+	case 'Z':
+		return at.Format("MST")
+	case 's':
+		return strconv.FormatInt(at.Unix(), 10)
+	case '%':
+		return "%"
+	}
+	return ""
+}
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Sanitize makes a single path element safe on Linux, macOS and Windows: separators, reserved
+// and control characters are replaced, trailing dots and spaces are trimmed and the length is capped
+func Sanitize(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r):
+			continue
+		case strings.ContainsRune(`<>:"/\|?*`, r):
+			b.WriteByte('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	out := strings.TrimRight(strings.TrimSpace(b.String()), ". ")
+	for len(out) > maxComponentLength {
+		_, size := utf8.DecodeLastRuneInString(out)
+		out = out[:len(out)-size]
+	}
+	out = strings.TrimRight(out, ". ")
+
+	if base, _, _ := strings.Cut(out, "."); reservedNames[strings.ToUpper(base)] {
+		out = "_" + out
+	}
+	return out
+}
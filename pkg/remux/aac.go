@@ -0,0 +1,69 @@
+package remux
+
+import "errors"
+
+// samplesPerAACFrame is the number of PCM samples carried by one AAC-LC frame
+const samplesPerAACFrame = 1024
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+type adtsHeader struct {
+	profile, sampleRateIndex, channelConfig byte
+	headerSize, frameSize                   int
+}
+
+func parseADTS(data []byte) (*adtsHeader, error) {
+	if len(data) < 7 || data[0] != 0xFF || data[1]&0xF0 != 0xF0 {
+		return nil, errors.New("invalid adts sync word")
+	}
+
+	h := &adtsHeader{
+		profile:         data[2] >> 6,
+		sampleRateIndex: (data[2] >> 2) & 0x0F,
+		channelConfig:   (data[2]&0x01)<<2 | data[3]>>6,
+		headerSize:      7,
+		frameSize:       int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5])>>5,
+	}
+	if data[1]&0x01 == 0 {
+		h.headerSize = 9
+	}
+
+	if int(h.sampleRateIndex) >= len(aacSampleRates) {
+		return nil, errors.New("invalid adts sample rate index")
+	}
+	if h.frameSize < h.headerSize {
+		return nil, errors.New("invalid adts frame size")
+	}
+	return h, nil
+}
+
+// audioSpecificConfig builds the two byte AudioSpecificConfig for the stream
+func (h *adtsHeader) audioSpecificConfig() []byte {
+	objectType := h.profile + 1
+	return []byte{
+		objectType<<3 | h.sampleRateIndex>>1,
+		(h.sampleRateIndex&0x01)<<7 | h.channelConfig<<3,
+	}
+}
+
+// handleAAC splits a PES payload into raw AAC frames
+func (t *track) handleAAC(es []byte) [][]byte {
+	var frames [][]byte
+
+	for len(es) > 0 {
+		h, err := parseADTS(es)
+		if err != nil || h.frameSize > len(es) {
+			break
+		}
+
+		if t.config == nil {
+			t.config = h.audioSpecificConfig()
+			t.sampleRate = aacSampleRates[h.sampleRateIndex]
+			t.channels = int(h.channelConfig)
+		}
+
+		frames = append(frames, es[h.headerSize:h.frameSize])
+		es = es[h.frameSize:]
+	}
+	return frames
+}
@@ -0,0 +1,154 @@
+package remux
+
+import (
+	"bytes"
+	"errors"
+)
+
+var errBitsExhausted = errors.New("bitstream exhausted")
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func newBitReader(data []byte) *bitReader {
+	return &bitReader{data: data}
+}
+
+func (b *bitReader) bit() (uint32, error) {
+	if b.pos >= len(b.data)*8 {
+		return 0, errBitsExhausted
+	}
+	v := (b.data[b.pos/8] >> (7 - uint(b.pos%8))) & 1
+	b.pos++
+	return uint32(v), nil
+}
+
+func (b *bitReader) bits(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		bit, err := b.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | bit
+	}
+	return v, nil
+}
+
+func (b *bitReader) skip(n int) error {
+	if b.pos+n > len(b.data)*8 {
+		return errBitsExhausted
+	}
+	b.pos += n
+	return nil
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (b *bitReader) ue() (uint32, error) {
+	zeros := 0
+	for {
+		bit, err := b.bit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errors.New("invalid exp-golomb code")
+		}
+	}
+	v, err := b.bits(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1<<uint(zeros) - 1) + v, nil
+}
+
+// se reads a signed Exp-Golomb code
+func (b *bitReader) se() (int32, error) {
+	v, err := b.ue()
+	if err != nil {
+		return 0, err
+	}
+	if v%2 == 0 {
+		return -int32(v / 2), nil
+	}
+	return int32(v/2) + 1, nil
+}
+
+// unescapeRBSP removes emulation prevention bytes (0x000003) from a NAL unit
+func unescapeRBSP(nal []byte) []byte {
+	if !bytes.Contains(nal, []byte{0, 0, 3}) {
+		return nal
+	}
+
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, c := range nal {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// splitAnnexB splits an Annex B byte stream into NAL units without start codes
+func splitAnnexB(data []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+
+	for i := 0; i+2 < len(data); {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				nals = appendNAL(nals, data[start:i])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+
+	if start >= 0 && start < len(data) {
+		nals = appendNAL(nals, data[start:])
+	}
+	return nals
+}
+
+func appendNAL(nals [][]byte, nal []byte) [][]byte {
+	// trailing zero bytes belong to the next (4-byte) start code
+	for len(nal) > 0 && nal[len(nal)-1] == 0 {
+		nal = nal[:len(nal)-1]
+	}
+	if len(nal) == 0 {
+		return nals
+	}
+	return append(nals, nal)
+}
+
+// toLengthPrefixed converts NAL units into the 4-byte length-prefixed form used by MP4 and Matroska
+func toLengthPrefixed(nals [][]byte) []byte {
+	size := 0
+	for _, nal := range nals {
+		size += 4 + len(nal)
+	}
+
+	out := make([]byte, 0, size)
+	for _, nal := range nals {
+		n := len(nal)
+		out = append(out, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		out = append(out, nal...)
+	}
+	return out
+}
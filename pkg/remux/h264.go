@@ -0,0 +1,231 @@
+package remux
+
+import (
+	"bytes"
+	"errors"
+)
+
+const (
+	h264NALIDR = 5
+	h264NALSPS = 7
+	h264NALPPS = 8
+	h264NALAUD = 9
+)
+
+type h264SPS struct {
+	profile, compat, level byte
+	width, height          int
+}
+
+func parseH264SPS(nal []byte) (*h264SPS, error) {
+	if len(nal) < 4 {
+		return nil, errors.New("h264 sps is too short")
+	}
+
+	sps := &h264SPS{profile: nal[1], compat: nal[2], level: nal[3]}
+	br := newBitReader(unescapeRBSP(nal[4:]))
+
+	if _, err := br.ue(); err != nil { // seq_parameter_set_id
+		return nil, err
+	}
+
+	chromaFormat := uint32(1)
+	switch sps.profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		var err error
+		if chromaFormat, err = br.ue(); err != nil {
+			return nil, err
+		}
+		if chromaFormat == 3 {
+			if err := br.skip(1); err != nil { // separate_colour_plane_flag
+				return nil, err
+			}
+		}
+		if _, err := br.ue(); err != nil { // bit_depth_luma_minus8
+			return nil, err
+		}
+		if _, err := br.ue(); err != nil { // bit_depth_chroma_minus8
+			return nil, err
+		}
+		if err := br.skip(1); err != nil { // qpprime_y_zero_transform_bypass_flag
+			return nil, err
+		}
+		present, err := br.bit()
+		if err != nil {
+			return nil, err
+		}
+		if present == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				listPresent, err := br.bit()
+				if err != nil {
+					return nil, err
+				}
+				if listPresent == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				if err := skipScalingList(br, size); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if _, err := br.ue(); err != nil { // log2_max_frame_num_minus4
+		return nil, err
+	}
+	pocType, err := br.ue()
+	if err != nil {
+		return nil, err
+	}
+	switch pocType {
+	case 0:
+		if _, err := br.ue(); err != nil {
+			return nil, err
+		}
+	case 1:
+		if err := br.skip(1); err != nil {
+			return nil, err
+		}
+		if _, err := br.se(); err != nil {
+			return nil, err
+		}
+		if _, err := br.se(); err != nil {
+			return nil, err
+		}
+		cycle, err := br.ue()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < cycle; i++ {
+			if _, err := br.se(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if _, err := br.ue(); err != nil { // max_num_ref_frames
+		return nil, err
+	}
+	if err := br.skip(1); err != nil { // gaps_in_frame_num_value_allowed_flag
+		return nil, err
+	}
+	widthMbs, err := br.ue()
+	if err != nil {
+		return nil, err
+	}
+	heightMapUnits, err := br.ue()
+	if err != nil {
+		return nil, err
+	}
+	frameMbsOnly, err := br.bit()
+	if err != nil {
+		return nil, err
+	}
+	if frameMbsOnly == 0 {
+		if err := br.skip(1); err != nil { // mb_adaptive_frame_field_flag
+			return nil, err
+		}
+	}
+	if err := br.skip(1); err != nil { // direct_8x8_inference_flag
+		return nil, err
+	}
+
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	cropping, err := br.bit()
+	if err != nil {
+		return nil, err
+	}
+	if cropping == 1 {
+		for _, v := range []*uint32{&cropLeft, &cropRight, &cropTop, &cropBottom} {
+			if *v, err = br.ue(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	cropUnitX, cropUnitY := uint32(1), 2-frameMbsOnly
+	switch chromaFormat {
+	case 1:
+		cropUnitX, cropUnitY = 2, 2*(2-frameMbsOnly)
+	case 2:
+		cropUnitX = 2
+	}
+
+	sps.width = int((widthMbs+1)*16 - (cropLeft+cropRight)*cropUnitX)
+	sps.height = int((2-frameMbsOnly)*(heightMapUnits+1)*16 - (cropTop+cropBottom)*cropUnitY)
+	return sps, nil
+}
+
+func skipScalingList(br *bitReader, size int) error {
+	last, next := int32(8), int32(8)
+	for j := 0; j < size; j++ {
+		if next != 0 {
+			delta, err := br.se()
+			if err != nil {
+				return err
+			}
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+	return nil
+}
+
+// buildAVCC builds an AVCDecoderConfigurationRecord
+func buildAVCC(sps, pps []byte) []byte {
+	out := []byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE1}
+	out = append(out, byte(len(sps)>>8), byte(len(sps)))
+	out = append(out, sps...)
+	out = append(out, 1, byte(len(pps)>>8), byte(len(pps)))
+	out = append(out, pps...)
+	return out
+}
+
+// handleH264 converts an Annex B access unit into length-prefixed form and
+// picks up parameter sets for the decoder configuration on the way
+func (t *track) handleH264(es []byte) ([]byte, bool) {
+	var nals [][]byte
+	var sps, pps []byte
+	key := false
+
+	for _, nal := range splitAnnexB(es) {
+		switch nal[0] & 0x1F {
+		case h264NALAUD:
+			continue
+		case h264NALIDR:
+			key = true
+		case h264NALSPS:
+			sps = nal
+		case h264NALPPS:
+			pps = nal
+		}
+		nals = append(nals, nal)
+	}
+
+	if sps != nil && !bytes.Equal(sps, t.sps) {
+		if parsed, err := parseH264SPS(sps); err == nil {
+			t.sps, t.h264SPS = append([]byte(nil), sps...), parsed
+		}
+	}
+	if pps != nil && !bytes.Equal(pps, t.pps) {
+		t.pps = append([]byte(nil), pps...)
+	}
+	// the parameter sets are kept in-band as well, a change only takes effect at a keyframe
+	if t.sps != nil && t.pps != nil && (t.config == nil || key) {
+		t.setConfig(buildAVCC(t.sps, t.pps), t.h264SPS.width, t.h264SPS.height)
+	}
+	if len(nals) == 0 {
+		return nil, false
+	}
+	return toLengthPrefixed(nals), key
+}
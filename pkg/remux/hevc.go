@@ -0,0 +1,208 @@
+package remux
+
+import (
+	"bytes"
+	"errors"
+)
+
+const (
+	hevcNALIRAPFirst = 16
+	hevcNALIRAPLast  = 23
+	hevcNALVPS       = 32
+	hevcNALSPS       = 33
+	hevcNALPPS       = 34
+	hevcNALAUD       = 35
+)
+
+type hevcSPS struct {
+	maxSubLayers      uint32
+	temporalIDNesting uint32
+	// profile_tier_level: profile space, tier, profile idc, compatibility flags,
+	// constraint flags and level idc exactly as they appear in the bitstream
+	ptl            [12]byte
+	chromaFormat   uint32
+	bitDepthLuma   uint32
+	bitDepthChroma uint32
+	width, height  int
+}
+
+func hevcNALType(nal []byte) byte {
+	return (nal[0] >> 1) & 0x3F
+}
+
+func parseHEVCSPS(nal []byte) (*hevcSPS, error) {
+	rbsp := unescapeRBSP(nal[min(2, len(nal)):])
+	if len(rbsp) < 13 {
+		return nil, errors.New("hevc sps is too short")
+	}
+
+	br := newBitReader(rbsp)
+	sps := &hevcSPS{}
+
+	if err := br.skip(4); err != nil { // sps_video_parameter_set_id
+		return nil, err
+	}
+	maxSubLayersMinus1, err := br.bits(3)
+	if err != nil {
+		return nil, err
+	}
+	if sps.temporalIDNesting, err = br.bit(); err != nil {
+		return nil, err
+	}
+	sps.maxSubLayers = maxSubLayersMinus1 + 1
+
+	// general profile_tier_level is byte aligned at this point
+	copy(sps.ptl[:], rbsp[1:13])
+	if err := br.skip(96); err != nil {
+		return nil, err
+	}
+
+	profilePresent := make([]uint32, maxSubLayersMinus1)
+	levelPresent := make([]uint32, maxSubLayersMinus1)
+	for i := uint32(0); i < maxSubLayersMinus1; i++ {
+		if profilePresent[i], err = br.bit(); err != nil {
+			return nil, err
+		}
+		if levelPresent[i], err = br.bit(); err != nil {
+			return nil, err
+		}
+	}
+	if maxSubLayersMinus1 > 0 {
+		if err := br.skip(int(2 * (8 - maxSubLayersMinus1))); err != nil {
+			return nil, err
+		}
+	}
+	for i := uint32(0); i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] == 1 {
+			if err := br.skip(88); err != nil {
+				return nil, err
+			}
+		}
+		if levelPresent[i] == 1 {
+			if err := br.skip(8); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if _, err := br.ue(); err != nil { // sps_seq_parameter_set_id
+		return nil, err
+	}
+	if sps.chromaFormat, err = br.ue(); err != nil {
+		return nil, err
+	}
+	if sps.chromaFormat == 3 {
+		if err := br.skip(1); err != nil { // separate_colour_plane_flag
+			return nil, err
+		}
+	}
+	width, err := br.ue()
+	if err != nil {
+		return nil, err
+	}
+	height, err := br.ue()
+	if err != nil {
+		return nil, err
+	}
+
+	var left, right, top, bottom uint32
+	window, err := br.bit()
+	if err != nil {
+		return nil, err
+	}
+	if window == 1 {
+		for _, v := range []*uint32{&left, &right, &top, &bottom} {
+			if *v, err = br.ue(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if sps.bitDepthLuma, err = br.ue(); err != nil {
+		return nil, err
+	}
+	if sps.bitDepthChroma, err = br.ue(); err != nil {
+		return nil, err
+	}
+
+	subWidth, subHeight := uint32(1), uint32(1)
+	switch sps.chromaFormat {
+	case 1:
+		subWidth, subHeight = 2, 2
+	case 2:
+		subWidth = 2
+	}
+
+	sps.width = int(width - (left+right)*subWidth)
+	sps.height = int(height - (top+bottom)*subHeight)
+	return sps, nil
+}
+
+// buildHVCC builds an HEVCDecoderConfigurationRecord
+func buildHVCC(sps *hevcSPS, vps, spsNAL, pps []byte) []byte {
+	out := []byte{1}
+	out = append(out, sps.ptl[:]...)
+	out = append(out,
+		0xF0, 0x00, // min_spatial_segmentation_idc
+		0xFC,                               // parallelismType
+		0xFC|byte(sps.chromaFormat&0x03),   // chromaFormat
+		0xF8|byte(sps.bitDepthLuma&0x07),   // bitDepthLumaMinus8
+		0xF8|byte(sps.bitDepthChroma&0x07), // bitDepthChromaMinus8
+		0x00, 0x00,                         // avgFrameRate
+		byte(sps.maxSubLayers&0x07)<<3|byte(sps.temporalIDNesting&0x01)<<2|0x03,
+		3, // numOfArrays
+	)
+
+	for _, nal := range [][]byte{vps, spsNAL, pps} {
+		out = append(out, 0x80|hevcNALType(nal), 0, 1, byte(len(nal)>>8), byte(len(nal)))
+		out = append(out, nal...)
+	}
+	return out
+}
+
+// handleHEVC converts an Annex B access unit into length-prefixed form and
+// picks up parameter sets for the decoder configuration on the way
+func (t *track) handleHEVC(es []byte) ([]byte, bool) {
+	var nals [][]byte
+	var vps, sps, pps []byte
+	key := false
+
+	for _, nal := range splitAnnexB(es) {
+		if len(nal) < 2 {
+			continue
+		}
+
+		switch typ := hevcNALType(nal); {
+		case typ == hevcNALAUD:
+			continue
+		case typ >= hevcNALIRAPFirst && typ <= hevcNALIRAPLast:
+			key = true
+		case typ == hevcNALVPS:
+			vps = nal
+		case typ == hevcNALSPS:
+			sps = nal
+		case typ == hevcNALPPS:
+			pps = nal
+		}
+		nals = append(nals, nal)
+	}
+
+	if vps != nil && !bytes.Equal(vps, t.vps) {
+		t.vps = append([]byte(nil), vps...)
+	}
+	if sps != nil && !bytes.Equal(sps, t.sps) {
+		if parsed, err := parseHEVCSPS(sps); err == nil {
+			t.sps, t.hevcSPS = append([]byte(nil), sps...), parsed
+		}
+	}
+	if pps != nil && !bytes.Equal(pps, t.pps) {
+		t.pps = append([]byte(nil), pps...)
+	}
+	// the parameter sets are kept in-band as well, a change only takes effect at a keyframe
+	if t.vps != nil && t.sps != nil && t.pps != nil && (t.config == nil || key) {
+		t.setConfig(buildHVCC(t.hevcSPS, t.vps, t.sps, t.pps), t.hevcSPS.width, t.hevcSPS.height)
+	}
+	if len(nals) == 0 {
+		return nil, false
+	}
+	return toLengthPrefixed(nals), key
+}
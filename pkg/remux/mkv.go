@@ -0,0 +1,302 @@
+package remux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	mkvIDEBML        = 0x1A45DFA3
+	mkvIDSegment     = 0x18538067
+	mkvIDSeekHead    = 0x114D9B74
+	mkvIDSeek        = 0x4DBB
+	mkvIDSeekID      = 0x53AB
+	mkvIDSeekPos     = 0x53AC
+	mkvIDInfo        = 0x1549A966
+	mkvIDTracks      = 0x1654AE6B
+	mkvIDCluster     = 0x1F43B675
+	mkvIDCues        = 0x1C53BB6B
+	mkvIDSimpleBlock = 0xA3
+	mkvIDTimecode    = 0xE7
+	mkvIDDuration    = 0x4489
+
+	mkvTimecodeScale = 1000000 // 1 ms
+	// mkvMaxClusterLength keeps block timecodes inside their signed 16-bit range
+	mkvMaxClusterLength = 30000
+	mkvAudioCluster     = 5000
+)
+
+type mkvCue struct {
+	time     int64
+	track    int
+	position int64
+}
+
+type mkvWriter struct {
+	f   *os.File
+	w   *bufio.Writer
+	pos int64
+
+	tracks   []*track
+	hasVideo bool
+
+	segmentStart  int64
+	durationPos   int64
+	cuesSeekPos   int64
+	cluster       []byte
+	clusterTime   int64
+	clusterOpen   bool
+	cues          []mkvCue
+	lastTimestamp int64
+}
+
+func newMKVWriter(f *os.File) *mkvWriter {
+	return &mkvWriter{
+		f: f,
+		w: bufio.NewWriterSize(f, 1<<20),
+	}
+}
+
+func (m *mkvWriter) write(b []byte) error {
+	n, err := m.w.Write(b)
+	m.pos += int64(n)
+	return err
+}
+
+func (m *mkvWriter) writeHeader(tracks []*track) error {
+	m.tracks = tracks
+	for _, t := range tracks {
+		m.hasVideo = m.hasVideo || t.video
+	}
+
+	header := ebmlElement(mkvIDEBML,
+		ebmlUint(0x4286, 1),
+		ebmlUint(0x42F7, 1),
+		ebmlUint(0x42F2, 4),
+		ebmlUint(0x42F3, 8),
+		ebmlString(0x4282, "matroska"),
+		ebmlUint(0x4287, 4),
+		ebmlUint(0x4285, 2),
+	)
+	if err := m.write(header); err != nil {
+		return err
+	}
+
+	// segment size is patched in finish
+	if err := m.write(append(ebmlID(mkvIDSegment), 0x01, 0, 0, 0, 0, 0, 0, 0)); err != nil {
+		return err
+	}
+	m.segmentStart = m.pos
+
+	info := ebmlElement(mkvIDInfo,
+		ebmlUint(0x2AD7B1, mkvTimecodeScale),
+		ebmlString(0x4D80, "stream-recorder"),
+		ebmlString(0x5741, "stream-recorder"),
+		ebmlFloat(mkvIDDuration, 0),
+	)
+	tracksElement := m.tracksElement()
+
+	// the seek head uses fixed-width positions so the cues entry can be patched in place
+	seekEntry := func(id uint32, pos int64) []byte {
+		return ebmlElement(mkvIDSeek, ebmlElement(mkvIDSeekID, ebmlID(id)), ebmlFixedUint(mkvIDSeekPos, uint64(pos)))
+	}
+	seekHeadLen := int64(len(ebmlElement(mkvIDSeekHead, seekEntry(mkvIDInfo, 0), seekEntry(mkvIDTracks, 0), seekEntry(mkvIDCues, 0))))
+	infoPos := seekHeadLen
+	tracksPos := infoPos + int64(len(info))
+
+	seekHead := ebmlElement(mkvIDSeekHead, seekEntry(mkvIDInfo, infoPos), seekEntry(mkvIDTracks, tracksPos), seekEntry(mkvIDCues, 0))
+	m.cuesSeekPos = m.segmentStart + seekHeadLen - 8
+	m.durationPos = m.segmentStart + infoPos + int64(len(info)) - 8
+
+	for _, b := range [][]byte{seekHead, info, tracksElement} {
+		if err := m.write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mkvWriter) tracksElement() []byte {
+	var entries [][]byte
+	for _, t := range m.tracks {
+		fields := [][]byte{
+			ebmlUint(0xD7, uint64(t.id)),
+			ebmlUint(0x73C5, uint64(t.id)),
+			ebmlUint(0x9C, 0),
+			ebmlString(0x22B59C, "und"),
+		}
+
+		switch t.codec {
+		case codecH264:
+			fields = append(fields, ebmlUint(0x83, 1), ebmlString(0x86, "V_MPEG4/ISO/AVC"))
+		case codecHEVC:
+			fields = append(fields, ebmlUint(0x83, 1), ebmlString(0x86, "V_MPEGH/ISO/HEVC"))
+		case codecAAC:
+			fields = append(fields, ebmlUint(0x83, 2), ebmlString(0x86, "A_AAC"))
+		}
+		fields = append(fields, ebmlElement(0x63A2, t.config))
+
+		if t.video {
+			fields = append(fields, ebmlElement(0xE0, ebmlUint(0xB0, uint64(t.width)), ebmlUint(0xBA, uint64(t.height))))
+		} else {
+			fields = append(fields, ebmlElement(0xE1, ebmlFloat(0xB5, float64(t.sampleRate)), ebmlUint(0x9F, uint64(t.channels))))
+		}
+		entries = append(entries, ebmlElement(0xAE, fields...))
+	}
+	return ebmlElement(mkvIDTracks, entries...)
+}
+
+func (m *mkvWriter) writePacket(p *packet) error {
+	timestamp := p.pts / 90
+
+	newCluster := !m.clusterOpen ||
+		(p.track.video && p.key) ||
+		timestamp-m.clusterTime >= mkvMaxClusterLength ||
+		timestamp-m.clusterTime < -mkvMaxClusterLength ||
+		(!m.hasVideo && timestamp-m.clusterTime >= mkvAudioCluster)
+	if newCluster {
+		if err := m.flushCluster(); err != nil {
+			return err
+		}
+		m.clusterOpen = true
+		m.clusterTime = timestamp
+		if p.track.video && p.key {
+			m.cues = append(m.cues, mkvCue{time: timestamp, track: p.track.id, position: m.pos - m.segmentStart})
+		}
+	}
+
+	relative := int16(timestamp - m.clusterTime)
+	flags := byte(0)
+	if p.key {
+		flags = 0x80
+	}
+
+	block := append(ebmlSize(uint64(p.track.id)), byte(uint16(relative)>>8), byte(relative), flags)
+	m.cluster = append(m.cluster, ebmlID(mkvIDSimpleBlock)...)
+	m.cluster = append(m.cluster, ebmlSize(uint64(len(block)+len(p.data)))...)
+	m.cluster = append(m.cluster, block...)
+	m.cluster = append(m.cluster, p.data...)
+
+	if timestamp > m.lastTimestamp {
+		m.lastTimestamp = timestamp
+	}
+	return nil
+}
+
+func (m *mkvWriter) flushCluster() error {
+	if !m.clusterOpen {
+		return nil
+	}
+
+	payload := append(ebmlUint(mkvIDTimecode, uint64(m.clusterTime)), m.cluster...)
+	m.cluster = m.cluster[:0]
+	m.clusterOpen = false
+
+	return m.write(ebmlElement(mkvIDCluster, payload))
+}
+
+func (m *mkvWriter) finish() error {
+	if err := m.flushCluster(); err != nil {
+		return err
+	}
+
+	cuesPos := m.pos - m.segmentStart
+	var points [][]byte
+	for _, c := range m.cues {
+		points = append(points, ebmlElement(0xBB,
+			ebmlUint(0xB3, uint64(c.time)),
+			ebmlElement(0xB7, ebmlUint(0xF7, uint64(c.track)), ebmlUint(0xF1, uint64(c.position))),
+		))
+	}
+	if err := m.write(ebmlElement(mkvIDCues, points...)); err != nil {
+		return err
+	}
+	if err := m.w.Flush(); err != nil {
+		return err
+	}
+
+	patches := []struct {
+		pos  int64
+		data []byte
+	}{
+		{m.segmentStart - 7, u64(uint64(m.pos - m.segmentStart))[1:]},
+		{m.durationPos, binary.BigEndian.AppendUint64(nil, math.Float64bits(float64(m.lastTimestamp)))},
+		{m.cuesSeekPos, u64(uint64(cuesPos))},
+	}
+	for _, p := range patches {
+		if _, err := m.f.WriteAt(p.data, p.pos); err != nil {
+			return err
+		}
+	}
+	_, err := m.f.Seek(0, io.SeekEnd)
+	return err
+}
+
+func ebmlID(id uint32) []byte {
+	switch {
+	case id <= 0xFF:
+		return []byte{byte(id)}
+	case id <= 0xFFFF:
+		return []byte{byte(id >> 8), byte(id)}
+	case id <= 0xFFFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	}
+}
+
+// ebmlSize encodes a size as the shortest EBML variable length integer
+func ebmlSize(n uint64) []byte {
+	length := 1
+	for length < 8 && n >= (uint64(1)<<(7*uint(length)))-1 {
+		length++
+	}
+
+	out := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		out[i] = byte(n)
+		n >>= 8
+	}
+	out[0] |= 0x80 >> uint(length-1)
+	return out
+}
+
+func ebmlElement(id uint32, payloads ...[]byte) []byte {
+	size := 0
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	out := append(ebmlID(id), ebmlSize(uint64(size))...)
+	for _, p := range payloads {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	var b []byte
+	for v > 0 {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+	}
+	if len(b) == 0 {
+		b = []byte{0}
+	}
+	return ebmlElement(id, b)
+}
+
+func ebmlFixedUint(id uint32, v uint64) []byte {
+	return ebmlElement(id, u64(v))
+}
+
+func ebmlFloat(id uint32, v float64) []byte {
+	return ebmlElement(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func ebmlString(id uint32, s string) []byte {
+	return ebmlElement(id, []byte(s))
+}
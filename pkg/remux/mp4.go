@@ -0,0 +1,554 @@
+package remux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	mp4MovieTimescale = 1000
+	mp4FragmentLength = 2 * 90000 // audio-only fragments, in 90 kHz units
+	mp4MaxChunkSize   = 1 << 20   // a chunk is written once it holds this many bytes
+
+	mp4SampleFlagsKey    = 0x02000000
+	mp4SampleFlagsNonKey = 0x01010000
+)
+
+type mp4Sample struct {
+	dts  int64
+	cto  int64
+	size uint32
+	key  bool
+	data []byte
+}
+
+// mp4Chunk is a run of samples of one track and one sample description, stored in an mdat of its own
+type mp4Chunk struct {
+	offset int64
+	count  uint32
+	desc   int
+}
+
+type mp4Track struct {
+	t         *track
+	timescale int64
+	samples   []mp4Sample
+	chunks    []mp4Chunk
+	lastDTS   int64
+	hasLast   bool
+	lastDelta int64
+}
+
+// mp4Writer writes its output in a single pass without seeking back, so the bytes it
+// writes are the final file
+type mp4Writer struct {
+	w          *bufio.Writer
+	fragmented bool
+	tracks     []*mp4Track
+	byID       map[int]*mp4Track
+
+	pos       int64
+	chunk     []byte
+	lastTrack *mp4Track
+	sequence  uint32
+}
+
+func newMP4Writer(w io.Writer, fragmented bool) *mp4Writer {
+	return &mp4Writer{
+		w:          bufio.NewWriterSize(w, 1<<20),
+		fragmented: fragmented,
+		byID:       make(map[int]*mp4Track),
+	}
+}
+
+func (m *mp4Writer) write(b []byte) error {
+	n, err := m.w.Write(b)
+	m.pos += int64(n)
+	return err
+}
+
+func (m *mp4Writer) writeHeader(tracks []*track) error {
+	for _, t := range tracks {
+		mt := &mp4Track{t: t, timescale: 90000}
+		if !t.video {
+			mt.timescale = int64(t.sampleRate)
+		}
+		m.tracks = append(m.tracks, mt)
+		m.byID[t.id] = mt
+	}
+
+	if m.fragmented {
+		ftyp := box("ftyp", []byte("iso5"), u32(512), []byte("iso5iso6mp41dash"))
+		if err := m.write(ftyp); err != nil {
+			return err
+		}
+		return m.write(m.moov())
+	}
+
+	return m.write(box("ftyp", []byte("isom"), u32(512), []byte("isomiso2mp41")))
+}
+
+// timestamp converts a 90 kHz timestamp into the track timescale. Audio is kept
+// sample exact as long as the source does not drift away from the frame grid.
+func (mt *mp4Track) timestamp(ts int64) int64 {
+	v := ts * mt.timescale / 90000
+	if mt.t.video || !mt.hasLast {
+		return v
+	}
+	next := mt.lastDTS + samplesPerAACFrame
+	if diff := v - next; diff > -samplesPerAACFrame/2 && diff < samplesPerAACFrame/2 {
+		return next
+	}
+	return v
+}
+
+func (m *mp4Writer) writePacket(p *packet) error {
+	mt := m.byID[p.track.id]
+	dts := mt.timestamp(p.dts)
+	if mt.hasLast {
+		if dts <= mt.lastDTS {
+			dts = mt.lastDTS + 1
+		}
+		mt.lastDelta = dts - mt.lastDTS
+	}
+	mt.lastDTS, mt.hasLast = dts, true
+
+	s := mp4Sample{
+		dts:  dts,
+		cto:  (p.pts - p.dts) * mt.timescale / 90000,
+		size: uint32(len(p.data)),
+		key:  p.key,
+	}
+
+	if m.fragmented {
+		if p.track.video && p.key && m.hasPending() {
+			if err := m.writeFragment(mt, dts); err != nil {
+				return err
+			}
+		}
+		s.data = p.data
+		mt.samples = append(mt.samples, s)
+
+		if !m.hasVideo() && m.pendingDuration(mt) >= mp4FragmentLength*mt.timescale/90000 {
+			return m.writeFragment(nil, 0)
+		}
+		return nil
+	}
+
+	if m.lastTrack != mt || len(mt.chunks) == 0 || mt.chunks[len(mt.chunks)-1].desc != p.desc || len(m.chunk)+len(p.data) > mp4MaxChunkSize {
+		if err := m.flushChunk(); err != nil {
+			return err
+		}
+		// the samples follow the 8 byte header of the mdat
+		mt.chunks = append(mt.chunks, mp4Chunk{offset: m.pos + 8, desc: p.desc})
+	}
+	mt.chunks[len(mt.chunks)-1].count++
+	m.lastTrack = mt
+	mt.samples = append(mt.samples, s)
+	m.chunk = append(m.chunk, p.data...)
+	return nil
+}
+
+// flushChunk writes the pending chunk as its own mdat, its size is known so nothing is patched later
+func (m *mp4Writer) flushChunk() error {
+	if len(m.chunk) == 0 {
+		return nil
+	}
+	if err := m.write(append(u32(uint32(8+len(m.chunk))), []byte("mdat")...)); err != nil {
+		return err
+	}
+	err := m.write(m.chunk)
+	m.chunk = m.chunk[:0]
+	return err
+}
+
+func (mt *mp4Track) defaultDuration() int64 {
+	if mt.t.video {
+		if mt.lastDelta > 0 {
+			return mt.lastDelta
+		}
+		return defaultVideoFrameDuration
+	}
+	return samplesPerAACFrame
+}
+
+// durations returns the duration of every sample; the last one repeats the previous delta
+func (mt *mp4Track) durations(next int64, hasNext bool) []int64 {
+	out := make([]int64, len(mt.samples))
+	for i := range mt.samples {
+		switch {
+		case i+1 < len(mt.samples):
+			out[i] = mt.samples[i+1].dts - mt.samples[i].dts
+		case hasNext && next > mt.samples[i].dts:
+			out[i] = next - mt.samples[i].dts
+		case i > 0:
+			out[i] = out[i-1]
+		default:
+			out[i] = mt.defaultDuration()
+		}
+	}
+	return out
+}
+
+func (m *mp4Writer) finish() error {
+	if m.fragmented {
+		if m.hasPending() {
+			if err := m.writeFragment(nil, 0); err != nil {
+				return err
+			}
+		}
+		return m.w.Flush()
+	}
+
+	if err := m.flushChunk(); err != nil {
+		return err
+	}
+	if err := m.write(m.moov()); err != nil {
+		return err
+	}
+	return m.w.Flush()
+}
+
+func (m *mp4Writer) hasPending() bool {
+	for _, mt := range m.tracks {
+		if len(mt.samples) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mp4Writer) hasVideo() bool {
+	for _, mt := range m.tracks {
+		if mt.t.video {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mp4Writer) pendingDuration(mt *mp4Track) int64 {
+	if len(mt.samples) == 0 {
+		return 0
+	}
+	return mt.samples[len(mt.samples)-1].dts - mt.samples[0].dts
+}
+
+// writeFragment writes the pending samples of every track as one moof/mdat pair.
+// next is the first sample of the following fragment, which closes the duration
+// of the last pending sample of that track.
+func (m *mp4Writer) writeFragment(next *mp4Track, nextDTS int64) error {
+	m.sequence++
+
+	var trafs []*mp4Track
+	var durations [][]int64
+	for _, mt := range m.tracks {
+		if len(mt.samples) == 0 {
+			continue
+		}
+		trafs = append(trafs, mt)
+		durations = append(durations, mt.durations(nextDTS, mt == next))
+	}
+
+	build := func(offsets []int32) []byte {
+		var children [][]byte
+		children = append(children, fullBox("mfhd", 0, 0, u32(m.sequence)))
+		for i, mt := range trafs {
+			children = append(children, mt.traf(durations[i], offsets[i]))
+		}
+		return box("moof", children...)
+	}
+
+	offsets := make([]int32, len(trafs))
+	moofSize := int32(len(build(offsets)))
+	dataSize := 0
+	for i, mt := range trafs {
+		offsets[i] = moofSize + 8 + int32(dataSize)
+		for _, s := range mt.samples {
+			dataSize += len(s.data)
+		}
+	}
+
+	if err := m.write(build(offsets)); err != nil {
+		return err
+	}
+	if err := m.write(append(u32(uint32(8+dataSize)), []byte("mdat")...)); err != nil {
+		return err
+	}
+	for _, mt := range trafs {
+		for _, s := range mt.samples {
+			if err := m.write(s.data); err != nil {
+				return err
+			}
+		}
+		mt.samples = mt.samples[:0]
+	}
+	return nil
+}
+
+func (mt *mp4Track) traf(durations []int64, dataOffset int32) []byte {
+	trun := append(u32(uint32(len(mt.samples))), u32(uint32(dataOffset))...)
+	for i, s := range mt.samples {
+		flags := uint32(mp4SampleFlagsNonKey)
+		if s.key {
+			flags = mp4SampleFlagsKey
+		}
+		trun = append(trun, u32(uint32(durations[i]))...)
+		trun = append(trun, u32(s.size)...)
+		trun = append(trun, u32(flags)...)
+		trun = append(trun, u32(uint32(int32(s.cto)))...)
+	}
+
+	return box("traf",
+		fullBox("tfhd", 0, 0x020000, u32(uint32(mt.t.id))),
+		fullBox("tfdt", 1, 0, u64(uint64(mt.samples[0].dts))),
+		fullBox("trun", 1, 0x000F01, trun),
+	)
+}
+
+func (m *mp4Writer) moov() []byte {
+	var movieDuration int64
+	var traks [][]byte
+	for _, mt := range m.tracks {
+		trak, duration := mt.trak(m.fragmented)
+		// the movie lasts until the end of the last track, including the delay of its start
+		traks = append(traks, trak)
+		if d := duration * mp4MovieTimescale / mt.timescale; d > movieDuration {
+			movieDuration = d
+		}
+	}
+
+	children := [][]byte{m.mvhd(movieDuration)}
+	children = append(children, traks...)
+	if m.fragmented {
+		var trex [][]byte
+		for _, mt := range m.tracks {
+			trex = append(trex, fullBox("trex", 0, 0, u32(uint32(mt.t.id)), u32(1), u32(0), u32(0), u32(0)))
+		}
+		children = append(children, box("mvex", trex...))
+	}
+	return box("moov", children...)
+}
+
+func (m *mp4Writer) mvhd(duration int64) []byte {
+	return fullBox("mvhd", 1, 0,
+		u64(0), u64(0), u32(mp4MovieTimescale), u64(uint64(duration)),
+		u32(0x00010000), u16(0x0100), make([]byte, 10),
+		matrix(),
+		make([]byte, 24),
+		u32(uint32(len(m.tracks)+1)),
+	)
+}
+
+// trak returns the track box and the duration of the track in its timescale
+func (mt *mp4Track) trak(fragmented bool) ([]byte, int64) {
+	var durations []int64
+	var duration, start int64
+	if !fragmented {
+		durations = mt.durations(0, false)
+		for _, d := range durations {
+			duration += d
+		}
+		if len(mt.samples) > 0 {
+			start = mt.samples[0].dts
+		}
+	}
+
+	volume, width, height := uint16(0), uint32(0), uint32(0)
+	handler, name := "vide", "VideoHandler"
+	mediaHeader := fullBox("vmhd", 0, 1, make([]byte, 8))
+	if mt.t.video {
+		width, height = uint32(mt.t.width)<<16, uint32(mt.t.height)<<16
+	} else {
+		volume = 0x0100
+		handler, name = "soun", "SoundHandler"
+		mediaHeader = fullBox("smhd", 0, 0, make([]byte, 4))
+	}
+
+	tkhd := fullBox("tkhd", 1, 0x03,
+		u64(0), u64(0), u32(uint32(mt.t.id)), u32(0), u64(uint64((start+duration)*mp4MovieTimescale/mt.timescale)),
+		make([]byte, 8), u16(0), u16(0), u16(volume), u16(0),
+		matrix(),
+		u32(width), u32(height),
+	)
+	mdhd := fullBox("mdhd", 1, 0, u64(0), u64(0), u32(uint32(mt.timescale)), u64(uint64(duration)), u16(0x55C4), u16(0))
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte(handler), make([]byte, 12), append([]byte(name), 0))
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+
+	stbl := box("stbl", mt.stbl(durations, fragmented)...)
+	return box("trak", tkhd, mt.edts(start, duration), box("mdia", mdhd, hdlr, box("minf", mediaHeader, dinf, stbl))), start + duration
+}
+
+// edts delays a track that starts after the others. The sample table always starts at media time 0,
+// so the offset of the first sample becomes an empty edit. Fragments carry it in their tfdt instead.
+func (mt *mp4Track) edts(start, duration int64) []byte {
+	if start <= 0 {
+		return nil
+	}
+
+	empty := append(append(u64(uint64(start*mp4MovieTimescale/mt.timescale)), u64(^uint64(0))...), u16(1)...)
+	media := append(append(u64(uint64(duration*mp4MovieTimescale/mt.timescale)), u64(0)...), u16(1)...)
+	return box("edts", fullBox("elst", 1, 0, u32(2), empty, u16(0), media, u16(0)))
+}
+
+func (mt *mp4Track) stbl(durations []int64, fragmented bool) [][]byte {
+	// fragments only get the configuration known when the header is written, later changes
+	// reach the decoder through the parameter sets that are kept in-band
+	descs := mt.t.sampleDescs()
+	if fragmented {
+		descs = descs[:1]
+	}
+	var entries []byte
+	for _, d := range descs {
+		entries = append(entries, mt.sampleEntry(d, fragmented)...)
+	}
+	stsd := fullBox("stsd", 0, 0, u32(uint32(len(descs))), entries)
+
+	var stts, ctts, stss, stsz, stsc, co64 []byte
+	var sttsCount, cttsCount, stssCount, stscCount uint32
+	hasCTTS := false
+	for i, s := range mt.samples {
+		if n := len(stts); i > 0 && int64(binary.BigEndian.Uint32(stts[n-4:])) == durations[i] {
+			binary.BigEndian.PutUint32(stts[n-8:], binary.BigEndian.Uint32(stts[n-8:])+1)
+		} else {
+			stts = append(append(stts, u32(1)...), u32(uint32(durations[i]))...)
+			sttsCount++
+		}
+
+		if n := len(ctts); i > 0 && int64(binary.BigEndian.Uint32(ctts[n-4:])) == s.cto {
+			binary.BigEndian.PutUint32(ctts[n-8:], binary.BigEndian.Uint32(ctts[n-8:])+1)
+		} else {
+			ctts = append(append(ctts, u32(1)...), u32(uint32(s.cto))...)
+			cttsCount++
+		}
+		hasCTTS = hasCTTS || s.cto != 0
+
+		if s.key {
+			stss = append(stss, u32(uint32(i+1))...)
+			stssCount++
+		}
+		stsz = append(stsz, u32(s.size)...)
+	}
+
+	for i, c := range mt.chunks {
+		if n := len(stsc); i > 0 && binary.BigEndian.Uint32(stsc[n-8:n-4]) == c.count && int(binary.BigEndian.Uint32(stsc[n-4:])) == c.desc+1 {
+			continue
+		}
+		stsc = append(stsc, u32(uint32(i+1))...)
+		stsc = append(stsc, u32(c.count)...)
+		stsc = append(stsc, u32(uint32(c.desc+1))...)
+		stscCount++
+	}
+	for _, c := range mt.chunks {
+		co64 = append(co64, u64(uint64(c.offset))...)
+	}
+
+	boxes := [][]byte{stsd, fullBox("stts", 0, 0, u32(sttsCount), stts)}
+	if hasCTTS {
+		boxes = append(boxes, fullBox("ctts", 0, 0, u32(cttsCount), ctts))
+	}
+	if mt.t.video && stssCount != uint32(len(mt.samples)) {
+		boxes = append(boxes, fullBox("stss", 0, 0, u32(stssCount), stss))
+	}
+	boxes = append(boxes,
+		fullBox("stsc", 0, 0, u32(stscCount), stsc),
+		fullBox("stsz", 0, 0, u32(0), u32(uint32(len(mt.samples))), stsz),
+		fullBox("co64", 0, 0, u32(uint32(len(mt.chunks))), co64),
+	)
+	return boxes
+}
+
+// sampleEntry describes one decoder configuration. Fragmented H.264 is marked avc3, which allows
+// the parameter sets in the samples to replace the ones of the entry.
+func (mt *mp4Track) sampleEntry(d sampleDesc, fragmented bool) []byte {
+	switch mt.t.codec {
+	case codecH264, codecHEVC:
+		entry, configBox := "avc1", "avcC"
+		if fragmented {
+			entry = "avc3"
+		}
+		if mt.t.codec == codecHEVC {
+			entry, configBox = "hev1", "hvcC"
+		}
+		return box(entry,
+			make([]byte, 6), u16(1),
+			make([]byte, 16),
+			u16(uint16(d.width)), u16(uint16(d.height)),
+			u32(0x00480000), u32(0x00480000),
+			u32(0), u16(1),
+			make([]byte, 32),
+			u16(0x0018), u16(0xFFFF),
+			box(configBox, d.config),
+		)
+	default:
+		return box("mp4a",
+			make([]byte, 6), u16(1),
+			make([]byte, 8),
+			u16(uint16(mt.t.channels)), u16(16),
+			u16(0), u16(0),
+			u32(uint32(mt.t.sampleRate)<<16),
+			mt.esds(),
+		)
+	}
+}
+
+func (mt *mp4Track) esds() []byte {
+	decoderSpecific := descriptor(0x05, mt.t.config)
+	decoderConfig := descriptor(0x04, []byte{0x40, 0x15, 0, 0, 0}, u32(0), u32(0), decoderSpecific)
+	es := descriptor(0x03, u16(uint16(mt.t.id)), []byte{0}, decoderConfig, descriptor(0x06, []byte{0x02}))
+	return fullBox("esds", 0, 0, es)
+}
+
+func descriptor(tag byte, payloads ...[]byte) []byte {
+	size := 0
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	out := []byte{tag, 0x80 | byte(size>>21), 0x80 | byte(size>>14), 0x80 | byte(size>>7), byte(size & 0x7F)}
+	for _, p := range payloads {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	out := make([]byte, 0, size)
+	out = append(out, u32(uint32(size))...)
+	out = append(out, typ...)
+	for _, p := range payloads {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func fullBox(typ string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{header}, payloads...)...)
+}
+
+func matrix() []byte {
+	var out []byte
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		out = append(out, u32(v)...)
+	}
+	return out
+}
+
+func u16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func u32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func u64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
@@ -0,0 +1,64 @@
+package remux
+
+import (
+	"io"
+	"time"
+)
+
+type span struct {
+	first, last int64
+	count       int
+}
+
+// Duration measures the playback duration of MPEG-TS data from its timestamps,
+// using the video track when there is one
+func Duration(r io.Reader) (time.Duration, error) {
+	spans := make(map[*track]*span)
+	d := newDemuxer(func(p *pes) error {
+		s, ok := spans[p.track]
+		if !ok {
+			spans[p.track] = &span{first: p.pts, last: p.pts, count: 1}
+			return nil
+		}
+
+		ts := p.pts
+		if ts < s.first-(1<<32) {
+			ts += 1 << 33
+		}
+		s.first = min(s.first, ts)
+		s.last = max(s.last, ts)
+		s.count++
+		return nil
+	})
+
+	if err := d.readFrom(r); err != nil {
+		return 0, err
+	}
+	if err := d.flush(); err != nil {
+		return 0, err
+	}
+
+	var main *span
+	for _, t := range d.tracks {
+		s, ok := spans[t]
+		if !ok {
+			continue
+		}
+		if main == nil || t.video {
+			main = s
+		}
+		if t.video {
+			break
+		}
+	}
+	if main == nil {
+		return 0, nil
+	}
+
+	// the span covers the start of the last frame, so one average frame is added on top
+	ticks := main.last - main.first
+	if main.count > 1 {
+		ticks += ticks / int64(main.count-1)
+	}
+	return time.Duration(ticks) * time.Second / 90000, nil
+}
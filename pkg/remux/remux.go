@@ -0,0 +1,336 @@
+package remux
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Format is an output container supported by the remuxer
+type Format string
+
+const (
+	FormatMP4  Format = "mp4"
+	FormatFMP4 Format = "fmp4"
+	FormatMKV  Format = "mkv"
+)
+
+// maxPendingPackets bounds how long the remuxer waits for decoder configurations
+// (SPS/PPS/VPS, ADTS header) of every track before it gives up on the missing ones
+const maxPendingPackets = 4096
+
+type codec int
+
+const (
+	codecH264 codec = iota + 1
+	codecHEVC
+	codecAAC
+)
+
+type track struct {
+	id    int
+	codec codec
+	video bool
+
+	// config is the first avcC/hvcC record or the AudioSpecificConfig
+	config        []byte
+	width, height int
+	sampleRate    int
+	channels      int
+
+	// descs holds every decoder configuration of a video track, a stream that changes its
+	// parameter sets (e.g. its resolution) at a keyframe gets a new one; desc is the current one
+	descs []sampleDesc
+	desc  int
+
+	vps, sps, pps []byte
+	h264SPS       *h264SPS
+	hevcSPS       *hevcSPS
+}
+
+// sampleDesc is a decoder configuration together with the picture size it describes
+type sampleDesc struct {
+	config        []byte
+	width, height int
+}
+
+// setConfig makes the configuration the current one, the first one becomes the config of the track
+func (t *track) setConfig(config []byte, width, height int) {
+	for i, d := range t.descs {
+		if bytes.Equal(d.config, config) {
+			t.desc = i
+			return
+		}
+	}
+
+	if t.config == nil {
+		t.config, t.width, t.height = config, width, height
+	}
+	t.descs = append(t.descs, sampleDesc{config: config, width: width, height: height})
+	t.desc = len(t.descs) - 1
+}
+
+// sampleDescs lists the decoder configurations, audio tracks only have their config
+func (t *track) sampleDescs() []sampleDesc {
+	if len(t.descs) > 0 {
+		return t.descs
+	}
+	return []sampleDesc{{config: t.config, width: t.width, height: t.height}}
+}
+
+// packet is a single access unit (video) or raw frame (audio) in 90 kHz units,
+// desc is the index of the decoder configuration it was encoded with
+type packet struct {
+	track    *track
+	dts, pts int64
+	key      bool
+	desc     int
+	data     []byte
+}
+
+type muxer interface {
+	writeHeader(tracks []*track) error
+	writePacket(p *packet) error
+	finish() error
+}
+
+// ParseFormat maps a file extension from the config onto a remuxer format
+func ParseFormat(fileFormat string, fragmented bool) (Format, bool) {
+	switch strings.ToLower(strings.TrimPrefix(fileFormat, ".")) {
+	case "mp4", "m4v":
+		if fragmented {
+			return FormatFMP4, true
+		}
+		return FormatMP4, true
+	case "mkv":
+		return FormatMKV, true
+	default:
+		return "", false
+	}
+}
+
+type remuxer struct {
+	mux     muxer
+	demux   *demuxer
+	tl      *timeline
+	tracks  []*track
+	pending []*packet
+	started bool
+	base    int64
+	keySeen bool
+}
+
+// Remux reads the MPEG-TS files in order as one continuous stream and writes
+// the H.264/H.265/AAC tracks into outputPath without re-encoding. It returns the
+// hex SHA-256 of the output, hashed while it is written. MKV patches its header
+// once the clusters are written, so its sum is empty and the file has to be hashed afterwards.
+func Remux(inputPaths []string, outputPath string, format Format) (string, error) {
+	if len(inputPaths) == 0 {
+		return "", errors.New("no input files")
+	}
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create output file: %w", err)
+	}
+
+	r := &remuxer{tl: newTimeline()}
+	h := sha256.New()
+	switch format {
+	case FormatMP4:
+		r.mux = newMP4Writer(io.MultiWriter(out, h), false)
+	case FormatFMP4:
+		r.mux = newMP4Writer(io.MultiWriter(out, h), true)
+	case FormatMKV:
+		r.mux = newMKVWriter(out)
+		h = nil
+	default:
+		_ = out.Close()
+		return "", fmt.Errorf("unsupported format %q", format)
+	}
+	r.demux = newDemuxer(r.handlePES)
+
+	if err := r.run(inputPaths); err != nil {
+		_ = out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil || h == nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (r *remuxer) run(inputPaths []string) error {
+	for _, path := range inputPaths {
+		if err := r.readFile(path); err != nil {
+			return err
+		}
+	}
+	if err := r.demux.flush(); err != nil {
+		return err
+	}
+
+	if !r.started {
+		if err := r.start(); err != nil {
+			return err
+		}
+	}
+	return r.mux.finish()
+}
+
+func (r *remuxer) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if err := r.demux.readFrom(f); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to demux %s: %w", path, err)
+	}
+	return nil
+}
+
+func (r *remuxer) handlePES(p *pes) error {
+	r.tl.adjust(p)
+
+	var packets []*packet
+	switch p.track.codec {
+	case codecH264, codecHEVC:
+		var data []byte
+		var key bool
+		if p.track.codec == codecH264 {
+			data, key = p.track.handleH264(p.data)
+		} else {
+			data, key = p.track.handleHEVC(p.data)
+		}
+		if data == nil {
+			return nil
+		}
+		packets = append(packets, &packet{track: p.track, dts: p.dts, pts: p.pts, key: key, desc: p.track.desc, data: data})
+	case codecAAC:
+		frames := p.track.handleAAC(p.data)
+		for i, frame := range frames {
+			offset := int64(i) * samplesPerAACFrame * 90000 / int64(p.track.sampleRate)
+			packets = append(packets, &packet{track: p.track, dts: p.dts + offset, pts: p.pts + offset, key: true, data: frame})
+		}
+	}
+
+	for _, pkt := range packets {
+		if err := r.handlePacket(pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *remuxer) handlePacket(p *packet) error {
+	if !r.started {
+		r.pending = append(r.pending, p)
+		if r.ready() || len(r.pending) >= maxPendingPackets {
+			return r.start()
+		}
+		return nil
+	}
+
+	return r.write(p)
+}
+
+// ready reports whether every announced track has its decoder configuration
+func (r *remuxer) ready() bool {
+	if len(r.demux.tracks) == 0 {
+		return false
+	}
+	for _, t := range r.demux.tracks {
+		if t.config == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *remuxer) start() error {
+	r.started = true
+	r.demux.lockTracks()
+
+	for _, t := range r.demux.tracks {
+		if t.config == nil {
+			t.id = 0
+			continue
+		}
+		r.tracks = append(r.tracks, t)
+		t.id = len(r.tracks)
+	}
+	if len(r.tracks) == 0 {
+		return errors.New("no supported audio/video streams found")
+	}
+
+	// start from the first video keyframe so the output opens with a decodable picture
+	hasVideo := false
+	for _, t := range r.tracks {
+		hasVideo = hasVideo || t.video
+	}
+	first := 0
+	if hasVideo {
+		first = -1
+		for i, p := range r.pending {
+			if p.track.video && p.track.id != 0 && p.key {
+				first = i
+				break
+			}
+		}
+		if first < 0 {
+			first = 0
+		}
+	}
+
+	kept := r.pending[first:]
+	r.pending = nil
+
+	r.base = -1
+	for _, p := range kept {
+		if p.track.id != 0 && (r.base < 0 || p.dts < r.base) {
+			r.base = p.dts
+		}
+	}
+	if r.base < 0 {
+		r.base = 0
+	}
+
+	if err := r.mux.writeHeader(r.tracks); err != nil {
+		return err
+	}
+	for _, p := range kept {
+		if err := r.write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *remuxer) write(p *packet) error {
+	if p.track.id == 0 {
+		return nil
+	}
+	if p.track.video && !r.keySeen {
+		if !p.key {
+			return nil
+		}
+		r.keySeen = true
+	}
+
+	p.dts -= r.base
+	p.pts -= r.base
+	if p.dts < 0 {
+		return nil
+	}
+	if p.pts < p.dts {
+		p.pts = p.dts
+	}
+	return r.mux.writePacket(p)
+}
@@ -0,0 +1,805 @@
+package remux
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	fixtureFrames      = 30
+	fixtureGOP         = 10
+	fixtureFrameTicks  = 3000 // 30 fps
+	fixtureAudioFrames = 45
+	fixtureStart       = 10 * 90000
+	fixtureVideoPID    = 0x100
+	fixtureAudioPID    = 0x101
+	fixturePMTPID      = 0x1000
+)
+
+// fixture describes the video of the stream writeFixture writes
+type fixture struct {
+	hevc bool
+	// resizeAt is the keyframe from which the picture is 640x480, 0 keeps 320x240 throughout
+	resizeAt int
+}
+
+// writeFixture writes one second of 320x240 H.264 or HEVC with a keyframe every ten frames and
+// just under a second of 48 kHz stereo AAC as MPEG-TS. The payloads are filler, the remuxer never decodes them.
+func writeFixture(t *testing.T, path string, f fixture) {
+	t.Helper()
+
+	videoType := byte(streamTypeH264)
+	if f.hevc {
+		videoType = streamTypeHEVC
+	}
+
+	var ts tsWriter
+	ts.psi(0, 0x00, []byte{0x00, 0x01, 0xE0 | fixturePMTPID>>8, fixturePMTPID & 0xFF})
+	ts.psi(fixturePMTPID, 0x02, []byte{
+		0xE0 | fixtureVideoPID>>8, fixtureVideoPID & 0xFF, 0xF0, 0x00,
+		videoType, 0xE0 | fixtureVideoPID>>8, fixtureVideoPID & 0xFF, 0xF0, 0x00,
+		streamTypeAAC, 0xE0 | fixtureAudioPID>>8, fixtureAudioPID & 0xFF, 0xF0, 0x00,
+	})
+
+	audioTicks := int64(samplesPerAACFrame * 90000 / 48000)
+	// a PES is complete when the next one of its stream starts, audio that is complete before the
+	// first keyframe would be dropped with the frames in front of it, so the audio starts a frame later
+	audioStart := int64(fixtureStart + fixtureFrameTicks)
+
+	audio := 0
+	for frame := 0; frame < fixtureFrames; frame++ {
+		pts := int64(fixtureStart + frame*fixtureFrameTicks)
+		for ; audio < fixtureAudioFrames && audioStart+int64(audio)*audioTicks < pts; audio++ {
+			ts.pes(fixtureAudioPID, 0xC0, audioStart+int64(audio)*audioTicks, fixtureADTS(20+audio))
+		}
+
+		width, height := uint32(320), uint32(240)
+		if f.resizeAt > 0 && frame >= f.resizeAt {
+			width, height = 640, 480
+		}
+		ts.pes(fixtureVideoPID, 0xE0, pts, f.accessUnit(frame, width, height))
+	}
+	for ; audio < fixtureAudioFrames; audio++ {
+		ts.pes(fixtureAudioPID, 0xC0, audioStart+int64(audio)*audioTicks, fixtureADTS(20+audio))
+	}
+
+	if err := os.WriteFile(path, ts.buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// accessUnit is a video frame, keyframes carry the parameter sets of the picture size
+func (f fixture) accessUnit(frame int, width, height uint32) []byte {
+	key := frame%fixtureGOP == 0
+	if f.hevc {
+		au := annexB([]byte{hevcNALAUD << 1, 0x01, 0x50})
+		if key {
+			au = append(au, annexB(filler(hevcNALVPS<<1, 20))...)
+			au = append(au, annexB(fixtureHEVCSPS(width, height))...)
+			au = append(au, annexB(filler(hevcNALPPS<<1, 4))...)
+			return append(au, annexB(filler(19<<1, 400+frame))...) // IDR_W_RADL
+		}
+		return append(au, annexB(filler(1<<1, 100+frame))...) // TRAIL_R
+	}
+
+	au := annexB([]byte{0x09, 0xF0})
+	if key {
+		au = append(au, annexB(fixtureSPS(width/16, height/16))...)
+		au = append(au, annexB([]byte{0x68, 0xCE, 0x38, 0x80})...)
+		return append(au, annexB(filler(0x65, 400+frame))...)
+	}
+	return append(au, annexB(filler(0x41, 100+frame))...)
+}
+
+// fixtureSPS is a baseline profile SPS of the given number of macroblocks
+func fixtureSPS(widthMbs, heightMbs uint32) []byte {
+	var bw bitWriter
+	bw.ue(0)             // seq_parameter_set_id
+	bw.ue(0)             // log2_max_frame_num_minus4
+	bw.ue(0)             // pic_order_cnt_type
+	bw.ue(0)             // log2_max_pic_order_cnt_lsb_minus4
+	bw.ue(1)             // max_num_ref_frames
+	bw.bits(0, 1)        // gaps_in_frame_num_value_allowed_flag
+	bw.ue(widthMbs - 1)  // pic_width_in_mbs_minus1
+	bw.ue(heightMbs - 1) // pic_height_in_map_units_minus1
+	bw.bits(1, 1)        // frame_mbs_only_flag
+	bw.bits(1, 1)        // direct_8x8_inference_flag
+	bw.bits(0, 1)        // frame_cropping_flag
+	bw.bits(0, 1)        // vui_parameters_present_flag
+	bw.bits(1, 1)        // rbsp_stop_one_bit
+	return append([]byte{0x67, 66, 0xC0, 30}, escapeRBSP(bw.bytes())...)
+}
+
+// fixtureHEVCSPS is a Main profile 4:2:0 SPS with the given picture size, level 3.1
+func fixtureHEVCSPS(width, height uint32) []byte {
+	var bw bitWriter
+	bw.bits(0, 4)           // sps_video_parameter_set_id
+	bw.bits(0, 3)           // sps_max_sub_layers_minus1
+	bw.bits(1, 1)           // sps_temporal_id_nesting_flag
+	bw.bits(0x01, 8)        // general_profile_space, general_tier_flag, general_profile_idc
+	bw.bits(0x60000000, 32) // general_profile_compatibility_flags
+	bw.bits(0xB000, 16)     // general_progressive_source_flag and the other constraint flags
+	bw.bits(0, 32)
+	bw.bits(93, 8) // general_level_idc
+	bw.ue(0)       // sps_seq_parameter_set_id
+	bw.ue(1)       // chroma_format_idc
+	bw.ue(width)   // pic_width_in_luma_samples
+	bw.ue(height)  // pic_height_in_luma_samples
+	bw.bits(0, 1)  // conformance_window_flag
+	bw.ue(0)       // bit_depth_luma_minus8
+	bw.ue(0)       // bit_depth_chroma_minus8
+	bw.bits(1, 1)  // rbsp_stop_one_bit, the remaining fields are not read
+	return append([]byte{hevcNALSPS << 1, 0x01}, escapeRBSP(bw.bytes())...)
+}
+
+// escapeRBSP inserts the emulation prevention bytes a NAL unit needs
+func escapeRBSP(rbsp []byte) []byte {
+	var out []byte
+	zeros := 0
+	for _, c := range rbsp {
+		if zeros >= 2 && c <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// fixtureADTS is an AAC-LC frame of 48 kHz stereo with a payload of n bytes
+func fixtureADTS(n int) []byte {
+	size := 7 + n
+	header := []byte{0xFF, 0xF1, 1<<6 | 3<<2, 2<<6 | byte(size>>11), byte(size >> 3), byte(size&0x07)<<5 | 0x1F, 0xFC}
+	return append(header, bytes.Repeat([]byte{0x21}, n)...)
+}
+
+func filler(header byte, n int) []byte {
+	return append([]byte{header}, bytes.Repeat([]byte{0x11}, n)...)
+}
+
+func annexB(nal []byte) []byte {
+	return append([]byte{0, 0, 0, 1}, nal...)
+}
+
+type tsWriter struct {
+	buf bytes.Buffer
+	cc  map[int]byte
+}
+
+// psi writes a single section table, the PAT of program 1 or its PMT
+func (w *tsWriter) psi(pid int, tableID byte, body []byte) {
+	section := []byte{tableID, 0xB0, 0, 0x00, 0x01, 0xC1, 0x00, 0x00}
+	section = append(section, body...)
+	length := len(section) - 3 + 4
+	section[1], section[2] = 0xB0|byte(length>>8), byte(length)
+	section = binary.BigEndian.AppendUint32(section, crc32MPEG(section))
+	w.packets(pid, append([]byte{0}, section...))
+}
+
+func (w *tsWriter) pes(pid int, streamID byte, pts int64, data []byte) {
+	header := []byte{0, 0, 1, streamID, 0, 0, 0x80, 0x80, 5}
+	if streamID != 0xE0 {
+		length := 3 + 5 + len(data)
+		header[4], header[5] = byte(length>>8), byte(length)
+	}
+	header = append(header,
+		0x21|byte(pts>>29)&0x0E, byte(pts>>22), byte(pts>>14)|1, byte(pts>>7), byte(pts<<1)|1)
+	w.packets(pid, append(header, data...))
+}
+
+// packets splits a payload into 188 byte packets, the last one is padded by its adaptation field
+func (w *tsWriter) packets(pid int, payload []byte) {
+	if w.cc == nil {
+		w.cc = make(map[int]byte)
+	}
+
+	for first := true; len(payload) > 0; first = false {
+		pkt := []byte{tsSyncByte, byte(pid >> 8), byte(pid), 0x10 | w.cc[pid]&0x0F}
+		if first {
+			pkt[1] |= 0x40
+		}
+		w.cc[pid]++
+
+		n := min(len(payload), tsPacketSize-4)
+		if stuffing := tsPacketSize - 4 - n; stuffing > 0 {
+			pkt[3] |= 0x20
+			pkt = append(pkt, byte(stuffing-1))
+			if stuffing > 1 {
+				pkt = append(pkt, 0x00)
+				pkt = append(pkt, bytes.Repeat([]byte{0xFF}, stuffing-2)...)
+			}
+		}
+		w.buf.Write(append(pkt, payload[:n]...))
+		payload = payload[n:]
+	}
+}
+
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+type bitWriter struct {
+	out  []byte
+	used int
+}
+
+func (b *bitWriter) bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if b.used%8 == 0 {
+			b.out = append(b.out, 0)
+		}
+		b.out[len(b.out)-1] |= byte(v>>uint(i)&1) << (7 - uint(b.used%8))
+		b.used++
+	}
+}
+
+func (b *bitWriter) ue(v uint32) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	b.bits(0, n)
+	b.bits(v, n+1)
+}
+
+func (b *bitWriter) bytes() []byte {
+	return b.out
+}
+
+// mp4Box is a box of the output with its payload, children are read on demand
+type mp4Box struct {
+	kind string
+	data []byte
+}
+
+func mp4Boxes(t *testing.T, data []byte) []mp4Box {
+	t.Helper()
+
+	var boxes []mp4Box
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("truncated box header")
+		}
+		size, header := uint64(binary.BigEndian.Uint32(data)), 8
+		if size == 1 {
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < uint64(header) || size > uint64(len(data)) {
+			t.Fatalf("box %q has an invalid size %d", data[4:8], size)
+		}
+		boxes = append(boxes, mp4Box{kind: string(data[4:8]), data: data[header:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+// mp4Find returns the boxes at the path below the given ones
+func mp4Find(t *testing.T, boxes []mp4Box, path ...string) []mp4Box {
+	t.Helper()
+
+	var found []mp4Box
+	for _, b := range boxes {
+		if b.kind != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			found = append(found, b)
+			continue
+		}
+		found = append(found, mp4Find(t, mp4Boxes(t, b.data), path[1:]...)...)
+	}
+	return found
+}
+
+type mp4TrackInfo struct {
+	handler       string
+	entry         string
+	samples       int
+	keyframes     int
+	bytes         int
+	width, height int
+	// delay is the empty edit in front of the track in milliseconds
+	delay int
+}
+
+func mp4Tracks(t *testing.T, moov []mp4Box) []mp4TrackInfo {
+	t.Helper()
+
+	var tracks []mp4TrackInfo
+	for _, trak := range mp4Find(t, moov, "trak") {
+		children := mp4Boxes(t, trak.data)
+		var info mp4TrackInfo
+		info.handler = string(mp4Find(t, children, "mdia", "hdlr")[0].data[8:12])
+
+		stbl := mp4Find(t, children, "mdia", "minf", "stbl")
+		stsz := mp4Find(t, stbl, "stbl", "stsz")[0].data
+		info.samples = int(binary.BigEndian.Uint32(stsz[8:]))
+		for i := 0; i < info.samples; i++ {
+			info.bytes += int(binary.BigEndian.Uint32(stsz[12+4*i:]))
+		}
+		if stss := mp4Find(t, stbl, "stbl", "stss"); len(stss) > 0 {
+			info.keyframes = int(binary.BigEndian.Uint32(stss[0].data[4:]))
+		}
+
+		entries := mp4SampleEntries(t, stbl)
+		info.entry = entries[0].kind
+		if info.handler == "vide" {
+			info.width, info.height = mp4EntrySize(t, entries[0])
+		}
+
+		if elst := mp4Find(t, children, "edts", "elst"); len(elst) > 0 {
+			// version 1 entries, an empty edit has a media time of -1
+			if int64(binary.BigEndian.Uint64(elst[0].data[16:])) == -1 {
+				info.delay = int(binary.BigEndian.Uint64(elst[0].data[8:]))
+			}
+		}
+		tracks = append(tracks, info)
+	}
+	return tracks
+}
+
+func mp4SampleEntries(t *testing.T, stbl []mp4Box) []mp4Box {
+	t.Helper()
+
+	stsd := mp4Find(t, stbl, "stbl", "stsd")[0].data
+	entries := mp4Boxes(t, stsd[8:])
+	if n := int(binary.BigEndian.Uint32(stsd[4:])); n != len(entries) {
+		t.Fatalf("stsd announces %d entries and holds %d", n, len(entries))
+	}
+	return entries
+}
+
+// mp4EntrySize returns the picture size of a video sample entry and checks its decoder configuration
+func mp4EntrySize(t *testing.T, entry mp4Box) (int, int) {
+	t.Helper()
+
+	configBox := map[string]string{"avc1": "avcC", "avc3": "avcC", "hev1": "hvcC"}[entry.kind]
+	if len(mp4Find(t, mp4Boxes(t, entry.data[78:]), configBox)) != 1 {
+		t.Errorf("%s has no %s", entry.kind, configBox)
+	}
+	return int(binary.BigEndian.Uint16(entry.data[24:])), int(binary.BigEndian.Uint16(entry.data[26:]))
+}
+
+func TestRemuxMP4(t *testing.T) {
+	dir := t.TempDir()
+	input, output := filepath.Join(dir, "in.ts"), filepath.Join(dir, "out.mp4")
+	writeFixture(t, input, fixture{})
+
+	sum, err := Remux([]string{input}, output, FormatMP4)
+	if err != nil {
+		t.Fatalf("Remux: %v", err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256.Sum256(data); sum != hex.EncodeToString(want[:]) {
+		t.Errorf("Remux() = %s, want the SHA-256 of the file", sum)
+	}
+
+	// every chunk is an mdat of its own, moov follows them
+	top := mp4Boxes(t, data)
+	last := len(top) - 1
+	if len(top) < 3 || top[0].kind != "ftyp" || top[last].kind != "moov" {
+		t.Fatalf("the file is not ftyp, mdat boxes and moov")
+	}
+	var mdatBytes int
+	for _, b := range top[1:last] {
+		if b.kind != "mdat" {
+			t.Fatalf("the file holds a %s between ftyp and moov", b.kind)
+		}
+		mdatBytes += len(b.data)
+	}
+
+	tracks := mp4Tracks(t, mp4Boxes(t, top[last].data))
+	want := []mp4TrackInfo{
+		{handler: "vide", entry: "avc1", samples: fixtureFrames, keyframes: fixtureFrames / fixtureGOP, width: 320, height: 240},
+		// the audio starts a frame after the video
+		{handler: "soun", entry: "mp4a", samples: fixtureAudioFrames, delay: fixtureFrameTicks / 90},
+	}
+	if len(tracks) != len(want) {
+		t.Fatalf("got %d tracks, want %d", len(tracks), len(want))
+	}
+
+	var stored int
+	for i, w := range want {
+		got := tracks[i]
+		stored += got.bytes
+		got.bytes = 0
+		if got != w {
+			t.Errorf("track %d = %+v, want %+v", i+1, got, w)
+		}
+	}
+	if stored != mdatBytes {
+		t.Errorf("samples take %d bytes, the mdat boxes hold %d", stored, mdatBytes)
+	}
+	for _, co64 := range mp4Find(t, mp4Boxes(t, top[last].data), "trak", "mdia", "minf", "stbl", "co64") {
+		for i, n := 0, int(binary.BigEndian.Uint32(co64.data[4:])); i < n; i++ {
+			if offset := binary.BigEndian.Uint64(co64.data[8+8*i:]); offset < 8 || offset > uint64(len(data)) || string(data[offset-4:offset]) != "mdat" {
+				t.Fatalf("chunk %d starts at %d, which is not the payload of an mdat", i+1, offset)
+			}
+		}
+	}
+}
+
+func TestRemuxFragmentedMP4(t *testing.T) {
+	dir := t.TempDir()
+	input, output := filepath.Join(dir, "in.ts"), filepath.Join(dir, "out.mp4")
+	writeFixture(t, input, fixture{})
+
+	sum, err := Remux([]string{input}, output, FormatFMP4)
+	if err != nil {
+		t.Fatalf("Remux: %v", err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256.Sum256(data); sum != hex.EncodeToString(want[:]) {
+		t.Errorf("Remux() = %s, want the SHA-256 of the file", sum)
+	}
+
+	top := mp4Boxes(t, data)
+	if len(top) < 4 || top[0].kind != "ftyp" || top[1].kind != "moov" {
+		t.Fatalf("the file does not start with ftyp and moov")
+	}
+	if len(mp4Find(t, top, "moov", "mvex", "trex")) != 2 {
+		t.Errorf("moov does not announce two fragmented tracks")
+	}
+
+	samples := make(map[uint32]int)
+	for i := 2; i < len(top); i += 2 {
+		if top[i].kind != "moof" || i+1 >= len(top) || top[i+1].kind != "mdat" {
+			t.Fatalf("box %d is not a moof followed by an mdat", i)
+		}
+		for _, traf := range mp4Find(t, top[i:i+1], "moof", "traf") {
+			children := mp4Boxes(t, traf.data)
+			id := binary.BigEndian.Uint32(mp4Find(t, children, "tfhd")[0].data[4:])
+			samples[id] += int(binary.BigEndian.Uint32(mp4Find(t, children, "trun")[0].data[4:]))
+		}
+	}
+	if samples[1] != fixtureFrames || samples[2] != fixtureAudioFrames {
+		t.Errorf("fragments hold %d video and %d audio samples, want %d and %d", samples[1], samples[2], fixtureFrames, fixtureAudioFrames)
+	}
+}
+
+// ebmlNode is an element of the output with its payload
+type ebmlNode struct {
+	id   uint64
+	data []byte
+}
+
+func ebmlVint(t *testing.T, data []byte, keepMarker bool) (uint64, int) {
+	t.Helper()
+
+	if len(data) == 0 || data[0] == 0 {
+		t.Fatalf("invalid EBML variable size integer")
+	}
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > len(data) {
+		t.Fatalf("truncated EBML variable size integer")
+	}
+
+	v := uint64(data[0])
+	if !keepMarker {
+		v &= uint64(0xFF >> length)
+	}
+	for _, b := range data[1:length] {
+		v = v<<8 | uint64(b)
+	}
+	return v, length
+}
+
+func ebmlChildren(t *testing.T, data []byte) []ebmlNode {
+	t.Helper()
+
+	var nodes []ebmlNode
+	for len(data) > 0 {
+		id, n := ebmlVint(t, data, true)
+		size, m := ebmlVint(t, data[n:], false)
+		if uint64(n+m)+size > uint64(len(data)) {
+			t.Fatalf("element %X has an invalid size %d", id, size)
+		}
+		nodes = append(nodes, ebmlNode{id: id, data: data[n+m : uint64(n+m)+size]})
+		data = data[uint64(n+m)+size:]
+	}
+	return nodes
+}
+
+func ebmlFind(t *testing.T, nodes []ebmlNode, id uint64) []ebmlNode {
+	t.Helper()
+
+	var found []ebmlNode
+	for _, n := range nodes {
+		if n.id == id {
+			found = append(found, n)
+		}
+	}
+	return found
+}
+
+func TestRemuxMKV(t *testing.T) {
+	dir := t.TempDir()
+	input, output := filepath.Join(dir, "in.ts"), filepath.Join(dir, "out.mkv")
+	writeFixture(t, input, fixture{})
+
+	// the header is patched once the clusters are written, so the file is hashed afterwards
+	if sum, err := Remux([]string{input}, output, FormatMKV); err != nil || sum != "" {
+		t.Fatalf("Remux() = %q, %v, want no sum", sum, err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	top := ebmlChildren(t, data)
+	if len(top) != 2 || top[0].id != mkvIDEBML || top[1].id != mkvIDSegment {
+		t.Fatalf("the file is not an EBML header followed by one segment")
+	}
+	segment := ebmlChildren(t, top[1].data)
+
+	var codecs []string
+	for _, entry := range ebmlFind(t, ebmlChildren(t, ebmlFind(t, segment, mkvIDTracks)[0].data), 0xAE) {
+		codecs = append(codecs, string(ebmlFind(t, ebmlChildren(t, entry.data), 0x86)[0].data))
+	}
+	if len(codecs) != 2 || codecs[0] != "V_MPEG4/ISO/AVC" || codecs[1] != "A_AAC" {
+		t.Errorf("codecs = %v, want [V_MPEG4/ISO/AVC A_AAC]", codecs)
+	}
+
+	blocks, keyframes := make(map[byte]int), 0
+	for _, cluster := range ebmlFind(t, segment, mkvIDCluster) {
+		for _, block := range ebmlFind(t, ebmlChildren(t, cluster.data), mkvIDSimpleBlock) {
+			blocks[block.data[0]&0x7F]++
+			if block.data[0]&0x7F == 1 && block.data[3]&0x80 != 0 {
+				keyframes++
+			}
+		}
+	}
+	if blocks[1] != fixtureFrames || blocks[2] != fixtureAudioFrames {
+		t.Errorf("clusters hold %d video and %d audio blocks, want %d and %d", blocks[1], blocks[2], fixtureFrames, fixtureAudioFrames)
+	}
+	if keyframes != fixtureFrames/fixtureGOP {
+		t.Errorf("got %d video keyframes, want %d", keyframes, fixtureFrames/fixtureGOP)
+	}
+	if len(ebmlFind(t, segment, mkvIDCues)) != 1 {
+		t.Errorf("the segment has no cues")
+	}
+
+	info := ebmlChildren(t, ebmlFind(t, segment, mkvIDInfo)[0].data)
+	duration := math.Float64frombits(binary.BigEndian.Uint64(ebmlFind(t, info, mkvIDDuration)[0].data))
+	// the last timestamp in milliseconds, here the one of the last audio frame
+	lastAudio := fixtureFrameTicks + (fixtureAudioFrames-1)*samplesPerAACFrame*90000/48000
+	if want := float64(lastAudio / 90); duration != want {
+		t.Errorf("duration = %v ms, want %v", duration, want)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "in.ts")
+	writeFixture(t, path, fixture{})
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	got, err := Duration(f)
+	if err != nil {
+		t.Fatalf("Duration: %v", err)
+	}
+	if want := fixtureFrames * fixtureFrameTicks * time.Second / 90000; got != want {
+		t.Errorf("Duration = %v, want %v", got, want)
+	}
+}
+
+func TestRemuxResize(t *testing.T) {
+	const resizeAt = 2 * fixtureGOP
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.ts")
+	writeFixture(t, input, fixture{resizeAt: resizeAt})
+
+	output := filepath.Join(dir, "out.mp4")
+	if _, err := Remux([]string{input}, output, FormatMP4); err != nil {
+		t.Fatalf("Remux: %v", err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trak := mp4Find(t, mp4Boxes(t, data), "moov", "trak")[0]
+	stbl := mp4Find(t, mp4Boxes(t, trak.data), "mdia", "minf", "stbl")
+	entries := mp4SampleEntries(t, stbl)
+	if len(entries) != 2 {
+		t.Fatalf("the video has %d sample entries, want one for each picture size", len(entries))
+	}
+	for i, want := range [][2]int{{320, 240}, {640, 480}} {
+		if w, h := mp4EntrySize(t, entries[i]); w != want[0] || h != want[1] {
+			t.Errorf("sample entry %d is %dx%d, want %dx%d", i+1, w, h, want[0], want[1])
+		}
+	}
+
+	// stsc maps runs of chunks onto a sample count and a sample entry
+	stsc := mp4Find(t, stbl, "stbl", "stsc")[0].data
+	chunks := int(binary.BigEndian.Uint32(mp4Find(t, stbl, "stbl", "co64")[0].data[4:]))
+	perEntry := make(map[uint32]int)
+	for i, n := 0, int(binary.BigEndian.Uint32(stsc[4:])); i < n; i++ {
+		entry := stsc[8+12*i:]
+		last := chunks + 1
+		if i+1 < n {
+			last = int(binary.BigEndian.Uint32(stsc[8+12*(i+1):]))
+		}
+		first := int(binary.BigEndian.Uint32(entry))
+		perEntry[binary.BigEndian.Uint32(entry[8:])] += (last - first) * int(binary.BigEndian.Uint32(entry[4:]))
+	}
+	if perEntry[1] != resizeAt || perEntry[2] != fixtureFrames-resizeAt {
+		t.Errorf("the sample entries describe %d and %d frames, want %d and %d", perEntry[1], perEntry[2], resizeAt, fixtureFrames-resizeAt)
+	}
+
+	// fragments keep the first entry, the new parameter sets stay in the samples
+	output = filepath.Join(dir, "out.fmp4")
+	if _, err := Remux([]string{input}, output, FormatFMP4); err != nil {
+		t.Fatalf("Remux: %v", err)
+	}
+	if data, err = os.ReadFile(output); err != nil {
+		t.Fatal(err)
+	}
+	trak = mp4Find(t, mp4Boxes(t, data), "moov", "trak")[0]
+	entries = mp4SampleEntries(t, mp4Find(t, mp4Boxes(t, trak.data), "mdia", "minf", "stbl"))
+	if len(entries) != 1 || entries[0].kind != "avc3" {
+		t.Errorf("the fragmented video has %d sample entries, want a single avc3", len(entries))
+	}
+}
+
+func TestRemuxHEVC(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.ts")
+	writeFixture(t, input, fixture{hevc: true})
+
+	output := filepath.Join(dir, "out.mp4")
+	if _, err := Remux([]string{input}, output, FormatMP4); err != nil {
+		t.Fatalf("Remux: %v", err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks := mp4Tracks(t, mp4Boxes(t, mp4Find(t, mp4Boxes(t, data), "moov")[0].data))
+	if len(tracks) != 2 {
+		t.Fatalf("got %d tracks, want 2", len(tracks))
+	}
+	video := tracks[0]
+	video.bytes = 0
+	want := mp4TrackInfo{handler: "vide", entry: "hev1", samples: fixtureFrames, keyframes: fixtureFrames / fixtureGOP, width: 320, height: 240}
+	if video != want {
+		t.Errorf("video track = %+v, want %+v", video, want)
+	}
+
+	output = filepath.Join(dir, "out.mkv")
+	if _, err := Remux([]string{input}, output, FormatMKV); err != nil {
+		t.Fatalf("Remux: %v", err)
+	}
+	if data, err = os.ReadFile(output); err != nil {
+		t.Fatal(err)
+	}
+	segment := ebmlChildren(t, ebmlChildren(t, data)[1].data)
+	entry := ebmlChildren(t, ebmlFind(t, ebmlChildren(t, ebmlFind(t, segment, mkvIDTracks)[0].data), 0xAE)[0].data)
+	if codec := string(ebmlFind(t, entry, 0x86)[0].data); codec != "V_MPEGH/ISO/HEVC" {
+		t.Errorf("the video codec is %s, want V_MPEGH/ISO/HEVC", codec)
+	}
+	// the hvcC record starts with its version and the profile of the SPS
+	if private := ebmlFind(t, entry, 0x63A2); len(private) != 1 || private[0].data[0] != 1 || private[0].data[1] != 0x01 {
+		t.Errorf("the video has no hvcC record of a Main profile stream")
+	}
+}
+
+func TestTimelineAdjust(t *testing.T) {
+	video := &track{video: true}
+	audio := &track{sampleRate: 48000}
+	const audioTicks = samplesPerAACFrame * 90000 / 48000
+
+	type step struct {
+		track         *track
+		dts, pts      int64
+		discontinuity bool
+		// want is the adjusted dts, the composition offset is kept
+		want int64
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"continuous", []step{
+			{video, 1000, 4000, false, 1000},
+			{video, 4000, 7000, false, 4000},
+			{video, 7000, 10000, false, 7000},
+		}},
+		{"33-bit wrap", []step{
+			{video, timestampWrap - 6000, timestampWrap - 3000, false, timestampWrap - 6000},
+			{video, timestampWrap - 3000, 0, false, timestampWrap - 3000},
+			{video, 0, 3000, false, timestampWrap},
+			{video, 3000, 6000, false, timestampWrap + 3000},
+		}},
+		{"backwards jump", []step{
+			{video, 900000, 900000, false, 900000},
+			{video, 903000, 903000, false, 903000},
+			{video, 90000, 90000, false, 906000},
+			{video, 93000, 93000, false, 909000},
+		}},
+		{"gap without discontinuity is kept", []step{
+			{video, 90000, 90000, false, 90000},
+			{video, 93000, 93000, false, 93000},
+			{video, 93000 + 3*90000, 93000 + 3*90000, false, 93000 + 3*90000},
+		}},
+		{"discontinuity folds a short gap", []step{
+			{video, 90000, 90000, false, 90000},
+			{video, 93000, 93000, false, 93000},
+			{video, 93000 + 3*90000, 93000 + 3*90000, true, 96000},
+			{video, 96000 + 3*90000, 96000 + 3*90000, false, 99000},
+		}},
+		{"discontinuity in order stays", []step{
+			{video, 90000, 90000, false, 90000},
+			{video, 93000, 93000, true, 93000},
+		}},
+		{"tracks share the offset", []step{
+			{video, 90000, 90000, false, 90000},
+			{audio, 90000, 90000, false, 90000},
+			{video, 93000, 93000, false, 93000},
+			{audio, 90000 + audioTicks, 90000 + audioTicks, false, 90000 + audioTicks},
+			// a splice moves both streams 100 seconds back
+			{video, 93000 - 9000000 + 3000, 93000 - 9000000 + 3000, true, 96000},
+			{audio, 90000 - 9000000 + 2*audioTicks, 90000 - 9000000 + 2*audioTicks, true, 90000 + 2*audioTicks},
+			{video, 93000 - 9000000 + 6000, 93000 - 9000000 + 6000, false, 99000},
+		}},
+		{"repeated timestamps keep increasing", []step{
+			{video, 90000, 90000, false, 90000},
+			{video, 90000, 90000, false, 90001},
+		}},
+	}
+
+	for _, tt := range tests {
+		tl := newTimeline()
+		for i, s := range tt.steps {
+			p := &pes{track: s.track, dts: s.dts, pts: s.pts, discontinuity: s.discontinuity}
+			tl.adjust(p)
+
+			cto := s.pts - s.dts
+			if cto < -timestampWrap/2 {
+				cto += timestampWrap
+			}
+			if p.dts != s.want || p.pts != s.want+cto {
+				t.Errorf("%s: step %d = dts %d pts %d, want dts %d pts %d", tt.name, i+1, p.dts, p.pts, s.want, s.want+cto)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package remux
+
+const (
+	// maxTimestampJump is the largest gap between two consecutive packets of a
+	// track that is still treated as continuous media
+	maxTimestampJump = 5 * 90000
+	timestampWrap    = int64(1) << 33
+
+	defaultVideoFrameDuration = 3000 // 30 fps in 90 kHz units
+)
+
+// timeline turns the raw 33-bit MPEG-TS clock into one monotonic timeline.
+// Wrap-arounds, encoder restarts and splices (e.g. skipped ad breaks) show up as
+// jumps; they are folded out by a single offset shared by all tracks, so audio
+// and video stay in sync across the discontinuity.
+type timeline struct {
+	offset int64
+	last   map[*track]int64
+	delta  map[*track]int64
+	// rebased marks tracks whose next packet already sees an offset that
+	// another track adjusted for the same discontinuity
+	rebased map[*track]bool
+}
+
+func newTimeline() *timeline {
+	return &timeline{
+		last:    make(map[*track]int64),
+		delta:   make(map[*track]int64),
+		rebased: make(map[*track]bool),
+	}
+}
+
+func (tl *timeline) adjust(p *pes) {
+	if p.pts < p.dts-timestampWrap/2 {
+		p.pts += timestampWrap
+	}
+	cto := p.pts - p.dts
+	dts := p.dts + tl.offset
+
+	if last, ok := tl.last[p.track]; ok {
+		delta := tl.frameDuration(p.track)
+		diff := dts - last
+
+		jump := diff <= -maxTimestampJump || diff > maxTimestampJump
+		if p.discontinuity && !tl.rebased[p.track] && (diff <= 0 || diff > 2*delta) {
+			jump = true
+		}
+		tl.rebased[p.track] = false
+
+		switch {
+		case jump:
+			expected := last + delta
+			tl.offset += expected - dts
+			dts = expected
+			for t := range tl.last {
+				tl.rebased[t] = t != p.track
+			}
+		case diff <= 0:
+			dts = last + 1
+		default:
+			tl.delta[p.track] = diff
+		}
+	}
+
+	tl.last[p.track] = dts
+	p.dts = dts
+	p.pts = dts + cto
+}
+
+func (tl *timeline) frameDuration(t *track) int64 {
+	if d, ok := tl.delta[t]; ok && d > 0 {
+		return d
+	}
+	if !t.video && t.sampleRate > 0 {
+		return samplesPerAACFrame * 90000 / int64(t.sampleRate)
+	}
+	return defaultVideoFrameDuration
+}
@@ -0,0 +1,296 @@
+package remux
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+
+	streamTypeAAC  = 0x0F
+	streamTypeH264 = 0x1B
+	streamTypeHEVC = 0x24
+)
+
+// pes is a reassembled elementary stream packet with 90 kHz timestamps
+type pes struct {
+	track         *track
+	pts, dts      int64
+	discontinuity bool
+	data          []byte
+}
+
+type pesStream struct {
+	track         *track
+	buf           []byte
+	started       bool
+	discontinuity bool
+}
+
+type demuxer struct {
+	pmtPID  int
+	streams map[uint16]*pesStream
+	tracks  []*track
+	locked  bool
+	emit    func(p *pes) error
+}
+
+func newDemuxer(emit func(p *pes) error) *demuxer {
+	return &demuxer{
+		pmtPID:  -1,
+		streams: make(map[uint16]*pesStream),
+		emit:    emit,
+	}
+}
+
+// lockTracks stops the demuxer from adding tracks once the output header has been written
+func (d *demuxer) lockTracks() {
+	d.locked = true
+}
+
+func (d *demuxer) readFrom(r io.Reader) error {
+	br := bufio.NewReaderSize(r, 1<<20)
+	pkt := make([]byte, tsPacketSize)
+
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b != tsSyncByte {
+			continue
+		}
+
+		pkt[0] = b
+		if _, err := io.ReadFull(br, pkt[1:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+
+		if err := d.handlePacket(pkt); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *demuxer) handlePacket(pkt []byte) error {
+	pusi := pkt[1]&0x40 != 0
+	pid := uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+	afc := (pkt[3] >> 4) & 0x03
+
+	payload := pkt[4:]
+	discontinuity := false
+	if afc == 2 || afc == 3 {
+		afLen := int(pkt[4])
+		if afLen > 0 {
+			discontinuity = pkt[5]&0x80 != 0
+		}
+		if 5+afLen > len(pkt) {
+			return nil
+		}
+		payload = pkt[5+afLen:]
+	}
+	if afc == 0 || afc == 2 {
+		payload = nil
+	}
+
+	switch {
+	case pid == 0:
+		if pusi {
+			d.parsePAT(payload)
+		}
+		return nil
+	case int(pid) == d.pmtPID:
+		if pusi {
+			d.parsePMT(payload)
+		}
+		return nil
+	}
+
+	s, ok := d.streams[pid]
+	if !ok {
+		return nil
+	}
+	if discontinuity {
+		s.discontinuity = true
+	}
+
+	if pusi {
+		if err := d.flushStream(s); err != nil {
+			return err
+		}
+		s.started = true
+	}
+	if s.started {
+		s.buf = append(s.buf, payload...)
+	}
+	return nil
+}
+
+func psiSection(payload []byte) []byte {
+	if len(payload) < 1 {
+		return nil
+	}
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil
+	}
+
+	section := payload[1+pointer:]
+	length := int(section[1]&0x0F)<<8 | int(section[2])
+	if 3+length > len(section) || length < 9 {
+		return nil
+	}
+	// drop CRC32
+	return section[:3+length-4]
+}
+
+func (d *demuxer) parsePAT(payload []byte) {
+	section := psiSection(payload)
+	if section == nil || section[0] != 0x00 {
+		return
+	}
+
+	for i := 8; i+4 <= len(section); i += 4 {
+		program := int(section[i])<<8 | int(section[i+1])
+		if program == 0 {
+			continue
+		}
+		d.pmtPID = int(section[i+2]&0x1F)<<8 | int(section[i+3])
+		return
+	}
+}
+
+func (d *demuxer) parsePMT(payload []byte) {
+	section := psiSection(payload)
+	if section == nil || section[0] != 0x02 || len(section) < 12 {
+		return
+	}
+
+	infoLen := int(section[10]&0x0F)<<8 | int(section[11])
+	for i := 12 + infoLen; i+5 <= len(section); {
+		streamType := section[i]
+		pid := uint16(section[i+1]&0x1F)<<8 | uint16(section[i+2])
+		esInfoLen := int(section[i+3]&0x0F)<<8 | int(section[i+4])
+		i += 5 + esInfoLen
+
+		var c codec
+		switch streamType {
+		case streamTypeH264:
+			c = codecH264
+		case streamTypeHEVC:
+			c = codecHEVC
+		case streamTypeAAC:
+			c = codecAAC
+		default:
+			continue
+		}
+
+		if s, ok := d.streams[pid]; ok && s.track.codec == c {
+			continue
+		}
+		t := d.trackFor(c)
+		if t == nil {
+			continue
+		}
+		d.streams[pid] = &pesStream{track: t}
+	}
+}
+
+// trackFor returns the track for the codec, so that a PID change after a
+// discontinuity keeps feeding the same output track
+func (d *demuxer) trackFor(c codec) *track {
+	for _, t := range d.tracks {
+		if t.codec == c {
+			return t
+		}
+	}
+	if d.locked {
+		return nil
+	}
+
+	t := &track{id: len(d.tracks) + 1, codec: c, video: c != codecAAC}
+	d.tracks = append(d.tracks, t)
+	return t
+}
+
+func (d *demuxer) flushStream(s *pesStream) error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	data := s.buf
+	s.buf = nil
+
+	p, err := parsePES(data)
+	if err != nil {
+		return nil
+	}
+	p.track = s.track
+	p.discontinuity = s.discontinuity
+	s.discontinuity = false
+
+	return d.emit(p)
+}
+
+// flush emits the PES packets that are still being assembled
+func (d *demuxer) flush() error {
+	for _, t := range d.tracks {
+		for _, s := range d.streams {
+			if s.track != t {
+				continue
+			}
+			if err := d.flushStream(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func parsePES(data []byte) (*pes, error) {
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return nil, errors.New("invalid pes start code")
+	}
+
+	flags := data[7] >> 6
+	headerLen := int(data[8])
+	if 9+headerLen > len(data) {
+		return nil, fmt.Errorf("invalid pes header length %d", headerLen)
+	}
+
+	p := &pes{data: data[9+headerLen:]}
+	switch flags {
+	case 2:
+		if headerLen < 5 {
+			return nil, errors.New("pes header too short for pts")
+		}
+		p.pts = parseTimestamp(data[9:14])
+		p.dts = p.pts
+	case 3:
+		if headerLen < 10 {
+			return nil, errors.New("pes header too short for pts/dts")
+		}
+		p.pts = parseTimestamp(data[9:14])
+		p.dts = parseTimestamp(data[14:19])
+	default:
+		return nil, errors.New("pes packet has no timestamp")
+	}
+	return p, nil
+}
+
+func parseTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 |
+		int64(b[1])<<22 |
+		int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 |
+		int64(b[4]>>1)
+}
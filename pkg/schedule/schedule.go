@@ -0,0 +1,286 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// horizon is how far Next and End look ahead, a schedule that limits months can stay closed for most of a year
+const horizon = 366 * 24 * time.Hour
+
+var dayNames = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+var monthNames = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+
+// Schedule is a set of time windows separated by ";". A window is either weekdays with hour ranges
+// like "mon-fri 18:00-23:30" or "sat,sun 10:00-14:00,20:00-02:00", where a range past midnight ends
+// the next day, or a cron expression "minute hour day month weekday" that matches every minute of the window.
+// Times are wall-clock times of whatever location the checked time is in.
+type Schedule struct {
+	raw   string
+	week  [7 * 24 * 60]bool
+	crons []cron
+}
+
+// Parse checks the schedule and builds its windows
+func Parse(expr string) (*Schedule, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, fmt.Errorf("schedule is empty")
+	}
+
+	s := &Schedule{raw: expr}
+	for _, entry := range strings.Split(expr, ";") {
+		fields := strings.Fields(entry)
+		switch len(fields) {
+		case 0:
+			continue
+		case 5:
+			c, err := parseCron(fields)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %w", strings.TrimSpace(entry), err)
+			}
+			s.crons = append(s.crons, c)
+		case 1, 2:
+			if err := s.addWindow(fields); err != nil {
+				return nil, fmt.Errorf("%q: %w", strings.TrimSpace(entry), err)
+			}
+		default:
+			return nil, fmt.Errorf("%q is neither a weekday window nor a cron expression", strings.TrimSpace(entry))
+		}
+	}
+	if len(s.crons) == 0 && s.week == [len(s.week)]bool{} {
+		return nil, fmt.Errorf("schedule has no windows")
+	}
+	return s, nil
+}
+
+func (s *Schedule) String() string {
+	return s.raw
+}
+
+// Allowed reports whether t falls into a window
+func (s *Schedule) Allowed(t time.Time) bool {
+	if s.week[minuteOfWeek(t)] {
+		return true
+	}
+	for _, c := range s.crons {
+		if c.match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns when the next window opens, t itself while a window is open. The zero time
+// means no window opens within a year.
+func (s *Schedule) Next(t time.Time) time.Time {
+	if s.Allowed(t) {
+		return t
+	}
+	for m := t.Truncate(time.Minute).Add(time.Minute); m.Sub(t) < horizon; m = m.Add(time.Minute) {
+		if s.Allowed(m) {
+			return m
+		}
+	}
+	return time.Time{}
+}
+
+// End returns when the window open at t closes, windows that follow each other without a gap
+// count as one. The zero time means it does not close within a year.
+func (s *Schedule) End(t time.Time) time.Time {
+	if !s.Allowed(t) {
+		return t
+	}
+	for m := t.Truncate(time.Minute).Add(time.Minute); m.Sub(t) < horizon; m = m.Add(time.Minute) {
+		if !s.Allowed(m) {
+			return m
+		}
+	}
+	return time.Time{}
+}
+
+// addWindow parses "[days] HH:MM-HH:MM[,HH:MM-HH:MM...]", without days the window applies every day
+func (s *Schedule) addWindow(fields []string) error {
+	days := [7]bool{true, true, true, true, true, true, true}
+	if len(fields) == 2 {
+		var err error
+		if days, err = parseDays(fields[0]); err != nil {
+			return err
+		}
+		fields = fields[1:]
+	}
+
+	for _, r := range strings.Split(fields[0], ",") {
+		from, to, ok := strings.Cut(r, "-")
+		if !ok {
+			return fmt.Errorf("hour range %q must look like 18:00-23:00", r)
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return err
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return err
+		}
+		if end <= start {
+			end += 24 * 60
+		}
+
+		for day, on := range days {
+			if !on {
+				continue
+			}
+			for m := start; m < end; m++ {
+				s.week[(day*24*60+m)%len(s.week)] = true
+			}
+		}
+	}
+	return nil
+}
+
+func parseDays(value string) ([7]bool, error) {
+	var days [7]bool
+	if value == "*" || value == "daily" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := dayNames[from]
+		if !ok {
+			return days, fmt.Errorf("unknown weekday %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = dayNames[to]; !ok {
+				return days, fmt.Errorf("unknown weekday %q", to)
+			}
+		}
+		// fri-mon wraps over the weekend
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock returns the minutes since midnight, 24:00 is the end of the day
+func parseClock(value string) (int, error) {
+	h, m, ok := strings.Cut(value, ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return hour*60 + minute, nil
+}
+
+func minuteOfWeek(t time.Time) int {
+	return (int(t.Weekday())*24+t.Hour())*60 + t.Minute()
+}
+
+// cron is a parsed "minute hour day month weekday" expression
+type cron struct {
+	minute, hour, day, month, weekday []bool
+	anyDay, anyWeekday                bool
+}
+
+func parseCron(fields []string) (cron, error) {
+	var c cron
+	var err error
+	if c.minute, err = parseField(fields[0], 0, 59, nil); err != nil {
+		return c, fmt.Errorf("minute: %w", err)
+	}
+	if c.hour, err = parseField(fields[1], 0, 23, nil); err != nil {
+		return c, fmt.Errorf("hour: %w", err)
+	}
+	if c.day, err = parseField(fields[2], 1, 31, nil); err != nil {
+		return c, fmt.Errorf("day: %w", err)
+	}
+	if c.month, err = parseField(fields[3], 1, 12, monthNames); err != nil {
+		return c, fmt.Errorf("month: %w", err)
+	}
+	if c.weekday, err = parseField(fields[4], 0, 7, dayNames); err != nil {
+		return c, fmt.Errorf("weekday: %w", err)
+	}
+	// 7 is Sunday as well
+	c.weekday[0] = c.weekday[0] || c.weekday[7]
+	c.anyDay = strings.HasPrefix(fields[2], "*")
+	c.anyWeekday = strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+// parseField reads a comma separated list of values, ranges and */step or range/step items
+func parseField(value string, lo, hi int, names map[string]int) ([]bool, error) {
+	set := make([]bool, hi+1)
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		step := 1
+		if base, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step %q", s)
+			}
+			part, step = base, n
+		}
+
+		first, last := lo, hi
+		if part != "*" {
+			from, to, isRange := strings.Cut(part, "-")
+			var err error
+			if first, err = fieldValue(from, lo, hi, names); err != nil {
+				return nil, err
+			}
+			last = first
+			if isRange {
+				if last, err = fieldValue(to, lo, hi, names); err != nil {
+					return nil, err
+				}
+			} else if step > 1 {
+				last = hi
+			}
+			if last < first {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+		}
+
+		for v := first; v <= last; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func fieldValue(value string, lo, hi int, names map[string]int) (int, error) {
+	if n, ok := names[value]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < lo || n > hi {
+		return 0, fmt.Errorf("value %q is out of range %d-%d", value, lo, hi)
+	}
+	return n, nil
+}
+
+// match follows cron: when both the day and the weekday are restricted, either of them is enough
+func (c cron) match(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	day, weekday := c.day[t.Day()], c.weekday[int(t.Weekday())]
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekday
+	case c.anyWeekday:
+		return day
+	}
+	return day || weekday
+}
@@ -0,0 +1,154 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+// at returns a time of 2026 in UTC, June 1st is a Monday
+func at(month time.Month, day, hour, minute int) time.Time {
+	return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"   ",
+		";",
+		"mon",
+		"mon 10:00",
+		"xyz 10:00-11:00",
+		"mon-xyz 10:00-11:00",
+		"mon 25:00-26:00",
+		"mon 10:60-11:00",
+		"mon 24:30-01:00",
+		"mon tue 10:00-11:00 x",
+		"1 2 3 4",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+	}
+
+	for _, expr := range tests {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		expr string
+		at   time.Time
+		want bool
+	}{
+		{"mon-fri 18:00-23:30", at(6, 1, 19, 0), true},
+		{"mon-fri 18:00-23:30", at(6, 1, 23, 30), false},
+		{"mon-fri 18:00-23:30", at(6, 6, 19, 0), false},
+
+		// past midnight the window ends the next day
+		{"sat 22:00-02:00", at(6, 6, 23, 0), true},
+		{"sat 22:00-02:00", at(6, 7, 1, 59), true},
+		{"sat 22:00-02:00", at(6, 7, 2, 0), false},
+		{"sat 22:00-02:00", at(6, 5, 23, 0), false},
+		{"sat 23:00-01:00", at(6, 7, 0, 30), true},
+		{"10:00-24:00", at(6, 3, 23, 59), true},
+
+		// fri-mon wraps over the weekend
+		{"fri-mon 10:00-12:00", at(6, 5, 11, 0), true},
+		{"fri-mon 10:00-12:00", at(6, 7, 11, 0), true},
+		{"fri-mon 10:00-12:00", at(6, 8, 11, 0), true},
+		{"fri-mon 10:00-12:00", at(6, 2, 11, 0), false},
+		{"fri-mon 10:00-12:00", at(6, 4, 11, 0), false},
+		{"sat,sun 10:00-11:00,20:00-21:00", at(6, 7, 20, 30), true},
+		{"sat,sun 10:00-11:00,20:00-21:00", at(6, 7, 15, 0), false},
+		{"10:00-11:00; sat 20:00-21:00", at(6, 3, 10, 30), true},
+		{"10:00-11:00; sat 20:00-21:00", at(6, 6, 20, 30), true},
+		{"daily 10:00-11:00", at(6, 4, 10, 0), true},
+
+		// cron matches the day or the weekday when both are restricted
+		{"* 20 1 * mon", at(6, 8, 20, 10), true},
+		{"* 20 1 * mon", at(7, 1, 20, 10), true},
+		{"* 20 1 * mon", at(6, 2, 20, 10), false},
+		{"* 20 1 * mon", at(6, 8, 21, 10), false},
+		{"* 20 1 * *", at(6, 8, 20, 10), false},
+		{"* 20 1 * *", at(7, 1, 20, 10), true},
+		{"* 20 * * mon", at(7, 1, 20, 10), false},
+		{"* 20 * * mon", at(6, 1, 20, 10), true},
+		{"*/15 * * jun *", at(6, 3, 4, 45), true},
+		{"*/15 * * jun *", at(6, 3, 4, 7), false},
+		{"*/15 * * jun *", at(7, 3, 4, 45), false},
+		{"0-29/10 9-17 * * *", at(6, 3, 17, 20), true},
+		{"0-29/10 9-17 * * *", at(6, 3, 17, 30), false},
+		{"* * * * 7", at(6, 7, 12, 0), true},
+		{"* * * * 0", at(6, 7, 12, 0), true},
+		{"* * * * sat", at(6, 7, 12, 0), false},
+	}
+
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.expr, err)
+		}
+		if got := s.Allowed(tt.at); got != tt.want {
+			t.Errorf("Parse(%q).Allowed(%s) = %v, want %v", tt.expr, tt.at.Format(time.RFC1123), got, tt.want)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		expr string
+		at   time.Time
+		want time.Time
+	}{
+		{"mon-fri 18:00-23:30", at(6, 6, 12, 0), at(6, 8, 18, 0)},
+		{"mon-fri 18:00-23:30", at(6, 1, 19, 0), at(6, 1, 19, 0)},
+		{"mon-fri 18:00-23:30", at(6, 1, 12, 34).Add(56 * time.Second), at(6, 1, 18, 0)},
+		{"sat 22:00-02:00", at(6, 7, 2, 0), at(6, 13, 22, 0)},
+		{"fri-mon 10:00-12:00", at(6, 2, 9, 0), at(6, 5, 10, 0)},
+		{"* 20 1 * mon", at(6, 2, 0, 0), at(6, 8, 20, 0)},
+		{"0 0 30 feb *", at(6, 1, 0, 0), time.Time{}},
+	}
+
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.expr, err)
+		}
+		if got := s.Next(tt.at); !got.Equal(tt.want) {
+			t.Errorf("Parse(%q).Next(%s) = %s, want %s", tt.expr, tt.at.Format(time.RFC1123), got.Format(time.RFC1123), tt.want.Format(time.RFC1123))
+		}
+	}
+}
+
+func TestEnd(t *testing.T) {
+	tests := []struct {
+		expr string
+		at   time.Time
+		want time.Time
+	}{
+		{"sat 22:00-02:00", at(6, 6, 23, 0), at(6, 7, 2, 0)},
+		{"fri-mon 10:00-12:00", at(6, 7, 10, 30), at(6, 7, 12, 0)},
+		{"mon-fri 18:00-23:30", at(6, 6, 12, 0), at(6, 6, 12, 0)},
+		// windows that follow each other count as one
+		{"10:00-12:00; 12:00-13:00", at(6, 3, 11, 0), at(6, 3, 13, 0)},
+		{"sat 20:00-24:00; sun 00:00-01:00", at(6, 6, 21, 0), at(6, 7, 1, 0)},
+		{"* 20 1 * mon", at(6, 8, 20, 15), at(6, 8, 21, 0)},
+		{"00:00-24:00", at(6, 3, 11, 0), time.Time{}},
+	}
+
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.expr, err)
+		}
+		if got := s.End(tt.at); !got.Equal(tt.want) {
+			t.Errorf("Parse(%q).End(%s) = %s, want %s", tt.expr, tt.at.Format(time.RFC1123), got.Format(time.RFC1123), tt.want.Format(time.RFC1123))
+		}
+	}
+}